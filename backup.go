@@ -0,0 +1,324 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/storage"
+	"BytesDB/vfs"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ManifestFileName the file written at last into the backup directory, the backup without it
+// is not completed
+const ManifestFileName = "MANIFEST"
+
+const manifestVersion = 1
+
+// BackupManifest the tables and the files in the backup
+type BackupManifest struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Tables  []BackupTable `json:"tables"`
+}
+
+// BackupTable the files of a table, they're in <backup>/<schema>/<table>
+type BackupTable struct {
+	Schema string           `json:"schema"`
+	Table  string           `json:"table"`
+	Files  []BackupFileInfo `json:"files"`
+}
+
+// BackupFileInfo the size and the crc of a file, checked by Restore
+type BackupFileInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	CRC  uint32 `json:"crc"`
+}
+
+// Backup copy the tables into dir while the database is written, the writes are stopped only while
+// the files are opened, so the backup is the database as of then. the sealed segments are
+// hard-linked if the file system supports it, otherwise copied, and the active segments are
+// copied up to the offset of then. the directory has the same layout as data.dir, so it could be
+// opened as data.dir, better read-only to keep it intact, or copied into data.dir by Restore
+func (db *Database) Backup(dir string) error {
+	if db.options.StorageType == storage.Memory {
+		return fmt.Errorf("%w: %s", core.ErrBackupNotSupported, storage.Memory)
+	}
+	fs := vfs.Or(db.options.FS)
+	if _, err := fs.Stat(path.Join(dir, ManifestFileName)); err == nil {
+		return fmt.Errorf("backup already exists: %s", dir)
+	}
+	// the compaction removing the segments waits until the files are copied
+	db.maintenance.Lock()
+	defer db.maintenance.Unlock()
+
+	sessions, err := listTables(fs, db.options.DataDir)
+	if err != nil {
+		return err
+	}
+	tables, err := db.openBackupFiles(sessions)
+	if err != nil {
+		return err
+	}
+	defer closeBackupFiles(tables)
+
+	manifest := &BackupManifest{Version: manifestVersion, Created: time.Now()}
+	for i, session := range sessions {
+		table := BackupTable{Schema: session.Schema, Table: session.Table}
+		tableDir := path.Join(dir, session.Schema, session.Table)
+		if err := fs.MkdirAll(tableDir, 0755); err != nil {
+			return err
+		}
+		for _, file := range tables[i] {
+			info, err := backupFile(fs, file, path.Join(tableDir, file.Name))
+			if err != nil {
+				return err
+			}
+			table.Files = append(table.Files, info)
+		}
+		manifest.Tables = append(manifest.Tables, table)
+	}
+	return writeManifest(fs, dir, manifest)
+}
+
+// openBackupFiles open the files of the tables with the writes stopped
+func (db *Database) openBackupFiles(sessions []core.Session) ([][]core.BackupFile, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	tables := make([][]core.BackupFile, 0, len(sessions))
+	for _, session := range sessions {
+		s, err := db.sm.Storage(session)
+		if err != nil {
+			closeBackupFiles(tables)
+			return nil, err
+		}
+		backup, ok := s.(core.BackupStorage)
+		if !ok {
+			closeBackupFiles(tables)
+			return nil, fmt.Errorf("%w: %s", core.ErrBackupNotSupported, db.options.StorageType)
+		}
+		files, err := backup.BackupFiles()
+		if err != nil {
+			closeBackupFiles(tables)
+			return nil, err
+		}
+		tables = append(tables, files)
+	}
+	return tables, nil
+}
+
+func closeBackupFiles(tables [][]core.BackupFile) {
+	for _, files := range tables {
+		for _, file := range files {
+			_ = file.Data.Close()
+		}
+	}
+}
+
+// listTables the tables in <data.dir>/<schema>/<table>, the hidden directories are skipped,
+// e.g. the cache of the object storage
+func listTables(fs vfs.FS, dataDir string) ([]core.Session, error) {
+	schemas, err := fs.ReadDir(dataDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessions []core.Session
+	for _, schema := range schemas {
+		if !schema.IsDir() || strings.HasPrefix(schema.Name(), ".") {
+			continue
+		}
+		tables, err := fs.ReadDir(path.Join(dataDir, schema.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			if table.IsDir() && !strings.HasPrefix(table.Name(), ".") {
+				sessions = append(sessions, core.Session{Schema: schema.Name(), Table: table.Name()})
+			}
+		}
+	}
+	return sessions, nil
+}
+
+// backupFile hard-link the sealed file if it's possible, or copy it
+func backupFile(fs vfs.FS, file core.BackupFile, dst string) (BackupFileInfo, error) {
+	if file.Path != "" && vfs.Link(fs, file.Path, dst) == nil {
+		// the crc is still computed, the linked file is read but not written
+		return checksum(file.Name, file.Data, io.Discard)
+	}
+	to, err := fs.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return BackupFileInfo{}, err
+	}
+	info, err := checksum(file.Name, file.Data, to)
+	if err == nil {
+		err = to.Sync()
+	}
+	if closeErr := to.Close(); err == nil {
+		err = closeErr
+	}
+	return info, err
+}
+
+// checksum copy the data into w, return the size and the crc of the data
+func checksum(name string, data io.Reader, w io.Writer) (BackupFileInfo, error) {
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(w, hash), data)
+	if err != nil {
+		return BackupFileInfo{}, err
+	}
+	return BackupFileInfo{Name: name, Size: size, CRC: hash.Sum32()}, nil
+}
+
+// writeManifest the manifest is written into a temporary file and synced, then renamed
+func writeManifest(fs vfs.FS, dir string, manifest *BackupManifest) error {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	bts, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(dir, ManifestFileName+".tmp")
+	file, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(bts)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+	return fs.Rename(tmpPath, path.Join(dir, ManifestFileName))
+}
+
+// ReadBackupManifest the manifest of the backup, ErrBackupCorrupted if it's not completed
+func ReadBackupManifest(fs vfs.FS, dir string) (*BackupManifest, error) {
+	file, err := vfs.Open(vfs.Or(fs), path.Join(dir, ManifestFileName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: no %s in %s", core.ErrBackupCorrupted, ManifestFileName, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(file).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrBackupCorrupted, err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", core.ErrBackupCorrupted, manifest.Version)
+	}
+	return manifest, nil
+}
+
+// Restore copy the backup into data.dir of the config, the files are checked by the manifest.
+// data.dir is locked while restoring, it must have no tables, so a database is not overwritten.
+// the tables restored partially by a failed Restore should be removed before retrying
+func Restore(cfg *config.DBConfig, backupDir string) error {
+	if err := config.Resolve(cfg); err != nil {
+		return err
+	}
+	if cfg.ReadOnly {
+		return core.ErrReadOnly
+	}
+	if cfg.StorageType == storage.Memory {
+		return fmt.Errorf("%w: %s", core.ErrBackupNotSupported, storage.Memory)
+	}
+	fs := vfs.Or(cfg.FS)
+	manifest, err := ReadBackupManifest(fs, backupDir)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockDataDir(cfg)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	existing, err := listTables(fs, cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("data dir is not empty: %s", cfg.DataDir)
+	}
+
+	for _, table := range manifest.Tables {
+		tableDir := path.Join(cfg.DataDir, table.Schema, table.Table)
+		if err := fs.MkdirAll(tableDir, 0755); err != nil {
+			return err
+		}
+		for _, info := range table.Files {
+			src := path.Join(backupDir, table.Schema, table.Table, info.Name)
+			if err := restoreFile(fs, src, path.Join(tableDir, info.Name), info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreFile copy the file into a temporary file, it's renamed if the size and the crc are matched
+func restoreFile(fs vfs.FS, src, dst string, expected BackupFileInfo) error {
+	from, err := vfs.Open(fs, src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	tmpPath := dst + ".tmp"
+	to, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := checksum(expected.Name, from, to)
+	if err == nil && info != expected {
+		err = fmt.Errorf("%w: %s", core.ErrBackupCorrupted, src)
+	}
+	if err == nil {
+		err = to.Sync()
+	}
+	if closeErr := to.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+	return fs.Rename(tmpPath, dst)
+}
@@ -22,7 +22,7 @@ import (
 
 const NonTxnSeqNo uint64 = 0
 
-var TxnFinishKey = []byte("txn-f")
+var TxnFinishKey = core.TxnFinishKey
 
 type WriteBatchOptions struct {
 	MaxBatchSize int
@@ -39,7 +39,7 @@ type WriteBatch struct {
 
 // NewWriteBatch Initialize for batch writes
 func (db *Database) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	if index.ResolveIndexType(db.options.IndexType) == index.BTree {
+	if db.options.IndexType == index.BTree {
 		panic("can not use write batch, seq no file not exists")
 	}
 
@@ -51,6 +51,9 @@ func (db *Database) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
 	}
 }
 func (wb *WriteBatch) Put(key core.Bytes, value core.Bytes) error {
+	if wb.db.readOnly() {
+		return core.ErrReadOnly
+	}
 	if len(key) == 0 {
 		return core.ErrKeyIsEmpty
 	}
@@ -69,9 +72,15 @@ func (wb *WriteBatch) Put(key core.Bytes, value core.Bytes) error {
 }
 
 func (wb *WriteBatch) Delete(key core.Bytes) error {
+	if wb.db.readOnly() {
+		return core.ErrReadOnly
+	}
 	return nil
 }
 
 func (wb *WriteBatch) Commit() error {
+	if wb.db.readOnly() {
+		return core.ErrReadOnly
+	}
 	return nil
 }
@@ -0,0 +1,86 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"bytes"
+	"errors"
+)
+
+// CompareAndSwap put the value if the current value of the key equals the old one, return
+// false if the key is changed or not exists. The check and the write hold the write lock of the
+// database, so they're serialized against Put and Delete
+func (db *Database) CompareAndSwap(session core.Session, key, old, value core.Bytes) (bool, error) {
+	if db.readOnly() {
+		return false, core.ErrReadOnly
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	current, found, err := db.current(session, key)
+	if err != nil || !found || !bytes.Equal(current, old) {
+		return false, err
+	}
+	return true, db.put(session, key, value)
+}
+
+// PutIfAbsent put the value if the key not exists, return false if it exists
+func (db *Database) PutIfAbsent(session core.Session, key, value core.Bytes) (bool, error) {
+	if db.readOnly() {
+		return false, core.ErrReadOnly
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	_, found, err := db.current(session, key)
+	if err != nil || found {
+		return false, err
+	}
+	return true, db.put(session, key, value)
+}
+
+// DeleteIfEquals delete the key if its current value equals the value, return false if it's
+// changed or not exists
+func (db *Database) DeleteIfEquals(session core.Session, key, value core.Bytes) (bool, error) {
+	if db.readOnly() {
+		return false, core.ErrReadOnly
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	current, found, err := db.current(session, key)
+	if err != nil || !found || !bytes.Equal(current, value) {
+		return false, err
+	}
+	return true, db.delete(session, key)
+}
+
+// current the value of the key, found is false if it not exists or it's deleted in the versioned mode,
+// the caller holds the lock
+func (db *Database) current(session core.Session, key core.Bytes) (core.Bytes, bool, error) {
+	pos, err := db.im.Get(session, key)
+	if errors.Is(err, core.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := db.readValue(session, pos)
+	if errors.Is(err, core.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
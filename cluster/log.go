@@ -0,0 +1,278 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"BytesDB/vfs"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	logFileName   = "raft.log"
+	stateFileName = "raft.state"
+)
+
+// Entry an entry of the raft log, Data is the encoded command, it's empty for the entry appended
+// by the new leader
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+// raftState the state kept across the restarts
+type raftState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote"`
+	// the entries until the snapshot are compacted
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	SnapshotTerm  uint64 `json:"snapshot_term"`
+	// Installing the snapshot is restored into data.dir, it's restored again by the restart
+	// if it's not finished
+	Installing uint64 `json:"installing"`
+}
+
+// readState the state of the node, the zero state if it's not written yet
+func readState(fs vfs.FS, dir string) (raftState, error) {
+	var state raftState
+	file, err := vfs.Open(fs, path.Join(dir, stateFileName))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&state); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+// writeState the state is written into a temporary file and synced, then renamed
+func writeState(fs vfs.FS, dir string, state raftState) error {
+	bts, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(dir, stateFileName+".tmp")
+	file, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(bts)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+	return fs.Rename(tmpPath, path.Join(dir, stateFileName))
+}
+
+// raftLog the entries after the snapshot, they're appended to the log file and synced, each one is
+// [crc][varint size][varint index][varint term][data], the crc covers the rest
+type raftLog struct {
+	fs   vfs.FS
+	dir  string
+	file vfs.File
+	// the index and the term of the last entry compacted
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	// entries[i] is the entry of snapshotIndex+1+i, offsets[i] is its offset in the file
+	entries []Entry
+	offsets []int64
+	size    int64
+}
+
+// openLog load the entries after the snapshot, the torn entry at the end is truncated
+func openLog(fs vfs.FS, dir string, snapshotIndex, snapshotTerm uint64) (*raftLog, error) {
+	file, err := fs.OpenFile(path.Join(dir, logFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &raftLog{fs: fs, dir: dir, file: file, snapshotIndex: snapshotIndex, snapshotTerm: snapshotTerm}
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	var offset int64
+	for offset < int64(len(data)) {
+		entry, n, ok := decodeEntry(data[offset:])
+		if !ok {
+			break
+		}
+		// the entries compacted before the log is rewritten, or the ones not following the last
+		// one, e.g. the log is not rewritten after the snapshot is installed
+		if entry.Index == l.lastIndex()+1 {
+			l.entries = append(l.entries, entry)
+			l.offsets = append(l.offsets, offset)
+		}
+		offset += int64(n)
+	}
+	l.size = offset
+	if offset < int64(len(data)) {
+		if err := file.Truncate(offset); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func encodeEntry(entry Entry) []byte {
+	payload := binary.AppendUvarint(nil, entry.Index)
+	payload = binary.AppendUvarint(payload, entry.Term)
+	payload = append(payload, entry.Data...)
+	buf := binary.BigEndian.AppendUint32(nil, 0)
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	buf = append(buf, payload...)
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decodeEntry the entry at the beginning of data and its size, ok is false if it's torn
+func decodeEntry(data []byte) (Entry, int, bool) {
+	if len(data) < 4 {
+		return Entry{}, 0, false
+	}
+	size, n := binary.Uvarint(data[4:])
+	if n <= 0 || uint64(len(data)-4-n) < size {
+		return Entry{}, 0, false
+	}
+	end := 4 + n + int(size)
+	if crc32.ChecksumIEEE(data[4:end]) != binary.BigEndian.Uint32(data) {
+		return Entry{}, 0, false
+	}
+	payload := data[4+n : end]
+	index, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return Entry{}, 0, false
+	}
+	payload = payload[n:]
+	term, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return Entry{}, 0, false
+	}
+	return Entry{Index: index, Term: term, Data: bytes.Clone(payload[n:])}, end, true
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshotIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapshotTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term the term of the entry, ok is false if it's compacted or not exists
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapshotIndex {
+		return l.snapshotTerm, true
+	}
+	if index < l.snapshotIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapshotIndex-1].Term, true
+}
+
+// slice the copy of the entries in [lo, hi), they're after the snapshot
+func (l *raftLog) slice(lo, hi uint64) []Entry {
+	if lo >= hi {
+		return nil
+	}
+	return append([]Entry(nil), l.entries[lo-l.snapshotIndex-1:hi-l.snapshotIndex-1]...)
+}
+
+// append the entries after the last one, they're synced before returning
+func (l *raftLog) append(entries ...Entry) error {
+	var buf []byte
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		offsets = append(offsets, l.size+int64(len(buf)))
+		buf = append(buf, encodeEntry(entry)...)
+	}
+	if _, err := l.file.WriteAt(buf, l.size); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entries...)
+	l.offsets = append(l.offsets, offsets...)
+	l.size += int64(len(buf))
+	return nil
+}
+
+// truncate remove the entries from the index, they're conflicted with the leader's
+func (l *raftLog) truncate(index uint64) error {
+	i := index - l.snapshotIndex - 1
+	if err := l.file.Truncate(l.offsets[i]); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.size = l.offsets[i]
+	// the entries sent are copied, so they're not overwritten by the later appends
+	l.entries = l.entries[:i:i]
+	l.offsets = l.offsets[:i:i]
+	return nil
+}
+
+// compact drop the entries until the snapshot, the entries after it are kept if the entry of the
+// snapshot is in the log, otherwise all the entries are dropped. the log file is rewritten
+func (l *raftLog) compact(index, term uint64) error {
+	var kept []Entry
+	if t, ok := l.term(index); ok && t == term && index >= l.snapshotIndex {
+		kept = l.slice(index+1, l.lastIndex()+1)
+	}
+	tmpPath := path.Join(l.dir, logFileName+".tmp")
+	file, err := l.fs.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	compacted := &raftLog{fs: l.fs, dir: l.dir, file: file, snapshotIndex: index, snapshotTerm: term}
+	if err := compacted.append(kept...); err != nil {
+		_ = file.Close()
+		_ = l.fs.Remove(tmpPath)
+		return err
+	}
+	if err := l.fs.Rename(tmpPath, path.Join(l.dir, logFileName)); err != nil {
+		_ = file.Close()
+		return err
+	}
+	_ = l.file.Close()
+	*l = *compacted
+	return nil
+}
+
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
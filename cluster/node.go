@@ -0,0 +1,1031 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"BytesDB"
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/storage"
+	"BytesDB/vfs"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the entries sent by a MsgAppend and applied at a time
+const (
+	maxAppendEntries = 256
+	maxApplyEntries  = 256
+)
+
+type Role byte
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// Config the node of the cluster
+type Config struct {
+	// ID the id of the node, unique in the cluster
+	ID string
+	// Peers the ids of all the nodes, including this one
+	Peers []string
+	// DB the config of the local database, it's written by the entries committed only
+	DB *config.DBConfig
+	// Dir the directory of the raft log, the state and the snapshots, <data.dir>/.raft by default
+	Dir       string
+	Transport Transport
+	// ElectionTimeout the follower not hearing from the leader in it, randomized up to twice of it,
+	// starts an election, and the leader not hearing from the majority in it steps down
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold the entries applied since the last snapshot before a snapshot is taken,
+	// and the entries before it are compacted
+	SnapshotThreshold uint64
+}
+
+// OpType the type of the write of the Op
+type OpType byte
+
+const (
+	OpPut OpType = iota
+	OpDelete
+)
+
+// Op a write of the batch
+type Op struct {
+	Type    OpType
+	Session core.Session
+	Key     core.Bytes
+	Value   core.Bytes
+}
+
+// command the data of the entry, the ops are applied atomically
+type command struct {
+	Ops []Op
+}
+
+// Status the state of the node
+type Status struct {
+	ID      string
+	Role    Role
+	Term    uint64
+	Leader  string
+	Commit  uint64
+	Applied uint64
+	// SnapshotIndex the entries until it are compacted
+	SnapshotIndex uint64
+	// Err the error failed the node, e.g. the raft log could not be written
+	Err error
+}
+
+// Node a node of the cluster, the writes are appended to the raft log by the leader and applied to
+// the local database of each node once they're committed by the majority
+type Node struct {
+	cfg       Config
+	fs        vfs.FS
+	transport Transport
+
+	// the database is replaced by installing a snapshot, the reads hold the read lock
+	dbMutex sync.RWMutex
+	db      *BytesDB.Database
+
+	mutex    sync.Mutex
+	state    raftState
+	log      *raftLog
+	role     Role
+	leader   string
+	commit   uint64
+	applied  uint64
+	election time.Time
+	// the next heartbeat of the leader
+	heartbeat time.Time
+	votes     map[string]bool
+	// the next entry to send and the last entry matched of the peers
+	next  map[string]uint64
+	match map[string]uint64
+	// the last response of the peers, the leader steps down if the majority is not heard
+	contact map[string]time.Time
+	// the snapshot is not sent again to the peer until the election timeout
+	snapshotSent map[string]time.Time
+	// the proposals waiting for the entries applied
+	waiters  map[uint64]waiter
+	snapshot *Message
+	closed   bool
+	failed   error
+
+	applySignal chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Open the node, the local database is opened and the entries committed are applied once the
+// leader is known
+func Open(cfg Config) (*Node, error) {
+	if cfg.ID == "" || !slices.Contains(cfg.Peers, cfg.ID) {
+		return nil, fmt.Errorf("node %q is not in the peers %v", cfg.ID, cfg.Peers)
+	}
+	if cfg.Transport == nil || cfg.DB == nil {
+		return nil, errors.New("transport and database config are required")
+	}
+	if err := config.Resolve(cfg.DB); err != nil {
+		return nil, err
+	}
+	// the snapshots are the backups of the database
+	if cfg.DB.StorageType == storage.Memory || cfg.DB.ReadOnly || cfg.DB.ReplicaOf != "" {
+		return nil, fmt.Errorf("%w: %s", core.ErrBackupNotSupported, cfg.DB.StorageType)
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = path.Join(cfg.DB.DataDir, ".raft")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = 1024
+	}
+	fs := vfs.Or(cfg.DB.FS)
+	if err := fs.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		cfg:          cfg,
+		fs:           fs,
+		transport:    cfg.Transport,
+		next:         make(map[string]uint64),
+		match:        make(map[string]uint64),
+		contact:      make(map[string]time.Time),
+		snapshotSent: make(map[string]time.Time),
+		waiters:      make(map[uint64]waiter),
+		applySignal:  make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	state, err := readState(fs, cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// the snapshot restored partially is restored again
+	if state.Installing > 0 {
+		if err := n.restore(state.Installing); err != nil {
+			return nil, err
+		}
+		state.Installing = 0
+		if err := writeState(fs, cfg.Dir, state); err != nil {
+			return nil, err
+		}
+	}
+	if n.db, err = BytesDB.Open(cfg.DB); err != nil {
+		return nil, err
+	}
+	if n.log, err = openLog(fs, cfg.Dir, state.SnapshotIndex, state.SnapshotTerm); err != nil {
+		n.db.Close()
+		return nil, err
+	}
+	// the entries after the snapshot are applied again once they're known to be committed,
+	// the puts and the deletions applied twice have the same result
+	n.state = state
+	n.commit = state.SnapshotIndex
+	n.applied = state.SnapshotIndex
+	n.resetElection()
+
+	n.transport.Receive(n.step)
+	n.wg.Add(2)
+	go n.tickLoop()
+	go n.applyLoop()
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Leader the id of the leader known by the node, empty if it's not known
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leader
+}
+
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		Role:          n.role,
+		Term:          n.state.Term,
+		Leader:        n.leader,
+		Commit:        n.commit,
+		Applied:       n.applied,
+		SnapshotIndex: n.log.snapshotIndex,
+		Err:           n.failed,
+	}
+}
+
+func (n *Node) Put(ctx context.Context, session core.Session, key, value core.Bytes) error {
+	return n.Batch(ctx, Op{Type: OpPut, Session: session, Key: key, Value: value})
+}
+
+func (n *Node) Delete(ctx context.Context, session core.Session, key core.Bytes) error {
+	return n.Batch(ctx, Op{Type: OpDelete, Session: session, Key: key})
+}
+
+// Batch write the ops atomically, it returns once the ops are applied by the leader. return
+// ErrNotLeader if the node is not the leader, or ErrLeadershipLost if the leader steps down
+// before the ops are committed, the ops may be applied by the new leader, so they're retried
+func (n *Node) Batch(ctx context.Context, ops ...Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	for _, op := range ops {
+		if len(op.Key) == 0 {
+			return core.ErrKeyIsEmpty
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(command{Ops: ops}); err != nil {
+		return err
+	}
+	return n.propose(ctx, buf.Bytes())
+}
+
+// Barrier wait until the entries committed before it are applied, the reads of the leader after
+// it are linearizable
+func (n *Node) Barrier(ctx context.Context) error {
+	return n.propose(ctx, nil)
+}
+
+// Get the value of the key read after Barrier, so it's the latest one, it's served by the leader
+func (n *Node) Get(ctx context.Context, session core.Session, key core.Bytes) (core.Bytes, error) {
+	if err := n.Barrier(ctx); err != nil {
+		return nil, err
+	}
+	return n.LocalGet(session, key)
+}
+
+// LocalGet the value of the key in the local database, it may be stale
+func (n *Node) LocalGet(session core.Session, key core.Bytes) (core.Bytes, error) {
+	n.dbMutex.RLock()
+	defer n.dbMutex.RUnlock()
+	if n.db == nil {
+		return nil, core.ErrNodeClosed
+	}
+	return n.db.Get(session, key)
+}
+
+// Keys the keys of the table in the local database, they may be stale
+func (n *Node) Keys(session core.Session) []core.Bytes {
+	n.dbMutex.RLock()
+	defer n.dbMutex.RUnlock()
+	if n.db == nil {
+		return nil
+	}
+	return n.db.Keys(session)
+}
+
+// Close the node and its transport, the proposals waiting return ErrNodeClosed
+func (n *Node) Close() {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return
+	}
+	n.closed = true
+	n.failWaiters(core.ErrNodeClosed)
+	n.mutex.Unlock()
+
+	n.transport.Close()
+	close(n.done)
+	n.wg.Wait()
+
+	_ = n.log.close()
+	n.dbMutex.Lock()
+	defer n.dbMutex.Unlock()
+	if n.db != nil {
+		n.db.Close()
+		n.db = nil
+	}
+}
+
+func (n *Node) propose(ctx context.Context, data []byte) error {
+	n.mutex.Lock()
+	if err := n.usable(); err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	if n.role != Leader {
+		leader := n.leader
+		n.mutex.Unlock()
+		return fmt.Errorf("%w, the leader is %q", core.ErrNotLeader, leader)
+	}
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.state.Term, Data: data}
+	if err := n.log.append(entry); err != nil {
+		n.fail(err)
+		n.mutex.Unlock()
+		return err
+	}
+	n.match[n.cfg.ID] = entry.Index
+	w := waiter{term: entry.Term, done: make(chan error, 1)}
+	n.waiters[entry.Index] = w
+	n.broadcastAppend()
+	n.advanceCommit()
+	n.mutex.Unlock()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		n.mutex.Lock()
+		delete(n.waiters, entry.Index)
+		n.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// usable return the error if the node is closed or failed, the caller holds the lock
+func (n *Node) usable() error {
+	if n.closed {
+		return core.ErrNodeClosed
+	}
+	return n.failed
+}
+
+// fail stop the node taking part in the cluster, e.g. the raft log could not be written, the
+// caller holds the lock
+func (n *Node) fail(err error) {
+	if n.failed == nil {
+		n.failed = err
+	}
+	n.role = Follower
+	n.leader = ""
+	n.failWaiters(err)
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.done <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *Node) persist() error {
+	return writeState(n.fs, n.cfg.Dir, n.state)
+}
+
+func (n *Node) quorum() int {
+	return len(n.cfg.Peers)/2 + 1
+}
+
+func (n *Node) send(msg Message) {
+	msg.Term = n.state.Term
+	n.transport.Send(msg)
+}
+
+func (n *Node) resetElection() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.election = time.Now().Add(timeout)
+}
+
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+
+func (n *Node) tick() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.usable() != nil {
+		return
+	}
+	now := time.Now()
+	if n.role != Leader {
+		if now.After(n.election) {
+			n.campaign()
+		}
+		return
+	}
+	// the leader partitioned from the majority steps down, so the proposals fail fast
+	active := 1
+	for _, peer := range n.cfg.Peers {
+		if peer != n.cfg.ID && now.Sub(n.contact[peer]) < n.cfg.ElectionTimeout {
+			active++
+		}
+	}
+	if active < n.quorum() {
+		n.becomeFollower(n.state.Term, "")
+		return
+	}
+	if now.After(n.heartbeat) {
+		n.broadcastAppend()
+	}
+}
+
+func (n *Node) campaign() {
+	n.state.Term++
+	n.state.Vote = n.cfg.ID
+	if err := n.persist(); err != nil {
+		n.fail(err)
+		return
+	}
+	n.role = Candidate
+	n.leader = ""
+	n.votes = map[string]bool{n.cfg.ID: true}
+	n.resetElection()
+	if len(n.votes) >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.cfg.Peers {
+		if peer != n.cfg.ID {
+			n.send(Message{Type: MsgVote, To: peer, LastIndex: n.log.lastIndex(), LastTerm: n.log.lastTerm()})
+		}
+	}
+}
+
+// becomeLeader the entry of the term is appended, so the entries of the former terms are committed
+// with it
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leader = n.cfg.ID
+	now := time.Now()
+	for _, peer := range n.cfg.Peers {
+		n.next[peer] = n.log.lastIndex() + 1
+		n.match[peer] = 0
+		n.contact[peer] = now
+	}
+	if err := n.log.append(Entry{Index: n.log.lastIndex() + 1, Term: n.state.Term}); err != nil {
+		n.fail(err)
+		return
+	}
+	n.match[n.cfg.ID] = n.log.lastIndex()
+	n.broadcastAppend()
+	n.advanceCommit()
+}
+
+// becomeFollower the proposals waiting fail if it's the leader, the caller holds the lock
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.state.Term {
+		n.state.Term = term
+		n.state.Vote = ""
+		if err := n.persist(); err != nil {
+			n.fail(err)
+			return
+		}
+	}
+	if n.role == Leader {
+		n.failWaiters(core.ErrLeadershipLost)
+		n.resetElection()
+	}
+	n.role = Follower
+	n.leader = leader
+}
+
+func (n *Node) broadcastAppend() {
+	for _, peer := range n.cfg.Peers {
+		if peer != n.cfg.ID {
+			n.sendAppend(peer)
+		}
+	}
+	n.heartbeat = time.Now().Add(n.cfg.HeartbeatInterval)
+}
+
+// sendAppend send the entries from the next one of the peer, or the snapshot if they're compacted
+func (n *Node) sendAppend(peer string) {
+	next := n.next[peer]
+	if next <= n.log.snapshotIndex {
+		n.sendSnapshot(peer)
+		return
+	}
+	prevTerm, _ := n.log.term(next - 1)
+	entries := n.log.slice(next, min(n.log.lastIndex()+1, next+maxAppendEntries))
+	n.send(Message{Type: MsgAppend, To: peer, PrevIndex: next - 1, PrevTerm: prevTerm, Entries: entries, Commit: n.commit})
+}
+
+// sendSnapshot the files of the snapshot are read and sent in the background
+func (n *Node) sendSnapshot(peer string) {
+	if time.Since(n.snapshotSent[peer]) < n.cfg.ElectionTimeout {
+		return
+	}
+	n.snapshotSent[peer] = time.Now()
+	msg := Message{Type: MsgSnapshot, To: peer, Term: n.state.Term}
+	index, term := n.log.snapshotIndex, n.log.snapshotTerm
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		// the snapshot may be removed by a later one, it's sent again by the next heartbeat
+		files, err := readSnapshot(n.fs, n.snapshotDir(index))
+		if err != nil {
+			return
+		}
+		msg.Snapshot = &Snapshot{Index: index, Term: term, Files: files}
+		n.transport.Send(msg)
+	}()
+}
+
+// advanceCommit commit the entries of the term replicated to the majority
+func (n *Node) advanceCommit() {
+	for index := n.log.lastIndex(); index > n.commit; index-- {
+		// the entries of the former terms are committed by the later one
+		if term, _ := n.log.term(index); term != n.state.Term {
+			return
+		}
+		replicated := 0
+		for _, peer := range n.cfg.Peers {
+			if n.match[peer] >= index {
+				replicated++
+			}
+		}
+		if replicated >= n.quorum() {
+			n.commit = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applySignal <- struct{}{}:
+	default:
+	}
+}
+
+// step handle the message from the peer
+func (n *Node) step(msg Message) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.usable() != nil {
+		return
+	}
+	if msg.Term > n.state.Term {
+		n.becomeFollower(msg.Term, "")
+		if n.failed != nil {
+			return
+		}
+	}
+	switch msg.Type {
+	case MsgVote:
+		n.handleVote(msg)
+	case MsgVoteResponse:
+		if n.role == Candidate && msg.Term == n.state.Term && msg.Granted {
+			n.votes[msg.From] = true
+			if len(n.votes) >= n.quorum() {
+				n.becomeLeader()
+			}
+		}
+	case MsgAppend:
+		n.handleAppend(msg)
+	case MsgAppendResponse:
+		n.handleAppendResponse(msg)
+	case MsgSnapshot:
+		n.handleSnapshot(msg)
+	}
+}
+
+// handleVote grant the vote if it's not voted to others in the term, and the candidate's log is
+// as up-to-date as the node's
+func (n *Node) handleVote(msg Message) {
+	lastTerm := n.log.lastTerm()
+	upToDate := msg.LastTerm > lastTerm || (msg.LastTerm == lastTerm && msg.LastIndex >= n.log.lastIndex())
+	granted := msg.Term == n.state.Term && (n.state.Vote == "" || n.state.Vote == msg.From) && upToDate
+	if granted && n.state.Vote == "" {
+		n.state.Vote = msg.From
+		if err := n.persist(); err != nil {
+			n.fail(err)
+			return
+		}
+	}
+	if granted {
+		n.resetElection()
+	}
+	n.send(Message{Type: MsgVoteResponse, To: msg.From, Granted: granted})
+}
+
+// handleAppend append the entries if the log has the entry before them, the conflicted entries
+// are truncated
+func (n *Node) handleAppend(msg Message) {
+	if msg.Term < n.state.Term {
+		n.send(Message{Type: MsgAppendResponse, To: msg.From})
+		return
+	}
+	n.role = Follower
+	n.leader = msg.From
+	n.resetElection()
+
+	prevIndex, prevTerm, entries := msg.PrevIndex, msg.PrevTerm, msg.Entries
+	// the entries compacted are committed, so they're matched
+	if prevIndex < n.log.snapshotIndex {
+		skip := n.log.snapshotIndex - prevIndex
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prevIndex, prevTerm = n.log.snapshotIndex, n.log.snapshotTerm
+	}
+	if term, ok := n.log.term(prevIndex); !ok || term != prevTerm {
+		hint := prevIndex - 1
+		if n.log.lastIndex() < prevIndex {
+			hint = n.log.lastIndex()
+		}
+		n.send(Message{Type: MsgAppendResponse, To: msg.From, Match: hint})
+		return
+	}
+	for i, entry := range entries {
+		if term, ok := n.log.term(entry.Index); ok {
+			if term == entry.Term {
+				continue
+			}
+			if err := n.log.truncate(entry.Index); err != nil {
+				n.fail(err)
+				return
+			}
+		}
+		if err := n.log.append(entries[i:]...); err != nil {
+			n.fail(err)
+			return
+		}
+		break
+	}
+
+	last := prevIndex + uint64(len(entries))
+	if msg.Commit > n.commit && last > n.commit {
+		n.commit = min(msg.Commit, last)
+		n.signalApply()
+	}
+	n.send(Message{Type: MsgAppendResponse, To: msg.From, Success: true, Match: last})
+}
+
+func (n *Node) handleAppendResponse(msg Message) {
+	if n.role != Leader || msg.Term != n.state.Term {
+		return
+	}
+	n.contact[msg.From] = time.Now()
+	if msg.Success {
+		n.match[msg.From] = max(n.match[msg.From], msg.Match)
+		n.next[msg.From] = max(n.next[msg.From], msg.Match+1)
+		n.advanceCommit()
+		if n.next[msg.From] <= n.log.lastIndex() {
+			n.sendAppend(msg.From)
+		}
+		return
+	}
+	n.next[msg.From] = max(n.match[msg.From]+1, min(n.next[msg.From]-1, msg.Match+1))
+	n.sendAppend(msg.From)
+}
+
+// handleSnapshot the snapshot after the entries committed is installed by the apply loop
+func (n *Node) handleSnapshot(msg Message) {
+	if msg.Term < n.state.Term || msg.Snapshot == nil {
+		n.send(Message{Type: MsgAppendResponse, To: msg.From})
+		return
+	}
+	n.role = Follower
+	n.leader = msg.From
+	n.resetElection()
+	if msg.Snapshot.Index <= n.commit {
+		n.send(Message{Type: MsgAppendResponse, To: msg.From, Success: true, Match: msg.Snapshot.Index})
+		return
+	}
+	if n.snapshot == nil || n.snapshot.Snapshot.Index < msg.Snapshot.Index {
+		n.snapshot = &msg
+		n.signalApply()
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.applySignal:
+		}
+		if err := n.applyCommitted(); err != nil {
+			n.mutex.Lock()
+			n.fail(err)
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// applyCommitted apply the entries committed, or install the snapshot received, a snapshot is
+// taken once the entries applied are more than the threshold
+func (n *Node) applyCommitted() error {
+	for {
+		n.mutex.Lock()
+		if n.usable() != nil {
+			n.mutex.Unlock()
+			return nil
+		}
+		if snapshot := n.snapshot; snapshot != nil {
+			n.snapshot = nil
+			n.mutex.Unlock()
+			if err := n.install(snapshot); err != nil {
+				return err
+			}
+			continue
+		}
+		if n.applied >= n.commit {
+			n.mutex.Unlock()
+			return n.takeSnapshot()
+		}
+		entries := n.log.slice(n.applied+1, min(n.commit, n.applied+maxApplyEntries)+1)
+		n.mutex.Unlock()
+
+		for _, entry := range entries {
+			if err := n.apply(entry); err != nil {
+				return err
+			}
+			n.mutex.Lock()
+			n.applied = entry.Index
+			if w, ok := n.waiters[entry.Index]; ok {
+				delete(n.waiters, entry.Index)
+				if w.term == entry.Term {
+					w.done <- nil
+				} else {
+					w.done <- core.ErrLeadershipLost
+				}
+			}
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// apply the ops of the entry to the database, the ops of a batch are written by a transaction
+func (n *Node) apply(entry Entry) error {
+	if len(entry.Data) == 0 {
+		return nil
+	}
+	var cmd command
+	if err := gob.NewDecoder(bytes.NewReader(entry.Data)).Decode(&cmd); err != nil {
+		return err
+	}
+	if len(cmd.Ops) == 1 {
+		op := cmd.Ops[0]
+		if op.Type == OpDelete {
+			return n.db.Delete(op.Session, op.Key)
+		}
+		return n.db.Put(op.Session, op.Key, op.Value)
+	}
+	txn := n.db.Begin()
+	for _, op := range cmd.Ops {
+		var err error
+		if op.Type == OpDelete {
+			err = txn.Delete(op.Session, op.Key)
+		} else {
+			err = txn.Put(op.Session, op.Key, op.Value)
+		}
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+func (n *Node) snapshotDir(index uint64) string {
+	return path.Join(n.cfg.Dir, "snapshot", fmt.Sprintf("%020d", index))
+}
+
+// takeSnapshot back up the database as of the last entry applied, the entries until it are
+// compacted. it's called by the apply loop, so the database is not written while it's copied
+func (n *Node) takeSnapshot() error {
+	n.mutex.Lock()
+	index := n.applied
+	term, _ := n.log.term(index)
+	due := index-n.log.snapshotIndex >= n.cfg.SnapshotThreshold
+	n.mutex.Unlock()
+	if !due {
+		return nil
+	}
+
+	dir := n.snapshotDir(index)
+	// left by a failed one
+	if err := n.fs.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := n.db.Backup(dir); err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	err := n.compact(index, term)
+	n.mutex.Unlock()
+	return err
+}
+
+// compact record the snapshot, then the entries until it are dropped with the older snapshots,
+// the caller holds the lock
+func (n *Node) compact(index, term uint64) error {
+	n.state.SnapshotIndex = index
+	n.state.SnapshotTerm = term
+	n.state.Installing = 0
+	if err := n.persist(); err != nil {
+		return err
+	}
+	if err := n.log.compact(index, term); err != nil {
+		return err
+	}
+	snapshots, err := n.fs.ReadDir(path.Join(n.cfg.Dir, "snapshot"))
+	if err != nil {
+		return err
+	}
+	current := path.Base(n.snapshotDir(index))
+	for _, snapshot := range snapshots {
+		if snapshot.Name() < current {
+			if err := n.fs.RemoveAll(path.Join(n.cfg.Dir, "snapshot", snapshot.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// install the snapshot of the leader, the files are written into the snapshot directory, then the
+// database is closed and restored from it
+func (n *Node) install(msg *Message) error {
+	snapshot := msg.Snapshot
+	n.mutex.Lock()
+	stale := snapshot.Index <= n.applied
+	n.mutex.Unlock()
+	if !stale {
+		if err := n.writeSnapshot(snapshot); err != nil {
+			return err
+		}
+		n.mutex.Lock()
+		n.state.Installing = snapshot.Index
+		err := n.persist()
+		n.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+
+		n.dbMutex.Lock()
+		n.db.Close()
+		n.db = nil
+		err = n.restore(snapshot.Index)
+		if err == nil {
+			n.db, err = BytesDB.Open(n.cfg.DB)
+		}
+		n.dbMutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !stale {
+		if err := n.compact(snapshot.Index, snapshot.Term); err != nil {
+			return err
+		}
+		n.applied = snapshot.Index
+		n.commit = max(n.commit, snapshot.Index)
+	}
+	n.send(Message{Type: MsgAppendResponse, To: msg.From, Success: true, Match: snapshot.Index})
+	return nil
+}
+
+// writeSnapshot the manifest is written at last, so the snapshot without it is not completed
+func (n *Node) writeSnapshot(snapshot *Snapshot) error {
+	dir := n.snapshotDir(snapshot.Index)
+	if err := n.fs.RemoveAll(dir); err != nil {
+		return err
+	}
+	files := slices.Clone(snapshot.Files)
+	slices.SortStableFunc(files, func(a, b SnapshotFile) int {
+		if a.Name == BytesDB.ManifestFileName {
+			return 1
+		}
+		if b.Name == BytesDB.ManifestFileName {
+			return -1
+		}
+		return 0
+	})
+	for _, file := range files {
+		name := path.Join(dir, path.Clean("/"+file.Name))
+		if err := n.fs.MkdirAll(path.Dir(name), 0755); err != nil {
+			return err
+		}
+		f, err := n.fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(file.Data)
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore the tables in data.dir are removed, then the snapshot is restored, the database is closed
+func (n *Node) restore(index uint64) error {
+	entries, err := n.fs.ReadDir(n.cfg.DB.DataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			if err := n.fs.RemoveAll(path.Join(n.cfg.DB.DataDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return BytesDB.Restore(n.cfg.DB, n.snapshotDir(index))
+}
+
+// readSnapshot the files of the snapshot with the paths relative to dir
+func readSnapshot(fs vfs.FS, dir string) ([]SnapshotFile, error) {
+	if _, err := BytesDB.ReadBackupManifest(fs, dir); err != nil {
+		return nil, err
+	}
+	var files []SnapshotFile
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := fs.ReadDir(path.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := path.Join(rel, entry.Name())
+			if entry.IsDir() {
+				if err := walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			file, err := vfs.Open(fs, path.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(file)
+			_ = file.Close()
+			if err != nil {
+				return err
+			}
+			files = append(files, SnapshotFile{Name: name, Data: data})
+		}
+		return nil
+	}
+	return files, walk("")
+}
@@ -0,0 +1,243 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/vfs"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var session = core.Session{
+	Schema: "public",
+	Table:  "test",
+}
+
+// testCluster the nodes in one process connected by the Network, the nodes keep their files in
+// memory across the restarts
+type testCluster struct {
+	t         *testing.T
+	network   *Network
+	ids       []string
+	fs        map[string]*vfs.MemFS
+	nodes     map[string]*Node
+	threshold uint64
+}
+
+func newTestCluster(t *testing.T, size int, threshold uint64) *testCluster {
+	c := &testCluster{
+		t:         t,
+		network:   NewNetwork(),
+		fs:        make(map[string]*vfs.MemFS),
+		nodes:     make(map[string]*Node),
+		threshold: threshold,
+	}
+	for i := 0; i < size; i++ {
+		id := "node" + strconv.Itoa(i)
+		c.ids = append(c.ids, id)
+		c.fs[id] = vfs.NewMemFS()
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(c.close)
+	return c
+}
+
+func (c *testCluster) start(id string) *Node {
+	node, err := Open(Config{
+		ID:                id,
+		Peers:             c.ids,
+		DB:                &config.DBConfig{DataDir: "/tmp/bytesdb-cluster", MaxFileSize: 1024, FS: c.fs[id]},
+		Transport:         c.network.Transport(id),
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SnapshotThreshold: c.threshold,
+	})
+	assert.Nil(c.t, err)
+	c.nodes[id] = node
+	return node
+}
+
+func (c *testCluster) stop(id string) {
+	c.nodes[id].Close()
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) close() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+}
+
+// leader wait until one of the nodes is the leader known by all of them
+func (c *testCluster) leader(ids ...string) *Node {
+	var leader *Node
+	assert.Eventually(c.t, func() bool {
+		leader = nil
+		for _, id := range ids {
+			status := c.nodes[id].Status()
+			if status.Leader == "" || (leader != nil && leader.ID() != status.Leader) {
+				return false
+			}
+			leader = c.nodes[status.Leader]
+		}
+		return leader != nil && leader.Status().Role == Leader
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (c *testCluster) others(id string) []string {
+	var others []string
+	for _, other := range c.ids {
+		if other != id {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// waitValue wait until the value is applied by the nodes, nil value for the key deleted
+func (c *testCluster) waitValue(key string, value core.Bytes, ids ...string) {
+	for _, id := range ids {
+		node := c.nodes[id]
+		assert.Eventually(c.t, func() bool {
+			got, err := node.LocalGet(session, core.Bytes(key))
+			if value == nil {
+				return errors.Is(err, core.ErrKeyNotFound)
+			}
+			return err == nil && string(got) == string(value)
+		}, 5*time.Second, 10*time.Millisecond, "%s of %s", key, id)
+	}
+}
+
+func TestNode_Replicate(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader(c.ids...)
+	ctx := context.Background()
+
+	assert.Nil(t, leader.Put(ctx, session, core.Bytes("a"), core.Bytes("1")))
+	assert.Nil(t, leader.Batch(ctx,
+		Op{Type: OpPut, Session: session, Key: core.Bytes("b"), Value: core.Bytes("2")},
+		Op{Type: OpPut, Session: session, Key: core.Bytes("c"), Value: core.Bytes("3")},
+		Op{Type: OpDelete, Session: session, Key: core.Bytes("a")},
+	))
+	assert.ErrorIs(t, leader.Put(ctx, session, nil, core.Bytes("x")), core.ErrKeyIsEmpty)
+	value, err := leader.Get(ctx, session, core.Bytes("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("3"), value)
+
+	follower := c.nodes[c.others(leader.ID())[0]]
+	err = follower.Put(ctx, session, core.Bytes("d"), core.Bytes("4"))
+	assert.ErrorIs(t, err, core.ErrNotLeader)
+	_, err = follower.Get(ctx, session, core.Bytes("c"))
+	assert.ErrorIs(t, err, core.ErrNotLeader)
+
+	c.waitValue("a", nil, c.ids...)
+	c.waitValue("b", core.Bytes("2"), c.ids...)
+	c.waitValue("c", core.Bytes("3"), c.ids...)
+	for _, id := range c.ids {
+		assert.Equal(t, 2, len(c.nodes[id].Keys(session)))
+	}
+}
+
+func TestNode_Partition(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.leader(c.ids...)
+	ctx := context.Background()
+	assert.Nil(t, old.Put(ctx, session, core.Bytes("key"), core.Bytes("before")))
+
+	// the leader partitioned from the majority could not commit, and steps down
+	others := c.others(old.ID())
+	c.network.Partition([]string{old.ID()}, others)
+	err := old.Put(ctx, session, core.Bytes("lost"), core.Bytes("x"))
+	assert.True(t, errors.Is(err, core.ErrLeadershipLost) || errors.Is(err, core.ErrNotLeader), err)
+	assert.Eventually(t, func() bool { return old.Status().Role != Leader }, 5*time.Second, 10*time.Millisecond)
+
+	// the majority elects a new leader in a later term
+	leader := c.leader(others...)
+	assert.NotEqual(t, old.ID(), leader.ID())
+	assert.Nil(t, leader.Put(ctx, session, core.Bytes("key"), core.Bytes("after")))
+	c.waitValue("key", core.Bytes("after"), others...)
+	value, err := old.LocalGet(session, core.Bytes("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("before"), value)
+
+	// the entry not committed is overwritten once the partition is healed
+	c.network.Heal()
+	// the old leader's log is behind, so it's not elected
+	leader = c.leader(c.ids...)
+	assert.NotEqual(t, old.ID(), leader.ID())
+	assert.Nil(t, leader.Put(ctx, session, core.Bytes("healed"), core.Bytes("y")))
+	c.waitValue("key", core.Bytes("after"), c.ids...)
+	c.waitValue("healed", core.Bytes("y"), c.ids...)
+	c.waitValue("lost", nil, c.ids...)
+
+	// the minority partition elects no leader
+	c.network.Partition([]string{leader.ID()}, []string{others[0]}, []string{others[1]})
+	time.Sleep(500 * time.Millisecond)
+	for _, id := range c.ids {
+		assert.NotEqual(t, Leader, c.nodes[id].Status().Role, id)
+	}
+	c.network.Heal()
+	assert.Nil(t, c.leader(c.ids...).Put(ctx, session, core.Bytes("key"), core.Bytes("last")))
+	c.waitValue("key", core.Bytes("last"), c.ids...)
+}
+
+func TestNode_Snapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 8)
+	leader := c.leader(c.ids...)
+	ctx := context.Background()
+
+	// the follower partitioned misses the entries compacted, it's sent the snapshot once it's healed
+	lagging := c.others(leader.ID())[0]
+	c.network.Partition([]string{lagging}, c.others(lagging))
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, leader.Put(ctx, session, core.Bytes("key"+strconv.Itoa(i)), core.Bytes(strconv.Itoa(i))))
+	}
+	assert.Nil(t, leader.Delete(ctx, session, core.Bytes("key0")))
+	assert.True(t, leader.Status().SnapshotIndex > 0)
+	assert.Equal(t, uint64(0), c.nodes[lagging].Status().SnapshotIndex)
+
+	c.network.Heal()
+	leader = c.leader(c.ids...)
+	assert.Nil(t, leader.Put(ctx, session, core.Bytes("healed"), core.Bytes("y")))
+	c.waitValue("healed", core.Bytes("y"), c.ids...)
+	c.waitValue("key0", nil, c.ids...)
+	c.waitValue("key29", core.Bytes("29"), c.ids...)
+	assert.True(t, c.nodes[lagging].Status().SnapshotIndex > 0)
+	assert.Equal(t, 30, len(c.nodes[lagging].Keys(session)))
+
+	// the nodes restarted recover from the snapshots and the logs
+	for _, id := range c.ids {
+		c.stop(id)
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	leader = c.leader(c.ids...)
+	value, err := leader.Get(ctx, session, core.Bytes("key15"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("15"), value)
+	assert.Nil(t, leader.Put(ctx, session, core.Bytes("restarted"), core.Bytes("z")))
+	c.waitValue("restarted", core.Bytes("z"), c.ids...)
+	c.waitValue("healed", core.Bytes("y"), c.ids...)
+}
@@ -0,0 +1,184 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"sync"
+)
+
+type MessageType byte
+
+const (
+	MsgVote MessageType = iota
+	MsgVoteResponse
+	MsgAppend
+	// MsgAppendResponse the response of MsgAppend and MsgSnapshot
+	MsgAppendResponse
+	MsgSnapshot
+)
+
+// Message the message between the nodes
+type Message struct {
+	Type MessageType
+	From string
+	To   string
+	Term uint64
+
+	// LastIndex and LastTerm the last entry of the candidate of MsgVote
+	LastIndex uint64
+	LastTerm  uint64
+	Granted   bool
+
+	// PrevIndex and PrevTerm the entry before Entries of MsgAppend
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []Entry
+	Commit    uint64
+	Success   bool
+	// Match the last entry matched by the follower, or the hint of the next entry sent if it's
+	// not success
+	Match uint64
+
+	Snapshot *Snapshot
+}
+
+// Snapshot the backup of the database as of the entry, the files are in the layout of the backup
+type Snapshot struct {
+	Index uint64
+	Term  uint64
+	Files []SnapshotFile
+}
+
+// SnapshotFile Name is the path relative to the backup directory
+type SnapshotFile struct {
+	Name string
+	Data []byte
+}
+
+// Transport sends the messages between the nodes, the messages may be dropped, delayed or
+// reordered, they're retried by the nodes
+type Transport interface {
+	Send(msg Message)
+	// Receive set the handler of the messages sent to the node, it's called one by one
+	Receive(handler func(Message))
+	Close()
+}
+
+// inboxSize the messages queued more than it are dropped
+const inboxSize = 1024
+
+// Network the in-process network of the nodes, e.g. for the tests, the messages between the
+// partitions are dropped
+type Network struct {
+	mutex sync.Mutex
+	nodes map[string]*memTransport
+	// the partition of the nodes, the nodes not in it are in the partition 0
+	partitions map[string]int
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: make(map[string]*memTransport), partitions: make(map[string]int)}
+}
+
+// Transport the transport of the node joining the network, the one joined before is replaced
+func (nw *Network) Transport(id string) Transport {
+	t := &memTransport{id: id, network: nw, inbox: make(chan Message, inboxSize), done: make(chan struct{})}
+	nw.mutex.Lock()
+	nw.nodes[id] = t
+	nw.mutex.Unlock()
+	go t.run()
+	return t
+}
+
+// Partition split the nodes into the groups, the messages are delivered in the same group only,
+// the nodes not in the groups are in another group
+func (nw *Network) Partition(groups ...[]string) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+	nw.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			nw.partitions[id] = i + 1
+		}
+	}
+}
+
+// Heal the partitions, all the nodes are connected again
+func (nw *Network) Heal() {
+	nw.Partition()
+}
+
+func (nw *Network) deliver(msg Message) {
+	nw.mutex.Lock()
+	to, ok := nw.nodes[msg.To]
+	connected := nw.partitions[msg.From] == nw.partitions[msg.To]
+	nw.mutex.Unlock()
+	if !ok || !connected {
+		return
+	}
+	select {
+	case to.inbox <- msg:
+	case <-to.done:
+	default:
+	}
+}
+
+type memTransport struct {
+	id      string
+	network *Network
+	inbox   chan Message
+	mutex   sync.Mutex
+	handler func(Message)
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (t *memTransport) Send(msg Message) {
+	msg.From = t.id
+	t.network.deliver(msg)
+}
+
+func (t *memTransport) Receive(handler func(Message)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.handler = handler
+}
+
+func (t *memTransport) Close() {
+	t.once.Do(func() {
+		close(t.done)
+		t.network.mutex.Lock()
+		if t.network.nodes[t.id] == t {
+			delete(t.network.nodes, t.id)
+		}
+		t.network.mutex.Unlock()
+	})
+}
+
+func (t *memTransport) run() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case msg := <-t.inbox:
+			t.mutex.Lock()
+			handler := t.handler
+			t.mutex.Unlock()
+			if handler != nil {
+				handler(msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"io"
+	"slices"
+)
+
+// Compact merge the sealed segments of the table, the live records are appended to the
+// active segment, then the sealed segments and their hit files are removed.
+// The stale records, including the ones in the deleted ranges, and all the tombstones of the
+// sealed segments are dropped, since the older records of the same keys are in the merged
+// segments as well. The merge operands are folded into the values by the merge operator of
+// the table.
+func (db *Database) Compact(session core.Session) error {
+	if db.readOnly() {
+		return core.ErrReadOnly
+	}
+	db.maintenance.Lock()
+	defer db.maintenance.Unlock()
+
+	segments, err := db.sm.SealedSegments(session)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	scanner, err := db.sm.Scan(session, core.ScanOptions{
+		Segments:  segments,
+		WithValue: true,
+		VerifyCRC: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	if db.options.Versioned {
+		return db.compactVersioned(session, segments, scanner)
+	}
+	folds := make(map[string]bool)
+	for {
+		pos, record, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// the records of the committed transactions are moved as the plain ones, the others
+		// are not in the index
+		if record.IsTxn() {
+			if _, record, err = record.UnwrapTxn(); err != nil {
+				return err
+			}
+		}
+		if record.Type == core.Deleted || record.Type == core.RangeDeleted {
+			continue
+		}
+		// the merge operands and the values they may be folded with are folded after the scan,
+		// instead of moving the operands linked to the merged segments
+		if record.Type == core.Merge || db.options.MergeOperators[session] != nil {
+			folds[string(record.Key)] = true
+		}
+		if record.Type == core.Merge {
+			continue
+		}
+		if err := db.moveIfLive(session, pos, record); err != nil {
+			return err
+		}
+	}
+	for key := range folds {
+		if err := db.foldHead(session, core.Bytes(key)); err != nil {
+			return err
+		}
+	}
+
+	if err := db.sm.Flush(session); err != nil {
+		return err
+	}
+	return db.removeSegments(session, segments)
+}
+
+// compactVersioned the versions kept by the retention of the keys in the sealed segments are
+// appended to the active segment, the dropped versions and the deletions without the older
+// versions kept are removed with the segments
+func (db *Database) compactVersioned(session core.Session, segments []int64, scanner core.RecordScanner) error {
+	merged := make(map[int64]bool, len(segments))
+	for _, segment := range segments {
+		merged[segment] = true
+	}
+	seen := make(map[string]bool)
+	var keys []core.Bytes
+	for {
+		_, record, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if record.IsTxn() {
+			if _, record, err = record.UnwrapTxn(); err != nil {
+				return err
+			}
+		}
+		if record.Type == core.RangeDeleted {
+			continue
+		}
+		if !seen[string(record.Key)] {
+			seen[string(record.Key)] = true
+			keys = append(keys, record.Key)
+		}
+	}
+
+	for _, key := range keys {
+		if err := db.rewriteVersions(session, key, merged); err != nil {
+			return err
+		}
+	}
+	if err := db.sm.Flush(session); err != nil {
+		return err
+	}
+	return db.removeSegments(session, segments)
+}
+
+// removeSegments remove the merged segments, they're kept if the snapshots of the table are open,
+// since the snapshots may read the records in them, and removed by the last release
+func (db *Database) removeSegments(session core.Session, segments []int64) error {
+	db.mutex.Lock()
+	if len(db.snapshots[session]) > 0 {
+		for _, segment := range segments {
+			if !slices.Contains(db.obsolete[session], segment) {
+				db.obsolete[session] = append(db.obsolete[session], segment)
+			}
+		}
+		db.mutex.Unlock()
+		return nil
+	}
+	db.mutex.Unlock()
+
+	// the snapshots taken from now on read the moved records, not the merged segments
+	for _, segment := range segments {
+		if err := db.sm.RemoveSegment(session, segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveIfLive append the record again if the index still points to it, the value is not changed,
+// so it's not seen as a write by the snapshots and the transactions
+func (db *Database) moveIfLive(session core.Session, pos *core.RecordPosition, record *core.Record) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	current, err := db.im.Get(session, record.Key)
+	if err == core.ErrKeyNotFound || (err == nil && *current != *pos) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	moved, err := db.sm.Write(session, record)
+	if err != nil {
+		return err
+	}
+	_, err = db.im.Put(session, record.Key, moved)
+	return err
+}
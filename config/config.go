@@ -14,6 +14,12 @@ limitations under the License.
 
 package config
 
+import (
+	"BytesDB/core"
+	"BytesDB/vfs"
+	"time"
+)
+
 // DBConfig holds all database configuration
 type DBConfig struct {
 	// Root directory for database files
@@ -22,9 +28,86 @@ type DBConfig struct {
 	// Maximum size for a single storage file (in bytes)
 	MaxFileSize int64 `properties:"storage.file.max.size,default=1048576"` // default 1MB
 
+	// Read the sealed(rotated) storage files by mmap instead of pread
+	MmapSealedSegments bool `properties:"storage.file.mmap,default=false"`
+
+	// Max bytes of the records cached in memory for reading, 0 disables the cache
+	CacheCapacity int64 `properties:"storage.cache.capacity,default=0"`
+
 	// Index type
 	IndexType string `properties:"index.type,default=local_hash"`
 
+	// Pages(4KB) cached in memory by the bptree index of a table
+	IndexCachePages int `properties:"index.cache.pages,default=1024"`
+
 	// Storage type
 	StorageType string `properties:"storage.type,default=local_file"`
+
+	// Directory of the objects for the object storage, it's the stand-in of the S3-compatible
+	// storage if ObjectStore is not set
+	ObjectStoreDir string `properties:"storage.object.dir"`
+
+	// Directory of the segments fetched from the object store, <data.dir>/.object-cache by default
+	ObjectCacheDir string `properties:"storage.object.cache.dir"`
+
+	// Max count of the fetched segments cached for each table
+	ObjectCacheSegments int `properties:"storage.object.cache.segments,default=16"`
+
+	// Hex encoded AES key(16, 24 or 32 bytes), the data is encrypted at rest if set
+	EncryptionKey string `properties:"encryption.key"`
+
+	// Id of the encryption key, recorded in the segment header for key rotation
+	EncryptionKeyID uint32 `properties:"encryption.key.id,default=0"`
+
+	// Open the database read-only, e.g. for the analytics against a copy of data.dir, the writes
+	// return ErrReadOnly and nothing is written to data.dir
+	ReadOnly bool `properties:"read.only,default=false"`
+
+	// The address of the primary, e.g. 127.0.0.1:7070, the database is a read-only replica of it
+	// if it's set, the writes return ErrReadOnly and the records of the primary are applied
+	ReplicaOf string `properties:"replication.primary"`
+
+	// The messages queued for a replica but not sent yet, the replica is dropped once it's
+	// exceeded and catches up from its tails when it reconnects
+	ReplicationMaxPending int `properties:"replication.max.pending,default=100000"`
+
+	// Keep the old versions of the keys, each write gets a version and the old values are read
+	// by GetAt and GetHistory until the merge drops them by the retention
+	Versioned bool `properties:"versioned,default=false"`
+
+	// The count of the latest versions of a key kept by the merge, 0 means no limit
+	VersionsKept int `properties:"versioned.keep.versions,default=0"`
+
+	// The versions older than it are dropped by the merge, e.g. 168h, 0 means no limit
+	VersionsMaxAge time.Duration `properties:"versioned.keep.age,default=0"`
+
+	// VersionRetention tells the merge if an old version is kept, built from VersionsKept and
+	// VersionsMaxAge if the caller not sets it
+	VersionRetention core.RetentionPolicy
+
+	// MergeOperators the merge operators of the tables, the operands written by Merge are
+	// folded by them, set by the caller, e.g. core.Int64AddOperator for the counters
+	MergeOperators map[core.Session]core.MergeOperator
+
+	// KeyProvider provides the encryption keys, built from EncryptionKey when loading
+	// the config, or set by the caller for the keys managed outside
+	KeyProvider core.KeyProvider
+
+	// Root directory of the cold tier for the tiered storage, e.g. on a slower volume
+	TieredColdDir string `properties:"storage.tiered.cold.dir"`
+
+	// The sealed segments older than it are moved to the cold tier, e.g. 24h, 0 means no limit
+	TieredHotMaxAge time.Duration `properties:"storage.tiered.hot.max.age,default=0"`
+
+	// The oldest sealed segments are moved to the cold tier when the hot ones of a table
+	// are larger than it (in bytes), 0 means no limit
+	TieredHotMaxSize int64 `properties:"storage.tiered.hot.max.size,default=0"`
+
+	// ObjectStore the sealed segments are uploaded to by the object storage, set by the caller
+	// for the S3-compatible storage
+	ObjectStore core.ObjectStore
+
+	// FS the file system of the data files, vfs.Default if it's not set,
+	// e.g. vfs.NewMemFS() or vfs.NewFaultFS() in the tests
+	FS vfs.FS
 }
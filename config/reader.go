@@ -15,11 +15,14 @@ limitations under the License.
 package config
 
 import (
+	"BytesDB/core"
+	"BytesDB/encryption"
 	"bufio"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // LoadConfig reads the db.properties file and returns a DBConfig
@@ -67,10 +70,68 @@ func LoadConfig(configPath string) (*DBConfig, error) {
 			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
 				config.MaxFileSize = size
 			}
+		case "storage.file.mmap":
+			if mmap, err := strconv.ParseBool(value); err == nil {
+				config.MmapSealedSegments = mmap
+			}
+		case "storage.cache.capacity":
+			if capacity, err := strconv.ParseInt(value, 10, 64); err == nil {
+				config.CacheCapacity = capacity
+			}
 		case "index.type":
 			config.IndexType = value
+		case "index.cache.pages":
+			if pages, err := strconv.Atoi(value); err == nil {
+				config.IndexCachePages = pages
+			}
 		case "storage.type":
-			config.IndexType = value
+			config.StorageType = value
+		case "storage.object.dir":
+			config.ObjectStoreDir = filepath.Clean(value)
+		case "storage.object.cache.dir":
+			config.ObjectCacheDir = filepath.Clean(value)
+		case "storage.object.cache.segments":
+			if segments, err := strconv.Atoi(value); err == nil {
+				config.ObjectCacheSegments = segments
+			}
+		case "storage.tiered.cold.dir":
+			config.TieredColdDir = filepath.Clean(value)
+		case "storage.tiered.hot.max.age":
+			if age, err := time.ParseDuration(value); err == nil {
+				config.TieredHotMaxAge = age
+			}
+		case "storage.tiered.hot.max.size":
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				config.TieredHotMaxSize = size
+			}
+		case "read.only":
+			if readOnly, err := strconv.ParseBool(value); err == nil {
+				config.ReadOnly = readOnly
+			}
+		case "replication.primary":
+			config.ReplicaOf = value
+		case "replication.max.pending":
+			if pending, err := strconv.Atoi(value); err == nil {
+				config.ReplicationMaxPending = pending
+			}
+		case "versioned":
+			if versioned, err := strconv.ParseBool(value); err == nil {
+				config.Versioned = versioned
+			}
+		case "versioned.keep.versions":
+			if count, err := strconv.Atoi(value); err == nil {
+				config.VersionsKept = count
+			}
+		case "versioned.keep.age":
+			if age, err := time.ParseDuration(value); err == nil {
+				config.VersionsMaxAge = age
+			}
+		case "encryption.key":
+			config.EncryptionKey = value
+		case "encryption.key.id":
+			if id, err := strconv.ParseUint(value, 10, 32); err == nil {
+				config.EncryptionKeyID = uint32(id)
+			}
 		}
 	}
 
@@ -78,19 +139,52 @@ func LoadConfig(configPath string) (*DBConfig, error) {
 		return nil, err
 	}
 
-	// Set defaults for empty values
-	if config.DataDir == "" {
-		config.DataDir = "/tmp/bytesdb"
+	if err := Resolve(config); err != nil {
+		return nil, err
 	}
-	if config.MaxFileSize == 0 {
-		config.MaxFileSize = 1048576 // 1MB
+
+	return config, nil
+}
+
+// Resolve set defaults for empty values, and build the key provider from the encryption key
+// if the caller not provides one
+func Resolve(cfg *DBConfig) error {
+	if cfg.DataDir == "" {
+		cfg.DataDir = "/tmp/bytesdb"
+	}
+	if cfg.MaxFileSize == 0 {
+		cfg.MaxFileSize = 1048576 // 1MB
+	}
+	if cfg.IndexType == "" {
+		cfg.IndexType = "local_hash"
+	}
+	if cfg.IndexCachePages == 0 {
+		cfg.IndexCachePages = 1024
 	}
-	if config.IndexType == "" {
-		config.IndexType = "local_hash"
+	if cfg.StorageType == "" {
+		cfg.StorageType = "local_file"
 	}
-	if config.StorageType == "" {
-		config.StorageType = "local_file"
+	if cfg.ObjectCacheSegments == 0 {
+		cfg.ObjectCacheSegments = 16
+	}
+	if cfg.ReplicationMaxPending == 0 {
+		cfg.ReplicationMaxPending = 100000
+	}
+	if cfg.VersionRetention == nil {
+		cfg.VersionRetention = core.RetainVersions(cfg.VersionsKept, cfg.VersionsMaxAge)
+	}
+	if cfg.KeyProvider == nil && cfg.EncryptionKey != "" {
+		kp, err := encryption.NewHexKeyProvider(cfg.EncryptionKeyID, cfg.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		cfg.KeyProvider = kp
+	}
+	if cfg.KeyProvider != nil {
+		if _, err := cfg.KeyProvider.Key(cfg.KeyProvider.CurrentKeyID()); err != nil {
+			return err
+		}
 	}
 
-	return config, nil
+	return nil
 }
@@ -20,3 +20,29 @@ var ErrKeyIsNil = errors.New("key is nil")
 var ErrKeyIsEmpty = errors.New("key is empty")
 var ErrKeyNotFound = errors.New("key not found")
 var ErrRecordPositionNil = errors.New("record position is nil")
+var ErrKeyTooLarge = errors.New("key is too large")
+var ErrCorruptedRecord = errors.New("corrupted record")
+var ErrDecryptFailed = errors.New("failed to decrypt data")
+var ErrUnknownKeyID = errors.New("unknown encryption key id")
+var ErrUnknownIndexType = errors.New("unknown index type")
+var ErrUnknownStorageType = errors.New("unknown storage type")
+var ErrObjectNotFound = errors.New("object not found")
+var ErrDatabaseLocked = errors.New("database is locked by another process")
+var ErrReadOnly = errors.New("database is opened read-only")
+var ErrBackupNotSupported = errors.New("storage does not support backup")
+var ErrBackupCorrupted = errors.New("backup is corrupted")
+var ErrSnapshotReleased = errors.New("snapshot is released")
+var ErrTxnConflict = errors.New("transaction conflicts with the writes committed after it begins")
+var ErrTxnClosed = errors.New("transaction is committed or rolled back")
+var ErrNotVersioned = errors.New("database is not opened in the versioned mode")
+var ErrNoMergeOperator = errors.New("no merge operator registered for the table")
+var ErrInvalidOperand = errors.New("invalid merge operand")
+var ErrWatchOverflow = errors.New("watch events are not received fast enough, watch again after the position of the last event received")
+var ErrWatchPositionCompacted = errors.New("watch position is compacted, the changes after it may be lost")
+var ErrReplicationNotSupported = errors.New("storage does not support replication")
+var ErrReplicaDiverged = errors.New("replica is diverged from the primary")
+var ErrNotLeader = errors.New("node is not the leader of the cluster")
+var ErrLeadershipLost = errors.New("leadership is lost before the entry is committed, it may be applied by the new leader")
+var ErrNodeClosed = errors.New("node is closed")
+var ErrRebalancing = errors.New("shards are rebalancing, the writes are rejected until the rebalance completes")
+var ErrShardMissing = errors.New("shard added by the rebalance not completed is missing from the config")
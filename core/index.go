@@ -23,6 +23,22 @@ type Index interface {
 	Iterator(reverse bool) (Iterator, error)
 }
 
+// PrefixIndex is implemented by the index could iterate the keys with the prefix
+// without scanning all keys
+type PrefixIndex interface {
+	PrefixIterator(prefix Bytes, reverse bool) (Iterator, error)
+}
+
+// PersistentIndex is implemented by the index stored on disk, it's not rebuilt from the storage
+// when it's opened, only the records after the Checkpoint are loaded
+type PersistentIndex interface {
+	// Checkpoint the position of the last record put to the index
+	Checkpoint() RecordPosition
+	// Flush persist the changes of the index
+	Flush() error
+	Close() error
+}
+
 type Iterator interface {
 	// Rewind Back to the first data
 	Rewind()
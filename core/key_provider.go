@@ -0,0 +1,27 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+// KeyProvider supplies the keys used to encrypt segments at rest.
+// The key id is recorded in each segment header, so old segments stay readable
+// after the current key is rotated as long as the provider still knows the old id.
+type KeyProvider interface {
+	// CurrentKeyID the key id used for newly created segments
+	CurrentKeyID() uint32
+
+	// Key return the key of the id, the key must be 16, 24 or 32 bytes
+	// return ErrUnknownKeyID if the id is unknown to the provider
+	Key(id uint32) (Bytes, error)
+}
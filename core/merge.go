@@ -0,0 +1,96 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// MergeOperator folds the merge operands of a key into its value, it's registered per table
+// by DBConfig.MergeOperators
+type MergeOperator interface {
+	// Merge fold the operands into the existing value, the oldest operand first, existing is
+	// nil if the key not exists or it's deleted
+	Merge(key, existing Bytes, operands []Bytes) (Bytes, error)
+}
+
+// EncodeMergeOperand prefix the operand by the position of the previous record of the key,
+// the records of the versioned mode keep it in the VersionHeader instead
+func EncodeMergeOperand(prev *RecordPosition, operand Bytes) Bytes {
+	buf := make(Bytes, 0, binary.MaxVarintLen64*3+len(operand))
+	return append(appendPosition(buf, prev), operand...)
+}
+
+// UnwrapMerge the position of the previous record of the key, and the record of the operand
+func (r *Record) UnwrapMerge() (*RecordPosition, *Record, error) {
+	prev, operand, ok := readPosition(r.Value)
+	if !ok {
+		return nil, nil, ErrCorruptedRecord
+	}
+	return prev, &Record{Key: r.Key, Value: operand, Type: r.Type}, nil
+}
+
+// Int64AddOperator add the operands to the existing value, the values and the operands are
+// int64 encoded by EncodeInt64, e.g. for the counters
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) Merge(_, existing Bytes, operands []Bytes) (Bytes, error) {
+	var sum int64
+	if existing != nil {
+		v, err := DecodeInt64(existing)
+		if err != nil {
+			return nil, err
+		}
+		sum = v
+	}
+	for _, operand := range operands {
+		v, err := DecodeInt64(operand)
+		if err != nil {
+			return nil, err
+		}
+		sum += v
+	}
+	return EncodeInt64(sum), nil
+}
+
+// EncodeInt64 the 8 bytes big endian of the value
+func EncodeInt64(v int64) Bytes {
+	return binary.BigEndian.AppendUint64(nil, uint64(v))
+}
+
+// DecodeInt64 the value encoded by EncodeInt64, ErrInvalidOperand if it's not 8 bytes
+func DecodeInt64(bts Bytes) (int64, error) {
+	if len(bts) != 8 {
+		return 0, ErrInvalidOperand
+	}
+	return int64(binary.BigEndian.Uint64(bts)), nil
+}
+
+// BytesAppendOperator append the operands to the existing value, separated by the Separator
+type BytesAppendOperator struct {
+	Separator Bytes
+}
+
+func (op BytesAppendOperator) Merge(_, existing Bytes, operands []Bytes) (Bytes, error) {
+	value := slices.Clone(existing)
+	for i, operand := range operands {
+		if existing != nil || i > 0 {
+			value = append(value, op.Separator...)
+		}
+		value = append(value, operand...)
+	}
+	return value, nil
+}
@@ -0,0 +1,51 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRecord_UnwrapMerge(t *testing.T) {
+	for _, prev := range []*RecordPosition{nil, {Segment: 2, Position: 512, Size: 30}} {
+		record := &Record{Key: Bytes("key"), Value: EncodeMergeOperand(prev, Bytes("operand")), Type: Merge}
+		decoded, operand, err := record.UnwrapMerge()
+		assert.Nil(t, err)
+		assert.Equal(t, prev, decoded)
+		assert.Equal(t, &Record{Key: Bytes("key"), Value: Bytes("operand"), Type: Merge}, operand)
+	}
+	_, _, err := (&Record{Type: Merge}).UnwrapMerge()
+	assert.Equal(t, ErrCorruptedRecord, err)
+}
+
+func TestMergeOperators(t *testing.T) {
+	value, err := Int64AddOperator{}.Merge(nil, nil, []Bytes{EncodeInt64(3), EncodeInt64(-1)})
+	assert.Nil(t, err)
+	assert.Equal(t, EncodeInt64(2), value)
+	value, err = Int64AddOperator{}.Merge(nil, EncodeInt64(10), []Bytes{EncodeInt64(5)})
+	assert.Nil(t, err)
+	assert.Equal(t, EncodeInt64(15), value)
+	_, err = Int64AddOperator{}.Merge(nil, Bytes("10"), []Bytes{EncodeInt64(5)})
+	assert.Equal(t, ErrInvalidOperand, err)
+
+	op := BytesAppendOperator{Separator: Bytes(",")}
+	value, err = op.Merge(nil, nil, []Bytes{Bytes("a"), Bytes("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, Bytes("a,b"), value)
+	value, err = op.Merge(nil, Bytes("x"), []Bytes{Bytes("a")})
+	assert.Nil(t, err)
+	assert.Equal(t, Bytes("x,a"), value)
+}
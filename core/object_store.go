@@ -0,0 +1,33 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import "io"
+
+// ObjectStore keeps the objects by the names, e.g. a bucket of the S3-compatible storage,
+// the sealed segments are offloaded into it by the object storage
+type ObjectStore interface {
+	// Put create or replace the object with the data
+	Put(name string, data io.Reader) error
+
+	// Get open the data of the object, return ErrObjectNotFound if it's not exists
+	Get(name string) (io.ReadCloser, error)
+
+	// Delete remove the object, it's not an error if the object is not exists
+	Delete(name string) error
+
+	// List the names of the objects with the prefix, in order
+	List(prefix string) ([]string, error)
+}
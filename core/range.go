@@ -0,0 +1,55 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// InRange the key is in [start, end), the range is not bounded above if end is empty
+func InRange(key, start, end Bytes) bool {
+	return bytes.Compare(key, start) >= 0 && (len(end) == 0 || bytes.Compare(key, end) < 0)
+}
+
+// PrefixEnd the end of the range of the keys with the prefix, i.e. the first key greater than
+// all of them, nil if they're not bounded above, e.g. the prefix is empty or all 0xff
+func PrefixEnd(prefix Bytes) Bytes {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// EncodeRange the key of the RangeDeleted record, the size of start, start then end
+func EncodeRange(start, end Bytes) Bytes {
+	buf := make(Bytes, 0, binary.MaxVarintLen64+len(start)+len(end))
+	buf = binary.AppendUvarint(buf, uint64(len(start)))
+	buf = append(buf, start...)
+	return append(buf, end...)
+}
+
+// DecodeRange the start and the end encoded by EncodeRange
+func DecodeRange(bts Bytes) (Bytes, Bytes, error) {
+	size, bts, ok := readUvarint(bts)
+	if !ok || size > uint64(len(bts)) {
+		return nil, nil, ErrCorruptedRecord
+	}
+	return bts[:size], bts[size:], nil
+}
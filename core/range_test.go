@@ -0,0 +1,49 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestInRange(t *testing.T) {
+	assert.True(t, InRange(Bytes("b"), Bytes("b"), Bytes("d")))
+	assert.True(t, InRange(Bytes("c1"), Bytes("b"), Bytes("d")))
+	assert.False(t, InRange(Bytes("d"), Bytes("b"), Bytes("d")))
+	assert.False(t, InRange(Bytes("a"), Bytes("b"), Bytes("d")))
+	assert.True(t, InRange(Bytes("z"), Bytes("b"), nil))
+	assert.True(t, InRange(Bytes(""), nil, nil))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, Bytes("ab"), PrefixEnd(Bytes("aa")))
+	assert.Equal(t, Bytes("b"), PrefixEnd(Bytes{'a', 0xff}))
+	assert.Nil(t, PrefixEnd(Bytes{0xff, 0xff}))
+	assert.Nil(t, PrefixEnd(nil))
+}
+
+func TestDecodeRange(t *testing.T) {
+	start, end, err := DecodeRange(EncodeRange(Bytes("a"), Bytes("bc")))
+	assert.Nil(t, err)
+	assert.Equal(t, Bytes("a"), start)
+	assert.Equal(t, Bytes("bc"), end)
+	start, end, err = DecodeRange(EncodeRange(nil, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(start))
+	assert.Equal(t, 0, len(end))
+	_, _, err = DecodeRange(Bytes{5, 'a'})
+	assert.Equal(t, ErrCorruptedRecord, err)
+}
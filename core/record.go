@@ -27,6 +27,20 @@ const (
 	Normal RecordType = iota
 	// Deleted the record is deleted
 	Deleted
+	// TxnNormal the record put by a transaction, the key is prefixed by the sequence number
+	// of the transaction, see EncodeTxnKey
+	TxnNormal
+	// TxnDeleted the record deleted by a transaction, the key is prefixed as TxnNormal
+	TxnDeleted
+	// TxnFinished the transaction of the sequence number is committed, the records of it are
+	// ignored without this record
+	TxnFinished
+	// Merge the merge operand of the key, folded into the previous value of the key by the
+	// MergeOperator of the table, see EncodeMergeOperand
+	Merge
+	// RangeDeleted the keys in the range are deleted, the range is encoded in the key by
+	// EncodeRange, so it's loaded without the value
+	RangeDeleted
 )
 
 // Record the record that use between index and storage
@@ -106,3 +120,27 @@ func BytesToRecord(bts Bytes) *Record {
 		header.Typ,
 	}
 }
+
+// DecodeRecord same as BytesToRecord, but return ErrCorruptedRecord instead of panic
+// when the crc or the sizes in the header not match the bytes
+func DecodeRecord(bts Bytes) (*Record, error) {
+	if len(bts) < 5 {
+		return nil, ErrCorruptedRecord
+	}
+	header, index := BytesToHeader(bts)
+	if header.Crc != crc32.ChecksumIEEE(bts[4:]) {
+		return nil, ErrCorruptedRecord
+	}
+	if index+int(header.KeySize)+int(header.ValueSize) != len(bts) {
+		return nil, ErrCorruptedRecord
+	}
+
+	key := bts[index : index+int(header.KeySize)]
+	index += int(header.KeySize)
+
+	return &Record{
+		key,
+		bts[index:],
+		header.Typ,
+	}, nil
+}
@@ -17,6 +17,8 @@ package core
 // RecordPosition the position of the record
 // use it to read actual data from storage
 type RecordPosition struct {
+	// Segment the sequence number of the segment that the record written to
+	Segment  int64
 	Position int64
 	Size     int
 }
@@ -74,3 +74,26 @@ func TestRecordToBytesCrc(t *testing.T) {
 
 	assert.Equal(t, recordCrc, crc)
 }
+
+func TestDecodeRecord(t *testing.T) {
+	record := &Record{
+		Bytes("hello"),
+		Bytes("world"),
+		Normal,
+	}
+
+	bts := record.Pack()
+	decoded, err := DecodeRecord(bts)
+	assert.Nil(t, err)
+	assert.Equal(t, record, decoded)
+
+	// flip one bit of the value
+	bts[len(bts)-1] ^= 1
+	decoded, err = DecodeRecord(bts)
+	assert.Nil(t, decoded)
+	assert.Equal(t, ErrCorruptedRecord, err)
+
+	decoded, err = DecodeRecord(bts[:3])
+	assert.Nil(t, decoded)
+	assert.Equal(t, ErrCorruptedRecord, err)
+}
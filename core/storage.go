@@ -14,6 +14,8 @@ limitations under the License.
 
 package core
 
+import "io"
+
 // Storage each Storage is indicated by StorageId by caller
 type Storage interface {
 	// Read from storage with the position(int64)
@@ -21,6 +23,13 @@ type Storage interface {
 	// return EOF error if reach end of storage when len([]byte) > remaining size of storage
 	Read(Bytes, int64) (int, error)
 
+	// ReadSegment same as Read, but read from the segment with the sequence number,
+	// the active segment included
+	ReadSegment(Bytes, int64, int64) (int, error)
+
+	// ActiveSegment the sequence number of the segment that Write appends to
+	ActiveSegment() int64
+
 	// Write to the storage with the position
 	Write(Bytes) (int, error)
 
@@ -38,8 +47,80 @@ type Storage interface {
 	RemoveAll() error
 
 	PositionIterator() (PositionIterator, error)
+
+	// Scan the records of the segments sequentially
+	Scan(ScanOptions) (RecordScanner, error)
+
+	// SealedSegments the sequence numbers of the segments not written anymore, in order
+	SealedSegments() []int64
+
+	// RemoveSegment remove the sealed segment, e.g. after it's merged
+	RemoveSegment(int64) error
 }
 
 type PositionIterator interface {
 	Next() (*RecordPosition, Bytes, RecordType, error)
 }
+
+type ScanOptions struct {
+	// Segments to scan in order, all segments(the sealed then the active one) if it's nil
+	Segments []int64
+	// WithValue read the value of the records, only the key is read if false
+	WithValue bool
+	// VerifyCRC check the crc of the records, the value is read for checking even WithValue is false
+	VerifyCRC bool
+}
+
+// RecordScanner scans the records sequentially, shared by the index loading and merge
+type RecordScanner interface {
+	// Next return the position and the record, the value of the record is nil if scanning
+	// without value, return io.EOF if no more records
+	Next() (*RecordPosition, *Record, error)
+	Close() error
+}
+
+// SegmentViewer is implemented by the storage could expose its bytes without copying
+type SegmentViewer interface {
+	// View call fn with the bytes [offset, offset+size) of the segment,
+	// the bytes are only valid inside fn and must not be modified
+	View(segment int64, offset int64, size int, fn func(Bytes) error) error
+}
+
+// ReplicaStorage is implemented by the storage could follow the segments of the primary,
+// so the records replicated are at the same positions
+type ReplicaStorage interface {
+	// RotateTo seal the active segment and start the segment, it must be after the active one
+	RotateTo(segment int64) error
+}
+
+// TieredStorage is implemented by the storage keeping the segments in several tiers
+type TieredStorage interface {
+	// TierUsage the usage of each tier
+	TierUsage() ([]TierUsage, error)
+}
+
+// TierUsage the segments and the bytes kept in a tier of the storage
+type TierUsage struct {
+	Tier     string
+	Segments int
+	Bytes    int64
+}
+
+// BackupStorage is implemented by the storage could be backed up while it's written
+type BackupStorage interface {
+	// BackupFiles open the data and hit files of the table as of now, the active segment is
+	// limited to its current size. the caller stops the writes while it's called, but the files
+	// are read after the writes resume, so they keep the content even the segments are rotated,
+	// moved or removed later. the caller closes the files
+	BackupFiles() ([]BackupFile, error)
+}
+
+// BackupFile a file of the table copied into the backup
+type BackupFile struct {
+	// Name the file name in the table directory
+	Name string
+	// Path the sealed file could be hard-linked instead of copying, empty if it's not a local file
+	Path string
+	// Data the bytes of the file to copy
+	Data io.ReadCloser
+}
@@ -0,0 +1,56 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import "encoding/binary"
+
+// TxnFinishKey the key of the TxnFinished record, prefixed by the sequence number of the transaction
+var TxnFinishKey = []byte("txn-f")
+
+// EncodeTxnKey prefix the key by the sequence number of the transaction
+func EncodeTxnKey(seq uint64, key Bytes) Bytes {
+	buf := make(Bytes, binary.MaxVarintLen64+len(key))
+	n := binary.PutUvarint(buf, seq)
+	n += copy(buf[n:], key)
+	return buf[:n]
+}
+
+// DecodeTxnKey the sequence number of the transaction and the key, see EncodeTxnKey
+func DecodeTxnKey(bts Bytes) (uint64, Bytes, error) {
+	seq, n := binary.Uvarint(bts)
+	if n <= 0 {
+		return 0, nil, ErrCorruptedRecord
+	}
+	return seq, bts[n:], nil
+}
+
+// IsTxn the record is put or deleted by a transaction
+func (r *Record) IsTxn() bool {
+	return r.Type.Base() == TxnNormal || r.Type.Base() == TxnDeleted
+}
+
+// UnwrapTxn the sequence number of the transaction, and the record as it's written without
+// the transaction, e.g. Normal for TxnNormal, the Versioned flag is kept
+func (r *Record) UnwrapTxn() (uint64, *Record, error) {
+	seq, key, err := DecodeTxnKey(r.Key)
+	if err != nil {
+		return 0, nil, err
+	}
+	typ := Normal
+	if r.Type.Base() == TxnDeleted {
+		typ = Deleted
+	}
+	return seq, &Record{Key: key, Value: r.Value, Type: typ | r.Type&Versioned}, nil
+}
@@ -0,0 +1,33 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRecord_UnwrapTxn(t *testing.T) {
+	record := &Record{Key: EncodeTxnKey(300, Bytes("key")), Value: Bytes("value"), Type: TxnDeleted}
+	assert.True(t, record.IsTxn())
+	seq, plain, err := record.UnwrapTxn()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(300), seq)
+	assert.Equal(t, &Record{Key: Bytes("key"), Value: Bytes("value"), Type: Deleted}, plain)
+
+	assert.False(t, (&Record{Type: Normal}).IsTxn())
+	_, _, err = (&Record{Type: TxnNormal}).UnwrapTxn()
+	assert.Equal(t, ErrCorruptedRecord, err)
+}
@@ -0,0 +1,140 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Versioned the flag of the record type written in the versioned mode, the value of the record
+// is prefixed by the VersionHeader, e.g. Normal|Versioned
+const Versioned RecordType = 0x80
+
+// Base the record type without the Versioned flag
+func (t RecordType) Base() RecordType {
+	return t &^ Versioned
+}
+
+func (t RecordType) IsVersioned() bool {
+	return t&Versioned != 0
+}
+
+// VersionHeader the version of the record, and the position of the previous version of the key
+type VersionHeader struct {
+	Version uint64
+	// Time the unix nano time of the write
+	Time int64
+	// Prev the previous version, nil if it's the oldest one kept
+	Prev *RecordPosition
+}
+
+// EncodeVersioned prefix the value by the header
+func EncodeVersioned(header *VersionHeader, value Bytes) Bytes {
+	buf := make(Bytes, 0, binary.MaxVarintLen64*5+len(value))
+	buf = binary.AppendUvarint(buf, header.Version)
+	buf = binary.AppendVarint(buf, header.Time)
+	buf = appendPosition(buf, header.Prev)
+	return append(buf, value...)
+}
+
+// appendPosition append the position, segment -1 if it's nil
+func appendPosition(buf Bytes, pos *RecordPosition) Bytes {
+	if pos == nil {
+		return binary.AppendVarint(buf, -1)
+	}
+	buf = binary.AppendVarint(buf, pos.Segment)
+	buf = binary.AppendVarint(buf, pos.Position)
+	return binary.AppendUvarint(buf, uint64(pos.Size))
+}
+
+// readPosition the position appended by appendPosition
+func readPosition(bts Bytes) (*RecordPosition, Bytes, bool) {
+	segment, bts, ok := readVarint(bts)
+	if !ok || segment < 0 {
+		return nil, bts, ok
+	}
+	pos := &RecordPosition{Segment: segment}
+	var size uint64
+	if pos.Position, bts, ok = readVarint(bts); !ok {
+		return nil, nil, false
+	}
+	if size, bts, ok = readUvarint(bts); !ok {
+		return nil, nil, false
+	}
+	pos.Size = int(size)
+	return pos, bts, true
+}
+
+// UnwrapVersion the header of the versioned record and the record as it's written without
+// the version, the plain record is version 0 without the previous one
+func (r *Record) UnwrapVersion() (*VersionHeader, *Record, error) {
+	if !r.Type.IsVersioned() {
+		return &VersionHeader{}, r, nil
+	}
+	bts := r.Value
+	header := &VersionHeader{}
+	var ok bool
+	if header.Version, bts, ok = readUvarint(bts); !ok {
+		return nil, nil, ErrCorruptedRecord
+	}
+	if header.Time, bts, ok = readVarint(bts); !ok {
+		return nil, nil, ErrCorruptedRecord
+	}
+	if header.Prev, bts, ok = readPosition(bts); !ok {
+		return nil, nil, ErrCorruptedRecord
+	}
+	return header, &Record{Key: r.Key, Value: bts, Type: r.Type.Base()}, nil
+}
+
+func readUvarint(bts Bytes) (uint64, Bytes, bool) {
+	v, n := binary.Uvarint(bts)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, bts[n:], true
+}
+
+func readVarint(bts Bytes) (int64, Bytes, bool) {
+	v, n := binary.Varint(bts)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, bts[n:], true
+}
+
+// VersionInfo an old version of a key, which is kept or dropped by the RetentionPolicy
+type VersionInfo struct {
+	Version uint64
+	Time    time.Time
+	// Newer the count of the versions of the key newer than it
+	Newer   int
+	Deleted bool
+}
+
+// RetentionPolicy tells the merge if the old version of a key is kept, the latest version
+// is always kept, and the versions older than a dropped one are dropped as well
+type RetentionPolicy func(info VersionInfo) bool
+
+// RetainVersions keep the versions if they're in the latest count ones and not older than
+// the max age, 0 means no limit
+func RetainVersions(count int, maxAge time.Duration) RetentionPolicy {
+	return func(info VersionInfo) bool {
+		if count > 0 && info.Newer >= count {
+			return false
+		}
+		return maxAge <= 0 || time.Since(info.Time) <= maxAge
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRecord_UnwrapVersion(t *testing.T) {
+	for _, prev := range []*RecordPosition{nil, {Segment: 3, Position: 1024, Size: 42}} {
+		header := &VersionHeader{Version: 7, Time: time.Now().UnixNano(), Prev: prev}
+		record := &Record{Key: Bytes("key"), Value: EncodeVersioned(header, Bytes("value")), Type: Deleted | Versioned}
+		decoded, plain, err := record.UnwrapVersion()
+		assert.Nil(t, err)
+		assert.Equal(t, header, decoded)
+		assert.Equal(t, &Record{Key: Bytes("key"), Value: Bytes("value"), Type: Deleted}, plain)
+	}
+
+	plain := &Record{Key: Bytes("key"), Value: Bytes("value"), Type: Normal}
+	header, unwrapped, err := plain.UnwrapVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), header.Version)
+	assert.Equal(t, plain, unwrapped)
+	_, _, err = (&Record{Type: Normal | Versioned}).UnwrapVersion()
+	assert.Equal(t, ErrCorruptedRecord, err)
+}
+
+func TestRetainVersions(t *testing.T) {
+	policy := RetainVersions(2, time.Hour)
+	assert.True(t, policy(VersionInfo{Newer: 1, Time: time.Now()}))
+	assert.False(t, policy(VersionInfo{Newer: 2, Time: time.Now()}))
+	assert.False(t, policy(VersionInfo{Newer: 1, Time: time.Now().Add(-2 * time.Hour)}))
+	assert.True(t, RetainVersions(0, 0)(VersionInfo{Newer: 100}))
+}
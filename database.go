@@ -19,15 +19,50 @@ import (
 	"BytesDB/core"
 	"BytesDB/index"
 	"BytesDB/storage"
+	"BytesDB/vfs"
 	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sync"
 )
 
+// Stats runtime statistics of the database
+type Stats struct {
+	Cache storage.CacheStats
+}
+
 type Database struct {
 	options *config.DBConfig
 	im      *index.IndexManager
 	sm      *storage.StorageManager
+	// writes hold the write lock, so the merge could check and move a record atomically
+	mutex *sync.RWMutex
+	// serialize Compact and Backup, so the segments are not removed while they're copied
+	maintenance *sync.Mutex
+	// the open snapshots of the tables, guarded by mutex
+	snapshots map[core.Session]map[*Snapshot]struct{}
+	// the segments merged but kept for the open snapshots of the tables, guarded by mutex
+	obsolete map[core.Session][]int64
+	// the state of the transactions
+	txns *txnManager
+	// the versions of the writes in the versioned mode
+	versions *sequence
+	// the watchers of the tables, guarded by mutex
+	watchers map[core.Session]map[*Watcher]struct{}
+	// the primary streaming the writes to the replicas, guarded by mutex
+	primary *Primary
+	// following the primary if it's a replica
+	replica *replica
+	// lock of data.dir, nil for the memory storage
+	lock io.Closer
 }
 
+// LockFileName the file in data.dir locked by the opened database, so the data files
+// are not written by two processes
+const LockFileName = "LOCK"
+
 func OpenBytesDb() *Database {
 	// TODO: implement it
 	cfg, err := config.LoadConfig("db.properties")
@@ -35,25 +70,113 @@ func OpenBytesDb() *Database {
 		panic(err)
 	}
 
-	return &Database{
-		options: cfg,
-		im:      index.NewIndexManager(cfg),
-		sm:      storage.NewStorageManager(cfg),
+	db, err := Open(cfg)
+	if err != nil {
+		panic(err)
 	}
+	return db
 }
 
+// Open the database with the config instead of loading db.properties,
+// e.g. set a KeyProvider to the config for the keys managed outside
+func Open(cfg *config.DBConfig) (*Database, error) {
+	if err := config.Resolve(cfg); err != nil {
+		return nil, err
+	}
+	// the records are replicated at the same positions by rotating the segments as the primary
+	if cfg.ReplicaOf != "" && cfg.StorageType != storage.Local_File {
+		return nil, fmt.Errorf("%w: %s", core.ErrReplicationNotSupported, cfg.StorageType)
+	}
+	if cfg.ReplicaOf != "" && cfg.ReadOnly {
+		return nil, fmt.Errorf("%w: the replica is written by the primary", core.ErrReadOnly)
+	}
+
+	lock, err := lockDataDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sm, err := storage.NewStorageManager(cfg)
+	if err == nil {
+		var im *index.IndexManager
+		if im, err = index.NewIndexManager(cfg, sm); err == nil {
+			db := &Database{
+				options:     cfg,
+				im:          im,
+				sm:          sm,
+				mutex:       &sync.RWMutex{},
+				maintenance: &sync.Mutex{},
+				snapshots:   make(map[core.Session]map[*Snapshot]struct{}),
+				obsolete:    make(map[core.Session][]int64),
+				watchers:    make(map[core.Session]map[*Watcher]struct{}),
+				lock:        lock,
+			}
+			// the committed transactions are known before the indexes are loaded
+			if err = db.loadTxns(); err == nil {
+				im.SetTxnCommitted(db.txns.isCommitted)
+				if cfg.ReplicaOf != "" {
+					db.replica = newReplica(db, cfg.ReplicaOf)
+				}
+				return db, nil
+			}
+		}
+		sm.Close()
+	}
+	if lock != nil {
+		_ = lock.Close()
+	}
+	return nil, err
+}
+
+// lockDataDir take the lock of data.dir, return ErrDatabaseLocked if it's held by another process.
+// the memory storage keeps nothing in data.dir so it's not locked, nor the read-only database
+// since it's not writing, it could be opened with a writer, but the segments removed by the
+// writer's compaction are not readable anymore
+func lockDataDir(cfg *config.DBConfig) (io.Closer, error) {
+	if cfg.StorageType == storage.Memory || cfg.ReadOnly {
+		return nil, nil
+	}
+	fs := vfs.Or(cfg.FS)
+	if err := fs.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := fs.Lock(path.Join(cfg.DataDir, LockFileName))
+	if errors.Is(err, vfs.ErrLocked) {
+		return nil, fmt.Errorf("%w: %s", core.ErrDatabaseLocked, cfg.DataDir)
+	}
+	return lock, err
+}
+
+// Put write the value of the key, the writes are serialized by the database lock since the
+// record and the index are updated together, so the index type doesn't make them concurrent
 func (db *Database) Put(Session core.Session, key, value core.Bytes) error {
-	record := &core.Record{
-		Key:   key,
-		Value: value,
-		Type:  core.Normal,
+	if db.readOnly() {
+		return core.ErrReadOnly
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.put(Session, key, value)
+}
+
+// put write the value of the key, the caller holds the write lock
+func (db *Database) put(session core.Session, key, value core.Bytes) error {
+	record, err := db.newRecord(session, key, value, core.Normal)
+	if err != nil {
+		return err
+	}
+	pos, err := db.sm.Write(session, record)
+	if err != nil {
+		return err
 	}
-	pos := db.sm.Write(Session, record)
-	_, err := db.im.Put(Session, key, pos)
-	return err
+	if err := db.indexPut(session, key, pos); err != nil {
+		return err
+	}
+	return db.publish(session, record, pos)
 }
 
 func (db *Database) Get(session core.Session, key core.Bytes) (core.Bytes, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
 	pos, err := db.im.Get(session, key)
 	if err != nil {
 		return nil, err
@@ -63,11 +186,20 @@ func (db *Database) Get(session core.Session, key core.Bytes) (core.Bytes, error
 		panic("error get position, supposed to return error")
 	}
 
-	record := db.sm.Read(session, pos)
-	return record.Value, nil
+	return db.readValue(session, pos)
 }
 
 func (db *Database) Delete(session core.Session, key core.Bytes) error {
+	if db.readOnly() {
+		return core.ErrReadOnly
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.delete(session, key)
+}
+
+// delete write the deletion of the key if it's live, the caller holds the write lock
+func (db *Database) delete(session core.Session, key core.Bytes) error {
 	pos, err := db.im.Get(session, key)
 	if err != nil && !errors.Is(err, core.ErrKeyNotFound) {
 		return err
@@ -76,14 +208,119 @@ func (db *Database) Delete(session core.Session, key core.Bytes) error {
 	if pos == nil {
 		return nil
 	}
+	if live, err := db.isLive(session, pos); err != nil || !live {
+		return err
+	}
+
+	record, err := db.newRecord(session, key, nil, core.Deleted)
+	if err != nil {
+		return err
+	}
+	if pos, err = db.sm.Write(session, record); err != nil {
+		return err
+	}
+	if err := db.applyIndex(session, key, record.Type, pos); err != nil {
+		return err
+	}
+	return db.publish(session, record, pos)
+}
+
+// DeleteRange delete the keys in [start, end), the range is not bounded above if end is empty.
+// A range tombstone is written instead of the deletion of each key, except the versioned mode
+// keeping the deletion of each key in its history
+func (db *Database) DeleteRange(session core.Session, start, end core.Bytes) error {
+	if db.readOnly() {
+		return core.ErrReadOnly
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	keys, err := db.im.RangeKeys(session, start, end)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	if db.options.Versioned {
+		for _, key := range keys {
+			if err := db.delete(session, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	record := &core.Record{Key: core.EncodeRange(start, end), Type: core.RangeDeleted}
+	pos, err := db.sm.Write(session, record)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := db.indexDelete(session, key); err != nil {
+			return err
+		}
+	}
+	return db.publish(session, record, pos)
+}
 
-	db.sm.Delete(session, key)
-	_, err = db.im.Delete(session, key)
-	return err
+// DeletePrefix delete the keys with the prefix
+func (db *Database) DeletePrefix(session core.Session, prefix core.Bytes) error {
+	return db.DeleteRange(session, prefix, core.PrefixEnd(prefix))
 }
 
 func (db *Database) Keys(session core.Session) []core.Bytes {
-	return db.im.ListKeys(session)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if !db.options.Versioned {
+		return db.im.ListKeys(session)
+	}
+	// the deleted keys are in the index in the versioned mode
+	it, err := db.im.Iterator(session, false)
+	if err != nil {
+		return nil
+	}
+	defer it.Close()
+	var keys []core.Bytes
+	for ; it.Valid(); it.Next() {
+		if live, _ := db.isLive(session, it.Value()); live {
+			keys = append(keys, it.Key())
+		}
+	}
+	return keys
+}
+
+// readOnly the writes are rejected, the replica is written by the primary only
+func (db *Database) readOnly() bool {
+	return db.options.ReadOnly || db.options.ReplicaOf != ""
+}
+
+// Tables the tables in data.dir and the ones opened, the internal txn table is not included
+func (db *Database) Tables() ([]core.Session, error) {
+	var sessions []core.Session
+	if db.options.StorageType != storage.Memory {
+		var err error
+		if sessions, err = listTables(vfs.Or(db.options.FS), db.options.DataDir); err != nil {
+			return nil, err
+		}
+	}
+	for _, session := range db.sm.Sessions() {
+		if !slices.Contains(sessions, session) {
+			sessions = append(sessions, session)
+		}
+	}
+	return slices.DeleteFunc(sessions, func(session core.Session) bool {
+		return session == TxnSession
+	}), nil
+}
+
+func (db *Database) Stats() Stats {
+	return Stats{
+		Cache: db.sm.CacheStats(),
+	}
+}
+
+// TierUsage the usage of each tier of the table, nil if the storage is not tiered
+func (db *Database) TierUsage(session core.Session) ([]core.TierUsage, error) {
+	return db.sm.TierUsage(session)
 }
 
 // RemoveAllData Note this only for test
@@ -93,14 +330,30 @@ func (db *Database) RemoveAllData(session core.Session) {
 	}
 
 	if db.sm != nil {
-		db.sm.RemoveAllData(session)
+		_ = db.sm.RemoveAllData(session)
 	}
 }
 
 func (db *Database) Close() {
+	if db.replica != nil {
+		db.replica.stop()
+		db.replica = nil
+	}
+	db.mutex.RLock()
+	primary := db.primary
+	db.mutex.RUnlock()
+	if primary != nil {
+		_ = primary.Close()
+	}
+	db.closeWatchers()
 	db.sm.Close()
 	db.sm = nil
 
 	db.im.Close()
 	db.im = nil
+
+	if db.lock != nil {
+		_ = db.lock.Close()
+		db.lock = nil
+	}
 }
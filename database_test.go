@@ -15,10 +15,23 @@ limitations under the License.
 package BytesDB
 
 import (
+	"BytesDB/config"
 	"BytesDB/core"
+	"BytesDB/utils"
+	"BytesDB/vfs"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var session = core.Session{
@@ -29,6 +42,7 @@ var session = core.Session{
 func TestOpenBytesDb(t *testing.T) {
 	db := OpenBytesDb()
 	assert.NotNil(t, db)
+	db.Close()
 }
 
 func TestDatabase_Put_Get(t *testing.T) {
@@ -36,6 +50,7 @@ func TestDatabase_Put_Get(t *testing.T) {
 	assert.NotNil(t, db)
 	t.Cleanup(func() {
 		db.RemoveAllData(session)
+		db.Close()
 	})
 
 	err := db.Put(session, core.Bytes("hello"), core.Bytes("world"))
@@ -55,6 +70,7 @@ func TestDatabase_Put_Delete(t *testing.T) {
 	assert.NotNil(t, db)
 	t.Cleanup(func() {
 		db.RemoveAllData(session)
+		db.Close()
 	})
 
 	err := db.Put(session, core.Bytes("hello"), core.Bytes("world"))
@@ -93,6 +109,7 @@ func TestDatabase_Put_Update_Delete(t *testing.T) {
 	assert.NotNil(t, db)
 	t.Cleanup(func() {
 		db.RemoveAllData(session)
+		db.Close()
 	})
 	err := db.Put(session, core.Bytes("hello"), core.Bytes("world"))
 	assert.Nil(t, err)
@@ -127,6 +144,7 @@ func TestDatabase_Startup(t *testing.T) {
 
 	t.Cleanup(func() {
 		db.RemoveAllData(session)
+		db.Close()
 	})
 
 	for i := 0; i < 100; i++ {
@@ -180,6 +198,7 @@ func TestDatabase_Startup_Delete_Size(t *testing.T) {
 
 	t.Cleanup(func() {
 		db.RemoveAllData(session)
+		db.Close()
 	})
 
 	for i := 0; i < 100; i++ {
@@ -212,3 +231,1418 @@ func TestDatabase_Startup_Delete_Size(t *testing.T) {
 	// Not write the data as the key not exists and stop after the memo index checking
 	assert.Equal(t, nsz, sz)
 }
+
+func TestDatabase_Encrypted_Startup(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:       "/tmp/bytesdb-encrypted",
+		EncryptionKey: "000102030405060708090a0b0c0d0e0f",
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+
+	for i := 0; i < 100; i++ {
+		_ = db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("val"+strconv.Itoa(i)))
+	}
+	db.Close()
+
+	db, err = Open(&config.DBConfig{
+		DataDir:       cfg.DataDir,
+		EncryptionKey: cfg.EncryptionKey,
+	})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("val"+strconv.Itoa(i)), val)
+	}
+	db.Close()
+
+	_, err = Open(&config.DBConfig{
+		DataDir:       cfg.DataDir,
+		EncryptionKey: "not a hex key",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestDatabase_Startup_Sealed_Segments(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:            "/tmp/bytesdb-sealed",
+		MaxFileSize:        1024,
+		MmapSealedSegments: true,
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+
+	for i := 0; i < 200; i++ {
+		_ = db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("val"+strconv.Itoa(i)))
+	}
+	db.Close()
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("val"+strconv.Itoa(i)), val)
+	}
+	db.Close()
+}
+
+func TestDatabase_Stats_Cache(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:       "/tmp/bytesdb-cache",
+		CacheCapacity: 1024 * 1024,
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		db.Close()
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+
+	_ = db.Put(session, core.Bytes("hello"), core.Bytes("world"))
+	for i := 0; i < 3; i++ {
+		val, err := db.Get(session, core.Bytes("hello"))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("world"), val)
+	}
+	stats := db.Stats()
+	assert.Equal(t, uint64(2), stats.Cache.Hits)
+	assert.Equal(t, uint64(1), stats.Cache.Misses)
+}
+
+func TestDatabase_Compact(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:       "/tmp/bytesdb-compact",
+		MaxFileSize:   1024,
+		CacheCapacity: 1024 * 1024,
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			_ = db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("val"+strconv.Itoa(round)))
+		}
+	}
+	for i := 0; i < 10; i++ {
+		_ = db.Delete(session, core.Bytes(strconv.Itoa(i)))
+	}
+	sealed := sealedSegments(t, db)
+	assert.True(t, len(sealed) > 2)
+
+	err = db.Compact(session)
+	assert.Nil(t, err)
+	for _, segment := range sealedSegments(t, db) {
+		assert.True(t, segment > sealed[len(sealed)-1])
+	}
+
+	check := func() {
+		for i := 0; i < 50; i++ {
+			val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+			if i < 10 {
+				assert.Equal(t, core.ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, core.Bytes("val4"), val)
+		}
+	}
+	check()
+
+	db.Close()
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+	db.Close()
+}
+
+func TestDatabase_Memory_Storage(t *testing.T) {
+	for _, indexType := range []string{"local_hash", "btree", "art", "skiplist"} {
+		t.Run(indexType, func(t *testing.T) {
+			t.Parallel()
+			cfg := &config.DBConfig{
+				DataDir:     "/tmp/bytesdb-memory",
+				MaxFileSize: 1024,
+				IndexType:   indexType,
+				StorageType: "memory",
+			}
+			db, err := Open(cfg)
+			assert.Nil(t, err)
+			defer db.Close()
+
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 50; i++ {
+					assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes(indexType+strconv.Itoa(round))))
+				}
+			}
+			for i := 0; i < 10; i++ {
+				assert.Nil(t, db.Delete(session, core.Bytes(strconv.Itoa(i))))
+			}
+			assert.Nil(t, db.Compact(session))
+
+			assert.Equal(t, 40, len(db.Keys(session)))
+			for i := 10; i < 50; i++ {
+				val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+				assert.Nil(t, err)
+				assert.Equal(t, core.Bytes(indexType+"4"), val)
+			}
+			_, err = os.Stat(cfg.DataDir)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestDatabase_MemFS_Crash(t *testing.T) {
+	for _, indexType := range []string{"local_hash", "bptree"} {
+		t.Run(indexType, func(t *testing.T) {
+			mfs := vfs.NewMemFS()
+			cfg := &config.DBConfig{
+				DataDir:     "/tmp/bytesdb-memfs",
+				MaxFileSize: 1024,
+				IndexType:   indexType,
+				FS:          mfs,
+			}
+			db, err := Open(cfg)
+			assert.Nil(t, err)
+			for i := 0; i < 100; i++ {
+				assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value"+strconv.Itoa(i))))
+			}
+			_, err = os.Stat(cfg.DataDir)
+			assert.True(t, os.IsNotExist(err))
+
+			// the records of the sealed segments are synced when rotating, the ones of the
+			// active segment are lost
+			mfs.Crash()
+			db, err = Open(cfg)
+			assert.Nil(t, err)
+			defer db.Close()
+			keys := db.Keys(session)
+			assert.True(t, len(keys) > 0 && len(keys) < 100)
+			for i := 0; i < len(keys); i++ {
+				val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+				assert.Nil(t, err)
+				assert.Equal(t, core.Bytes("value"+strconv.Itoa(i)), val)
+			}
+		})
+	}
+}
+
+func TestDatabase_Object_Storage(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	cfg := &config.DBConfig{
+		DataDir:        "/tmp/bytesdb-object",
+		MaxFileSize:    1024,
+		StorageType:    "object",
+		ObjectStoreDir: "/tmp/bytesdb-object-store",
+		FS:             mfs,
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value"+strconv.Itoa(round))))
+		}
+	}
+	// the sealed segments are uploaded in the background
+	assert.Eventually(t, func() bool {
+		objects, err := mfs.ReadDir("/tmp/bytesdb-object-store/public/test")
+		return err == nil && len(objects) > 0
+	}, time.Second, time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Delete(session, core.Bytes(strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Compact(session))
+	db.Close()
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, 40, len(db.Keys(session)))
+	for i := 10; i < 50; i++ {
+		val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("value4"), val)
+	}
+}
+
+func TestDatabase_Tiered_Storage(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:          "/tmp/bytesdb-tiered",
+		MaxFileSize:      1024,
+		StorageType:      "tiered",
+		TieredColdDir:    "/tmp/bytesdb-tiered-cold",
+		TieredHotMaxSize: 2048,
+		FS:               vfs.NewMemFS(),
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value"+strconv.Itoa(i))))
+	}
+	// the sealed segments are moved in the background
+	assert.Eventually(t, func() bool {
+		tiers, err := db.TierUsage(session)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(tiers))
+		return tiers[1].Segments > 0
+	}, 5*time.Second, time.Millisecond)
+	for i := 0; i < 500; i++ {
+		val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("value"+strconv.Itoa(i)), val)
+	}
+
+	memory, err := Open(&config.DBConfig{StorageType: "memory"})
+	assert.Nil(t, err)
+	defer memory.Close()
+	tiers, err := memory.TierUsage(session)
+	assert.Nil(t, err)
+	assert.Nil(t, tiers)
+}
+
+func TestOpen_Locked(t *testing.T) {
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-locked"}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	_, err = Open(&config.DBConfig{DataDir: cfg.DataDir})
+	assert.ErrorIs(t, err, core.ErrDatabaseLocked)
+
+	// the lock is released by Close, and by the failed Open
+	db.Close()
+	_, err = Open(&config.DBConfig{DataDir: cfg.DataDir, IndexType: "unknown"})
+	assert.ErrorIs(t, err, core.ErrUnknownIndexType)
+	db, err = Open(&config.DBConfig{DataDir: cfg.DataDir})
+	assert.Nil(t, err)
+	db.Close()
+}
+
+func TestDatabase_Read_Only(t *testing.T) {
+	for _, indexType := range []string{"local_hash", "bptree"} {
+		t.Run(indexType, func(t *testing.T) {
+			mfs := vfs.NewMemFS()
+			cfg := &config.DBConfig{
+				DataDir:     "/tmp/bytesdb-read-only",
+				MaxFileSize: 1024,
+				IndexType:   indexType,
+				FS:          mfs,
+			}
+			writer, err := Open(cfg)
+			assert.Nil(t, err)
+			for i := 0; i < 100; i++ {
+				assert.Nil(t, writer.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value"+strconv.Itoa(i))))
+			}
+			writer.Close()
+			files := func() map[string]int64 {
+				sizes := make(map[string]int64)
+				entries, err := mfs.ReadDir("/tmp/bytesdb-read-only/public/test")
+				assert.Nil(t, err)
+				for _, entry := range entries {
+					info, _ := entry.Info()
+					sizes[entry.Name()] = info.Size()
+				}
+				return sizes
+			}
+			before := files()
+
+			// the read-only database is opened with the writer
+			writer, err = Open(cfg)
+			assert.Nil(t, err)
+			defer writer.Close()
+			db, err := Open(&config.DBConfig{DataDir: cfg.DataDir, MaxFileSize: 1024, IndexType: indexType, FS: mfs, ReadOnly: true})
+			assert.Nil(t, err)
+			assert.Equal(t, core.ErrReadOnly, db.Put(session, core.Bytes("0"), core.Bytes("value")))
+			assert.Equal(t, core.ErrReadOnly, db.Delete(session, core.Bytes("0")))
+			assert.Equal(t, core.ErrReadOnly, db.Compact(session))
+			batch := db.NewWriteBatch(WriteBatchOptions{})
+			assert.Equal(t, core.ErrReadOnly, batch.Put(core.Bytes("0"), core.Bytes("value")))
+			assert.Equal(t, core.ErrReadOnly, batch.Commit())
+
+			assert.Equal(t, 100, len(db.Keys(session)))
+			for i := 0; i < 100; i++ {
+				val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+				assert.Nil(t, err)
+				assert.Equal(t, core.Bytes("value"+strconv.Itoa(i)), val)
+			}
+			it, err := db.im.Iterator(session, false)
+			assert.Nil(t, err)
+			count := 0
+			for ; it.Valid(); it.Next() {
+				count++
+			}
+			it.Close()
+			assert.Equal(t, 100, count)
+			_, err = db.Get(core.Session{Schema: "public", Table: "empty"}, core.Bytes("0"))
+			assert.Equal(t, core.ErrKeyNotFound, err)
+			db.Close()
+			assert.Equal(t, before, files())
+			_, err = mfs.Stat("/tmp/bytesdb-read-only/public/empty")
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestDatabase_Backup_Restore(t *testing.T) {
+	for _, storageType := range []string{"local_file", "tiered", "object"} {
+		t.Run(storageType, func(t *testing.T) {
+			mfs := vfs.NewMemFS()
+			cfg := &config.DBConfig{
+				DataDir:          "/tmp/bytesdb-backup",
+				MaxFileSize:      1024,
+				StorageType:      storageType,
+				TieredColdDir:    "/tmp/bytesdb-backup-cold",
+				TieredHotMaxSize: 2048,
+				ObjectStoreDir:   "/tmp/bytesdb-backup-store",
+				FS:               mfs,
+			}
+			db, err := Open(cfg)
+			assert.Nil(t, err)
+			defer db.Close()
+			other := core.Session{Schema: "public", Table: "other"}
+			for i := 0; i < 300; i++ {
+				assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value"+strconv.Itoa(i))))
+			}
+			for i := 0; i < 10; i++ {
+				assert.Nil(t, db.Delete(session, core.Bytes(strconv.Itoa(i))))
+				assert.Nil(t, db.Put(other, core.Bytes(strconv.Itoa(i)), core.Bytes("other")))
+			}
+
+			assert.Nil(t, db.Backup("/tmp/bytesdb-backup-1"))
+			assert.NotNil(t, db.Backup("/tmp/bytesdb-backup-1"))
+			// the writes after the backup are not included
+			assert.Nil(t, db.Put(session, core.Bytes("after"), core.Bytes("value")))
+			assert.Nil(t, db.Put(session, core.Bytes("10"), core.Bytes("changed")))
+			assert.Nil(t, db.Compact(session))
+
+			check := func(db *Database) {
+				assert.Equal(t, 290, len(db.Keys(session)))
+				for i := 10; i < 300; i++ {
+					val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+					assert.Nil(t, err)
+					assert.Equal(t, core.Bytes("value"+strconv.Itoa(i)), val)
+				}
+				_, err := db.Get(session, core.Bytes("after"))
+				assert.Equal(t, core.ErrKeyNotFound, err)
+				assert.Equal(t, 10, len(db.Keys(other)))
+			}
+
+			// the backup is opened as data.dir
+			backup, err := Open(&config.DBConfig{DataDir: "/tmp/bytesdb-backup-1", FS: mfs, ReadOnly: true})
+			assert.Nil(t, err)
+			check(backup)
+			backup.Close()
+
+			restoreCfg := &config.DBConfig{DataDir: "/tmp/bytesdb-restored", MaxFileSize: 1024, FS: mfs}
+			assert.Nil(t, Restore(restoreCfg, "/tmp/bytesdb-backup-1"))
+			restored, err := Open(restoreCfg)
+			assert.Nil(t, err)
+			check(restored)
+			restored.Close()
+			assert.NotNil(t, Restore(restoreCfg, "/tmp/bytesdb-backup-1"))
+
+			manifest, err := ReadBackupManifest(mfs, "/tmp/bytesdb-backup-1")
+			assert.Nil(t, err)
+			assert.Equal(t, 2, len(manifest.Tables))
+			info := manifest.Tables[1].Files[0]
+			file, err := mfs.OpenFile("/tmp/bytesdb-backup-1/public/test/"+info.Name, os.O_RDWR, 0644)
+			assert.Nil(t, err)
+			_, _ = file.WriteAt([]byte("corrupted"), info.Size-1)
+			_ = file.Close()
+			err = Restore(&config.DBConfig{DataDir: "/tmp/bytesdb-restored-2", FS: mfs}, "/tmp/bytesdb-backup-1")
+			assert.ErrorIs(t, err, core.ErrBackupCorrupted)
+			err = Restore(&config.DBConfig{DataDir: "/tmp/bytesdb-restored-2", FS: mfs}, "/tmp/bytesdb-backup-none")
+			assert.ErrorIs(t, err, core.ErrBackupCorrupted)
+		})
+	}
+}
+
+func TestDatabase_Backup_While_Writing(t *testing.T) {
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-backup-writing", MaxFileSize: 1024, FS: vfs.NewMemFS()}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_ = db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value"+strconv.Itoa(i)))
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Backup("/tmp/bytesdb-backup-writing-"+strconv.Itoa(i)))
+	}
+	<-done
+
+	// each backup is a prefix of the writes
+	for i := 0; i < 5; i++ {
+		backup, err := Open(&config.DBConfig{DataDir: "/tmp/bytesdb-backup-writing-" + strconv.Itoa(i), FS: cfg.FS, ReadOnly: true})
+		assert.Nil(t, err)
+		count := len(backup.Keys(session))
+		for j := 0; j < 1000; j++ {
+			val, err := backup.Get(session, core.Bytes(strconv.Itoa(j)))
+			if j < count {
+				assert.Nil(t, err)
+				assert.Equal(t, core.Bytes("value"+strconv.Itoa(j)), val)
+			} else {
+				assert.Equal(t, core.ErrKeyNotFound, err)
+			}
+		}
+		backup.Close()
+	}
+
+	memory, err := Open(&config.DBConfig{StorageType: "memory"})
+	assert.Nil(t, err)
+	defer memory.Close()
+	assert.ErrorIs(t, memory.Backup("/tmp/bytesdb-backup-memory"), core.ErrBackupNotSupported)
+}
+
+func TestDatabase_Snapshot(t *testing.T) {
+	for _, indexType := range []string{"local_hash", "art"} {
+		t.Run(indexType, func(t *testing.T) {
+			db, err := Open(&config.DBConfig{DataDir: "/tmp/bytesdb-snapshot", MaxFileSize: 1024, IndexType: indexType, FS: vfs.NewMemFS()})
+			assert.Nil(t, err)
+			defer db.Close()
+			for i := 0; i < 200; i++ {
+				assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value"+strconv.Itoa(i))))
+			}
+			snapshot, err := db.Snapshot(session)
+			assert.Nil(t, err)
+
+			for i := 0; i < 50; i++ {
+				assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("changed")))
+			}
+			for i := 50; i < 100; i++ {
+				assert.Nil(t, db.Delete(session, core.Bytes(strconv.Itoa(i))))
+			}
+			assert.Nil(t, db.Put(session, core.Bytes("new"), core.Bytes("value")))
+			sealed := len(sealedSegments(t, db))
+			// the merged segments are kept for the snapshot
+			assert.Nil(t, db.Compact(session))
+			assert.True(t, len(sealedSegments(t, db)) >= sealed)
+
+			check := func() {
+				for i := 0; i < 200; i++ {
+					val, err := snapshot.Get(core.Bytes(strconv.Itoa(i)))
+					assert.Nil(t, err)
+					assert.Equal(t, core.Bytes("value"+strconv.Itoa(i)), val)
+				}
+				_, err = snapshot.Get(core.Bytes("new"))
+				assert.Equal(t, core.ErrKeyNotFound, err)
+				assert.Equal(t, 200, len(snapshot.Keys()))
+
+				it, err := snapshot.Iterator(true)
+				assert.Nil(t, err)
+				var keys []string
+				for ; it.Valid(); it.Next() {
+					keys = append(keys, string(it.Key()))
+				}
+				it.Close()
+				assert.Equal(t, 200, len(keys))
+				assert.Equal(t, "99", keys[0])
+				assert.Equal(t, "0", keys[199])
+
+				it, err = snapshot.PrefixIterator(core.Bytes("5"), false)
+				assert.Nil(t, err)
+				count := 0
+				for ; it.Valid(); it.Next() {
+					count++
+				}
+				it.Close()
+				// 5, 50-59
+				assert.Equal(t, 11, count)
+			}
+			check()
+			assert.Nil(t, db.Compact(session))
+			check()
+
+			assert.Nil(t, snapshot.Release())
+			assert.Nil(t, snapshot.Release())
+			_, err = snapshot.Get(core.Bytes("0"))
+			assert.Equal(t, core.ErrSnapshotReleased, err)
+			// the merged segments are removed by the release
+			assert.True(t, len(sealedSegments(t, db)) < sealed)
+
+			assert.Equal(t, 151, len(db.Keys(session)))
+			val, err := db.Get(session, core.Bytes("0"))
+			assert.Nil(t, err)
+			assert.Equal(t, core.Bytes("changed"), val)
+			_, err = db.Get(session, core.Bytes("50"))
+			assert.Equal(t, core.ErrKeyNotFound, err)
+		})
+	}
+}
+
+func TestDatabase_Txn(t *testing.T) {
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-txn", MaxFileSize: 1024, FS: vfs.NewMemFS()}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	other := core.Session{Schema: "public", Table: "other"}
+	assert.Nil(t, db.Put(session, core.Bytes("a"), core.Bytes("1")))
+	assert.Nil(t, db.Put(other, core.Bytes("b"), core.Bytes("1")))
+
+	txn := db.Begin()
+	val, err := txn.Get(session, core.Bytes("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("1"), val)
+	assert.Nil(t, txn.Put(session, core.Bytes("a"), core.Bytes("2")))
+	assert.Nil(t, txn.Delete(other, core.Bytes("b")))
+	assert.Nil(t, txn.Put(other, core.Bytes("c"), core.Bytes("2")))
+	val, err = txn.Get(session, core.Bytes("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("2"), val)
+	_, err = txn.Get(other, core.Bytes("b"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	// the writes are not seen before committing
+	val, err = db.Get(session, core.Bytes("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("1"), val)
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, core.ErrTxnClosed, txn.Commit())
+	assert.Equal(t, core.ErrTxnClosed, txn.Put(session, core.Bytes("a"), core.Bytes("3")))
+
+	check := func(db *Database) {
+		val, err := db.Get(session, core.Bytes("a"))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("2"), val)
+		_, err = db.Get(other, core.Bytes("b"))
+		assert.Equal(t, core.ErrKeyNotFound, err)
+		val, err = db.Get(other, core.Bytes("c"))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("2"), val)
+	}
+	check(db)
+
+	// read-write conflict
+	txn = db.Begin()
+	_, _ = txn.Get(session, core.Bytes("a"))
+	assert.Nil(t, txn.Put(other, core.Bytes("d"), core.Bytes("1")))
+	assert.Nil(t, db.Put(session, core.Bytes("a"), core.Bytes("3")))
+	assert.Equal(t, core.ErrTxnConflict, txn.Commit())
+	_, err = db.Get(other, core.Bytes("d"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	assert.Nil(t, db.Put(session, core.Bytes("a"), core.Bytes("2")))
+
+	// write-write conflict, the first committer wins
+	first, second := db.Begin(), db.Begin()
+	assert.Nil(t, first.Put(other, core.Bytes("c"), core.Bytes("first")))
+	assert.Nil(t, second.Put(other, core.Bytes("c"), core.Bytes("second")))
+	assert.Nil(t, first.Commit())
+	assert.Equal(t, core.ErrTxnConflict, second.Commit())
+	assert.Nil(t, db.Put(other, core.Bytes("c"), core.Bytes("2")))
+
+	// the writes of the keys not touched by the transaction are not conflicts
+	txn = db.Begin()
+	assert.Nil(t, txn.Put(session, core.Bytes("e"), core.Bytes("1")))
+	assert.Nil(t, db.Put(session, core.Bytes("f"), core.Bytes("1")))
+	txn.Rollback()
+	assert.Equal(t, core.ErrTxnClosed, txn.Commit())
+	_, err = db.Get(session, core.Bytes("e"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	txn = db.Begin()
+	assert.Nil(t, txn.Put(session, core.Bytes("e"), core.Bytes("1")))
+	assert.Nil(t, db.Put(session, core.Bytes("f"), core.Bytes("2")))
+	assert.Nil(t, txn.Commit())
+	assert.Nil(t, db.Delete(session, core.Bytes("e")))
+	assert.Nil(t, db.Delete(session, core.Bytes("f")))
+
+	// the committed records are loaded after reopening, and kept by the compaction
+	db.Close()
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check(db)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value")))
+		assert.Nil(t, db.Put(other, core.Bytes(strconv.Itoa(i)), core.Bytes("value")))
+	}
+	assert.Nil(t, db.Compact(session))
+	assert.Nil(t, db.Compact(other))
+	check(db)
+	db.Close()
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer db.Close()
+	check(db)
+}
+
+func TestDatabase_Txn_Not_Finished(t *testing.T) {
+	ffs := vfs.NewFaultFS(vfs.NewMemFS())
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-txn-failed", FS: ffs}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+
+	// the TxnFinished record is not written, the reserved sequence numbers are
+	ffs.Inject(vfs.Fault{Op: vfs.OpWrite, Suffix: "txn/" + utils.BuildDataFileName(0), After: 1, Err: errors.New("disk is full")})
+	txn := db.Begin()
+	assert.Nil(t, txn.Put(session, core.Bytes("a"), core.Bytes("1")))
+	assert.NotNil(t, txn.Commit())
+	_, err = db.Get(session, core.Bytes("a"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	db.Close()
+
+	ffs.Reset()
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	_, err = db.Get(session, core.Bytes("a"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	// the sequence number of the unfinished transaction is not reused
+	txn = db.Begin()
+	assert.Nil(t, txn.Put(session, core.Bytes("b"), core.Bytes("1")))
+	assert.Nil(t, txn.Commit())
+	db.Close()
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer db.Close()
+	_, err = db.Get(session, core.Bytes("a"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	val, err := db.Get(session, core.Bytes("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("1"), val)
+}
+
+func TestDatabase_Versioned(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-versioned", MaxFileSize: 1024, Versioned: true, FS: mfs}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	key := core.Bytes("key")
+	var versions []uint64
+	for _, value := range []string{"v1", "v2", "v3"} {
+		assert.Nil(t, db.Put(session, key, core.Bytes(value)))
+		versions = append(versions, db.LastVersion())
+	}
+	assert.Nil(t, db.Delete(session, key))
+	versions = append(versions, db.LastVersion())
+	txn := db.Begin()
+	assert.Nil(t, txn.Put(session, key, core.Bytes("v5")))
+	assert.Nil(t, txn.Commit())
+	versions = append(versions, db.LastVersion())
+	assert.Nil(t, db.Put(session, core.Bytes("gone"), core.Bytes("value")))
+	assert.Nil(t, db.Delete(session, core.Bytes("gone")))
+	assert.Nil(t, db.Delete(session, core.Bytes("gone")))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value")))
+	}
+
+	check := func(db *Database, kept int) {
+		expected := []string{"v1", "v2", "v3", "", "v5"}
+		for i, version := range versions {
+			val, err := db.GetAt(session, key, version)
+			if expected[i] == "" || i < len(versions)-kept {
+				assert.Equal(t, core.ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, core.Bytes(expected[i]), val)
+			}
+		}
+		_, err := db.GetAt(session, key, 0)
+		assert.Equal(t, core.ErrKeyNotFound, err)
+		history, err := db.GetHistory(session, key)
+		assert.Nil(t, err)
+		assert.Equal(t, kept, len(history))
+		for i, version := range history {
+			assert.Equal(t, versions[len(versions)-1-i], version.Version)
+			assert.Equal(t, expected[len(versions)-1-i] == "", version.Deleted)
+		}
+		val, err := db.Get(session, key)
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("v5"), val)
+		_, err = db.Get(session, core.Bytes("gone"))
+		assert.Equal(t, core.ErrKeyNotFound, err)
+		assert.Equal(t, 101, len(db.Keys(session)))
+	}
+	check(db, 5)
+	history, err := db.GetHistory(session, core.Bytes("gone"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(history))
+
+	// all versions are kept by default
+	assert.Nil(t, db.Compact(session))
+	check(db, 5)
+	last := db.LastVersion()
+	db.Close()
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check(db, 5)
+	assert.Nil(t, db.Put(session, core.Bytes("0"), core.Bytes("value")))
+	assert.True(t, db.LastVersion() > last)
+	db.Close()
+
+	for _, kept := range []int{2, 1} {
+		db, err = Open(&config.DBConfig{DataDir: cfg.DataDir, MaxFileSize: 1024, Versioned: true, VersionsKept: kept, FS: mfs})
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("value")))
+		}
+		assert.Nil(t, db.Compact(session))
+		check(db, kept)
+		db.Close()
+	}
+	db, err = Open(&config.DBConfig{DataDir: cfg.DataDir, MaxFileSize: 1024, Versioned: true, FS: mfs})
+	assert.Nil(t, err)
+	defer db.Close()
+	check(db, 1)
+	// the deletion is dropped without the older versions
+	_, err = db.GetHistory(session, core.Bytes("gone"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+
+	plain, err := Open(&config.DBConfig{StorageType: "memory"})
+	assert.Nil(t, err)
+	defer plain.Close()
+	_, err = plain.GetAt(session, key, 1)
+	assert.Equal(t, core.ErrNotVersioned, err)
+}
+
+func TestDatabase_CompareAndSwap(t *testing.T) {
+	for _, versioned := range []bool{false, true} {
+		cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-cas", FS: vfs.NewMemFS(), Versioned: versioned}
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		key := core.Bytes("lease")
+
+		ok, err := db.CompareAndSwap(session, key, nil, core.Bytes("a"))
+		assert.Nil(t, err)
+		assert.False(t, ok)
+		ok, err = db.PutIfAbsent(session, key, core.Bytes("a"))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		ok, err = db.PutIfAbsent(session, key, core.Bytes("b"))
+		assert.Nil(t, err)
+		assert.False(t, ok)
+		ok, err = db.CompareAndSwap(session, key, core.Bytes("b"), core.Bytes("c"))
+		assert.Nil(t, err)
+		assert.False(t, ok)
+		ok, err = db.CompareAndSwap(session, key, core.Bytes("a"), core.Bytes("c"))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		val, err := db.Get(session, key)
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("c"), val)
+		ok, err = db.DeleteIfEquals(session, key, core.Bytes("a"))
+		assert.Nil(t, err)
+		assert.False(t, ok)
+		ok, err = db.DeleteIfEquals(session, key, core.Bytes("c"))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		_, err = db.Get(session, key)
+		assert.Equal(t, core.ErrKeyNotFound, err)
+		// the deleted key is absent, even it's in the index in the versioned mode
+		ok, err = db.PutIfAbsent(session, key, core.Bytes("d"))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+
+		// the increments are not lost by the concurrent writers
+		counter := core.Bytes("counter")
+		assert.Nil(t, db.Put(session, counter, core.Bytes("0")))
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := 0; n < 50; {
+					old, err := db.Get(session, counter)
+					assert.Nil(t, err)
+					value, _ := strconv.Atoi(string(old))
+					ok, err := db.CompareAndSwap(session, counter, old, core.Bytes(strconv.Itoa(value+1)))
+					assert.Nil(t, err)
+					if ok {
+						n++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		val, err = db.Get(session, counter)
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("400"), val)
+		db.Close()
+	}
+
+	db, err := Open(&config.DBConfig{DataDir: "/tmp/bytesdb-cas", FS: vfs.NewMemFS(), ReadOnly: true})
+	assert.Nil(t, err)
+	_, err = db.PutIfAbsent(session, core.Bytes("a"), core.Bytes("a"))
+	assert.Equal(t, core.ErrReadOnly, err)
+	db.Close()
+}
+
+func TestDatabase_Merge(t *testing.T) {
+	appended := core.Session{Schema: "public", Table: "appended"}
+	fs := vfs.NewMemFS()
+	newConfig := func(versioned bool) *config.DBConfig {
+		return &config.DBConfig{DataDir: "/tmp/bytesdb-merge", MaxFileSize: 1024, FS: fs, Versioned: versioned,
+			MergeOperators: map[core.Session]core.MergeOperator{
+				session:  core.Int64AddOperator{},
+				appended: core.BytesAppendOperator{Separator: core.Bytes(",")},
+			}}
+	}
+	db, err := Open(newConfig(false))
+	assert.Nil(t, err)
+	counter := core.Bytes("counter")
+	assert.Equal(t, core.ErrNoMergeOperator, db.Merge(core.Session{Schema: "public", Table: "other"}, counter, core.EncodeInt64(1)))
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Merge(session, counter, core.EncodeInt64(1)))
+	}
+	assert.Nil(t, db.Put(session, core.Bytes("based"), core.EncodeInt64(10)))
+	assert.Nil(t, db.Merge(session, core.Bytes("based"), core.EncodeInt64(-3)))
+	snapshot, err := db.Snapshot(session)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge(session, core.Bytes("based"), core.EncodeInt64(-3)))
+	assert.Nil(t, db.Merge(appended, core.Bytes("log"), core.Bytes("a")))
+	assert.Nil(t, db.Merge(appended, core.Bytes("log"), core.Bytes("b")))
+	assert.Nil(t, db.Merge(appended, core.Bytes("deleted"), core.Bytes("a")))
+	assert.Nil(t, db.Delete(appended, core.Bytes("deleted")))
+	assert.Nil(t, db.Merge(appended, core.Bytes("deleted"), core.Bytes("b")))
+
+	check := func(db *Database, count int64) {
+		val, err := db.Get(session, counter)
+		assert.Nil(t, err)
+		assert.Equal(t, core.EncodeInt64(count), val)
+		val, err = db.Get(session, core.Bytes("based"))
+		assert.Nil(t, err)
+		assert.Equal(t, core.EncodeInt64(4), val)
+		val, err = db.Get(appended, core.Bytes("log"))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("a,b"), val)
+		val, err = db.Get(appended, core.Bytes("deleted"))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("b"), val)
+	}
+	check(db, 100)
+	val, err := snapshot.Get(core.Bytes("based"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.EncodeInt64(7), val)
+	assert.Nil(t, snapshot.Release())
+
+	// the operands are folded by the compaction, and the later ones are folded with the value
+	assert.Greater(t, len(sealedSegments(t, db)), 0)
+	assert.Nil(t, db.Compact(session))
+	assert.Nil(t, db.Compact(appended))
+	check(db, 100)
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Merge(session, counter, core.EncodeInt64(2)))
+	}
+	assert.Nil(t, db.Compact(session))
+	check(db, 200)
+	db.Close()
+
+	db, err = Open(newConfig(false))
+	assert.Nil(t, err)
+	check(db, 200)
+	ok, err := db.CompareAndSwap(session, counter, core.EncodeInt64(200), core.EncodeInt64(0))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	db.Close()
+
+	// the versions of the operands are the folded values
+	db, err = Open(newConfig(true))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge(session, counter, core.EncodeInt64(5)))
+	version := db.LastVersion()
+	assert.Nil(t, db.Merge(session, counter, core.EncodeInt64(1)))
+	val, err = db.GetAt(session, counter, version)
+	assert.Nil(t, err)
+	assert.Equal(t, core.EncodeInt64(5), val)
+	history, err := db.GetHistory(session, counter)
+	assert.Nil(t, err)
+	// the value swapped before the versioned mode is version 0
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, core.EncodeInt64(6), history[0].Value)
+	assert.Equal(t, core.EncodeInt64(5), history[1].Value)
+	assert.Equal(t, core.EncodeInt64(0), history[2].Value)
+	db.Close()
+
+	cfg := newConfig(true)
+	cfg.VersionsKept = 1
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put(session, core.Bytes("filler"), core.Bytes(strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Compact(session))
+	val, err = db.Get(session, counter)
+	assert.Nil(t, err)
+	assert.Equal(t, core.EncodeInt64(6), val)
+	history, err = db.GetHistory(session, counter)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(history))
+	db.Close()
+}
+
+func TestDatabase_DeleteRange(t *testing.T) {
+	for _, indexType := range []string{"local_hash", "btree", "art", "skiplist"} {
+		t.Run(indexType, func(t *testing.T) {
+			cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-range", MaxFileSize: 1024, IndexType: indexType, FS: vfs.NewMemFS()}
+			db, err := Open(cfg)
+			assert.Nil(t, err)
+			for _, key := range []string{"a1", "a2", "a3", "a4", "a5", "b1", "b2", "b3", "c1"} {
+				assert.Nil(t, db.Put(session, core.Bytes(key), core.Bytes(key)))
+			}
+			snapshot, err := db.Snapshot(session)
+			assert.Nil(t, err)
+			txn := db.Begin()
+			_, _ = txn.Get(session, core.Bytes("a3"))
+			assert.Nil(t, txn.Put(session, core.Bytes("d1"), core.Bytes("d1")))
+
+			assert.Nil(t, db.DeleteRange(session, core.Bytes("a2"), core.Bytes("a4")))
+			assert.Nil(t, db.DeletePrefix(session, core.Bytes("b")))
+			assert.Nil(t, db.Put(session, core.Bytes("b2"), core.Bytes("again")))
+			// nothing is written for the empty range
+			assert.Nil(t, db.DeleteRange(session, core.Bytes("x"), core.Bytes("y")))
+			assert.Equal(t, core.ErrTxnConflict, txn.Commit())
+
+			check := func(db *Database) {
+				for _, key := range []string{"a2", "a3", "b1", "b3", "d1"} {
+					_, err := db.Get(session, core.Bytes(key))
+					assert.Equal(t, core.ErrKeyNotFound, err, key)
+				}
+				val, err := db.Get(session, core.Bytes("b2"))
+				assert.Nil(t, err)
+				assert.Equal(t, core.Bytes("again"), val)
+				keys := db.Keys(session)
+				sort.Slice(keys, func(i, j int) bool {
+					return string(keys[i]) < string(keys[j])
+				})
+				assert.Equal(t, []core.Bytes{core.Bytes("a1"), core.Bytes("a4"), core.Bytes("a5"), core.Bytes("b2"), core.Bytes("c1")}, keys)
+			}
+			check(db)
+			val, err := snapshot.Get(core.Bytes("a3"))
+			assert.Nil(t, err)
+			assert.Equal(t, core.Bytes("a3"), val)
+			assert.Equal(t, 9, len(snapshot.Keys()))
+			assert.Nil(t, snapshot.Release())
+			db.Close()
+
+			// the range tombstone is replayed by the index recovery, and dropped by the compaction
+			db, err = Open(cfg)
+			assert.Nil(t, err)
+			check(db)
+			for i := 0; i < 30; i++ {
+				assert.Nil(t, db.Put(session, core.Bytes("c1"), core.Bytes(strconv.Itoa(i))))
+			}
+			assert.Nil(t, db.Compact(session))
+			check(db)
+			db.Close()
+			db, err = Open(cfg)
+			assert.Nil(t, err)
+			check(db)
+			db.Close()
+		})
+	}
+
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-range", FS: vfs.NewMemFS(), Versioned: true}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(session, core.Bytes("a1"), core.Bytes("1")))
+	assert.Nil(t, db.Put(session, core.Bytes("a2"), core.Bytes("2")))
+	assert.Nil(t, db.DeletePrefix(session, core.Bytes("a")))
+	assert.Equal(t, 0, len(db.Keys(session)))
+	history, err := db.GetHistory(session, core.Bytes("a1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(history))
+	assert.True(t, history[0].Deleted)
+	db.Close()
+}
+
+func TestDatabase_Watch(t *testing.T) {
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-watch", MaxFileSize: 1024, FS: vfs.NewMemFS(),
+		MergeOperators: map[core.Session]core.MergeOperator{session: core.BytesAppendOperator{}}}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	receive := func(w *Watcher, count int) []WatchEvent {
+		var events []WatchEvent
+		for len(events) < count {
+			select {
+			case event, ok := <-w.Events():
+				if !assert.True(t, ok, w.Err()) {
+					return events
+				}
+				events = append(events, event)
+			case <-time.After(5 * time.Second):
+				assert.Fail(t, "no event received")
+				return events
+			}
+		}
+		return events
+	}
+
+	assert.Nil(t, db.Put(session, core.Bytes("user/0"), core.Bytes("0")))
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, db.Put(session, core.Bytes("filler"), core.Bytes(strconv.Itoa(i))))
+	}
+	w, err := db.Watch(session, core.Bytes("user/"), WatchOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(session, core.Bytes("user/1"), core.Bytes("a")))
+	assert.Nil(t, db.Put(session, core.Bytes("other"), core.Bytes("x")))
+	assert.Nil(t, db.Delete(session, core.Bytes("user/1")))
+	assert.Nil(t, db.Merge(session, core.Bytes("user/2"), core.Bytes("b")))
+	assert.Nil(t, db.DeletePrefix(session, core.Bytes("user/")))
+	txn := db.Begin()
+	assert.Nil(t, txn.Put(session, core.Bytes("user/4"), core.Bytes("d")))
+	assert.Nil(t, txn.Put(session, core.Bytes("user/3"), core.Bytes("c")))
+	assert.Nil(t, txn.Commit())
+
+	events := receive(w, 6)
+	assert.Equal(t, 6, len(events))
+	expected := []WatchEvent{
+		{Type: WatchPut, Key: core.Bytes("user/1"), Value: core.Bytes("a")},
+		{Type: WatchDelete, Key: core.Bytes("user/1")},
+		{Type: WatchMerge, Key: core.Bytes("user/2"), Value: core.Bytes("b")},
+		{Type: WatchDeleteRange, Key: core.Bytes("user/"), End: core.Bytes("user0")},
+	}
+	for i, event := range expected {
+		event.Position = events[i].Position
+		assert.Equal(t, event, events[i])
+	}
+	assert.Equal(t, core.Bytes("user/"), events[4].Key[:5])
+	for i := 1; i < len(events); i++ {
+		assert.True(t, before(&events[i-1].Position, &events[i].Position))
+	}
+	w.Close()
+	_, ok := <-w.Events()
+	assert.False(t, ok)
+
+	// resumed after the event seen, the records are replayed then the later writes are received
+	w, err = db.Watch(session, core.Bytes("user/"), WatchOptions{After: &events[1].Position})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(session, core.Bytes("user/5"), core.Bytes("e")))
+	resumed := receive(w, 5)
+	assert.Equal(t, events[2:], resumed[:4])
+	assert.Equal(t, core.Bytes("user/5"), resumed[4].Key)
+	w.Close()
+
+	w, err = db.Watch(session, core.Bytes("user/"), WatchOptions{After: &core.RecordPosition{Segment: -1}})
+	assert.Nil(t, err)
+	replayed := receive(w, 1)
+	assert.Equal(t, core.Bytes("user/0"), replayed[0].Key)
+	assert.Equal(t, core.Bytes("0"), replayed[0].Value)
+	// the watchers are closed with the database
+	db.Close()
+	for range w.Events() {
+	}
+}
+
+func TestDatabase_Watch_Compacted(t *testing.T) {
+	db, err := Open(&config.DBConfig{DataDir: "/tmp/bytesdb-watch-compacted", MaxFileSize: 1024, FS: vfs.NewMemFS()})
+	assert.Nil(t, err)
+	defer db.Close()
+
+	w, err := db.Watch(session, core.Bytes("user/"), WatchOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(session, core.Bytes("user/1"), core.Bytes("a")))
+	event := <-w.Events()
+	w.Close()
+	assert.Nil(t, db.Delete(session, core.Bytes("user/1")))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(session, core.Bytes("filler"), core.Bytes(strconv.Itoa(i))))
+	}
+	assert.Contains(t, sealedSegments(t, db), event.Position.Segment)
+	assert.Nil(t, db.Compact(session))
+	assert.NotContains(t, sealedSegments(t, db), event.Position.Segment)
+
+	// the delete is dropped by Compact, so the watch is not resumed silently without it
+	w, err = db.Watch(session, core.Bytes("user/"), WatchOptions{After: &event.Position})
+	assert.Nil(t, err)
+	select {
+	case _, ok := <-w.Events():
+		assert.False(t, ok, "event replayed after the compacted position")
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "watcher not failed")
+	}
+	assert.ErrorIs(t, w.Err(), core.ErrWatchPositionCompacted)
+	w.Close()
+
+	// the position in the active segment is resumed
+	assert.Nil(t, db.Put(session, core.Bytes("user/2"), core.Bytes("b")))
+	w, err = db.Watch(session, core.Bytes("user/"), WatchOptions{After: &core.RecordPosition{Segment: -1}})
+	assert.Nil(t, err)
+	replayed := <-w.Events()
+	w.Close()
+	w, err = db.Watch(session, core.Bytes("user/"), WatchOptions{After: &replayed.Position})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Delete(session, core.Bytes("user/2")))
+	resumed := <-w.Events()
+	assert.Equal(t, WatchDelete, resumed.Type)
+	assert.Nil(t, w.Err())
+	w.Close()
+}
+
+func TestDatabase_Watch_Overflow(t *testing.T) {
+	db, err := Open(&config.DBConfig{DataDir: "/tmp/bytesdb-watch-overflow", FS: vfs.NewMemFS()})
+	assert.Nil(t, err)
+	defer db.Close()
+
+	w, err := db.Watch(session, core.Bytes("user/"), WatchOptions{MaxPending: 3})
+	assert.Nil(t, err)
+	defer w.Close()
+	// the events are not received while writing, the writes are not blocked by the watcher
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(session, core.Bytes("user/"+strconv.Itoa(i)), core.Bytes(strconv.Itoa(i))))
+	}
+	var received []WatchEvent
+	for event := range w.Events() {
+		received = append(received, event)
+	}
+	assert.ErrorIs(t, w.Err(), core.ErrWatchOverflow)
+	assert.True(t, len(received) < 10)
+
+	// resumed after the last event received
+	after := &core.RecordPosition{Segment: -1}
+	if len(received) > 0 {
+		after = &received[len(received)-1].Position
+	}
+	resumed, err := db.Watch(session, core.Bytes("user/"), WatchOptions{After: after})
+	assert.Nil(t, err)
+	defer resumed.Close()
+	for i := len(received); i < 10; i++ {
+		select {
+		case event := <-resumed.Events():
+			assert.Equal(t, core.Bytes("user/"+strconv.Itoa(i)), event.Key)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "no event received")
+			return
+		}
+	}
+	assert.Nil(t, resumed.Err())
+}
+
+func TestDatabase_Replication(t *testing.T) {
+	newConfig := func(replicaOf string, fs vfs.FS) *config.DBConfig {
+		return &config.DBConfig{DataDir: "/tmp/bytesdb-replication", MaxFileSize: 1024, FS: fs, ReplicaOf: replicaOf,
+			MergeOperators: map[core.Session]core.MergeOperator{session: core.Int64AddOperator{}}}
+	}
+	primary, err := Open(newConfig("", vfs.NewMemFS()))
+	assert.Nil(t, err)
+	defer primary.Close()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, primary.Put(session, core.Bytes("key"+strconv.Itoa(i)), core.Bytes(strconv.Itoa(i))))
+	}
+	assert.Nil(t, primary.Delete(session, core.Bytes("key0")))
+	assert.NotEmpty(t, sealedSegments(t, primary))
+
+	p, err := primary.ListenReplicas("127.0.0.1:0")
+	assert.Nil(t, err)
+	_, err = primary.ListenReplicas("127.0.0.1:0")
+	assert.NotNil(t, err)
+
+	replicaFS := vfs.NewMemFS()
+	replica, err := Open(newConfig(p.Addr(), replicaFS))
+	assert.Nil(t, err)
+	replicated := func() bool {
+		keys := primary.Keys(session)
+		if len(keys) != len(replica.Keys(session)) {
+			return false
+		}
+		for _, key := range keys {
+			expected, _ := primary.Get(session, key)
+			if value, err := replica.Get(session, key); err != nil || string(value) != string(expected) {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Eventually(t, func() bool { return replica.ReplicaStatus().CaughtUp }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, replicated())
+	_, err = replica.Get(session, core.Bytes("key0"))
+	assert.ErrorIs(t, err, core.ErrKeyNotFound)
+
+	// the later writes are streamed
+	assert.Nil(t, primary.Put(session, core.Bytes("key1"), core.Bytes("updated")))
+	assert.Nil(t, primary.Delete(session, core.Bytes("key2")))
+	assert.Nil(t, primary.Merge(session, core.Bytes("counter"), core.EncodeInt64(2)))
+	assert.Nil(t, primary.Merge(session, core.Bytes("counter"), core.EncodeInt64(3)))
+	assert.Nil(t, primary.DeletePrefix(session, core.Bytes("key4")))
+	txn := primary.Begin()
+	assert.Nil(t, txn.Put(session, core.Bytes("txn"), core.Bytes("committed")))
+	assert.Nil(t, txn.Delete(session, core.Bytes("key3")))
+	assert.Nil(t, txn.Commit())
+	assert.Eventually(t, replicated, 5*time.Second, 10*time.Millisecond)
+	value, err := replica.Get(session, core.Bytes("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.EncodeInt64(5), value)
+	_, err = replica.Get(session, core.Bytes("key45"))
+	assert.ErrorIs(t, err, core.ErrKeyNotFound)
+
+	// the lag is reported by both sides once the writes are acked
+	assert.Eventually(t, func() bool {
+		lags := p.Replicas()
+		return len(lags) == 1 && lags[0].CaughtUp && lags[0].Lag == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	status := replica.ReplicaStatus()
+	assert.True(t, status.Connected)
+	assert.Equal(t, p.Addr(), status.Primary)
+	assert.Equal(t, uint64(0), status.Lag)
+	assert.True(t, status.Applied > 0)
+	assert.Nil(t, status.Err)
+
+	// the replica is read-only
+	assert.ErrorIs(t, replica.Put(session, core.Bytes("key1"), core.Bytes("x")), core.ErrReadOnly)
+	assert.ErrorIs(t, replica.Delete(session, core.Bytes("key1")), core.ErrReadOnly)
+	assert.ErrorIs(t, replica.Compact(session), core.ErrReadOnly)
+	_, err = replica.ListenReplicas("127.0.0.1:0")
+	assert.ErrorIs(t, err, core.ErrReadOnly)
+
+	// the segments removed by the compaction are removed from the replica
+	assert.Nil(t, primary.Compact(session))
+	assert.Eventually(t, func() bool {
+		return slices.Equal(sealedSegments(t, primary), sealedSegments(t, replica))
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, replicated, 5*time.Second, 10*time.Millisecond)
+
+	// the reopened replica catches up from its tails, including the compaction missed
+	replica.Close()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, primary.Put(session, core.Bytes("later"+strconv.Itoa(i)), core.Bytes(strconv.Itoa(i))))
+	}
+	assert.Nil(t, primary.Delete(session, core.Bytes("key5")))
+	assert.Nil(t, primary.Compact(session))
+	replica, err = Open(newConfig(p.Addr(), replicaFS))
+	assert.Nil(t, err)
+	defer replica.Close()
+	assert.Eventually(t, func() bool { return replica.ReplicaStatus().CaughtUp }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, replicated())
+	assert.Equal(t, sealedSegments(t, primary), sealedSegments(t, replica))
+
+	// the replica of the replica is not supported, nor the memory storage
+	_, err = Open(&config.DBConfig{StorageType: "memory", ReplicaOf: p.Addr()})
+	assert.ErrorIs(t, err, core.ErrReplicationNotSupported)
+	assert.Nil(t, p.Close())
+	assert.Eventually(t, func() bool { return !replica.ReplicaStatus().Connected }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDatabase_Replication_Slow_Replica(t *testing.T) {
+	cfg := &config.DBConfig{DataDir: "/tmp/bytesdb-replication-slow", FS: vfs.NewMemFS(), ReplicationMaxPending: 2}
+	primary, err := Open(cfg)
+	assert.Nil(t, err)
+	defer primary.Close()
+	p, err := primary.ListenReplicas("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer p.Close()
+
+	// the replica not reading the messages queued
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	slow := &replicaConn{conn: conn, maxPending: cfg.ReplicationMaxPending, signal: make(chan struct{}, 1)}
+	p.mutex.Lock()
+	p.replicas[slow] = struct{}{}
+	p.mutex.Unlock()
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, primary.Put(session, core.Bytes("key"+strconv.Itoa(i)), core.Bytes(strconv.Itoa(i))))
+	}
+	assert.Equal(t, 1, len(p.Replicas()))
+
+	// dropped once the queue is full, the writes are not failed or blocked by it
+	assert.Nil(t, primary.Put(session, core.Bytes("key2"), core.Bytes("2")))
+	assert.Equal(t, 0, len(p.Replicas()))
+	_, err = peer.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	slow.mutex.Lock()
+	assert.True(t, slow.dropped)
+	assert.Nil(t, slow.pending)
+	slow.mutex.Unlock()
+}
+
+func TestOpen_Unknown_Type(t *testing.T) {
+	_, err := Open(&config.DBConfig{IndexType: "unknown"})
+	assert.ErrorIs(t, err, core.ErrUnknownIndexType)
+	_, err = Open(&config.DBConfig{StorageType: "unknown"})
+	assert.ErrorIs(t, err, core.ErrUnknownStorageType)
+}
+
+func TestDatabase_ART_Startup(t *testing.T) {
+	testOrderedIndexStartup(t, "art")
+}
+
+func TestDatabase_SkipList_Startup(t *testing.T) {
+	testOrderedIndexStartup(t, "skiplist")
+}
+
+func TestDatabase_BPTree_Startup(t *testing.T) {
+	testOrderedIndexStartup(t, "bptree")
+}
+
+func testOrderedIndexStartup(t *testing.T, indexType string) {
+	cfg := &config.DBConfig{
+		DataDir:   "/tmp/bytesdb-" + indexType,
+		IndexType: indexType,
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+
+	for i := 0; i < 100; i++ {
+		_ = db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("val"+strconv.Itoa(i)))
+	}
+	_ = db.Delete(session, core.Bytes("0"))
+	db.Close()
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 1; i < 100; i++ {
+		val, err := db.Get(session, core.Bytes(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes("val"+strconv.Itoa(i)), val)
+	}
+	_, err = db.Get(session, core.Bytes("0"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	assert.Equal(t, 99, len(db.Keys(session)))
+	db.Close()
+}
+
+// BenchmarkDatabase_Parallel 10% writes and 90% reads from the parallel goroutines, the
+// writes are serialized by the database lock whatever the index type
+func BenchmarkDatabase_Parallel(b *testing.B) {
+	const keys = 10000
+	for _, indexType := range []string{"btree", "skiplist"} {
+		b.Run(indexType, func(b *testing.B) {
+			db, err := Open(&config.DBConfig{
+				DataDir:     "/tmp/bytesdb-bench-" + indexType,
+				StorageType: "memory",
+				IndexType:   indexType,
+			})
+			assert.Nil(b, err)
+			b.Cleanup(db.Close)
+			for i := 0; i < keys; i++ {
+				_ = db.Put(session, core.Bytes(strconv.Itoa(i)), core.Bytes("val"))
+			}
+
+			var seed atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					key := core.Bytes(strconv.Itoa(rnd.Intn(keys)))
+					if rnd.Intn(10) == 0 {
+						_ = db.Put(session, key, core.Bytes("val"))
+					} else {
+						_, _ = db.Get(session, key)
+					}
+				}
+			})
+		})
+	}
+}
+
+func sealedSegments(t *testing.T, db *Database) []int64 {
+	segments, err := db.sm.SealedSegments(session)
+	assert.Nil(t, err)
+	return segments
+}
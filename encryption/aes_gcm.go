@@ -0,0 +1,77 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"BytesDB/core"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+)
+
+// AESGCM seals data with AES-GCM, the sealed bytes is [nonce, ciphertext, tag]
+type AESGCM struct {
+	aead cipher.AEAD
+}
+
+func NewAESGCM(key core.Bytes) (*AESGCM, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCM{aead: aead}, nil
+}
+
+// Overhead the extra bytes of the sealed data compare to the plain data
+func (c *AESGCM) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+func (c *AESGCM) Seal(plain core.Bytes) (core.Bytes, error) {
+	return c.SealWith(plain, nil)
+}
+
+// SealWith the additional data is authenticated but not sealed, the sealed data is only opened
+// with the same additional data, e.g. the place the data is written to
+func (c *AESGCM) SealWith(plain, additional core.Bytes) (core.Bytes, error) {
+	sealed := make(core.Bytes, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(sealed, sealed, plain, additional), nil
+}
+
+// Open return core.ErrDecryptFailed if the data is tampered or sealed by another key
+func (c *AESGCM) Open(sealed core.Bytes) (core.Bytes, error) {
+	return c.OpenWith(sealed, nil)
+}
+
+// OpenWith return core.ErrDecryptFailed if the additional data is not the one sealed with as well
+func (c *AESGCM) OpenWith(sealed, additional core.Bytes) (core.Bytes, error) {
+	if len(sealed) < c.Overhead() {
+		return nil, core.ErrDecryptFailed
+	}
+	nonce := sealed[:c.aead.NonceSize()]
+	plain, err := c.aead.Open(nil, nonce, sealed[c.aead.NonceSize():], additional)
+	if err != nil {
+		return nil, core.ErrDecryptFailed
+	}
+	return plain, nil
+}
@@ -0,0 +1,82 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"BytesDB/core"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var testKey = core.Bytes("0123456789abcdef0123456789abcdef")
+
+func TestAESGCM_Seal_Open(t *testing.T) {
+	c, err := NewAESGCM(testKey)
+	assert.Nil(t, err)
+
+	sealed, err := c.Seal(core.Bytes("hello world"))
+	assert.Nil(t, err)
+	assert.Equal(t, len("hello world")+c.Overhead(), len(sealed))
+	assert.NotContains(t, string(sealed), "hello world")
+
+	plain, err := c.Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("hello world"), plain)
+
+	// same plain data is sealed with different nonce
+	other, err := c.Seal(core.Bytes("hello world"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, sealed, other)
+}
+
+func TestAESGCM_Open_Failed(t *testing.T) {
+	c, err := NewAESGCM(testKey)
+	assert.Nil(t, err)
+	sealed, err := c.Seal(core.Bytes("hello world"))
+	assert.Nil(t, err)
+
+	tampered := append(core.Bytes{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = c.Open(tampered)
+	assert.Equal(t, core.ErrDecryptFailed, err)
+
+	_, err = c.Open(sealed[:c.Overhead()-1])
+	assert.Equal(t, core.ErrDecryptFailed, err)
+
+	another, err := NewAESGCM(core.Bytes("fedcba9876543210"))
+	assert.Nil(t, err)
+	_, err = another.Open(sealed)
+	assert.Equal(t, core.ErrDecryptFailed, err)
+}
+
+func TestAESGCM_Additional_Data(t *testing.T) {
+	c, err := NewAESGCM(testKey)
+	assert.Nil(t, err)
+	sealed, err := c.SealWith(core.Bytes("hello world"), core.Bytes("segment 1"))
+	assert.Nil(t, err)
+
+	plain, err := c.OpenWith(sealed, core.Bytes("segment 1"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("hello world"), plain)
+	_, err = c.OpenWith(sealed, core.Bytes("segment 2"))
+	assert.Equal(t, core.ErrDecryptFailed, err)
+	_, err = c.Open(sealed)
+	assert.Equal(t, core.ErrDecryptFailed, err)
+}
+
+func TestNewAESGCM_Invalid_Key(t *testing.T) {
+	_, err := NewAESGCM(core.Bytes("short"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,75 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"BytesDB/core"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// StaticKeyProvider keeps the keys in memory, keys can be added for rotation
+type StaticKeyProvider struct {
+	keys    map[uint32]core.Bytes
+	current uint32
+	mutex   sync.RWMutex
+}
+
+func NewStaticKeyProvider(id uint32, key core.Bytes) (*StaticKeyProvider, error) {
+	kp := &StaticKeyProvider{
+		keys: make(map[uint32]core.Bytes),
+	}
+	if err := kp.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// NewHexKeyProvider build a StaticKeyProvider with a hex encoded key
+func NewHexKeyProvider(id uint32, hexKey string) (*StaticKeyProvider, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, errors.New("invalid encryption key, expect hex encoded: " + err.Error())
+	}
+	return NewStaticKeyProvider(id, key)
+}
+
+// Rotate add the key and make it the current one, keys of old ids are kept for reading
+func (kp *StaticKeyProvider) Rotate(id uint32, key core.Bytes) error {
+	if _, err := NewAESGCM(key); err != nil {
+		return err
+	}
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
+	kp.keys[id] = key
+	kp.current = id
+	return nil
+}
+
+func (kp *StaticKeyProvider) CurrentKeyID() uint32 {
+	kp.mutex.RLock()
+	defer kp.mutex.RUnlock()
+	return kp.current
+}
+
+func (kp *StaticKeyProvider) Key(id uint32) (core.Bytes, error) {
+	kp.mutex.RLock()
+	defer kp.mutex.RUnlock()
+	if key, ok := kp.keys[id]; ok {
+		return key, nil
+	}
+	return nil, core.ErrUnknownKeyID
+}
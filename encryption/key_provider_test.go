@@ -0,0 +1,56 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"BytesDB/core"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStaticKeyProvider_Rotate(t *testing.T) {
+	kp, err := NewStaticKeyProvider(1, testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), kp.CurrentKeyID())
+
+	newKey := core.Bytes("fedcba9876543210")
+	err = kp.Rotate(2, newKey)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), kp.CurrentKeyID())
+
+	key, err := kp.Key(1)
+	assert.Nil(t, err)
+	assert.Equal(t, testKey, key)
+	key, err = kp.Key(2)
+	assert.Nil(t, err)
+	assert.Equal(t, newKey, key)
+
+	_, err = kp.Key(3)
+	assert.Equal(t, core.ErrUnknownKeyID, err)
+
+	// invalid key is rejected and the current key not changed
+	err = kp.Rotate(3, core.Bytes("short"))
+	assert.NotNil(t, err)
+	assert.Equal(t, uint32(2), kp.CurrentKeyID())
+}
+
+func TestNewHexKeyProvider(t *testing.T) {
+	kp, err := NewHexKeyProvider(7, "000102030405060708090a0b0c0d0e0f")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), kp.CurrentKeyID())
+
+	_, err = NewHexKeyProvider(7, "not a hex key")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,462 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package art
+
+import (
+	"BytesDB/core"
+	"bytes"
+	"sync"
+)
+
+// ART adaptive radix tree index, the keys sharing the same prefix share the inner nodes
+// instead of storing the full key in every entry of the hash or btree, the leaves only
+// keep the suffix below the inner nodes
+type ART struct {
+	root *node
+	size int
+	lock *sync.RWMutex
+}
+
+func NewART() *ART {
+	return &ART{
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (art *ART) Put(key core.Bytes, pos *core.RecordPosition) (*core.RecordPosition, error) {
+	if key == nil {
+		return nil, core.ErrKeyIsNil
+	}
+	if pos == nil {
+		return nil, core.ErrRecordPositionNil
+	}
+
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	old := insert(&art.root, key, pos, 0)
+	if old == nil {
+		art.size++
+	}
+	return old, nil
+}
+
+// insert return the old position if the key exists, depth is the number of the key
+// bytes consumed above the slot
+func insert(ref **node, key core.Bytes, pos *core.RecordPosition, depth int) *core.RecordPosition {
+	n := *ref
+	if n == nil {
+		*ref = newLeaf(key[depth:], pos)
+		return nil
+	}
+
+	if n.isLeaf() {
+		rest := key[depth:]
+		if bytes.Equal(n.key, rest) {
+			old := n.pos
+			n.pos = pos
+			return old
+		}
+		// split the leaf into a node4 with the common prefix
+		common := commonPrefix(n.key, rest)
+		inner := newNode4(bytes.Clone(rest[:common]))
+		if common == len(n.key) {
+			n.key = nil
+			inner.leaf = n
+		} else {
+			b := n.key[common]
+			n.key = bytes.Clone(n.key[common+1:])
+			inner.addChild(b, n)
+		}
+		inner.place(key, pos, depth+common)
+		*ref = inner
+		return nil
+	}
+
+	common := commonPrefix(n.prefix, key[depth:])
+	if common < len(n.prefix) {
+		// split the prefix of the node
+		inner := newNode4(bytes.Clone(n.prefix[:common]))
+		inner.addChild(n.prefix[common], n)
+		n.prefix = bytes.Clone(n.prefix[common+1:])
+		inner.place(key, pos, depth+common)
+		*ref = inner
+		return nil
+	}
+
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf != nil {
+			old := n.leaf.pos
+			n.leaf.pos = pos
+			return old
+		}
+		n.leaf = newLeaf(nil, pos)
+		return nil
+	}
+
+	if child := n.findChild(key[depth]); child != nil {
+		return insert(child, key, pos, depth+1)
+	}
+	n.addChild(key[depth], newLeaf(key[depth+1:], pos))
+	return nil
+}
+
+// place the new leaf under the inner node whose prefix ends at depth
+func (n *node) place(key core.Bytes, pos *core.RecordPosition, depth int) {
+	if depth == len(key) {
+		n.leaf = newLeaf(nil, pos)
+	} else {
+		n.addChild(key[depth], newLeaf(key[depth+1:], pos))
+	}
+}
+
+func (art *ART) Get(key core.Bytes) (*core.RecordPosition, error) {
+	if key == nil {
+		return nil, core.ErrKeyIsNil
+	}
+
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	if leaf := search(art.root, key); leaf != nil {
+		return leaf.pos, nil
+	}
+	return nil, core.ErrKeyNotFound
+}
+
+func search(n *node, key core.Bytes) *node {
+	depth := 0
+	for n != nil {
+		if n.isLeaf() {
+			if bytes.Equal(n.key, key[depth:]) {
+				return n
+			}
+			return nil
+		}
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			return n.leaf
+		}
+		child := n.findChild(key[depth])
+		if child == nil {
+			return nil
+		}
+		n = *child
+		depth++
+	}
+	return nil
+}
+
+func (art *ART) Delete(key core.Bytes) (bool, error) {
+	if key == nil {
+		return false, core.ErrKeyIsNil
+	}
+
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	deleted := remove(&art.root, key, 0)
+	if deleted {
+		art.size--
+	}
+	return deleted, nil
+}
+
+func remove(ref **node, key core.Bytes, depth int) bool {
+	n := *ref
+	if n == nil {
+		return false
+	}
+	if n.isLeaf() {
+		if bytes.Equal(n.key, key[depth:]) {
+			*ref = nil
+			return true
+		}
+		return false
+	}
+
+	if !bytes.HasPrefix(key[depth:], n.prefix) {
+		return false
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf == nil {
+			return false
+		}
+		n.leaf = nil
+		compact(ref)
+		return true
+	}
+
+	b := key[depth]
+	child := n.findChild(b)
+	if child == nil || !remove(child, key, depth+1) {
+		return false
+	}
+	if *child == nil {
+		n.removeChild(b)
+	}
+	compact(ref)
+	return true
+}
+
+// compact replace the inner node with its only leaf or child, the path of the inner
+// node is moved into the suffix of the leaf or the prefix of the child
+func compact(ref **node) {
+	n := *ref
+	switch {
+	case n.numChildren == 0:
+		if n.leaf != nil {
+			n.leaf.key = n.prefix
+		}
+		*ref = n.leaf
+	case n.numChildren == 1 && n.leaf == nil:
+		b, child := n.onlyChild()
+		if child.isLeaf() {
+			child.key = joinPath(n.prefix, []byte{b}, child.key)
+		} else {
+			child.prefix = joinPath(n.prefix, []byte{b}, child.prefix)
+		}
+		*ref = child
+	}
+}
+
+func joinPath(parts ...core.Bytes) core.Bytes {
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	path := make(core.Bytes, 0, size)
+	for _, part := range parts {
+		path = append(path, part...)
+	}
+	return path
+}
+
+func (art *ART) Exists(key core.Bytes) bool {
+	pos, err := art.Get(key)
+	return err == nil && pos != nil
+}
+
+func (art *ART) Size() int {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return art.size
+}
+
+func (art *ART) Iterator(reverse bool) (core.Iterator, error) {
+	return art.PrefixIterator(nil, reverse)
+}
+
+// PrefixIterator only the subtree of the prefix is visited
+func (art *ART) PrefixIterator(prefix core.Bytes, reverse bool) (core.Iterator, error) {
+	it := &artIterator{
+		art:     art,
+		prefix:  bytes.Clone(prefix),
+		reverse: reverse,
+	}
+	it.Rewind()
+	return it, nil
+}
+
+// searchPrefix return the node whose keys all start with the prefix, and the number of
+// the prefix bytes consumed above the node
+func searchPrefix(n *node, prefix core.Bytes) (*node, int) {
+	depth := 0
+	for n != nil {
+		if n.isLeaf() {
+			if bytes.HasPrefix(n.key, prefix[depth:]) {
+				return n, depth
+			}
+			return nil, 0
+		}
+		rest := prefix[depth:]
+		if len(rest) <= len(n.prefix) {
+			if bytes.HasPrefix(n.prefix, rest) {
+				return n, depth
+			}
+			return nil, 0
+		}
+		if !bytes.HasPrefix(rest, n.prefix) {
+			return nil, 0
+		}
+		depth += len(n.prefix)
+		child := n.findChild(prefix[depth])
+		if child == nil {
+			return nil, 0
+		}
+		n = *child
+		depth++
+	}
+	return nil, 0
+}
+
+func (art *ART) Close() error {
+	return nil
+}
+
+// artIterator walk the tree lazily with a stack of the visited nodes, the read lock is
+// only held for each step, so the writes between the steps may or may not be seen
+type artIterator struct {
+	art     *ART
+	prefix  core.Bytes
+	reverse bool
+	stack   []artFrame
+	key     core.Bytes
+	value   *core.RecordPosition
+}
+
+type artFrame struct {
+	node *node
+	// path the full key of a leaf, or the key bytes through the prefix of an inner node
+	path core.Bytes
+	// cursor the byte of the last visited child
+	cursor int
+	// leafDone the leaf of the inner node is visited or skipped
+	leafDone bool
+}
+
+func (ai *artIterator) push(n *node, parent core.Bytes) {
+	frame := artFrame{node: n, cursor: -1}
+	if ai.reverse {
+		frame.cursor = 256
+	}
+	if n.isLeaf() {
+		frame.path = joinPath(parent, n.key)
+	} else {
+		frame.path = joinPath(parent, n.prefix)
+	}
+	ai.stack = append(ai.stack, frame)
+}
+
+// start push the subtree of the prefix
+func (ai *artIterator) start() {
+	ai.stack = ai.stack[:0]
+	if subtree, depth := searchPrefix(ai.art.root, ai.prefix); subtree != nil {
+		ai.push(subtree, ai.prefix[:depth])
+	}
+}
+
+func (ai *artIterator) Rewind() {
+	ai.art.lock.RLock()
+	defer ai.art.lock.RUnlock()
+	ai.start()
+	ai.advance()
+}
+
+func (ai *artIterator) Seek(key core.Bytes) error {
+	ai.art.lock.RLock()
+	defer ai.art.lock.RUnlock()
+	ai.start()
+	// descend along the key, the frames are left to visit the keys after it
+	for len(ai.stack) > 0 {
+		frame := &ai.stack[len(ai.stack)-1]
+		if frame.node.isLeaf() {
+			cmp := bytes.Compare(frame.path, key)
+			frame.leafDone = ai.reverse && cmp > 0 || !ai.reverse && cmp < 0
+			break
+		}
+		path := frame.path
+		if !bytes.HasPrefix(key, path) || len(key) == len(path) {
+			// all keys of the node are on one side of the key
+			cmp := bytes.Compare(path, key)
+			if ai.reverse && cmp > 0 || !ai.reverse && cmp < 0 {
+				frame.leafDone = true
+				frame.cursor = 256
+				if ai.reverse {
+					frame.cursor = -1
+				}
+			} else if ai.reverse && cmp == 0 {
+				// only the leaf of the node
+				frame.cursor = -1
+			}
+			break
+		}
+		// the leaf of the node is before the key
+		frame.leafDone = !ai.reverse
+		b := int(key[len(path)])
+		child := frame.node.child(byte(b))
+		if child == nil {
+			frame.cursor = b
+			break
+		}
+		frame.cursor = b
+		ai.push(child, joinPath(path, []byte{byte(b)}))
+	}
+	ai.advance()
+	return nil
+}
+
+// advance move to the next key from the top of the stack
+func (ai *artIterator) advance() {
+	for len(ai.stack) > 0 {
+		frame := &ai.stack[len(ai.stack)-1]
+		n := frame.node
+		if n.isLeaf() {
+			done := frame.leafDone
+			frame.leafDone = true
+			if !done {
+				ai.key, ai.value = frame.path, n.pos
+				return
+			}
+		} else {
+			if !ai.reverse && !frame.leafDone {
+				frame.leafDone = true
+				if n.leaf != nil {
+					ai.key, ai.value = joinPath(frame.path, n.leaf.key), n.leaf.pos
+					return
+				}
+			}
+			if b, child := n.nextChild(frame.cursor, ai.reverse); child != nil {
+				frame.cursor = b
+				ai.push(child, joinPath(frame.path, []byte{byte(b)}))
+				continue
+			}
+			if ai.reverse && !frame.leafDone {
+				frame.leafDone = true
+				if n.leaf != nil {
+					ai.key, ai.value = joinPath(frame.path, n.leaf.key), n.leaf.pos
+					return
+				}
+			}
+		}
+		ai.stack = ai.stack[:len(ai.stack)-1]
+	}
+	ai.key, ai.value = nil, nil
+}
+
+func (ai *artIterator) Next() {
+	ai.art.lock.RLock()
+	defer ai.art.lock.RUnlock()
+	ai.advance()
+}
+
+func (ai *artIterator) Valid() bool {
+	return ai.value != nil
+}
+
+func (ai *artIterator) Key() core.Bytes {
+	return ai.key
+}
+
+func (ai *artIterator) Value() *core.RecordPosition {
+	return ai.value
+}
+
+func (ai *artIterator) Close() {
+	ai.stack = nil
+	ai.key, ai.value = nil, nil
+}
@@ -0,0 +1,297 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package art
+
+import (
+	"BytesDB/core"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestART_Put_Get(t *testing.T) {
+	art := NewART()
+	pos := &core.RecordPosition{Size: 10}
+
+	old, err := art.Put(core.Bytes("hello"), pos)
+	assert.Nil(t, err)
+	assert.Nil(t, old)
+
+	old, err = art.Put(core.Bytes("hello"), &core.RecordPosition{})
+	assert.Nil(t, err)
+	assert.Equal(t, pos, old)
+
+	_, err = art.Put(nil, pos)
+	assert.Equal(t, core.ErrKeyIsNil, err)
+	_, err = art.Put(core.Bytes("hello"), nil)
+	assert.Equal(t, core.ErrRecordPositionNil, err)
+
+	// keys are the prefix of each other
+	keys := []string{"", "h", "he", "hel", "help", "hello world", "world"}
+	for i, key := range keys {
+		_, err = art.Put(core.Bytes(key), &core.RecordPosition{Position: int64(i)})
+		assert.Nil(t, err)
+	}
+	for i, key := range keys {
+		v, err := art.Get(core.Bytes(key))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(i), v.Position)
+	}
+	assert.Equal(t, len(keys)+1, art.Size())
+
+	v, err := art.Get(core.Bytes("hell"))
+	assert.Nil(t, v)
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	assert.False(t, art.Exists(core.Bytes("hello world!")))
+	assert.True(t, art.Exists(core.Bytes("hello world")))
+}
+
+func TestART_Delete(t *testing.T) {
+	art := NewART()
+	ok, err := art.Delete(core.Bytes("hello"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	for _, key := range []string{"a", "ab", "abc", "abd", "b"} {
+		_, _ = art.Put(core.Bytes(key), &core.RecordPosition{})
+	}
+	ok, err = art.Delete(core.Bytes("ab"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = art.Delete(core.Bytes("ab"))
+	assert.False(t, ok)
+
+	assert.True(t, art.Exists(core.Bytes("a")))
+	assert.True(t, art.Exists(core.Bytes("abc")))
+	assert.True(t, art.Exists(core.Bytes("abd")))
+	assert.Equal(t, 4, art.Size())
+
+	for _, key := range []string{"a", "abc", "abd", "b"} {
+		ok, _ = art.Delete(core.Bytes(key))
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 0, art.Size())
+	assert.Nil(t, art.root)
+}
+
+// compare with a map, the node kinds grow and shrink with the random keys
+func TestART_Random(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	testRandom(t, func() string {
+		return strconv.FormatInt(rnd.Int63n(5000), 36)
+	})
+	// all 256 bytes for the node256
+	testRandom(t, func() string {
+		return string([]byte{byte(rnd.Intn(256)), byte(rnd.Intn(256))})[:1+rnd.Intn(2)]
+	})
+}
+
+func testRandom(t *testing.T, randomKey func() string) {
+	art := NewART()
+	expected := make(map[string]int64)
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < 20000; i++ {
+		key := randomKey()
+		if rnd.Intn(3) == 0 {
+			ok, err := art.Delete(core.Bytes(key))
+			assert.Nil(t, err)
+			_, exists := expected[key]
+			assert.Equal(t, exists, ok)
+			delete(expected, key)
+		} else {
+			_, err := art.Put(core.Bytes(key), &core.RecordPosition{Position: int64(i)})
+			assert.Nil(t, err)
+			expected[key] = int64(i)
+		}
+	}
+	assert.Equal(t, len(expected), art.Size())
+
+	var keys []string
+	for key, position := range expected {
+		keys = append(keys, key)
+		pos, err := art.Get(core.Bytes(key))
+		assert.Nil(t, err)
+		assert.Equal(t, position, pos.Position)
+	}
+	sort.Strings(keys)
+
+	it, err := art.Iterator(false)
+	assert.Nil(t, err)
+	for i := 0; i < len(keys); i++ {
+		assert.True(t, it.Valid())
+		assert.Equal(t, core.Bytes(keys[i]), it.Key())
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+
+	it, err = art.Iterator(true)
+	assert.Nil(t, err)
+	for i := len(keys) - 1; i >= 0; i-- {
+		assert.True(t, it.Valid())
+		assert.Equal(t, core.Bytes(keys[i]), it.Key())
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+}
+
+func TestART_PrefixIterator(t *testing.T) {
+	art := NewART()
+	keys := []string{"app", "apple", "application", "apply", "banana", "band", "ap"}
+	for _, key := range keys {
+		_, _ = art.Put(core.Bytes(key), &core.RecordPosition{})
+	}
+
+	for _, prefix := range []string{"", "a", "ap", "app", "appl", "appli", "b", "ban", "band", "c", "applications"} {
+		var expected []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				expected = append(expected, key)
+			}
+		}
+		sort.Strings(expected)
+
+		it, err := art.PrefixIterator(core.Bytes(prefix), false)
+		assert.Nil(t, err)
+		var actual []string
+		for ; it.Valid(); it.Next() {
+			actual = append(actual, string(it.Key()))
+		}
+		assert.Equal(t, expected, actual, prefix)
+
+		it, err = art.PrefixIterator(core.Bytes(prefix), true)
+		assert.Nil(t, err)
+		actual = nil
+		for ; it.Valid(); it.Next() {
+			actual = append([]string{string(it.Key())}, actual...)
+		}
+		assert.Equal(t, expected, actual, prefix)
+	}
+}
+
+func TestART_Iterator_Seek(t *testing.T) {
+	art := NewART()
+	for _, key := range []string{"a", "c", "e"} {
+		_, _ = art.Put(core.Bytes(key), &core.RecordPosition{})
+	}
+
+	it, _ := art.Iterator(false)
+	_ = it.Seek(core.Bytes("b"))
+	assert.Equal(t, core.Bytes("c"), it.Key())
+	_ = it.Seek(core.Bytes("c"))
+	assert.Equal(t, core.Bytes("c"), it.Key())
+	_ = it.Seek(core.Bytes("f"))
+	assert.False(t, it.Valid())
+	it.Rewind()
+	assert.Equal(t, core.Bytes("a"), it.Key())
+
+	it, _ = art.Iterator(true)
+	_ = it.Seek(core.Bytes("d"))
+	assert.Equal(t, core.Bytes("c"), it.Key())
+	it.Next()
+	assert.Equal(t, core.Bytes("a"), it.Key())
+	it.Close()
+	assert.False(t, it.Valid())
+}
+
+// seek the random keys in both directions and compare with the sorted keys
+func TestART_Iterator_Seek_Random(t *testing.T) {
+	art := NewART()
+	rnd := rand.New(rand.NewSource(3))
+	var keys []string
+	for i := 0; i < 2000; i++ {
+		key := strconv.FormatInt(rnd.Int63n(100000), 7)
+		if old, _ := art.Put(core.Bytes(key), &core.RecordPosition{}); old == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for i := 0; i < 500; i++ {
+		target := strconv.FormatInt(rnd.Int63n(100000), 7)
+		target = target[:1+rnd.Intn(len(target))]
+		it, _ := art.Iterator(false)
+		_ = it.Seek(core.Bytes(target))
+		j := sort.SearchStrings(keys, target)
+		for k := 0; k < 3 && j+k < len(keys); k++ {
+			assert.Equal(t, core.Bytes(keys[j+k]), it.Key(), target)
+			it.Next()
+		}
+		if j == len(keys) {
+			assert.False(t, it.Valid())
+		}
+
+		it, _ = art.Iterator(true)
+		_ = it.Seek(core.Bytes(target))
+		j = sort.Search(len(keys), func(i int) bool { return keys[i] > target }) - 1
+		for k := 0; k < 3 && j-k >= 0; k++ {
+			assert.Equal(t, core.Bytes(keys[j-k]), it.Key(), target)
+			it.Next()
+		}
+		if j < 0 {
+			assert.False(t, it.Valid())
+		}
+	}
+
+	it, _ := art.PrefixIterator(core.Bytes("12"), false)
+	_ = it.Seek(core.Bytes("0"))
+	assert.True(t, strings.HasPrefix(string(it.Key()), "12"))
+	_ = it.Seek(core.Bytes("13"))
+	assert.False(t, it.Valid())
+}
+
+func TestART_Leaf_Suffix(t *testing.T) {
+	art := NewART()
+	key := core.Bytes("hello world")
+	_, _ = art.Put(key, &core.RecordPosition{})
+	_, _ = art.Put(core.Bytes("hello"), &core.RecordPosition{})
+	key[0] = 'j'
+
+	// the leaf under the inner node "hello" only keeps the bytes after " "
+	assert.Equal(t, core.Bytes("hello"), art.root.prefix)
+	assert.Equal(t, core.Bytes("world"), art.root.child(' ').key)
+	assert.Empty(t, art.root.leaf.key)
+	assert.True(t, art.Exists(core.Bytes("hello world")))
+
+	// the path is moved back into the leaf
+	_, _ = art.Delete(core.Bytes("hello"))
+	assert.Equal(t, core.Bytes("hello world"), art.root.key)
+	assert.True(t, art.Exists(core.Bytes("hello world")))
+}
+
+func TestART_Iterator_Concurrent(t *testing.T) {
+	art := NewART()
+	for i := 0; i < 1000; i++ {
+		_, _ = art.Put(core.Bytes(strconv.Itoa(i)), &core.RecordPosition{})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_, _ = art.Delete(core.Bytes(strconv.Itoa(i)))
+			_, _ = art.Put(core.Bytes(strconv.Itoa(i+1000)), &core.RecordPosition{})
+		}
+	}()
+	it, _ := art.Iterator(false)
+	var last core.Bytes
+	for ; it.Valid(); it.Next() {
+		assert.True(t, last == nil || string(last) < string(it.Key()))
+		last = it.Key()
+	}
+	<-done
+}
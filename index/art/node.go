@@ -0,0 +1,293 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package art
+
+import (
+	"BytesDB/core"
+	"bytes"
+)
+
+type nodeKind uint8
+
+const (
+	leafNode nodeKind = iota
+	node4
+	node16
+	node48
+	node256
+)
+
+// node of the adaptive radix tree, the inner nodes grow from node4 to node256 by the
+// number of children, and shrink back when the children are removed
+type node struct {
+	kind nodeKind
+
+	// leaf
+	// key only the suffix below the slot of the leaf, the bytes above are the path of
+	// the inner nodes and the bytes of their children
+	key core.Bytes
+	pos *core.RecordPosition
+
+	// inner node
+	// prefix the compressed path shared by all keys under the node
+	prefix core.Bytes
+	// leaf the key ends at the node, it's ordered before all children
+	leaf        *node
+	numChildren int
+	// node4, node16: the sorted bytes of the children
+	// node48: the index+1 of the children for each byte, 0 means no child
+	keys     []byte
+	children []*node
+}
+
+// newLeaf the suffix is copied so the leaf doesn't pin the full key of the caller
+func newLeaf(suffix core.Bytes, pos *core.RecordPosition) *node {
+	return &node{kind: leafNode, key: bytes.Clone(suffix), pos: pos}
+}
+
+func newNode4(prefix core.Bytes) *node {
+	return &node{
+		kind:     node4,
+		prefix:   prefix,
+		keys:     make([]byte, 0, 4),
+		children: make([]*node, 0, 4),
+	}
+}
+
+func (n *node) isLeaf() bool {
+	return n.kind == leafNode
+}
+
+// findChild return the slot of the child, nil if no child for the byte
+func (n *node) findChild(b byte) **node {
+	switch n.kind {
+	case node4, node16:
+		for i, k := range n.keys {
+			if k == b {
+				return &n.children[i]
+			}
+		}
+	case node48:
+		if idx := n.keys[b]; idx > 0 {
+			return &n.children[idx-1]
+		}
+	case node256:
+		if n.children[b] != nil {
+			return &n.children[b]
+		}
+	}
+	return nil
+}
+
+func (n *node) isFull() bool {
+	switch n.kind {
+	case node4:
+		return n.numChildren == 4
+	case node16:
+		return n.numChildren == 16
+	case node48:
+		return n.numChildren == 48
+	}
+	return false
+}
+
+func (n *node) addChild(b byte, child *node) {
+	if n.isFull() {
+		n.grow()
+	}
+
+	switch n.kind {
+	case node4, node16:
+		i := 0
+		for i < len(n.keys) && n.keys[i] < b {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = b
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+	case node48:
+		for i, c := range n.children {
+			if c == nil {
+				n.children[i] = child
+				n.keys[b] = byte(i + 1)
+				break
+			}
+		}
+	case node256:
+		n.children[b] = child
+	}
+	n.numChildren++
+}
+
+func (n *node) removeChild(b byte) {
+	switch n.kind {
+	case node4, node16:
+		for i, k := range n.keys {
+			if k == b {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				n.children = append(n.children[:i], n.children[i+1:]...)
+				break
+			}
+		}
+	case node48:
+		idx := n.keys[b]
+		n.children[idx-1] = nil
+		n.keys[b] = 0
+	case node256:
+		n.children[b] = nil
+	}
+	n.numChildren--
+
+	n.shrink()
+}
+
+func (n *node) grow() {
+	switch n.kind {
+	case node4:
+		keys := make([]byte, len(n.keys), 16)
+		children := make([]*node, len(n.children), 16)
+		copy(keys, n.keys)
+		copy(children, n.children)
+		n.kind, n.keys, n.children = node16, keys, children
+	case node16:
+		keys := make([]byte, 256)
+		children := make([]*node, 48)
+		for i, k := range n.keys {
+			keys[k] = byte(i + 1)
+			children[i] = n.children[i]
+		}
+		n.kind, n.keys, n.children = node48, keys, children
+	case node48:
+		children := make([]*node, 256)
+		for b, idx := range n.keys {
+			if idx > 0 {
+				children[b] = n.children[idx-1]
+			}
+		}
+		n.kind, n.keys, n.children = node256, nil, children
+	}
+}
+
+// shrink to the smaller kind when the node is sparse enough, with some room to avoid
+// growing again immediately
+func (n *node) shrink() {
+	switch n.kind {
+	case node16:
+		if n.numChildren <= 3 {
+			keys := make([]byte, len(n.keys), 4)
+			children := make([]*node, len(n.children), 4)
+			copy(keys, n.keys)
+			copy(children, n.children)
+			n.kind, n.keys, n.children = node4, keys, children
+		}
+	case node48:
+		if n.numChildren <= 12 {
+			keys := make([]byte, 0, 16)
+			children := make([]*node, 0, 16)
+			for b, idx := range n.keys {
+				if idx > 0 {
+					keys = append(keys, byte(b))
+					children = append(children, n.children[idx-1])
+				}
+			}
+			n.kind, n.keys, n.children = node16, keys, children
+		}
+	case node256:
+		if n.numChildren <= 37 {
+			keys := make([]byte, 256)
+			children := make([]*node, 48)
+			i := 0
+			for b, child := range n.children {
+				if child != nil {
+					children[i] = child
+					keys[b] = byte(i + 1)
+					i++
+				}
+			}
+			n.kind, n.keys, n.children = node48, keys, children
+		}
+	}
+}
+
+// nextChild the child after the byte of the cursor, or before it in the reverse order,
+// the byte is -1 if there's no more child
+func (n *node) nextChild(cursor int, reverse bool) (int, *node) {
+	switch n.kind {
+	case node4, node16:
+		if reverse {
+			for i := len(n.keys) - 1; i >= 0; i-- {
+				if int(n.keys[i]) < cursor {
+					return int(n.keys[i]), n.children[i]
+				}
+			}
+		} else {
+			for i, k := range n.keys {
+				if int(k) > cursor {
+					return int(k), n.children[i]
+				}
+			}
+		}
+	case node48, node256:
+		step := 1
+		if reverse {
+			step = -1
+		}
+		for b := cursor + step; b >= 0 && b < 256; b += step {
+			if child := n.child(byte(b)); child != nil {
+				return b, child
+			}
+		}
+	}
+	return -1, nil
+}
+
+func (n *node) child(b byte) *node {
+	if ref := n.findChild(b); ref != nil {
+		return *ref
+	}
+	return nil
+}
+
+// onlyChild the byte and the only child
+func (n *node) onlyChild() (byte, *node) {
+	switch n.kind {
+	case node4, node16:
+		return n.keys[0], n.children[0]
+	case node48:
+		for b, idx := range n.keys {
+			if idx > 0 {
+				return byte(b), n.children[idx-1]
+			}
+		}
+	case node256:
+		for b, child := range n.children {
+			if child != nil {
+				return byte(b), child
+			}
+		}
+	}
+	return 0, nil
+}
+
+func commonPrefix(a, b core.Bytes) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,482 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bptree
+
+import (
+	"BytesDB/core"
+	"BytesDB/utils"
+	"BytesDB/vfs"
+	"bytes"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// IndexFileName the file of the index in the directory of the table
+const IndexFileName = "bptree" + utils.IndexFileSuffix
+
+// commitInterval the count of the changes committed together, the changes not committed
+// are recovered from the storage after the Checkpoint
+const commitInterval = 4096
+
+// Options of the bptree index
+type Options struct {
+	// KeyProvider seals the pages of the index created after it's set, nil means plain pages
+	KeyProvider core.KeyProvider
+	// CachePages the count of the pages cached in memory, 1024 if it's not set
+	CachePages int
+	// FS the file system of the index file, vfs.Default if it's not set
+	FS vfs.FS
+	// ReadOnly the index file is not written, the changes are kept in memory
+	ReadOnly bool
+}
+
+// BPTree the B+tree index stored in the table directory, only the cached pages are held in memory,
+// so the keys of the table don't need to fit in the memory
+// note: the pages are not merged when they're half empty, only the empty pages are released
+type BPTree struct {
+	pager *pager
+	lock  *sync.RWMutex
+	// version is changed by every change, the iterators seek again after it's changed
+	version uint64
+	changes int
+}
+
+func NewBPTree(rootPath, schema, table string, opts Options) (*BPTree, error) {
+	fs := vfs.Or(opts.FS)
+	dir := filepath.Join(rootPath, schema, table)
+	if !opts.ReadOnly {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CachePages <= 0 {
+		opts.CachePages = 1024
+	}
+	p, err := openPager(fs, filepath.Join(dir, IndexFileName), opts.KeyProvider, opts.CachePages, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &BPTree{
+		pager: p,
+		lock:  new(sync.RWMutex),
+	}, nil
+}
+
+func (bt *BPTree) Put(key core.Bytes, pos *core.RecordPosition) (*core.RecordPosition, error) {
+	if key == nil {
+		return nil, core.ErrKeyIsNil
+	}
+	if pos == nil {
+		return nil, core.ErrRecordPositionNil
+	}
+	if len(key) > maxKeySize {
+		return nil, core.ErrKeyTooLarge
+	}
+
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+
+	meta := &bt.pager.meta
+	var old *core.RecordPosition
+	if meta.root == 0 {
+		leaf := bt.pager.newNode(true)
+		leaf.insertAt(0, key, pos, 0)
+		meta.root = leaf.id
+	} else {
+		root, split, prev, err := bt.put(meta.root, key, pos)
+		if err != nil {
+			return nil, err
+		}
+		old = prev
+		meta.root = root.id
+		if split != nil {
+			branch := bt.pager.newNode(false)
+			branch.insertAt(0, root.keys[0], nil, root.id)
+			branch.insertAt(1, split.keys[0], nil, split.id)
+			meta.root = branch.id
+		}
+	}
+	if old == nil {
+		meta.count++
+	}
+	if pos.Segment > meta.checkpoint.Segment ||
+		pos.Segment == meta.checkpoint.Segment && pos.Position > meta.checkpoint.Position {
+		meta.checkpoint = core.RecordPosition{Segment: pos.Segment, Position: pos.Position}
+		bt.pager.changed = true
+	}
+	return old, bt.changed()
+}
+
+// put the key to the subtree, returns the new root of the subtree, and the new page
+// split from it if it's too large
+func (bt *BPTree) put(id pgid, key core.Bytes, pos *core.RecordPosition) (*node, *node, *core.RecordPosition, error) {
+	n, err := bt.pager.node(id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var old *core.RecordPosition
+	if n.leaf {
+		i := sort.Search(len(n.keys), func(i int) bool {
+			return bytes.Compare(n.keys[i], key) >= 0
+		})
+		if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+			old = n.positions[i]
+			if *old == *pos {
+				// replayed from the storage
+				return n, nil, old, nil
+			}
+			n = bt.pager.writable(n)
+			n.positions[i] = pos
+		} else {
+			n = bt.pager.writable(n)
+			n.insertAt(i, key, pos, 0)
+		}
+	} else {
+		i := childIndex(n, key)
+		child, split, prev, err := bt.put(n.children[i], key, pos)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		old = prev
+		if child.id == n.children[i] && split == nil {
+			return n, nil, old, nil
+		}
+		n = bt.pager.writable(n)
+		n.children[i] = child.id
+		if split != nil {
+			n.insertAt(i+1, split.keys[0], nil, split.id)
+		}
+	}
+
+	if n.size() <= bt.pager.bodySize {
+		return n, nil, old, nil
+	}
+	split := n.split(bt.pager.allocate())
+	bt.pager.dirty[split.id] = split
+	return n, split, old, nil
+}
+
+func (bt *BPTree) Get(key core.Bytes) (*core.RecordPosition, error) {
+	if key == nil {
+		return nil, core.ErrKeyIsNil
+	}
+
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+
+	if bt.pager.meta.root == 0 {
+		return nil, core.ErrKeyNotFound
+	}
+	n, err := bt.pager.node(bt.pager.meta.root)
+	for err == nil && !n.leaf {
+		n, err = bt.pager.node(n.children[childIndex(n, key)])
+	}
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) >= 0
+	})
+	if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+		return n.positions[i], nil
+	}
+	return nil, core.ErrKeyNotFound
+}
+
+func (bt *BPTree) Delete(key core.Bytes) (bool, error) {
+	if key == nil {
+		return false, core.ErrKeyIsNil
+	}
+
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+
+	meta := &bt.pager.meta
+	if meta.root == 0 {
+		return false, nil
+	}
+	root, found, err := bt.delete(meta.root, key)
+	if err != nil || !found {
+		return false, err
+	}
+
+	meta.count--
+	meta.root = 0
+	// the root with a single child is replaced by the child
+	for root != nil && !root.leaf && len(root.children) == 1 {
+		bt.pager.release(root.id)
+		if root, err = bt.pager.node(root.children[0]); err != nil {
+			return false, err
+		}
+	}
+	if root != nil {
+		meta.root = root.id
+	}
+	return true, bt.changed()
+}
+
+// delete the key from the subtree, returns the new root of the subtree, nil if it's empty
+func (bt *BPTree) delete(id pgid, key core.Bytes) (*node, bool, error) {
+	n, err := bt.pager.node(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if n.leaf {
+		i := sort.Search(len(n.keys), func(i int) bool {
+			return bytes.Compare(n.keys[i], key) >= 0
+		})
+		if i == len(n.keys) || !bytes.Equal(n.keys[i], key) {
+			return n, false, nil
+		}
+		if len(n.keys) == 1 {
+			bt.pager.release(n.id)
+			return nil, true, nil
+		}
+		n = bt.pager.writable(n)
+		n.removeAt(i)
+		return n, true, nil
+	}
+
+	i := childIndex(n, key)
+	child, found, err := bt.delete(n.children[i], key)
+	if err != nil || !found {
+		return n, found, err
+	}
+	if child == nil && len(n.children) == 1 {
+		bt.pager.release(n.id)
+		return nil, true, nil
+	}
+	n = bt.pager.writable(n)
+	if child == nil {
+		n.removeAt(i)
+	} else {
+		n.children[i] = child.id
+	}
+	return n, true, nil
+}
+
+// changed commit the changes if there are enough changes since the last commit
+func (bt *BPTree) changed() error {
+	bt.version++
+	bt.changes++
+	if bt.changes < commitInterval && len(bt.pager.dirty) < bt.pager.cache.capacity {
+		return nil
+	}
+	bt.changes = 0
+	return bt.pager.commit()
+}
+
+func (bt *BPTree) Exists(key core.Bytes) bool {
+	_, err := bt.Get(key)
+	return err == nil
+}
+
+func (bt *BPTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return int(bt.pager.meta.count)
+}
+
+// Checkpoint the position of the last record put to the index, the records after it
+// should be replayed when the index is opened
+func (bt *BPTree) Checkpoint() core.RecordPosition {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.pager.meta.checkpoint
+}
+
+// Flush commit the changes to the index file
+func (bt *BPTree) Flush() error {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	bt.changes = 0
+	return bt.pager.commit()
+}
+
+func (bt *BPTree) Close() error {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return bt.pager.close()
+}
+
+func (bt *BPTree) Iterator(reverse bool) (core.Iterator, error) {
+	it := &bptreeIterator{tree: bt, reverse: reverse}
+	it.Rewind()
+	return it, nil
+}
+
+// childIndex the last child whose lower bound is less or equal to the key
+func childIndex(n *node, key core.Bytes) int {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) > 0
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+type frame struct {
+	node  *node
+	index int
+}
+
+// bptreeIterator walks the leaves by the path from the root, the pages are read when
+// they're reached, after the tree is changed it seeks from the current key again
+type bptreeIterator struct {
+	tree    *BPTree
+	reverse bool
+	version uint64
+	path    []frame
+	key     core.Bytes
+	pos     *core.RecordPosition
+}
+
+func (bti *bptreeIterator) Rewind() {
+	bti.tree.lock.RLock()
+	defer bti.tree.lock.RUnlock()
+	bti.seek(nil)
+}
+
+// Seek find the first key greater or equals to the `key`, or the last key
+// less or equals to the `key` if it's reversed
+func (bti *bptreeIterator) Seek(key core.Bytes) error {
+	bti.tree.lock.RLock()
+	defer bti.tree.lock.RUnlock()
+	return bti.seek(key)
+}
+
+// seek from the root, the first or the last key if the key is nil
+func (bti *bptreeIterator) seek(key core.Bytes) error {
+	bti.version = bti.tree.version
+	bti.path = bti.path[:0]
+	bti.key, bti.pos = nil, nil
+
+	p := bti.tree.pager
+	if p.meta.root == 0 {
+		return nil
+	}
+	n, err := p.node(p.meta.root)
+	if err != nil {
+		return err
+	}
+	for {
+		var i int
+		switch {
+		case key == nil && !bti.reverse:
+			i = 0
+		case key == nil:
+			i = len(n.keys) - 1
+		case !n.leaf:
+			i = childIndex(n, key)
+		case !bti.reverse:
+			i = sort.Search(len(n.keys), func(i int) bool {
+				return bytes.Compare(n.keys[i], key) >= 0
+			})
+		default:
+			i = sort.Search(len(n.keys), func(i int) bool {
+				return bytes.Compare(n.keys[i], key) > 0
+			}) - 1
+		}
+		bti.path = append(bti.path, frame{node: n, index: i})
+		if n.leaf {
+			break
+		}
+		if n, err = p.node(n.children[i]); err != nil {
+			bti.path = bti.path[:0]
+			return err
+		}
+	}
+	return bti.settle()
+}
+
+// settle move to the next leaf if the index is out of the current leaf
+func (bti *bptreeIterator) settle() error {
+	p := bti.tree.pager
+	for len(bti.path) > 0 {
+		top := &bti.path[len(bti.path)-1]
+		if top.index < 0 || top.index >= len(top.node.keys) {
+			// go up to the parent and move to the next child
+			bti.path = bti.path[:len(bti.path)-1]
+			if len(bti.path) > 0 {
+				bti.step(&bti.path[len(bti.path)-1])
+			}
+			continue
+		}
+		if top.node.leaf {
+			bti.key, bti.pos = top.node.keys[top.index], top.node.positions[top.index]
+			return nil
+		}
+		// go down to the first or the last key of the child
+		child, err := p.node(top.node.children[top.index])
+		if err != nil {
+			bti.path = bti.path[:0]
+			return err
+		}
+		index := 0
+		if bti.reverse {
+			index = len(child.keys) - 1
+		}
+		bti.path = append(bti.path, frame{node: child, index: index})
+	}
+	bti.key, bti.pos = nil, nil
+	return nil
+}
+
+func (bti *bptreeIterator) step(f *frame) {
+	if bti.reverse {
+		f.index--
+	} else {
+		f.index++
+	}
+}
+
+func (bti *bptreeIterator) Next() {
+	if bti.key == nil {
+		return
+	}
+
+	bti.tree.lock.RLock()
+	defer bti.tree.lock.RUnlock()
+
+	if bti.version != bti.tree.version {
+		last := bti.key
+		if bti.seek(last) != nil || bti.key == nil || !bytes.Equal(bti.key, last) {
+			return
+		}
+	}
+	bti.step(&bti.path[len(bti.path)-1])
+	_ = bti.settle()
+}
+
+func (bti *bptreeIterator) Valid() bool {
+	return bti.key != nil
+}
+
+func (bti *bptreeIterator) Key() core.Bytes {
+	return bti.key
+}
+
+func (bti *bptreeIterator) Value() *core.RecordPosition {
+	return bti.pos
+}
+
+func (bti *bptreeIterator) Close() {
+	bti.path = nil
+	bti.key, bti.pos = nil, nil
+}
@@ -0,0 +1,319 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bptree
+
+import (
+	"BytesDB/core"
+	"BytesDB/encryption"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+var path = "/tmp/bytesdb-bptree"
+var schema = "test"
+var table = "test"
+
+func openTree(t *testing.T, opts Options) *BPTree {
+	tree, err := NewBPTree(path, schema, table, opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(path)
+	})
+	return tree
+}
+
+func position(i int) *core.RecordPosition {
+	return &core.RecordPosition{Segment: int64(i / 100), Position: int64(i % 100 * 10), Size: i}
+}
+
+func TestBPTree_Put_Get_Delete(t *testing.T) {
+	tree := openTree(t, Options{})
+	defer tree.Close()
+
+	old, err := tree.Put(core.Bytes("hello"), position(1))
+	assert.Nil(t, err)
+	assert.Nil(t, old)
+	old, err = tree.Put(core.Bytes("hello"), position(2))
+	assert.Nil(t, err)
+	assert.Equal(t, position(1), old)
+	_, err = tree.Put(nil, position(1))
+	assert.Equal(t, core.ErrKeyIsNil, err)
+	_, err = tree.Put(core.Bytes("hello"), nil)
+	assert.Equal(t, core.ErrRecordPositionNil, err)
+	_, err = tree.Put(make(core.Bytes, maxKeySize+1), position(1))
+	assert.Equal(t, core.ErrKeyTooLarge, err)
+
+	pos, err := tree.Get(core.Bytes("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, position(2), pos)
+	_, err = tree.Get(core.Bytes("hell"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	assert.True(t, tree.Exists(core.Bytes("hello")))
+	assert.Equal(t, 1, tree.Size())
+
+	deleted, err := tree.Delete(core.Bytes("hello"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	deleted, err = tree.Delete(core.Bytes("hello"))
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	assert.False(t, tree.Exists(core.Bytes("hello")))
+	assert.Equal(t, 0, tree.Size())
+}
+
+func TestBPTree_Reopen(t *testing.T) {
+	tree := openTree(t, Options{CachePages: 16})
+
+	keys := rand.New(rand.NewSource(1)).Perm(20000)
+	for _, i := range keys {
+		_, err := tree.Put(core.Bytes(strconv.Itoa(i)), position(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 20000; i += 2 {
+		deleted, err := tree.Delete(core.Bytes(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.True(t, deleted)
+	}
+	assert.Nil(t, tree.Close())
+
+	tree, err := NewBPTree(path, schema, table, Options{CachePages: 16})
+	assert.Nil(t, err)
+	defer tree.Close()
+	assert.Equal(t, 10000, tree.Size())
+	assert.Equal(t, core.RecordPosition{Segment: 199, Position: 990}, tree.Checkpoint())
+	for i := 0; i < 20000; i++ {
+		pos, err := tree.Get(core.Bytes(strconv.Itoa(i)))
+		if i%2 == 0 {
+			assert.Equal(t, core.ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, position(i), pos)
+		}
+	}
+}
+
+func TestBPTree_Iterator(t *testing.T) {
+	tree := openTree(t, Options{})
+	defer tree.Close()
+
+	var keys []string
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(i)
+		_, _ = tree.Put(core.Bytes(key), position(i))
+		if i%3 == 0 {
+			_, _ = tree.Delete(core.Bytes(key))
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	it, err := tree.Iterator(false)
+	assert.Nil(t, err)
+	for _, key := range keys {
+		assert.True(t, it.Valid())
+		assert.Equal(t, core.Bytes(key), it.Key())
+		i, _ := strconv.Atoi(key)
+		assert.Equal(t, position(i), it.Value())
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+
+	it, err = tree.Iterator(true)
+	assert.Nil(t, err)
+	for i := len(keys) - 1; i >= 0; i-- {
+		assert.True(t, it.Valid())
+		assert.Equal(t, core.Bytes(keys[i]), it.Key())
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+
+	// "3", "30" and "300" are deleted
+	it, _ = tree.Iterator(false)
+	assert.Nil(t, it.Seek(core.Bytes("3")))
+	assert.Equal(t, core.Bytes("3001"), it.Key())
+	it, _ = tree.Iterator(true)
+	assert.Nil(t, it.Seek(core.Bytes("3")))
+	assert.Equal(t, core.Bytes("2999"), it.Key())
+	it.Rewind()
+	assert.Equal(t, core.Bytes(keys[len(keys)-1]), it.Key())
+	it.Close()
+	assert.False(t, it.Valid())
+}
+
+func TestBPTree_Iterator_Changed(t *testing.T) {
+	tree := openTree(t, Options{})
+	defer tree.Close()
+	for i := 0; i < 1000; i++ {
+		_, _ = tree.Put(core.Bytes(strconv.Itoa(1000+i)), position(i))
+	}
+
+	it, _ := tree.Iterator(false)
+	var seen []string
+	for ; it.Valid(); it.Next() {
+		seen = append(seen, string(it.Key()))
+		if string(it.Key()) == "1500" {
+			// the next key and a key already passed are deleted, a later key is added
+			_, _ = tree.Delete(core.Bytes("1501"))
+			_, _ = tree.Delete(core.Bytes("1100"))
+			_, _ = tree.Put(core.Bytes("1500a"), position(1))
+		}
+	}
+	assert.Equal(t, 1000, len(seen))
+	assert.True(t, sort.StringsAreSorted(seen))
+	assert.Equal(t, "1500a", seen[501])
+	assert.Equal(t, "1502", seen[502])
+}
+
+func TestBPTree_Uncommitted(t *testing.T) {
+	tree := openTree(t, Options{})
+	for i := 0; i < 100; i++ {
+		_, _ = tree.Put(core.Bytes(strconv.Itoa(i)), position(i))
+	}
+	assert.Nil(t, tree.Flush())
+	for i := 100; i < 200; i++ {
+		_, _ = tree.Put(core.Bytes(strconv.Itoa(i)), position(i))
+	}
+	// crashed without the commit
+	assert.Nil(t, tree.pager.file.Close())
+
+	tree, err := NewBPTree(path, schema, table, Options{})
+	assert.Nil(t, err)
+	defer tree.Close()
+	assert.Equal(t, 100, tree.Size())
+	assert.Equal(t, core.RecordPosition{Position: 990}, tree.Checkpoint())
+	assert.True(t, tree.Exists(core.Bytes("99")))
+	assert.False(t, tree.Exists(core.Bytes("100")))
+}
+
+func TestBPTree_Torn_Meta(t *testing.T) {
+	tree := openTree(t, Options{})
+	_, _ = tree.Put(core.Bytes("first"), position(1))
+	assert.Nil(t, tree.Flush())
+	_, _ = tree.Put(core.Bytes("second"), position(2))
+	assert.Nil(t, tree.Flush())
+	txid := tree.pager.meta.txid
+	assert.Nil(t, tree.Close())
+
+	// the meta page of the last commit is torn
+	file, err := os.OpenFile(filepath.Join(path, schema, table, IndexFileName), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt(bytes.Repeat(core.Bytes{0xff}, 100), int64(txid%metaPages)*pageSize+100)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	tree, err = NewBPTree(path, schema, table, Options{})
+	assert.Nil(t, err)
+	defer tree.Close()
+	assert.Equal(t, txid-1, tree.pager.meta.txid)
+	assert.True(t, tree.Exists(core.Bytes("first")))
+	assert.False(t, tree.Exists(core.Bytes("second")))
+}
+
+func TestBPTree_Reuse_Pages(t *testing.T) {
+	tree := openTree(t, Options{})
+	defer tree.Close()
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 2000; i++ {
+			_, _ = tree.Put(core.Bytes(strconv.Itoa(i)), position(round))
+		}
+		assert.Nil(t, tree.Flush())
+		if round == 1 {
+			pages := tree.pager.meta.pages
+			defer func() {
+				// the released pages are reused instead of growing the file
+				assert.LessOrEqual(t, tree.pager.meta.pages, pages+pages/2)
+			}()
+		}
+	}
+	assert.Equal(t, 2000, tree.Size())
+}
+
+func TestBPTree_Encrypted(t *testing.T) {
+	keys, err := encryption.NewStaticKeyProvider(1, bytes.Repeat(core.Bytes{1}, 32))
+	assert.Nil(t, err)
+	tree := openTree(t, Options{KeyProvider: keys})
+	for i := 0; i < 1000; i++ {
+		_, _ = tree.Put(core.Bytes("secret"+strconv.Itoa(i)), position(i))
+	}
+	assert.Nil(t, tree.Close())
+
+	content, err := os.ReadFile(filepath.Join(path, schema, table, IndexFileName))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(content, core.Bytes("secret")))
+
+	_, err = NewBPTree(path, schema, table, Options{})
+	assert.Equal(t, core.ErrUnknownKeyID, err)
+
+	assert.Nil(t, keys.Rotate(2, bytes.Repeat(core.Bytes{2}, 32)))
+	tree, err = NewBPTree(path, schema, table, Options{KeyProvider: keys})
+	assert.Nil(t, err)
+	defer tree.Close()
+	_, _ = tree.Put(core.Bytes("secret1000"), position(1000))
+	assert.Nil(t, tree.Flush())
+	for i := 0; i <= 1000; i++ {
+		pos, err := tree.Get(core.Bytes("secret" + strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, position(i), pos)
+	}
+}
+
+func TestBPTree_Read_Only(t *testing.T) {
+	tree := openTree(t, Options{CachePages: 16})
+	for i := 0; i < 5000; i++ {
+		_, err := tree.Put(core.Bytes(strconv.Itoa(i)), position(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tree.Close())
+	indexPath := filepath.Join(path, schema, table, IndexFileName)
+	data, err := os.ReadFile(indexPath)
+	assert.Nil(t, err)
+
+	// the changes are kept in memory, even more than the cached pages
+	tree, err = NewBPTree(path, schema, table, Options{CachePages: 16, ReadOnly: true})
+	assert.Nil(t, err)
+	for i := 5000; i < 10000; i++ {
+		_, err := tree.Put(core.Bytes(strconv.Itoa(i)), position(i))
+		assert.Nil(t, err)
+	}
+	_, err = tree.Delete(core.Bytes("0"))
+	assert.Nil(t, err)
+	assert.Equal(t, 9999, tree.Size())
+	pos, err := tree.Get(core.Bytes("9999"))
+	assert.Nil(t, err)
+	assert.Equal(t, position(9999), pos)
+	assert.Nil(t, tree.Flush())
+	assert.Nil(t, tree.Close())
+	after, err := os.ReadFile(indexPath)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, after))
+
+	// the index file not exists is not created
+	tree, err = NewBPTree(path, schema, "empty", Options{ReadOnly: true})
+	assert.Nil(t, err)
+	_, err = tree.Put(core.Bytes("key"), position(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, tree.Size())
+	assert.Nil(t, tree.Close())
+	_, err = os.Stat(filepath.Join(path, schema, "empty"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,301 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bptree
+
+import (
+	"BytesDB/core"
+	"encoding/binary"
+	"errors"
+)
+
+// the file is split into the pages of the same size, a page is [checksum, body]:
+// the checksum is the crc of the body for the plain files, or the key id the body is
+// sealed with for the encrypted files
+// body:
+// 0 type
+// 1 reserved
+// [2,4) count of the entries
+// [4,...) entries
+const pageSize = 4096
+
+const (
+	pageChecksumSize = 4
+	pageHeaderSize   = 4
+)
+
+const (
+	metaPage byte = iota + 1
+	branchPage
+	leafPage
+	freelistPage
+)
+
+// pgid the page id, the offset of the page in the file is pgid * pageSize
+type pgid uint64
+
+// the first 2 pages are the meta pages, written alternately by the commits so a torn
+// meta page falls back to the previous commit
+const metaPages = 2
+
+// maxKeySize the key is limited so a page always holds at least 3 entries,
+// and the split produces 2 pages fitting the page size
+const maxKeySize = 1024
+
+// freelistCapacity the count of the page ids held by a freelist page, the first
+// entry is the next freelist page
+const freelistCapacity = (pageSize-pageChecksumSize-pageHeaderSize)/8 - 1
+
+var errCorruptedPage = errors.New("corrupted bptree page")
+
+// meta body:
+// [4,8) magic
+// 8 version
+// 9 flags
+// [10,16) reserved
+// [16,24) txid
+// [24,32) root page, 0 if the tree is empty
+// [32,40) page count, the pages beyond it are not allocated
+// [40,48) first freelist page, 0 if there is no free page
+// [48,56) count of the keys
+// [56,64) checkpoint segment
+// [64,72) checkpoint position
+const metaVersion = 1
+
+const (
+	metaFlagEncrypted byte = 1 << iota
+)
+
+var metaMagic = core.Bytes("BKVI")
+
+type meta struct {
+	encrypted  bool
+	txid       uint64
+	root       pgid
+	pages      pgid
+	freelist   pgid
+	count      uint64
+	checkpoint core.RecordPosition
+}
+
+func (m *meta) encode(body core.Bytes) {
+	body[0] = metaPage
+	copy(body[4:8], metaMagic)
+	body[8] = metaVersion
+	if m.encrypted {
+		body[9] |= metaFlagEncrypted
+	}
+	binary.LittleEndian.PutUint64(body[16:], m.txid)
+	binary.LittleEndian.PutUint64(body[24:], uint64(m.root))
+	binary.LittleEndian.PutUint64(body[32:], uint64(m.pages))
+	binary.LittleEndian.PutUint64(body[40:], uint64(m.freelist))
+	binary.LittleEndian.PutUint64(body[48:], m.count)
+	binary.LittleEndian.PutUint64(body[56:], uint64(m.checkpoint.Segment))
+	binary.LittleEndian.PutUint64(body[64:], uint64(m.checkpoint.Position))
+}
+
+func decodeMeta(body core.Bytes) (*meta, error) {
+	if body[0] != metaPage || string(body[4:8]) != string(metaMagic) || body[8] != metaVersion {
+		return nil, errCorruptedPage
+	}
+	return &meta{
+		encrypted: body[9]&metaFlagEncrypted != 0,
+		txid:      binary.LittleEndian.Uint64(body[16:]),
+		root:      pgid(binary.LittleEndian.Uint64(body[24:])),
+		pages:     pgid(binary.LittleEndian.Uint64(body[32:])),
+		freelist:  pgid(binary.LittleEndian.Uint64(body[40:])),
+		count:     binary.LittleEndian.Uint64(body[48:]),
+		checkpoint: core.RecordPosition{
+			Segment:  int64(binary.LittleEndian.Uint64(body[56:])),
+			Position: int64(binary.LittleEndian.Uint64(body[64:])),
+		},
+	}, nil
+}
+
+// node the decoded branch or leaf page, the nodes read from the file are shared by the
+// readers and never changed, the writers change the copies (see pager.writable)
+// branch: keys[i] is the lower bound of the keys in children[i], except the first one
+// leaf entry: [varint key size][key][varint segment][varint position][varint size]
+// branch entry: [varint key size][key][varint child]
+type node struct {
+	id        pgid
+	leaf      bool
+	keys      []core.Bytes
+	positions []*core.RecordPosition
+	children  []pgid
+}
+
+func (n *node) entrySize(i int) int {
+	size := uvarintSize(uint64(len(n.keys[i]))) + len(n.keys[i])
+	if n.leaf {
+		pos := n.positions[i]
+		return size + varintSize(pos.Segment) + varintSize(pos.Position) + varintSize(int64(pos.Size))
+	}
+	return size + uvarintSize(uint64(n.children[i]))
+}
+
+func (n *node) size() int {
+	size := pageHeaderSize
+	for i := range n.keys {
+		size += n.entrySize(i)
+	}
+	return size
+}
+
+func (n *node) encode(body core.Bytes) {
+	if n.leaf {
+		body[0] = leafPage
+	} else {
+		body[0] = branchPage
+	}
+	binary.LittleEndian.PutUint16(body[2:4], uint16(len(n.keys)))
+	off := pageHeaderSize
+	for i, key := range n.keys {
+		off += binary.PutUvarint(body[off:], uint64(len(key)))
+		off += copy(body[off:], key)
+		if n.leaf {
+			pos := n.positions[i]
+			off += binary.PutVarint(body[off:], pos.Segment)
+			off += binary.PutVarint(body[off:], pos.Position)
+			off += binary.PutVarint(body[off:], int64(pos.Size))
+		} else {
+			off += binary.PutUvarint(body[off:], uint64(n.children[i]))
+		}
+	}
+}
+
+func decodeNode(id pgid, body core.Bytes) (*node, error) {
+	if body[0] != leafPage && body[0] != branchPage {
+		return nil, errCorruptedPage
+	}
+	n := &node{id: id, leaf: body[0] == leafPage}
+	count := int(binary.LittleEndian.Uint16(body[2:4]))
+	n.keys = make([]core.Bytes, count)
+	if n.leaf {
+		n.positions = make([]*core.RecordPosition, count)
+	} else {
+		n.children = make([]pgid, count)
+	}
+
+	off := pageHeaderSize
+	next := func() (uint64, bool) {
+		v, s := binary.Uvarint(body[off:])
+		off += s
+		return v, s > 0
+	}
+	nextInt := func() (int64, bool) {
+		v, s := binary.Varint(body[off:])
+		off += s
+		return v, s > 0
+	}
+	for i := 0; i < count; i++ {
+		size, ok := next()
+		if !ok || off+int(size) > len(body) {
+			return nil, errCorruptedPage
+		}
+		n.keys[i] = append(core.Bytes{}, body[off:off+int(size)]...)
+		off += int(size)
+		if n.leaf {
+			segment, ok1 := nextInt()
+			position, ok2 := nextInt()
+			recordSize, ok3 := nextInt()
+			if !ok1 || !ok2 || !ok3 {
+				return nil, errCorruptedPage
+			}
+			n.positions[i] = &core.RecordPosition{Segment: segment, Position: position, Size: int(recordSize)}
+		} else {
+			child, ok := next()
+			if !ok {
+				return nil, errCorruptedPage
+			}
+			n.children[i] = pgid(child)
+		}
+	}
+	return n, nil
+}
+
+func (n *node) clone(id pgid) *node {
+	c := &node{id: id, leaf: n.leaf}
+	c.keys = append(make([]core.Bytes, 0, len(n.keys)+1), n.keys...)
+	if n.leaf {
+		c.positions = append(make([]*core.RecordPosition, 0, len(n.positions)+1), n.positions...)
+	} else {
+		c.children = append(make([]pgid, 0, len(n.children)+1), n.children...)
+	}
+	return c
+}
+
+// split the node in the middle by the size, the node keeps the first half
+// and the second half is returned
+func (n *node) split(id pgid) *node {
+	half := n.size() / 2
+	size := pageHeaderSize
+	at := 1
+	for ; at < len(n.keys)-1; at++ {
+		size += n.entrySize(at - 1)
+		if size >= half {
+			break
+		}
+	}
+
+	right := &node{id: id, leaf: n.leaf}
+	right.keys = append([]core.Bytes{}, n.keys[at:]...)
+	n.keys = n.keys[:at:at]
+	if n.leaf {
+		right.positions = append([]*core.RecordPosition{}, n.positions[at:]...)
+		n.positions = n.positions[:at:at]
+	} else {
+		right.children = append([]pgid{}, n.children[at:]...)
+		n.children = n.children[:at:at]
+	}
+	return right
+}
+
+func (n *node) insertAt(i int, key core.Bytes, pos *core.RecordPosition, child pgid) {
+	n.keys = append(n.keys, nil)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = key
+	if n.leaf {
+		n.positions = append(n.positions, nil)
+		copy(n.positions[i+1:], n.positions[i:])
+		n.positions[i] = pos
+	} else {
+		n.children = append(n.children, 0)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+	}
+}
+
+func (n *node) removeAt(i int) {
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	if n.leaf {
+		n.positions = append(n.positions[:i], n.positions[i+1:]...)
+	} else {
+		n.children = append(n.children[:i], n.children[i+1:]...)
+	}
+}
+
+func uvarintSize(v uint64) int {
+	size := 1
+	for v >= 0x80 {
+		v >>= 7
+		size++
+	}
+	return size
+}
+
+func varintSize(v int64) int {
+	// zigzag as binary.PutVarint
+	return uvarintSize(uint64(v<<1) ^ uint64(v>>63))
+}
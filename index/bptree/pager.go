@@ -0,0 +1,448 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bptree
+
+import (
+	"BytesDB/core"
+	"BytesDB/encryption"
+	"BytesDB/vfs"
+	"container/list"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// pager reads and writes the pages of the index file, the changes are copy-on-write:
+// a changed page is written to a new page, and the meta page switches to the new root
+// at the commit, so the file always holds the complete tree of the last commit
+type pager struct {
+	file vfs.File
+	meta meta
+	// the size of the page body, less than the page size if the pages are sealed
+	bodySize int
+
+	keys       core.KeyProvider
+	ciphers    map[uint32]*encryption.AESGCM
+	cipherLock sync.Mutex
+
+	// the pages changed since the last commit, not written to the file yet
+	dirty map[pgid]*node
+	cache *pageCache
+	// free pages could be reused by the current commit, the pages released by the current
+	// commit are pending until it's committed, since the last commit still references them
+	free          []pgid
+	pending       []pgid
+	freelistPages []pgid
+	changed       bool
+	// the changes of the read-only pager are kept in memory, the file is nil if it's not exists
+	readOnly bool
+}
+
+func openPager(fs vfs.FS, path string, keys core.KeyProvider, cachePages int, readOnly bool) (*pager, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := fs.OpenFile(path, flag, 0644)
+	if readOnly && os.IsNotExist(err) {
+		file, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &pager{
+		file:     file,
+		keys:     keys,
+		ciphers:  make(map[uint32]*encryption.AESGCM),
+		dirty:    make(map[pgid]*node),
+		cache:    newPageCache(cachePages),
+		readOnly: readOnly,
+	}
+	if err = p.init(); err != nil {
+		_ = p.closeFile()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pager) init() error {
+	var size int64
+	if p.file != nil {
+		stat, err := p.file.Stat()
+		if err != nil {
+			return err
+		}
+		size = stat.Size()
+	}
+
+	var err error
+	if size == 0 {
+		// the encryption of the index is decided when it's created, the same as the segments
+		p.meta = meta{encrypted: p.keys != nil, pages: metaPages}
+		if err = p.create(); err != nil {
+			return err
+		}
+	} else if err = p.readMeta(); err != nil {
+		return err
+	}
+
+	p.bodySize = pageSize - pageChecksumSize
+	if p.meta.encrypted {
+		if p.keys == nil {
+			return core.ErrUnknownKeyID
+		}
+		cipher, err := p.cipher(p.keys.CurrentKeyID())
+		if err != nil {
+			return err
+		}
+		p.bodySize -= cipher.Overhead()
+	}
+
+	for id := p.meta.freelist; id != 0; {
+		body, err := p.readPage(id)
+		if err != nil {
+			return err
+		}
+		if body[0] != freelistPage {
+			return errCorruptedPage
+		}
+		p.freelistPages = append(p.freelistPages, id)
+		count := int(binary.LittleEndian.Uint16(body[2:4]))
+		for i := 0; i < count; i++ {
+			p.free = append(p.free, pgid(binary.LittleEndian.Uint64(body[pageHeaderSize+8+i*8:])))
+		}
+		id = pgid(binary.LittleEndian.Uint64(body[pageHeaderSize:]))
+	}
+	return nil
+}
+
+// create write the meta pages of the empty index, the read-only one is only in memory
+func (p *pager) create() error {
+	if p.readOnly {
+		return nil
+	}
+	for i := pgid(0); i < metaPages; i++ {
+		if err := p.writeMeta(i); err != nil {
+			return err
+		}
+	}
+	return p.file.Sync()
+}
+
+// readMeta pick the valid meta page of the latest commit
+func (p *pager) readMeta() error {
+	var latest *meta
+	for i := pgid(0); i < metaPages; i++ {
+		body, err := p.readPlainPage(i)
+		if err != nil {
+			continue
+		}
+		m, err := decodeMeta(body)
+		if err != nil {
+			continue
+		}
+		if latest == nil || m.txid > latest.txid {
+			latest = m
+		}
+	}
+	if latest == nil {
+		return errCorruptedPage
+	}
+	p.meta = *latest
+	return nil
+}
+
+func (p *pager) writeMeta(id pgid) error {
+	body := make(core.Bytes, pageSize-pageChecksumSize)
+	p.meta.encode(body)
+	return p.writePlainPage(id, body)
+}
+
+func (p *pager) cipher(keyID uint32) (*encryption.AESGCM, error) {
+	p.cipherLock.Lock()
+	defer p.cipherLock.Unlock()
+	if cipher, ok := p.ciphers[keyID]; ok {
+		return cipher, nil
+	}
+	key, err := p.keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := encryption.NewAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	p.ciphers[keyID] = cipher
+	return cipher, nil
+}
+
+func (p *pager) readPlainPage(id pgid) (core.Bytes, error) {
+	buf := make(core.Bytes, pageSize)
+	if _, err := p.file.ReadAt(buf, int64(id)*pageSize); err != nil {
+		if err == io.EOF {
+			return nil, errCorruptedPage
+		}
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buf) != crc32.ChecksumIEEE(buf[pageChecksumSize:]) {
+		return nil, errCorruptedPage
+	}
+	return buf[pageChecksumSize:], nil
+}
+
+func (p *pager) writePlainPage(id pgid, body core.Bytes) error {
+	buf := make(core.Bytes, pageSize)
+	copy(buf[pageChecksumSize:], body)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[pageChecksumSize:]))
+	_, err := p.file.WriteAt(buf, int64(id)*pageSize)
+	return err
+}
+
+// readPage the body of the page, the sealed page is [key id, nonce, ciphertext, tag]
+func (p *pager) readPage(id pgid) (core.Bytes, error) {
+	if !p.meta.encrypted {
+		return p.readPlainPage(id)
+	}
+
+	buf := make(core.Bytes, pageSize)
+	if _, err := p.file.ReadAt(buf, int64(id)*pageSize); err != nil {
+		if err == io.EOF {
+			return nil, errCorruptedPage
+		}
+		return nil, err
+	}
+	cipher, err := p.cipher(binary.LittleEndian.Uint32(buf))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.Open(buf[pageChecksumSize:])
+}
+
+func (p *pager) writePage(id pgid, body core.Bytes) error {
+	if !p.meta.encrypted {
+		return p.writePlainPage(id, body)
+	}
+
+	keyID := p.keys.CurrentKeyID()
+	cipher, err := p.cipher(keyID)
+	if err != nil {
+		return err
+	}
+	sealed, err := cipher.Seal(body)
+	if err != nil {
+		return err
+	}
+	buf := make(core.Bytes, pageSize)
+	binary.LittleEndian.PutUint32(buf, keyID)
+	copy(buf[pageChecksumSize:], sealed)
+	_, err = p.file.WriteAt(buf, int64(id)*pageSize)
+	return err
+}
+
+// node the page of the id, the pages not changed should not be modified
+func (p *pager) node(id pgid) (*node, error) {
+	if n, ok := p.dirty[id]; ok {
+		return n, nil
+	}
+	if n, ok := p.cache.get(id); ok {
+		return n, nil
+	}
+
+	body, err := p.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(id, body)
+	if err != nil {
+		return nil, err
+	}
+	p.cache.put(n)
+	return n, nil
+}
+
+// writable the node could be modified, the node not changed since the last commit
+// is copied to a new page, the caller should update the reference of its parent
+func (p *pager) writable(n *node) *node {
+	if p.dirty[n.id] == n {
+		return n
+	}
+	c := n.clone(p.allocate())
+	p.release(n.id)
+	p.dirty[c.id] = c
+	return c
+}
+
+func (p *pager) newNode(leaf bool) *node {
+	n := &node{id: p.allocate(), leaf: leaf}
+	p.dirty[n.id] = n
+	return n
+}
+
+func (p *pager) allocate() pgid {
+	p.changed = true
+	if len(p.free) > 0 {
+		id := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		return id
+	}
+	id := p.meta.pages
+	p.meta.pages++
+	return id
+}
+
+func (p *pager) release(id pgid) {
+	p.changed = true
+	delete(p.dirty, id)
+	p.cache.remove(id)
+	p.pending = append(p.pending, id)
+}
+
+// commit write the changed pages and the free list, then switch the meta page to them
+func (p *pager) commit() error {
+	if !p.changed || p.readOnly {
+		return nil
+	}
+
+	// the pages of the old free list are released, and the new one is written to
+	// the pages at the end of the file, so writing it doesn't change the free pages
+	free := append(append(p.free, p.pending...), p.freelistPages...)
+	sort.Slice(free, func(i, j int) bool {
+		return free[i] > free[j]
+	})
+	var freelist []pgid
+	for i := 0; i < len(free); i += freelistCapacity {
+		freelist = append(freelist, p.meta.pages)
+		p.meta.pages++
+	}
+
+	body := make(core.Bytes, p.bodySize)
+	for _, n := range p.dirty {
+		clear(body)
+		n.encode(body)
+		if err := p.writePage(n.id, body); err != nil {
+			return err
+		}
+	}
+	for i, id := range freelist {
+		clear(body)
+		entries := free[i*freelistCapacity : min(len(free), (i+1)*freelistCapacity)]
+		body[0] = freelistPage
+		binary.LittleEndian.PutUint16(body[2:4], uint16(len(entries)))
+		if i+1 < len(freelist) {
+			binary.LittleEndian.PutUint64(body[pageHeaderSize:], uint64(freelist[i+1]))
+		}
+		for j, entry := range entries {
+			binary.LittleEndian.PutUint64(body[pageHeaderSize+8+j*8:], uint64(entry))
+		}
+		if err := p.writePage(id, body); err != nil {
+			return err
+		}
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+
+	p.meta.txid++
+	p.meta.freelist = 0
+	if len(freelist) > 0 {
+		p.meta.freelist = freelist[0]
+	}
+	if err := p.writeMeta(pgid(p.meta.txid % metaPages)); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+
+	for _, n := range p.dirty {
+		p.cache.put(n)
+	}
+	p.dirty = make(map[pgid]*node)
+	p.free = free
+	p.pending = nil
+	p.freelistPages = freelist
+	p.changed = false
+	return nil
+}
+
+func (p *pager) close() error {
+	if err := p.commit(); err != nil {
+		_ = p.closeFile()
+		return err
+	}
+	return p.closeFile()
+}
+
+func (p *pager) closeFile() error {
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
+
+// pageCache LRU cache of the decoded pages, bounded by the count of the pages
+type pageCache struct {
+	capacity int
+	nodes    map[pgid]*list.Element
+	lru      *list.List
+	mutex    sync.Mutex
+}
+
+func newPageCache(capacity int) *pageCache {
+	return &pageCache{
+		capacity: capacity,
+		nodes:    make(map[pgid]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (pc *pageCache) get(id pgid) (*node, bool) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	elem, ok := pc.nodes[id]
+	if !ok {
+		return nil, false
+	}
+	pc.lru.MoveToFront(elem)
+	return elem.Value.(*node), true
+}
+
+func (pc *pageCache) put(n *node) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if elem, ok := pc.nodes[n.id]; ok {
+		elem.Value = n
+		pc.lru.MoveToFront(elem)
+		return
+	}
+	pc.nodes[n.id] = pc.lru.PushFront(n)
+	for pc.lru.Len() > pc.capacity {
+		last := pc.lru.Back()
+		pc.lru.Remove(last)
+		delete(pc.nodes, last.Value.(*node).id)
+	}
+}
+
+func (pc *pageCache) remove(id pgid) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if elem, ok := pc.nodes[id]; ok {
+		pc.lru.Remove(elem)
+		delete(pc.nodes, id)
+	}
+}
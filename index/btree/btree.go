@@ -63,7 +63,9 @@ func (bt *BTree) Get(key core.Bytes) (*core.RecordPosition, error) {
 	}
 
 	it := &Item{key: key}
+	bt.lock.RLock()
 	item := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if item == nil {
 		return nil, core.ErrKeyNotFound
 	}
@@ -90,6 +92,8 @@ func (bt *BTree) Size() int {
 }
 
 func (bt *BTree) Exists(key core.Bytes) bool {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Get(&Item{key: key}) != nil
 }
 
@@ -27,6 +27,8 @@ type LocalHashIndex struct {
 	rootPath string
 	schema   string
 	table    string
+	// options to open the storage when loading the index
+	storageOpts file.Options
 }
 
 type iterator struct {
@@ -70,13 +72,15 @@ func (idx *LocalHashIndex) Iterator(reverse bool) (core.Iterator, error) {
 		return nil, errors.New("hash index reverse not supported")
 	}
 	var keys []string
-	var values []*core.RecordPosition
 	for item := range idx.index {
 		keys = append(keys, item)
-		values = append(values, idx.index[item])
 	}
 
 	sort.Strings(keys) // it's sort for testing, it not guarantee that the hash index keys are sorted
+	values := make([]*core.RecordPosition, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, idx.index[key])
+	}
 	return &iterator{
 		idx:    0,
 		keys:   keys,
@@ -85,24 +89,40 @@ func (idx *LocalHashIndex) Iterator(reverse bool) (core.Iterator, error) {
 }
 
 func NewLocalHashIndex(rootPath, schema, table string) *LocalHashIndex {
+	return NewLocalHashIndexWithOptions(rootPath, schema, table, file.Options{})
+}
+
+// NewLocalHashIndexWithOptions the options are used to open the storage to load the index,
+// e.g. the key provider of the encrypted storage
+func NewLocalHashIndexWithOptions(rootPath, schema, table string, opts file.Options) *LocalHashIndex {
 	localIndex := &LocalHashIndex{
-		index:    make(map[string]*core.RecordPosition),
-		rootPath: rootPath,
-		schema:   schema,
-		table:    table,
+		index:       make(map[string]*core.RecordPosition),
+		rootPath:    rootPath,
+		schema:      schema,
+		table:       table,
+		storageOpts: opts,
 	}
 	localIndex.loadIndex()
 	return localIndex
 }
 
+// NewEmptyLocalHashIndex the index is not loaded from the storage, the caller puts the
+// positions of the records, e.g. the IndexManager
+func NewEmptyLocalHashIndex() *LocalHashIndex {
+	return &LocalHashIndex{
+		index: make(map[string]*core.RecordPosition),
+	}
+}
+
 func (idx *LocalHashIndex) loadIndex() {
 	idx.index = make(map[string]*core.RecordPosition)
 	// TODO: support loading from hint file
 	// TODO: consider a better way to call this
-	storage, err := file.NewLocalFileStorage(idx.rootPath, idx.schema, idx.table)
+	storage, err := file.NewLocalFileStorageWithOptions(idx.rootPath, idx.schema, idx.table, idx.storageOpts)
 	if err != nil {
 		panic(err)
 	}
+	defer storage.Close()
 	pi, _ := storage.PositionIterator()
 
 	for item, key, typ, err := pi.Next(); item != nil && key != nil; item, key, typ, err = pi.Next() {
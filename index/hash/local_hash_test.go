@@ -16,8 +16,10 @@ package hash
 
 import (
 	"BytesDB/core"
+	"BytesDB/storage/file"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"strconv"
 	"testing"
 )
 
@@ -172,3 +174,41 @@ func TestLocalHashIndex_Iterator(t *testing.T) {
 		i++
 	}
 }
+
+// BenchmarkNewLocalHashIndex the startup time of loading the index from the table,
+// set BYTESDB_BENCH_TABLE_SIZE for the larger tables, e.g. 4294967296 for 4GB
+func BenchmarkNewLocalHashIndex(b *testing.B) {
+	size, err := strconv.ParseInt(os.Getenv("BYTESDB_BENCH_TABLE_SIZE"), 10, 64)
+	if err != nil {
+		size = 64 * 1024 * 1024
+	}
+	benchPath := "/tmp/bytesdb-hash-bench"
+	storage, err := file.NewLocalFileStorageWithOptions(benchPath, schema, table, file.Options{MaxSize: 64 * 1024 * 1024})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		os.RemoveAll(benchPath)
+	})
+
+	value := make(core.Bytes, 100)
+	var written int64
+	keys := 0
+	for ; written < size; keys++ {
+		n, err := storage.Write((&core.Record{Key: core.Bytes(strconv.Itoa(keys)), Value: value}).Pack())
+		if err != nil {
+			b.Fatal(err)
+		}
+		written += int64(n)
+	}
+	_ = storage.Close()
+
+	b.SetBytes(written)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx := NewLocalHashIndex(benchPath, schema, table)
+		if len(idx.index) != keys {
+			b.Fatalf("expect %d keys, got %d", keys, len(idx.index))
+		}
+	}
+}
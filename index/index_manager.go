@@ -17,53 +17,88 @@ package index
 import (
 	"BytesDB/config"
 	"BytesDB/core"
-	"BytesDB/index/btree"
-	"BytesDB/index/hash"
-	"os"
-	"path/filepath"
+	"bytes"
+	"io"
 	"sync"
 )
 
-type IndexType = byte
+type IndexType = string
 
+// the built-in index types, see RegisterIndexType for the others
 const (
-	Local_Hash IndexType = iota
-	BTree
+	Local_Hash IndexType = "local_hash"
+	BTree      IndexType = "btree"
+	ART        IndexType = "art"
+	SkipList   IndexType = "skiplist"
+	BPTree     IndexType = "bptree"
 )
 
+// StorageProvider provides the storage of the table that the index is loaded from
+type StorageProvider interface {
+	Storage(session core.Session) (core.Storage, error)
+}
+
 type IndexManager struct {
-	indexes map[core.Session]core.Index
-	mutex   sync.RWMutex
-	typ     IndexType
-	dataDir string
+	indexes  map[core.Session]core.Index
+	mutex    sync.RWMutex
+	cfg      *config.DBConfig
+	factory  IndexFactory
+	storages StorageProvider
+	// committed tells if the transaction of the sequence number is committed, the records of
+	// the transactions are not loaded if it's nil
+	committed func(seq uint64) bool
 }
 
-func NewIndexManager(cfg *config.DBConfig) *IndexManager {
-	return &IndexManager{
-		indexes: make(map[core.Session]core.Index),
-		mutex:   sync.RWMutex{},
-		typ:     ResolveIndexType(cfg.IndexType),
-		dataDir: cfg.DataDir,
+func NewIndexManager(cfg *config.DBConfig, storages StorageProvider) (*IndexManager, error) {
+	factory, err := ResolveIndexType(cfg.IndexType)
+	if err != nil {
+		return nil, err
 	}
+	return &IndexManager{
+		indexes:  make(map[core.Session]core.Index),
+		mutex:    sync.RWMutex{},
+		cfg:      cfg,
+		factory:  factory,
+		storages: storages,
+	}, nil
+}
+
+// SetTxnCommitted set the function telling if a transaction is committed, it's called before
+// the indexes are loaded
+func (im *IndexManager) SetTxnCommitted(committed func(seq uint64) bool) {
+	im.committed = committed
 }
 
 func (im *IndexManager) Get(id core.Session, key core.Bytes) (*core.RecordPosition, error) {
-	return im.resolve(id).Get(key)
+	idx, err := im.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Get(key)
 }
 
 func (im *IndexManager) Put(id core.Session, key core.Bytes, value *core.RecordPosition) (*core.RecordPosition, error) {
-	return im.resolve(id).Put(key, value)
+	idx, err := im.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Put(key, value)
 }
 
 func (im *IndexManager) Delete(id core.Session, key core.Bytes) (bool, error) {
-	return im.resolve(id).Delete(key)
+	idx, err := im.resolve(id)
+	if err != nil {
+		return false, err
+	}
+	return idx.Delete(key)
 }
 
 func (im *IndexManager) ListKeys(id core.Session) []core.Bytes {
-	im.mutex.RLock()
-	defer im.mutex.RUnlock()
 	var keys []core.Bytes
-	it, _ := im.Iterator(id, false)
+	it, err := im.Iterator(id, false)
+	if err != nil {
+		return nil
+	}
 	defer it.Close()
 
 	for ; it.Valid(); it.Next() {
@@ -73,65 +108,183 @@ func (im *IndexManager) ListKeys(id core.Session) []core.Bytes {
 }
 
 func (im *IndexManager) Iterator(id core.Session, reverse bool) (core.Iterator, error) {
-	return im.resolve(id).Iterator(reverse)
+	idx, err := im.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Iterator(reverse)
+}
+
+// PrefixIterator iterate the keys with the prefix, the index not implementing core.PrefixIndex
+// is scanned fully and filtered
+func (im *IndexManager) PrefixIterator(id core.Session, prefix core.Bytes, reverse bool) (core.Iterator, error) {
+	idx, err := im.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	if pi, ok := idx.(core.PrefixIndex); ok {
+		return pi.PrefixIterator(prefix, reverse)
+	}
+
+	it, err := idx.Iterator(reverse)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	filtered := &sliceIterator{reverse: reverse}
+	for ; it.Valid(); it.Next() {
+		if bytes.HasPrefix(it.Key(), prefix) {
+			filtered.keys = append(filtered.keys, it.Key())
+			filtered.values = append(filtered.values, it.Value())
+		}
+	}
+	return filtered, nil
+}
+
+// RangeKeys the keys in [start, end), the range is not bounded above if end is empty
+func (im *IndexManager) RangeKeys(id core.Session, start, end core.Bytes) ([]core.Bytes, error) {
+	idx, err := im.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	return rangeKeys(idx, start, end)
+}
+
+// rangeKeys the keys of the index in the range, the index not seeking is scanned fully
+func rangeKeys(idx core.Index, start, end core.Bytes) ([]core.Bytes, error) {
+	it, err := idx.Iterator(false)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	sorted := it.Seek(start) == nil
+	var keys []core.Bytes
+	for ; it.Valid(); it.Next() {
+		if core.InRange(it.Key(), start, end) {
+			keys = append(keys, it.Key())
+		} else if sorted {
+			break
+		}
+	}
+	return keys, nil
 }
 
 func (im *IndexManager) RemoveAllData(session core.Session) {
 	im.mutex.Lock()
 	defer im.mutex.Unlock()
+	im.closeIndexes()
 	im.indexes = make(map[core.Session]core.Index)
 }
 
 func (im *IndexManager) Close() {
 	im.mutex.Lock()
 	defer im.mutex.Unlock()
+	im.closeIndexes()
 	im.indexes = nil
 }
 
-func ResolveIndexType(typ string) IndexType {
-	// by default
-	if typ == "" {
-		return Local_Hash
-	}
-	switch typ {
-	case "local_hash":
-		return Local_Hash
-	default:
-		panic("unknown index type")
+// closeIndexes commit the persistent indexes, the caller holds the lock
+func (im *IndexManager) closeIndexes() {
+	for _, idx := range im.indexes {
+		if persistent, ok := idx.(core.PersistentIndex); ok {
+			_ = persistent.Close()
+		}
 	}
 }
 
-func (im *IndexManager) resolve(id core.Session) core.Index {
-	if _, ok := im.indexes[id]; !ok {
-		im.initializeIndex(im.typ, id)
+func (im *IndexManager) resolve(id core.Session) (core.Index, error) {
+	im.mutex.RLock()
+	idx, ok := im.indexes[id]
+	im.mutex.RUnlock()
+	if ok {
+		return idx, nil
 	}
-	return im.indexes[id]
+	return im.initializeIndex(id)
 }
 
-func (im *IndexManager) initializeIndex(typ IndexType, id core.Session) {
+func (im *IndexManager) initializeIndex(id core.Session) (core.Index, error) {
 	im.mutex.Lock()
 	defer im.mutex.Unlock()
 
-	if _, ok := im.indexes[id]; ok {
-		return
+	if idx, ok := im.indexes[id]; ok {
+		return idx, nil
 	}
 
-	switch typ {
-	case Local_Hash:
-		path := filepath.Join(im.dataDir, id.Schema, id.Table)
-		// TODO: remove It's strange to create the dir in index part
-		err := os.MkdirAll(path, 0777)
-		if err != nil {
-			panic(err)
+	idx, err := im.factory(im.cfg, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = im.load(idx, id); err != nil {
+		if persistent, ok := idx.(core.PersistentIndex); ok {
+			_ = persistent.Close()
 		}
-		im.indexes[id] = hash.NewLocalHashIndex(im.dataDir, id.Schema, id.Table)
-		return
+		return nil, err
+	}
+	im.indexes[id] = idx
+	return idx, nil
+}
 
-	case BTree:
-		im.indexes[id] = btree.NewBTree()
-		return
+// load the positions of the records from the storage into the index, the persistent index
+// only loads the records after its checkpoint
+func (im *IndexManager) load(idx core.Index, id core.Session) error {
+	storage, err := im.storages.Storage(id)
+	if err != nil {
+		return err
+	}
 
-	default:
-		panic("unknown index type")
+	var from core.RecordPosition
+	if persistent, ok := idx.(core.PersistentIndex); ok {
+		from = persistent.Checkpoint()
+	}
+	var segments []int64
+	for _, segment := range append(storage.SealedSegments(), storage.ActiveSegment()) {
+		if segment >= from.Segment {
+			segments = append(segments, segment)
+		}
+	}
+
+	scanner, err := storage.Scan(core.ScanOptions{Segments: segments})
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+	for {
+		pos, record, err := scanner.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pos.Segment == from.Segment && pos.Position < from.Position {
+			continue
+		}
+		if record.IsTxn() {
+			seq, plain, err := record.UnwrapTxn()
+			if err != nil {
+				return err
+			}
+			if im.committed == nil || !im.committed(seq) {
+				continue
+			}
+			record = plain
+		}
+		if record.Type == core.RangeDeleted {
+			start, end, err := core.DecodeRange(record.Key)
+			if err != nil {
+				return err
+			}
+			keys, err := rangeKeys(idx, start, end)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				_, _ = idx.Delete(key)
+			}
+		} else if record.Type == core.Deleted {
+			_, _ = idx.Delete(record.Key)
+		} else {
+			_, _ = idx.Put(record.Key, pos)
+		}
 	}
 }
@@ -0,0 +1,156 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/index/btree"
+	"BytesDB/storage"
+	"BytesDB/storage/file"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"testing"
+)
+
+var session = core.Session{
+	Schema: "public",
+	Table:  "test",
+}
+
+func TestIndexManager_PrefixIterator(t *testing.T) {
+	for _, typ := range []string{"local_hash", "art", "bptree"} {
+		cfg := &config.DBConfig{
+			DataDir:   "/tmp/bytesdb-index-manager-" + typ,
+			IndexType: typ,
+		}
+		sm, err := storage.NewStorageManager(cfg)
+		assert.Nil(t, err)
+		im, err := NewIndexManager(cfg, sm)
+		assert.Nil(t, err)
+		keys := []string{"app", "apple", "apply", "banana"}
+		for i, key := range keys {
+			_, err := im.Put(session, core.Bytes(key), &core.RecordPosition{Position: int64(i)})
+			assert.Nil(t, err)
+		}
+
+		it, err := im.PrefixIterator(session, core.Bytes("appl"), false)
+		assert.Nil(t, err)
+		assert.True(t, it.Valid())
+		assert.Equal(t, core.Bytes("apple"), it.Key())
+		assert.Equal(t, int64(1), it.Value().Position)
+		it.Next()
+		assert.Equal(t, core.Bytes("apply"), it.Key())
+		assert.Equal(t, int64(2), it.Value().Position)
+		it.Next()
+		assert.False(t, it.Valid())
+
+		im.Close()
+		sm.Close()
+		_ = os.RemoveAll(cfg.DataDir)
+	}
+}
+
+func TestIndexManager_BPTree_Checkpoint(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:   "/tmp/bytesdb-index-manager-checkpoint",
+		IndexType: "bptree",
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+	write := func(from, to int, typ core.RecordType) {
+		fs, err := file.NewLocalFileStorageWithOptions(cfg.DataDir, session.Schema, session.Table, file.Options{MaxSize: 1024})
+		assert.Nil(t, err)
+		for i := from; i < to; i++ {
+			_, err = fs.Write((&core.Record{Key: core.Bytes(strconv.Itoa(i)), Value: core.Bytes("value"), Type: typ}).Pack())
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, fs.Close())
+	}
+
+	open := func() (*IndexManager, *storage.StorageManager) {
+		sm, err := storage.NewStorageManager(cfg)
+		assert.Nil(t, err)
+		im, err := NewIndexManager(cfg, sm)
+		assert.Nil(t, err)
+		return im, sm
+	}
+
+	write(0, 100, core.Normal)
+	im, sm := open()
+	assert.Equal(t, 100, len(im.ListKeys(session)))
+	im.Close()
+	sm.Close()
+
+	// the records written after the index is closed are loaded from the checkpoint
+	write(100, 200, core.Normal)
+	write(0, 50, core.Deleted)
+	im, sm = open()
+	defer sm.Close()
+	defer im.Close()
+	assert.Equal(t, 150, len(im.ListKeys(session)))
+	_, err := im.Get(session, core.Bytes("0"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	pos, err := im.Get(session, core.Bytes("199"))
+	assert.Nil(t, err)
+	assert.NotNil(t, pos)
+}
+
+func TestNewIndexManager_Unknown_Type(t *testing.T) {
+	_, err := NewIndexManager(&config.DBConfig{IndexType: "unknown"}, nil)
+	assert.ErrorIs(t, err, core.ErrUnknownIndexType)
+
+	_, err = NewIndexManager(&config.DBConfig{IndexType: "btree"}, nil)
+	assert.Nil(t, err)
+}
+
+// customIndex a index type registered outside of the built-in ones
+type customIndex struct {
+	core.Index
+	session core.Session
+}
+
+func newCustomIndex(_ *config.DBConfig, session core.Session) (core.Index, error) {
+	return &customIndex{Index: btree.NewBTree(), session: session}, nil
+}
+
+func init() {
+	RegisterIndexType("custom", newCustomIndex)
+}
+
+func TestRegisterIndexType(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:   "/tmp/bytesdb-index-manager-custom",
+		IndexType: "custom",
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(cfg.DataDir)
+	})
+	assert.Panics(t, func() {
+		RegisterIndexType("custom", newCustomIndex)
+	})
+
+	sm, err := storage.NewStorageManager(cfg)
+	assert.Nil(t, err)
+	defer sm.Close()
+	im, err := NewIndexManager(cfg, sm)
+	assert.Nil(t, err)
+	defer im.Close()
+	_, err = im.Put(session, core.Bytes("key"), &core.RecordPosition{})
+	assert.Nil(t, err)
+	assert.Equal(t, session, im.indexes[session].(*customIndex).session)
+}
@@ -0,0 +1,91 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/index/art"
+	"BytesDB/index/bptree"
+	"BytesDB/index/btree"
+	"BytesDB/index/hash"
+	"BytesDB/index/skiplist"
+	"fmt"
+	"sync"
+)
+
+// IndexFactory creates the empty index of a table, the IndexManager loads the records
+// of the table into it, only the records after the checkpoint for the core.PersistentIndex
+type IndexFactory func(cfg *config.DBConfig, session core.Session) (core.Index, error)
+
+var indexTypes = struct {
+	sync.RWMutex
+	factories map[IndexType]IndexFactory
+}{factories: make(map[IndexType]IndexFactory)}
+
+func init() {
+	RegisterIndexType(Local_Hash, func(*config.DBConfig, core.Session) (core.Index, error) {
+		return hash.NewEmptyLocalHashIndex(), nil
+	})
+	RegisterIndexType(BTree, func(*config.DBConfig, core.Session) (core.Index, error) {
+		return btree.NewBTree(), nil
+	})
+	RegisterIndexType(ART, func(*config.DBConfig, core.Session) (core.Index, error) {
+		return art.NewART(), nil
+	})
+	RegisterIndexType(SkipList, func(*config.DBConfig, core.Session) (core.Index, error) {
+		return skiplist.NewSkipList(), nil
+	})
+	RegisterIndexType(BPTree, func(cfg *config.DBConfig, session core.Session) (core.Index, error) {
+		idx, err := bptree.NewBPTree(cfg.DataDir, session.Schema, session.Table, bptree.Options{
+			KeyProvider: cfg.KeyProvider,
+			CachePages:  cfg.IndexCachePages,
+			FS:          cfg.FS,
+			ReadOnly:    cfg.ReadOnly,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return idx, nil
+	})
+}
+
+// RegisterIndexType make the index type could be selected by index.type in db.properties,
+// it panics if the type is registered twice, e.g. register it in the init function of the package
+func RegisterIndexType(typ IndexType, factory IndexFactory) {
+	indexTypes.Lock()
+	defer indexTypes.Unlock()
+	if factory == nil {
+		panic("index factory is nil: " + typ)
+	}
+	if _, ok := indexTypes.factories[typ]; ok {
+		panic("index type registered twice: " + typ)
+	}
+	indexTypes.factories[typ] = factory
+}
+
+// ResolveIndexType the factory of the registered index type, local_hash by default
+func ResolveIndexType(typ string) (IndexFactory, error) {
+	if typ == "" {
+		typ = Local_Hash
+	}
+	indexTypes.RLock()
+	defer indexTypes.RUnlock()
+	factory, ok := indexTypes.factories[typ]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", core.ErrUnknownIndexType, typ)
+	}
+	return factory, nil
+}
@@ -0,0 +1,623 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package skiplist
+
+import (
+	"BytesDB/core"
+	"bytes"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	maxHeight = 20
+	// pValue 1/4 of the nodes of a level are promoted to the next level
+	pValue = 4
+)
+
+// SkipList a lock free skip list index, the writers link the nodes by CAS and
+// never block the readers or each other.
+// Every write pushes a version with the next write sequence to the node, the iterator
+// takes the sequence when it's created and only reads the versions not after it, so
+// it's a point-in-time view of the list.
+// A key is deleted by pushing a version without the position, then a marker node is
+// linked after it at each level once no open iterator is older than the deletion, so
+// nothing is linked after the deleted node any more, and the node is unlinked by CAS
+// from the previous node by the traversals passing it. A deleted node is never reused,
+// the key put again is linked with a new node after it.
+// The writes of the database are serialized by its lock whatever the index is, the
+// concurrent writers only gain from the skip list when it's used as core.Index directly.
+type SkipList struct {
+	head   *skipNode
+	height atomic.Int32
+	size   atomic.Int64
+	// seq the last write sequence
+	seq atomic.Uint64
+
+	// snapshots the number of the open iterators of each sequence, only locked when
+	// the iterators are created or closed
+	snapshots     map[uint64]int
+	snapshotsLock sync.Mutex
+	// oldest the sequence of the oldest open iterator, the versions it might read
+	// are kept
+	oldest atomic.Uint64
+	// retired the deleted nodes kept for the open iterators, they're unlinked when
+	// the iterators older than the deletion are closed
+	retired atomic.Pointer[retiredNode]
+}
+
+type retiredNode struct {
+	node *skipNode
+	next *retiredNode
+}
+
+type skipNode struct {
+	key core.Bytes
+	// the latest version first, the position is nil if the key is deleted
+	version atomic.Pointer[version]
+	next    []atomic.Pointer[skipNode]
+	// the node is the marker linked after a deleted node
+	marker bool
+}
+
+type version struct {
+	pos *core.RecordPosition
+	// seq 0 until the version is linked, it's assigned by the writer or the reader
+	// seeing it first, so a version is never visible to the iterators created before
+	// it's linked
+	seq  atomic.Uint64
+	prev atomic.Pointer[version]
+}
+
+func newNode(key core.Bytes, height int) *skipNode {
+	return &skipNode{
+		key:  key,
+		next: make([]atomic.Pointer[skipNode], height),
+	}
+}
+
+func NewSkipList() *SkipList {
+	sl := &SkipList{
+		head:      newNode(nil, maxHeight),
+		snapshots: make(map[uint64]int),
+	}
+	sl.height.Store(1)
+	sl.oldest.Store(math.MaxUint64)
+	return sl
+}
+
+func randomHeight() int {
+	h := 1
+	for h < maxHeight && rand.Intn(pValue) == 0 {
+		h++
+	}
+	return h
+}
+
+// sequence of the version, it's assigned if the version is not sequenced yet
+func (sl *SkipList) sequence(v *version) uint64 {
+	if seq := v.seq.Load(); seq != 0 {
+		return seq
+	}
+	v.seq.CompareAndSwap(0, sl.seq.Add(1))
+	return v.seq.Load()
+}
+
+// pos the latest position of the node, nil if it's deleted
+func (nd *skipNode) pos() *core.RecordPosition {
+	if v := nd.version.Load(); v != nil {
+		return v.pos
+	}
+	return nil
+}
+
+// visible the position of the node at the sequence, nil if it's deleted or not put yet
+func (sl *SkipList) visible(nd *skipNode, seq uint64) *core.RecordPosition {
+	for v := nd.version.Load(); v != nil; v = v.prev.Load() {
+		if sl.sequence(v) <= seq {
+			return v.pos
+		}
+	}
+	return nil
+}
+
+// removable the node is deleted and no open iterator is older than the deletion
+func (sl *SkipList) removable(nd *skipNode) bool {
+	v := nd.version.Load()
+	return v.pos == nil && sl.sequence(v) <= sl.oldest.Load()
+}
+
+// trim drop the versions older than the one read by the oldest iterator, from is the
+// version sequenced by the writer, the iterators created after it's sequenced read it
+// or the newer versions
+func (sl *SkipList) trim(from *version) {
+	oldest := sl.oldest.Load()
+	for v := from; v != nil; v = v.prev.Load() {
+		if v.seq.Load() <= oldest {
+			v.prev.Store(nil)
+			return
+		}
+	}
+}
+
+// loadNext the next node at the level, the marker after a deleted node is skipped
+func (nd *skipNode) loadNext(level int) *skipNode {
+	next := nd.next[level].Load()
+	if next != nil && next.marker {
+		return next.next[level].Load()
+	}
+	return next
+}
+
+// mark link the marker after the deleted node at the level, it returns the next node
+// the marker points to
+func (nd *skipNode) mark(level int) *skipNode {
+	for {
+		next := nd.next[level].Load()
+		if next != nil && next.marker {
+			return next.next[level].Load()
+		}
+		marker := &skipNode{marker: true, next: make([]atomic.Pointer[skipNode], level+1)}
+		marker.next[level].Store(next)
+		if nd.next[level].CompareAndSwap(next, marker) {
+			return next
+		}
+	}
+}
+
+// findSplice return the nodes at the level that before.key <= key <= next.key, both
+// are the node of the key if it's not deleted, the deleted nodes of the key kept for
+// the iterators are before the splice.
+// The removable nodes passed are unlinked at the level
+func (sl *SkipList) findSplice(key core.Bytes, before *skipNode, level int) (*skipNode, *skipNode) {
+	for {
+		next := before.next[level].Load()
+		if next != nil && next.marker {
+			// before is deleted, nothing could be linked after it
+			before = sl.head
+			continue
+		}
+		if next == nil {
+			return before, nil
+		}
+		if sl.removable(next) {
+			// the unlinking is retried with the next node loaded again if it fails
+			before.next[level].CompareAndSwap(next, next.mark(level))
+			continue
+		}
+		cmp := bytes.Compare(key, next.key)
+		if cmp == 0 && next.pos() != nil {
+			return next, next
+		}
+		if cmp < 0 {
+			return before, next
+		}
+		before = next
+	}
+}
+
+func (sl *SkipList) Put(key core.Bytes, pos *core.RecordPosition) (*core.RecordPosition, error) {
+	if key == nil {
+		return nil, core.ErrKeyIsNil
+	}
+	if pos == nil {
+		return nil, core.ErrRecordPositionNil
+	}
+
+	for {
+		// the node of the key is deleted while putting, put it again with a new node
+		if old, ok := sl.put(key, pos); ok {
+			return old, nil
+		}
+	}
+}
+
+func (sl *SkipList) put(key core.Bytes, pos *core.RecordPosition) (*core.RecordPosition, bool) {
+	listHeight := int(sl.height.Load())
+	var prev [maxHeight + 1]*skipNode
+	var next [maxHeight + 1]*skipNode
+	prev[listHeight] = sl.head
+	for i := listHeight - 1; i >= 0; i-- {
+		prev[i], next[i] = sl.findSplice(key, prev[i+1], i)
+		if prev[i] == next[i] {
+			return sl.update(prev[i], pos)
+		}
+	}
+
+	height := randomHeight()
+	nd := newNode(key, height)
+	nd.version.Store(&version{pos: pos})
+	for listHeight = int(sl.height.Load()); height > listHeight; listHeight = int(sl.height.Load()) {
+		if sl.height.CompareAndSwap(int32(listHeight), int32(height)) {
+			break
+		}
+	}
+
+	// link from the bottom, the node is visible once it's linked at level 0
+	for {
+		nd.next[0].Store(next[0])
+		if prev[0].next[0].CompareAndSwap(next[0], nd) {
+			break
+		}
+		// lost the race, find the splice again from the previous node
+		prev[0], next[0] = sl.findSplice(key, prev[0], 0)
+		if prev[0] == next[0] {
+			// the same key is linked by another writer
+			return sl.update(prev[0], pos)
+		}
+	}
+	sl.sequence(nd.version.Load())
+	sl.size.Add(1)
+
+	for i := 1; i < height; i++ {
+		if !sl.link(nd, i, prev[i], next[i]) {
+			break
+		}
+	}
+	if nd.pos() == nil {
+		// deleted while linking, it might be linked after the deleting traversal
+		sl.findLess(key)
+	}
+	return nil, true
+}
+
+// link the node at the upper level, false if the node is deleted
+func (sl *SkipList) link(nd *skipNode, level int, prev, next *skipNode) bool {
+	for {
+		if prev == nil {
+			// the level is higher than the list height when searching
+			prev, next = sl.findSplice(nd.key, sl.head, level)
+		}
+		if prev == next || nd.pos() == nil {
+			// another node of the key is linked after the node is deleted
+			return false
+		}
+		// the next of the node is marked if it's deleted
+		current := nd.next[level].Load()
+		if current != nil && current.marker || !nd.next[level].CompareAndSwap(current, next) {
+			return false
+		}
+		if prev.next[level].CompareAndSwap(next, nd) {
+			return true
+		}
+		prev, next = sl.findSplice(nd.key, prev, level)
+	}
+}
+
+// update push the version of the position to the node, false if the node is deleted
+func (sl *SkipList) update(nd *skipNode, pos *core.RecordPosition) (*core.RecordPosition, bool) {
+	for {
+		old := nd.version.Load()
+		// the version is sequenced before the ones pushed after it, and the new node
+		// of the key is sequenced after the deletion
+		sl.sequence(old)
+		if old.pos == nil {
+			return nil, false
+		}
+		v := &version{pos: pos}
+		v.prev.Store(old)
+		if nd.version.CompareAndSwap(old, v) {
+			sl.sequence(v)
+			sl.trim(v)
+			return old.pos, true
+		}
+	}
+}
+
+// findGreaterOrEqual the first node that node.key >= key, the deleted nodes of the key
+// are skipped
+func (sl *SkipList) findGreaterOrEqual(key core.Bytes) *skipNode {
+	before := sl.head
+	var next *skipNode
+	for level := int(sl.height.Load()) - 1; level >= 0; level-- {
+		before, next = sl.findSplice(key, before, level)
+		if before == next {
+			return next
+		}
+	}
+	return next
+}
+
+// findLess the last node that node.key < key, nil key means the last node of the list.
+// The removable nodes until the nodes of the key are unlinked instead of passed, the
+// lower levels of a marked node might miss the nodes linked after it's marked
+func (sl *SkipList) findLess(key core.Bytes) *skipNode {
+	before := sl.head
+	for level := int(sl.height.Load()) - 1; level >= 0; level-- {
+		for {
+			next := before.next[level].Load()
+			if next != nil && next.marker {
+				before = sl.head
+				continue
+			}
+			if next == nil {
+				break
+			}
+			if sl.removable(next) {
+				before.next[level].CompareAndSwap(next, next.mark(level))
+				continue
+			}
+			if key != nil && bytes.Compare(next.key, key) >= 0 {
+				break
+			}
+			before = next
+		}
+	}
+	if before == sl.head {
+		return nil
+	}
+	return before
+}
+
+// findFirst the first node that node.key >= key, including the deleted nodes of the key
+// kept for the iterators. The nodes of a smaller key might be linked after the node
+// found by findLess, they're skipped
+func (sl *SkipList) findFirst(key core.Bytes) *skipNode {
+	var nd *skipNode
+	if before := sl.findLess(key); before == nil {
+		nd = sl.head.loadNext(0)
+	} else {
+		nd = before.loadNext(0)
+	}
+	for nd != nil && bytes.Compare(nd.key, key) < 0 {
+		nd = nd.loadNext(0)
+	}
+	return nd
+}
+
+func (sl *SkipList) Get(key core.Bytes) (*core.RecordPosition, error) {
+	if key == nil {
+		return nil, core.ErrKeyIsNil
+	}
+
+	nd := sl.findGreaterOrEqual(key)
+	if nd != nil && bytes.Equal(nd.key, key) {
+		if pos := nd.pos(); pos != nil {
+			return pos, nil
+		}
+	}
+	return nil, core.ErrKeyNotFound
+}
+
+func (sl *SkipList) Delete(key core.Bytes) (bool, error) {
+	if key == nil {
+		return false, core.ErrKeyIsNil
+	}
+
+	nd := sl.findGreaterOrEqual(key)
+	if nd == nil || !bytes.Equal(nd.key, key) {
+		return false, nil
+	}
+	var tombstone *version
+	for {
+		old := nd.version.Load()
+		sl.sequence(old)
+		if old.pos == nil {
+			return false, nil
+		}
+		tombstone = &version{}
+		tombstone.prev.Store(old)
+		if nd.version.CompareAndSwap(old, tombstone) {
+			sl.sequence(tombstone)
+			break
+		}
+	}
+	sl.size.Add(-1)
+
+	if sl.removable(nd) {
+		sl.unlink(nd)
+		return true, nil
+	}
+	sl.trim(tombstone)
+	sl.retire(nd)
+	// the iterators might be closed before the node is retired
+	if sl.removable(nd) {
+		sl.reclaim()
+	}
+	return true, nil
+}
+
+// unlink the deleted node from all levels
+func (sl *SkipList) unlink(nd *skipNode) {
+	// mark from the top, so the node is unlinked from the upper levels first
+	for i := len(nd.next) - 1; i >= 0; i-- {
+		nd.mark(i)
+	}
+	// the new node of the key might be linked after it, findGreaterOrEqual could stop
+	// at the new node on the upper levels
+	sl.findLess(nd.key)
+}
+
+func (sl *SkipList) retire(nd *skipNode) {
+	retired := &retiredNode{node: nd}
+	for {
+		retired.next = sl.retired.Load()
+		if sl.retired.CompareAndSwap(retired.next, retired) {
+			return
+		}
+	}
+}
+
+// reclaim unlink the retired nodes no open iterator is older than, it's repeated if
+// the oldest iterator is closed meanwhile
+func (sl *SkipList) reclaim() {
+	for {
+		oldest := sl.oldest.Load()
+		for retired := sl.retired.Swap(nil); retired != nil; retired = retired.next {
+			if sl.removable(retired.node) {
+				sl.unlink(retired.node)
+			} else {
+				sl.retire(retired.node)
+			}
+		}
+		if sl.oldest.Load() == oldest {
+			return
+		}
+	}
+}
+
+func (sl *SkipList) Exists(key core.Bytes) bool {
+	pos, err := sl.Get(key)
+	return err == nil && pos != nil
+}
+
+func (sl *SkipList) Size() int {
+	return int(sl.size.Load())
+}
+
+// Iterator walks the list lazily without locks, it only sees the keys and positions
+// written before it's created, it should be closed to release the old versions
+func (sl *SkipList) Iterator(reverse bool) (core.Iterator, error) {
+	it := &skipListIterator{
+		list:    sl,
+		reverse: reverse,
+	}
+	it.open()
+	it.Rewind()
+	return it, nil
+}
+
+func (sl *SkipList) Close() error {
+	return nil
+}
+
+// updateOldest called with the snapshots locked
+func (sl *SkipList) updateOldest() {
+	oldest := uint64(math.MaxUint64)
+	for seq := range sl.snapshots {
+		oldest = min(oldest, seq)
+	}
+	sl.oldest.Store(oldest)
+}
+
+type skipListIterator struct {
+	list    *SkipList
+	reverse bool
+	// registered the sequence kept for the iterator, not after the snapshot
+	registered uint64
+	snapshot   uint64
+	closed     bool
+	node       *skipNode
+	// position of the current node, loaded when moving to the node
+	pos *core.RecordPosition
+}
+
+// open register the iterator before taking the snapshot, so the writers sequenced
+// after the snapshot see the iterator and keep the versions it reads
+func (it *skipListIterator) open() {
+	sl := it.list
+	sl.snapshotsLock.Lock()
+	defer sl.snapshotsLock.Unlock()
+	it.registered = sl.seq.Load()
+	sl.snapshots[it.registered]++
+	sl.updateOldest()
+	it.snapshot = sl.seq.Load()
+}
+
+func (it *skipListIterator) Rewind() {
+	if it.reverse {
+		it.moveBackward(it.list.findLess(nil))
+	} else {
+		it.moveForward(it.list.head.loadNext(0))
+	}
+}
+
+// Seek the first key less or equal to the key if it's reverse
+func (it *skipListIterator) Seek(key core.Bytes) error {
+	if !it.reverse {
+		it.moveForward(it.list.findFirst(key))
+		return nil
+	}
+
+	if it.moveEqual(key) {
+		return nil
+	}
+	it.moveBackward(it.list.findLess(key))
+	return nil
+}
+
+func (it *skipListIterator) Next() {
+	if it.node == nil {
+		return
+	}
+	if it.reverse {
+		it.moveBackward(it.list.findLess(it.node.key))
+	} else {
+		it.moveForward(it.node.loadNext(0))
+	}
+}
+
+// moveForward to the first node visible to the iterator starting from the nd
+func (it *skipListIterator) moveForward(nd *skipNode) {
+	for ; nd != nil; nd = nd.loadNext(0) {
+		if pos := it.list.visible(nd, it.snapshot); pos != nil {
+			it.node, it.pos = nd, pos
+			return
+		}
+	}
+	it.node, it.pos = nil, nil
+}
+
+// moveEqual to the node of the key visible to the iterator, the deleted nodes of the
+// key are before the new one
+func (it *skipListIterator) moveEqual(key core.Bytes) bool {
+	for nd := it.list.findFirst(key); nd != nil && bytes.Equal(nd.key, key); nd = nd.loadNext(0) {
+		if pos := it.list.visible(nd, it.snapshot); pos != nil {
+			it.node, it.pos = nd, pos
+			return true
+		}
+	}
+	return false
+}
+
+func (it *skipListIterator) moveBackward(nd *skipNode) {
+	for ; nd != nil; nd = it.list.findLess(nd.key) {
+		if it.moveEqual(nd.key) {
+			return
+		}
+	}
+	it.node, it.pos = nil, nil
+}
+
+func (it *skipListIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skipListIterator) Key() core.Bytes {
+	return it.node.key
+}
+
+func (it *skipListIterator) Value() *core.RecordPosition {
+	return it.pos
+}
+
+func (it *skipListIterator) Close() {
+	it.node, it.pos = nil, nil
+	if it.closed {
+		return
+	}
+	it.closed = true
+
+	sl := it.list
+	sl.snapshotsLock.Lock()
+	defer sl.snapshotsLock.Unlock()
+	if sl.snapshots[it.registered]--; sl.snapshots[it.registered] == 0 {
+		delete(sl.snapshots, it.registered)
+	}
+	sl.updateOldest()
+	sl.reclaim()
+}
@@ -0,0 +1,401 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package skiplist
+
+import (
+	"BytesDB/core"
+	"BytesDB/index/btree"
+	"BytesDB/index/hash"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSkipList_Put_Get_Delete(t *testing.T) {
+	sl := NewSkipList()
+	pos := &core.RecordPosition{Size: 10}
+
+	old, err := sl.Put(core.Bytes("hello"), pos)
+	assert.Nil(t, err)
+	assert.Nil(t, old)
+	old, err = sl.Put(core.Bytes("hello"), &core.RecordPosition{})
+	assert.Nil(t, err)
+	assert.Equal(t, pos, old)
+	_, err = sl.Put(nil, pos)
+	assert.Equal(t, core.ErrKeyIsNil, err)
+	_, err = sl.Put(core.Bytes("hello"), nil)
+	assert.Equal(t, core.ErrRecordPositionNil, err)
+
+	v, err := sl.Get(core.Bytes("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, &core.RecordPosition{}, v)
+	_, err = sl.Get(core.Bytes("hell"))
+	assert.Equal(t, core.ErrKeyNotFound, err)
+	assert.Equal(t, 1, sl.Size())
+
+	ok, err := sl.Delete(core.Bytes("hello"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = sl.Delete(core.Bytes("hello"))
+	assert.False(t, ok)
+	assert.False(t, sl.Exists(core.Bytes("hello")))
+	assert.Equal(t, 0, sl.Size())
+
+	// the key is put again with a new node
+	old, err = sl.Put(core.Bytes("hello"), pos)
+	assert.Nil(t, err)
+	assert.Nil(t, old)
+	assert.True(t, sl.Exists(core.Bytes("hello")))
+	assert.Equal(t, 1, sl.Size())
+}
+
+// linkedNodes the nodes linked at each level, including the deleted ones not unlinked yet
+func linkedNodes(sl *SkipList) []int {
+	counts := make([]int, maxHeight)
+	for level := range counts {
+		for nd := sl.head.next[level].Load(); nd != nil; nd = nd.next[level].Load() {
+			counts[level]++
+		}
+	}
+	return counts
+}
+
+func TestSkipList_Delete_Unlink(t *testing.T) {
+	sl := NewSkipList()
+	for i := 0; i < 1000; i++ {
+		_, _ = sl.Put(core.Bytes(strconv.Itoa(i)), &core.RecordPosition{Position: int64(i)})
+	}
+	for i := 0; i < 1000; i += 2 {
+		ok, _ := sl.Delete(core.Bytes(strconv.Itoa(i)))
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 500, linkedNodes(sl)[0])
+	assert.Equal(t, 500, sl.Size())
+
+	// the list does not grow with the keys put and deleted repeatedly
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 1000; i++ {
+			_, _ = sl.Put(core.Bytes(strconv.Itoa(i)), &core.RecordPosition{Position: int64(round)})
+		}
+		for i := 0; i < 1000; i++ {
+			_, _ = sl.Delete(core.Bytes(strconv.Itoa(i)))
+		}
+	}
+	assert.Equal(t, make([]int, maxHeight), linkedNodes(sl))
+	assert.Equal(t, 0, sl.Size())
+	it, _ := sl.Iterator(false)
+	assert.False(t, it.Valid())
+}
+
+func TestSkipList_Concurrent_Delete(t *testing.T) {
+	sl := NewSkipList()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := core.Bytes(strconv.Itoa(i % 100))
+				if (i+w)%2 == 0 {
+					_, _ = sl.Put(key, &core.RecordPosition{Position: int64(i)})
+				} else {
+					_, _ = sl.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	live := 0
+	for i := 0; i < 100; i++ {
+		if sl.Exists(core.Bytes(strconv.Itoa(i))) {
+			live++
+		}
+	}
+	assert.Equal(t, live, sl.Size())
+
+	for i := 0; i < 100; i++ {
+		_, _ = sl.Delete(core.Bytes(strconv.Itoa(i)))
+	}
+	assert.Equal(t, make([]int, maxHeight), linkedNodes(sl))
+	assert.Equal(t, 0, sl.Size())
+}
+
+func TestSkipList_Iterator(t *testing.T) {
+	sl := NewSkipList()
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		_, _ = sl.Put(core.Bytes(key), &core.RecordPosition{Position: int64(i)})
+		if i%3 == 0 {
+			_, _ = sl.Delete(core.Bytes(key))
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	it, err := sl.Iterator(false)
+	assert.Nil(t, err)
+	for _, key := range keys {
+		assert.True(t, it.Valid())
+		assert.Equal(t, core.Bytes(key), it.Key())
+		atoi, _ := strconv.Atoi(key)
+		assert.Equal(t, int64(atoi), it.Value().Position)
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+
+	it, err = sl.Iterator(true)
+	assert.Nil(t, err)
+	for i := len(keys) - 1; i >= 0; i-- {
+		assert.True(t, it.Valid())
+		assert.Equal(t, core.Bytes(keys[i]), it.Key())
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+
+	// "3", "30" and "300" are deleted
+	it, _ = sl.Iterator(false)
+	_ = it.Seek(core.Bytes("3"))
+	assert.Equal(t, core.Bytes("301"), it.Key())
+	it, _ = sl.Iterator(true)
+	_ = it.Seek(core.Bytes("3"))
+	assert.Equal(t, core.Bytes("299"), it.Key())
+	_ = it.Seek(core.Bytes("31"))
+	assert.Equal(t, core.Bytes("31"), it.Key())
+	it.Rewind()
+	assert.Equal(t, core.Bytes(keys[len(keys)-1]), it.Key())
+	it.Close()
+	assert.False(t, it.Valid())
+}
+
+func TestSkipList_Concurrent(t *testing.T) {
+	sl := NewSkipList()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := core.Bytes(strconv.Itoa(i))
+				_, err := sl.Put(key, &core.RecordPosition{Position: int64(i)})
+				assert.Nil(t, err)
+				if i%2 == 1 && w == 0 {
+					_, _ = sl.Delete(key)
+				}
+			}
+		}(w)
+		// the iterators never block or break the writers
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			it, _ := sl.Iterator(false)
+			var last core.Bytes
+			for ; it.Valid(); it.Next() {
+				assert.True(t, last == nil || last.Compare(it.Key()) < 0)
+				last = it.Key()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 2000; i++ {
+		pos, err := sl.Get(core.Bytes(strconv.Itoa(i)))
+		if err == nil {
+			assert.Equal(t, int64(i), pos.Position)
+		}
+	}
+	count := 0
+	it, _ := sl.Iterator(false)
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	assert.Equal(t, sl.Size(), count)
+}
+
+func TestSkipList_Iterator_Snapshot(t *testing.T) {
+	sl := NewSkipList()
+	for i := 0; i < 10; i++ {
+		_, _ = sl.Put(core.Bytes(strconv.Itoa(i)), &core.RecordPosition{Position: int64(i)})
+	}
+	it, _ := sl.Iterator(false)
+	reverse, _ := sl.Iterator(true)
+
+	// the writes after the iterators are created
+	_, _ = sl.Put(core.Bytes("1"), &core.RecordPosition{Position: 100})
+	_, _ = sl.Delete(core.Bytes("2"))
+	_, _ = sl.Delete(core.Bytes("3"))
+	_, _ = sl.Put(core.Bytes("3"), &core.RecordPosition{Position: 300})
+	_, _ = sl.Put(core.Bytes("5a"), &core.RecordPosition{})
+	pos, _ := sl.Get(core.Bytes("3"))
+	assert.Equal(t, int64(300), pos.Position)
+	assert.False(t, sl.Exists(core.Bytes("2")))
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, core.Bytes(strconv.Itoa(i)), it.Key())
+		assert.Equal(t, int64(i), it.Value().Position)
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+	_ = it.Seek(core.Bytes("2"))
+	assert.Equal(t, core.Bytes("2"), it.Key())
+	_ = it.Seek(core.Bytes("3"))
+	assert.Equal(t, int64(3), it.Value().Position)
+	_ = it.Seek(core.Bytes("5"))
+	it.Next()
+	assert.Equal(t, core.Bytes("6"), it.Key())
+
+	for i := 9; i >= 0; i-- {
+		assert.Equal(t, core.Bytes(strconv.Itoa(i)), reverse.Key())
+		assert.Equal(t, int64(i), reverse.Value().Position)
+		reverse.Next()
+	}
+	assert.False(t, reverse.Valid())
+	_ = reverse.Seek(core.Bytes("3"))
+	assert.Equal(t, int64(3), reverse.Value().Position)
+	_ = reverse.Seek(core.Bytes("2a"))
+	assert.Equal(t, core.Bytes("2"), reverse.Key())
+
+	// the deleted nodes are kept until the iterators are closed
+	assert.Equal(t, 12, linkedNodes(sl)[0])
+	it.Close()
+	reverse.Close()
+	assert.Equal(t, 10, linkedNodes(sl)[0])
+	it, _ = sl.Iterator(false)
+	_ = it.Seek(core.Bytes("2"))
+	assert.Equal(t, core.Bytes("3"), it.Key())
+	assert.Equal(t, int64(300), it.Value().Position)
+	it.Close()
+}
+
+// the writer puts the keys in order in each round, an iterator sees the rounds never
+// increasing along the keys since it's a point-in-time view
+func TestSkipList_Iterator_Snapshot_Concurrent(t *testing.T) {
+	sl := NewSkipList()
+	const keys = 200
+	for i := 0; i < keys; i++ {
+		_, _ = sl.Put(core.Bytes(fmt.Sprintf("%04d", i)), &core.RecordPosition{})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := int64(1); round <= 50; round++ {
+			for i := 0; i < keys; i++ {
+				key := core.Bytes(fmt.Sprintf("%04d", i))
+				if round%3 == 0 {
+					// put the key again with a new node
+					_, _ = sl.Delete(key)
+				}
+				_, _ = sl.Put(key, &core.RecordPosition{Position: round})
+			}
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, reverse := range []bool{false, true} {
+			it, _ := sl.Iterator(reverse)
+			var rounds []int64
+			for ; it.Valid(); it.Next() {
+				rounds = append(rounds, it.Value().Position)
+			}
+			it.Close()
+			if reverse {
+				slices.Reverse(rounds)
+			}
+			assert.GreaterOrEqual(t, len(rounds), keys-1)
+			for i := 1; i < len(rounds); i++ {
+				assert.LessOrEqual(t, rounds[i], rounds[i-1])
+				assert.LessOrEqual(t, rounds[0]-rounds[i], int64(1))
+			}
+		}
+	}
+	assert.Equal(t, keys, linkedNodes(sl)[0])
+}
+
+// lockedIndex the hash index is not safe for concurrent use, the database serializes it
+type lockedIndex struct {
+	core.Index
+	lock sync.RWMutex
+}
+
+func (li *lockedIndex) Put(key core.Bytes, pos *core.RecordPosition) (*core.RecordPosition, error) {
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	return li.Index.Put(key, pos)
+}
+
+func (li *lockedIndex) Get(key core.Bytes) (*core.RecordPosition, error) {
+	li.lock.RLock()
+	defer li.lock.RUnlock()
+	return li.Index.Get(key)
+}
+
+// BenchmarkParallel 10% writes and 90% reads from the parallel goroutines
+func BenchmarkParallel(b *testing.B) {
+	hashPath := "/tmp/bytesdb-skiplist-bench"
+	b.Cleanup(func() {
+		_ = os.RemoveAll(hashPath)
+	})
+	indexes := []struct {
+		name string
+		new  func() core.Index
+	}{
+		{"SkipList", func() core.Index { return NewSkipList() }},
+		{"BTree", func() core.Index { return btree.NewBTree() }},
+		{"LocalHash", func() core.Index {
+			return &lockedIndex{Index: hash.NewLocalHashIndex(hashPath, "public", "bench")}
+		}},
+	}
+
+	const keys = 100000
+	for _, writePercent := range []int{10, 100} {
+		for _, idx := range indexes {
+			b.Run(idx.name+"/writes-"+strconv.Itoa(writePercent)+"%", func(b *testing.B) {
+				index := idx.new()
+				for i := 0; i < keys; i++ {
+					_, _ = index.Put(core.Bytes(strconv.Itoa(i)), &core.RecordPosition{})
+				}
+				var seed atomic.Int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					rnd := rand.New(rand.NewSource(seed.Add(1)))
+					pos := &core.RecordPosition{}
+					for pb.Next() {
+						key := core.Bytes(strconv.Itoa(rnd.Intn(keys)))
+						if rnd.Intn(100) < writePercent {
+							_, _ = index.Put(key, pos)
+						} else {
+							_, _ = index.Get(key)
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"BytesDB/core"
+	"bytes"
+	"sort"
+)
+
+// sliceIterator iterate the collected keys and values, the keys are in the order of the iteration
+type sliceIterator struct {
+	currentIndex int
+	reverse      bool
+	keys         []core.Bytes
+	values       []*core.RecordPosition
+}
+
+// NewSliceIterator iterate the keys and the values collected in the order of the iteration,
+// e.g. the keys of a snapshot
+func NewSliceIterator(keys []core.Bytes, values []*core.RecordPosition, reverse bool) core.Iterator {
+	return &sliceIterator{keys: keys, values: values, reverse: reverse}
+}
+
+func (si *sliceIterator) Rewind() {
+	si.currentIndex = 0
+}
+
+func (si *sliceIterator) Seek(key core.Bytes) error {
+	if si.reverse {
+		si.currentIndex = sort.Search(len(si.keys), func(i int) bool {
+			return bytes.Compare(key, si.keys[i]) >= 0
+		})
+	} else {
+		si.currentIndex = sort.Search(len(si.keys), func(i int) bool {
+			return bytes.Compare(key, si.keys[i]) <= 0
+		})
+	}
+	return nil
+}
+
+func (si *sliceIterator) Next() {
+	si.currentIndex++
+}
+
+func (si *sliceIterator) Valid() bool {
+	return si.currentIndex < len(si.keys)
+}
+
+func (si *sliceIterator) Key() core.Bytes {
+	return si.keys[si.currentIndex]
+}
+
+func (si *sliceIterator) Value() *core.RecordPosition {
+	return si.values[si.currentIndex]
+}
+
+func (si *sliceIterator) Close() {
+	si.keys = nil
+	si.values = nil
+}
@@ -0,0 +1,129 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"errors"
+	"slices"
+)
+
+// Merge write the merge operand of the key, it's folded into the value by the merge operator of
+// the table when the key is read or compacted, return ErrNoMergeOperator if it's not registered
+func (db *Database) Merge(session core.Session, key, operand core.Bytes) error {
+	if db.readOnly() {
+		return core.ErrReadOnly
+	}
+	if db.options.MergeOperators[session] == nil {
+		return core.ErrNoMergeOperator
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	record, err := db.newRecord(session, key, operand, core.Merge)
+	if err != nil {
+		return err
+	}
+	pos, err := db.sm.Write(session, record)
+	if err != nil {
+		return err
+	}
+	if err := db.indexPut(session, key, pos); err != nil {
+		return err
+	}
+	return db.publish(session, record, pos)
+}
+
+// readLinked the plain record at the position, and the position of the previous record of the key
+// it's linked to by the version or the merge operand, the caller holds the lock
+func (db *Database) readLinked(session core.Session, pos *core.RecordPosition) (*core.RecordPosition, *core.Record, error) {
+	record, err := db.sm.Read(session, pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.IsTxn() {
+		if _, record, err = record.UnwrapTxn(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if record.Type.IsVersioned() {
+		header, plain, err := record.UnwrapVersion()
+		if err != nil {
+			return nil, nil, err
+		}
+		return header.Prev, plain, nil
+	}
+	if record.Type == core.Merge {
+		return record.UnwrapMerge()
+	}
+	return nil, record, nil
+}
+
+// fold the merge operand and the older ones of the key into the value before them, prev is the
+// position of the record before the operand, the caller holds the lock
+func (db *Database) fold(session core.Session, operand *core.Record, prev *core.RecordPosition) (core.Bytes, error) {
+	op := db.options.MergeOperators[session]
+	if op == nil {
+		return nil, core.ErrNoMergeOperator
+	}
+	operands := []core.Bytes{operand.Value}
+	var existing core.Bytes
+	for prev != nil {
+		older, record, err := db.readLinked(session, prev)
+		if err != nil {
+			return nil, err
+		}
+		if isDeletion(record.Type) {
+			break
+		}
+		if record.Type != core.Merge {
+			existing = record.Value
+			break
+		}
+		operands = append(operands, record.Value)
+		prev = older
+	}
+	slices.Reverse(operands)
+	return op.Merge(operand.Key, existing, operands)
+}
+
+// foldHead replace the merge operands of the key by a record of the folded value, so they're not
+// linked to the merged segments, the value is not changed so it's not seen as a write
+func (db *Database) foldHead(session core.Session, key core.Bytes) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	head, err := db.im.Get(session, key)
+	if errors.Is(err, core.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	prev, record, err := db.readLinked(session, head)
+	if err != nil || record.Type != core.Merge {
+		return err
+	}
+	value, err := db.fold(session, record, prev)
+	if err != nil {
+		return err
+	}
+	pos, err := db.sm.Write(session, &core.Record{Key: key, Value: value, Type: core.Normal})
+	if err != nil {
+		return err
+	}
+	_, err = db.im.Put(session, key, pos)
+	return err
+}
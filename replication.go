@@ -0,0 +1,798 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"BytesDB/storage"
+	"BytesDB/vfs"
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the primary sends the heartbeat if there's nothing to send, the connection without any message
+// in the timeout is dropped and the replica reconnects after the retry interval
+const (
+	heartbeatInterval    = 100 * time.Millisecond
+	replicationTimeout   = 3 * time.Second
+	replicaRetryInterval = 200 * time.Millisecond
+)
+
+type replicationMessageType byte
+
+const (
+	// msgRecord the record appended at Pos
+	msgRecord replicationMessageType = iota
+	// msgRotate the active segment is sealed and Pos.Segment is started
+	msgRotate
+	// msgRemove the segment Pos.Segment is removed, e.g. by the compaction
+	msgRemove
+	// msgCaughtUp the records before the replica is connected are sent, Seq is the last write then
+	msgCaughtUp
+	// msgHeartbeat Seq is the last write of the primary
+	msgHeartbeat
+	// msgDiverged the replica has the records the primary not has
+	msgDiverged
+)
+
+// replicationMessage the message sent to the replicas, Seq is the number of the writes of the
+// primary counted from it's listening, it's 0 for the records sent by the catch-up
+type replicationMessage struct {
+	Type    replicationMessageType
+	Session core.Session
+	Pos     core.RecordPosition
+	Record  *core.Record
+	Seq     uint64
+}
+
+// replicaHello the tables of the replica sent once it's connected, the records after the tails
+// are sent by the primary
+type replicaHello struct {
+	Tables []replicaTable
+}
+
+type replicaTable struct {
+	Session core.Session
+	// Tail the end of the active segment
+	Tail     core.RecordPosition
+	Segments []int64
+}
+
+// replicaAck the replica applied the writes until Applied
+type replicaAck struct {
+	Applied uint64
+}
+
+// ReplicaLag the state of a replica connected to the primary
+type ReplicaLag struct {
+	Addr string
+	// CaughtUp the records written before it's connected are applied
+	CaughtUp bool
+	// Acked the writes applied by the replica, it's acked every heartbeat
+	Acked uint64
+	// Lag the writes not acked by the replica yet
+	Lag     uint64
+	LastAck time.Time
+}
+
+// ReplicaStatus the state of the replica following the primary
+type ReplicaStatus struct {
+	Primary   string
+	Connected bool
+	CaughtUp  bool
+	// Applied the writes of the primary applied, counted from the primary's listening
+	Applied uint64
+	// Lag the writes of the primary not applied yet, as of the last message received
+	Lag         uint64
+	LastContact time.Time
+	// Err the error dropped the last connection, e.g. ErrReplicaDiverged
+	Err error
+}
+
+// Primary streams the records appended to the segments to the replicas, each replica catches up
+// from its tails by the sealed and active segments, then the later writes are sent as they're
+// written. the writes not sent yet are queued in memory up to config.ReplicationMaxPending for
+// each replica, and the compaction waits until the catch-up is done
+type Primary struct {
+	db       *Database
+	listener net.Listener
+	// the count of the writes and the removed segments
+	written  atomic.Uint64
+	mutex    sync.Mutex
+	replicas map[*replicaConn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// replicaConn a connected replica, the messages are queued by the writes and sent by serve,
+// the replica is dropped once the messages queued exceed maxPending
+type replicaConn struct {
+	conn       net.Conn
+	mutex      sync.Mutex
+	pending    []replicationMessage
+	maxPending int
+	dropped    bool
+	signal     chan struct{}
+	caughtUp   bool
+	acked      uint64
+	lastAck    time.Time
+}
+
+// ListenReplicas accept the replicas at addr, e.g. 127.0.0.1:0 for a random port, the replicas
+// are opened with the same storage options, so the records are at the same positions
+func (db *Database) ListenReplicas(addr string) (*Primary, error) {
+	if db.readOnly() {
+		return nil, core.ErrReadOnly
+	}
+	if db.options.StorageType == storage.Memory {
+		return nil, fmt.Errorf("%w: %s", core.ErrReplicationNotSupported, storage.Memory)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.primary != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("replicas are accepted at %s already", db.primary.Addr())
+	}
+	p := &Primary{db: db, listener: listener, replicas: make(map[*replicaConn]struct{})}
+	db.primary = p
+	db.sm.SetObserver(p)
+	p.wg.Add(1)
+	go p.accept()
+	return p, nil
+}
+
+// Addr the address the replicas connect to
+func (p *Primary) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Replicas the state of the connected replicas
+func (p *Primary) Replicas() []ReplicaLag {
+	written := p.written.Load()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	lags := make([]ReplicaLag, 0, len(p.replicas))
+	for r := range p.replicas {
+		r.mutex.Lock()
+		lag := ReplicaLag{
+			Addr:     r.conn.RemoteAddr().String(),
+			CaughtUp: r.caughtUp,
+			Acked:    r.acked,
+			LastAck:  r.lastAck,
+		}
+		r.mutex.Unlock()
+		if written > lag.Acked {
+			lag.Lag = written - lag.Acked
+		}
+		lags = append(lags, lag)
+	}
+	return lags
+}
+
+// Close stop accepting the replicas and drop the connected ones
+func (p *Primary) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	err := p.listener.Close()
+	for r := range p.replicas {
+		_ = r.conn.Close()
+	}
+	p.mutex.Unlock()
+	p.wg.Wait()
+
+	p.db.mutex.Lock()
+	defer p.db.mutex.Unlock()
+	p.db.sm.SetObserver(nil)
+	p.db.primary = nil
+	return err
+}
+
+// Written queue the record to the replicas, the caller holds the write lock of the database
+func (p *Primary) Written(session core.Session, pos *core.RecordPosition, record *core.Record) {
+	seq := p.written.Add(1)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.replicas) == 0 {
+		return
+	}
+	// the key and the value are owned by the caller of the write
+	copied := &core.Record{Key: bytes.Clone(record.Key), Value: bytes.Clone(record.Value), Type: record.Type}
+	for r := range p.replicas {
+		if !r.push(replicationMessage{Type: msgRecord, Session: session, Pos: *pos, Record: copied, Seq: seq}) {
+			delete(p.replicas, r)
+		}
+	}
+}
+
+// Removed queue the removal of the segment to the replicas
+func (p *Primary) Removed(session core.Session, segment int64) {
+	seq := p.written.Add(1)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for r := range p.replicas {
+		if !r.push(replicationMessage{Type: msgRemove, Session: session, Pos: core.RecordPosition{Segment: segment}, Seq: seq}) {
+			delete(p.replicas, r)
+		}
+	}
+}
+
+// push queue the message to send, false is returned if the replica is dropped since it's not
+// keeping up, the connection is closed and the messages queued are discarded, the replica
+// reconnects and catches up from its tails
+func (r *replicaConn) push(msg replicationMessage) bool {
+	r.mutex.Lock()
+	r.dropped = r.dropped || len(r.pending) >= r.maxPending
+	if r.dropped {
+		r.pending = nil
+	} else {
+		r.pending = append(r.pending, msg)
+	}
+	dropped := r.dropped
+	r.mutex.Unlock()
+	if dropped {
+		_ = r.conn.Close()
+		return false
+	}
+	select {
+	case r.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (p *Primary) accept() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			_ = conn.Close()
+			return
+		}
+		p.wg.Add(1)
+		p.mutex.Unlock()
+		go p.serve(conn)
+	}
+}
+
+// catchUp the records of a table sent to the replica before the later writes
+type catchUp struct {
+	session core.Session
+	// the records in [from, end) are sent, then the segments of the replica removed by the
+	// primary are removed
+	from, end core.RecordPosition
+	removes   []int64
+}
+
+// serve the replica until it's disconnected
+func (p *Primary) serve(conn net.Conn) {
+	defer p.wg.Done()
+	defer conn.Close()
+	r := &replicaConn{conn: conn, maxPending: p.db.options.ReplicationMaxPending, signal: make(chan struct{}, 1)}
+
+	_ = conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	dec := gob.NewDecoder(bufio.NewReader(conn))
+	var hello replicaHello
+	if err := dec.Decode(&hello); err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	w := bufio.NewWriter(conn)
+	enc := gob.NewEncoder(w)
+
+	// the segments are not removed until the records are sent
+	p.db.maintenance.Lock()
+	plans, seq, err := p.register(r, hello)
+	if err == nil {
+		err = p.catchUp(enc, plans)
+	}
+	p.db.maintenance.Unlock()
+	defer p.unregister(r)
+	if errors.Is(err, core.ErrReplicaDiverged) {
+		_ = enc.Encode(replicationMessage{Type: msgDiverged})
+		_ = w.Flush()
+		return
+	}
+	if err != nil {
+		return
+	}
+	r.mutex.Lock()
+	r.caughtUp = true
+	r.mutex.Unlock()
+	if err := enc.Encode(replicationMessage{Type: msgCaughtUp, Seq: seq}); err != nil {
+		return
+	}
+
+	go p.readAcks(r, dec)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		var pending []replicationMessage
+		select {
+		case <-r.signal:
+			r.mutex.Lock()
+			dropped := r.dropped
+			pending = r.pending
+			r.pending = nil
+			r.mutex.Unlock()
+			if dropped {
+				return
+			}
+		case <-ticker.C:
+			pending = []replicationMessage{{Type: msgHeartbeat, Seq: p.written.Load()}}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		for _, msg := range pending {
+			if err := enc.Encode(msg); err != nil {
+				return
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// register the replica with the writes stopped, so the writes after the tails captured are queued,
+// return the records to send and the last write before them
+func (p *Primary) register(r *replicaConn, hello replicaHello) ([]catchUp, uint64, error) {
+	db := p.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	sessions, err := listTables(vfs.Or(db.options.FS), db.options.DataDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	tables := make(map[core.Session]replicaTable, len(hello.Tables))
+	for _, table := range hello.Tables {
+		tables[table.Session] = table
+	}
+	plans := make([]catchUp, 0, len(sessions))
+	for _, session := range sessions {
+		s, err := db.sm.Storage(session)
+		if err != nil {
+			return nil, 0, err
+		}
+		size, err := s.Size()
+		if err != nil {
+			return nil, 0, err
+		}
+		plan := catchUp{session: session, end: core.RecordPosition{Segment: s.ActiveSegment(), Position: size}}
+		table, ok := tables[session]
+		if ok {
+			if before(&plan.end, &table.Tail) {
+				return nil, 0, fmt.Errorf("%w: %s.%s", core.ErrReplicaDiverged, session.Schema, session.Table)
+			}
+			plan.from = table.Tail
+			segments := append(s.SealedSegments(), plan.end.Segment)
+			for _, segment := range table.Segments {
+				if segment < plan.end.Segment && !slices.Contains(segments, segment) {
+					plan.removes = append(plan.removes, segment)
+				}
+			}
+		}
+		// the transactions are committed before their records are applied
+		if session == TxnSession {
+			plans = append([]catchUp{plan}, plans...)
+		} else {
+			plans = append(plans, plan)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, 0, net.ErrClosed
+	}
+	p.replicas[r] = struct{}{}
+	return plans, p.written.Load(), nil
+}
+
+func (p *Primary) unregister(r *replicaConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.replicas, r)
+}
+
+// catchUp send the records of the tables after the tails of the replica
+func (p *Primary) catchUp(enc *gob.Encoder, plans []catchUp) error {
+	for _, plan := range plans {
+		var sendErr error
+		err := p.db.tail(plan.session, plan.from, plan.end, func(pos *core.RecordPosition, record *core.Record) bool {
+			sendErr = enc.Encode(replicationMessage{Type: msgRecord, Session: plan.session, Pos: *pos, Record: record})
+			return sendErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		if sendErr != nil {
+			return sendErr
+		}
+		// the segments of the replica are sealed before they're removed
+		if err := enc.Encode(replicationMessage{Type: msgRotate, Session: plan.session, Pos: core.RecordPosition{Segment: plan.end.Segment}}); err != nil {
+			return err
+		}
+		for _, segment := range plan.removes {
+			if err := enc.Encode(replicationMessage{Type: msgRemove, Session: plan.session, Pos: core.RecordPosition{Segment: segment}}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readAcks read the acks of the replica, the connection is closed if it's failed
+func (p *Primary) readAcks(r *replicaConn, dec *gob.Decoder) {
+	for {
+		_ = r.conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		var ack replicaAck
+		if err := dec.Decode(&ack); err != nil {
+			_ = r.conn.Close()
+			return
+		}
+		r.mutex.Lock()
+		r.acked = ack.Applied
+		r.lastAck = time.Now()
+		r.mutex.Unlock()
+	}
+}
+
+// replica follows the primary, it's reconnected until the database is closed
+type replica struct {
+	db      *Database
+	addr    string
+	mutex   sync.Mutex
+	status  ReplicaStatus
+	conn    net.Conn
+	done    chan struct{}
+	stopped chan struct{}
+	// the records of the transactions not committed yet by the sequence numbers, guarded by
+	// the write lock of the database
+	txnRecords map[uint64][]replicatedRecord
+}
+
+type replicatedRecord struct {
+	session core.Session
+	pos     core.RecordPosition
+	record  *core.Record
+}
+
+func newReplica(db *Database, addr string) *replica {
+	r := &replica{
+		db:         db,
+		addr:       addr,
+		status:     ReplicaStatus{Primary: addr},
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		txnRecords: make(map[uint64][]replicatedRecord),
+	}
+	go r.run()
+	return r
+}
+
+// ReplicaStatus the state of the replication if the database is a replica, see config.ReplicaOf
+func (db *Database) ReplicaStatus() ReplicaStatus {
+	if db.replica == nil {
+		return ReplicaStatus{}
+	}
+	db.replica.mutex.Lock()
+	defer db.replica.mutex.Unlock()
+	return db.replica.status
+}
+
+func (r *replica) run() {
+	defer close(r.stopped)
+	for {
+		err := r.follow()
+		r.mutex.Lock()
+		r.conn = nil
+		r.status.Connected = false
+		r.status.CaughtUp = false
+		if err != nil {
+			r.status.Err = err
+		}
+		r.mutex.Unlock()
+		select {
+		case <-r.done:
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// follow apply the records sent by the primary until the connection is dropped
+func (r *replica) follow() error {
+	conn, err := net.DialTimeout("tcp", r.addr, replicationTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r.mutex.Lock()
+	select {
+	case <-r.done:
+		r.mutex.Unlock()
+		return nil
+	default:
+	}
+	r.conn = conn
+	r.status = ReplicaStatus{Primary: r.addr, Connected: true, LastContact: time.Now()}
+	r.mutex.Unlock()
+
+	hello, err := r.db.replicaHello()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(hello); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(bufio.NewReader(conn))
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		var msg replicationMessage
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		switch msg.Type {
+		case msgRecord:
+			err = r.db.applyReplicated(r, msg.Session, &msg.Pos, msg.Record)
+		case msgRotate:
+			err = r.db.rotateReplicated(msg.Session, msg.Pos.Segment)
+		case msgRemove:
+			err = r.db.removeReplicated(msg.Session, msg.Pos.Segment)
+		case msgDiverged:
+			err = core.ErrReplicaDiverged
+		}
+		if err != nil {
+			return err
+		}
+		if r.update(msg) {
+			if err := enc.Encode(replicaAck{Applied: r.applied()}); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// update the status by the message applied, return true if it's acked
+func (r *replica) update(msg replicationMessage) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := &r.status
+	status.LastContact = time.Now()
+	primary := status.Applied + status.Lag
+	ack := false
+	switch msg.Type {
+	case msgCaughtUp:
+		status.CaughtUp = true
+		status.Err = nil
+		status.Applied = msg.Seq
+		ack = true
+	case msgHeartbeat:
+		ack = true
+	default:
+		if msg.Seq > 0 {
+			status.Applied = msg.Seq
+		}
+	}
+	status.Lag = 0
+	if primary = max(primary, msg.Seq); primary > status.Applied {
+		status.Lag = primary - status.Applied
+	}
+	return ack
+}
+
+func (r *replica) applied() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.status.Applied
+}
+
+// stop following the primary
+func (r *replica) stop() {
+	r.mutex.Lock()
+	close(r.done)
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+	r.mutex.Unlock()
+	<-r.stopped
+}
+
+// replicaHello the tails of the tables of the replica
+func (db *Database) replicaHello() (replicaHello, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	sessions, err := listTables(vfs.Or(db.options.FS), db.options.DataDir)
+	if err != nil {
+		return replicaHello{}, err
+	}
+	hello := replicaHello{Tables: make([]replicaTable, 0, len(sessions))}
+	for _, session := range sessions {
+		s, err := db.sm.Storage(session)
+		if err != nil {
+			return replicaHello{}, err
+		}
+		size, err := s.Size()
+		if err != nil {
+			return replicaHello{}, err
+		}
+		active := s.ActiveSegment()
+		hello.Tables = append(hello.Tables, replicaTable{
+			Session:  session,
+			Tail:     core.RecordPosition{Segment: active, Position: size},
+			Segments: append(s.SealedSegments(), active),
+		})
+	}
+	return hello, nil
+}
+
+// applyReplicated append the record at the same position as the primary, then the index is
+// updated as the write of the primary
+func (db *Database) applyReplicated(r *replica, session core.Session, pos *core.RecordPosition, record *core.Record) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	s, err := db.sm.Storage(session)
+	if err != nil {
+		return err
+	}
+	if pos.Segment > s.ActiveSegment() {
+		if err := db.sm.RotateTo(session, pos.Segment); err != nil {
+			return err
+		}
+	}
+	written, err := db.sm.Write(session, record)
+	if err != nil {
+		return err
+	}
+	if written.Segment != pos.Segment || written.Position != pos.Position {
+		return fmt.Errorf("%w: %s.%s record at %d:%d is written at %d:%d", core.ErrReplicaDiverged,
+			session.Schema, session.Table, pos.Segment, pos.Position, written.Segment, written.Position)
+	}
+
+	if session == TxnSession {
+		if record.Type != core.TxnFinished {
+			return nil
+		}
+		seq, _, err := core.DecodeTxnKey(record.Key)
+		if err != nil {
+			return err
+		}
+		db.txns.commit(seq)
+		records := r.txnRecords[seq]
+		delete(r.txnRecords, seq)
+		for _, txnRecord := range records {
+			if err := db.indexReplicated(r, txnRecord.session, &txnRecord.pos, txnRecord.record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return db.indexReplicated(r, session, written, record)
+}
+
+// indexReplicated update the index by the record replicated, the records of the transaction are
+// kept until it's committed, the caller holds the write lock
+func (db *Database) indexReplicated(r *replica, session core.Session, pos *core.RecordPosition, record *core.Record) error {
+	if record.IsTxn() {
+		seq, plain, err := record.UnwrapTxn()
+		if err != nil {
+			return err
+		}
+		if !db.txns.isCommitted(seq) {
+			r.txnRecords[seq] = append(r.txnRecords[seq], replicatedRecord{session: session, pos: *pos, record: record})
+			return nil
+		}
+		record = plain
+	}
+
+	if record.Type == core.RangeDeleted {
+		start, end, err := core.DecodeRange(record.Key)
+		if err != nil {
+			return err
+		}
+		keys, err := db.im.RangeKeys(session, start, end)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := db.indexDelete(session, key); err != nil {
+				return err
+			}
+		}
+	} else if err := db.applyIndex(session, record.Key, record.Type, pos); err != nil {
+		return err
+	}
+	return db.publish(session, record, pos)
+}
+
+// rotateReplicated start the active segment of the primary if the replica is behind it
+func (db *Database) rotateReplicated(session core.Session, segment int64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	s, err := db.sm.Storage(session)
+	if err != nil {
+		return err
+	}
+	if segment <= s.ActiveSegment() {
+		return nil
+	}
+	return db.sm.RotateTo(session, segment)
+}
+
+// removeReplicated remove the segment removed by the primary, the keys still pointing to it are
+// dropped, they're deleted or moved by the primary while the replica is disconnected
+func (db *Database) removeReplicated(session core.Session, segment int64) error {
+	db.maintenance.Lock()
+	defer db.maintenance.Unlock()
+
+	db.mutex.Lock()
+	it, err := db.im.Iterator(session, false)
+	if err != nil {
+		db.mutex.Unlock()
+		return err
+	}
+	var keys []core.Bytes
+	for ; it.Valid(); it.Next() {
+		if it.Value().Segment == segment {
+			keys = append(keys, it.Key())
+		}
+	}
+	it.Close()
+	for _, key := range keys {
+		if err := db.indexDelete(session, key); err != nil {
+			db.mutex.Unlock()
+			return err
+		}
+	}
+	db.mutex.Unlock()
+
+	err = db.removeSegments(session, []int64{segment})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
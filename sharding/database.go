@@ -0,0 +1,457 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"BytesDB"
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/storage"
+	"BytesDB/vfs"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sync"
+)
+
+// RebalanceMarkerName the file in data.dir of each shard while the keys are migrated to the
+// shard added, it holds the data.dir of the shard added. the rebalance is run again by Open if
+// it's left by a failed one, and Open fails if the shard added is not in the config
+const RebalanceMarkerName = "REBALANCING"
+
+// Config the shards of the database
+type Config struct {
+	// Shards the configs of the databases, each one has its own data.dir. a shard is placed on
+	// the ring by its data.dir, so it's not changed once the keys are written
+	Shards []*config.DBConfig
+	// VirtualNodes the points of each shard on the ring, 128 by default
+	VirtualNodes int
+}
+
+type shard struct {
+	name string
+	cfg  *config.DBConfig
+	db   *BytesDB.Database
+}
+
+// Database routes the keys of the tables to the shards by consistent hashing, the keys of a table
+// are read across the shards in order. the writes of a batch or a transaction are not supported
+// across the shards, each shard is a Database on its own
+type Database struct {
+	// the reads, the writes and the migration hold the read lock, the write lock is only held to
+	// change the shards and the ring
+	mutex sync.RWMutex
+	// serialize AddShard and Rebalance
+	rebalanceMutex sync.Mutex
+	// a key is copied to its owner and deleted from the other shard holding it, the reads
+	// falling back to the copies and the snapshots of the shards are not taken in between
+	moveMutex    sync.Mutex
+	shards       []*shard
+	ring         *ring
+	virtualNodes int
+	// the keys are being migrated, or not all migrated since a rebalance failed, the writes are
+	// rejected and the reads fall back to the copies left in the other shards until it completes
+	rebalancing bool
+}
+
+// Open the shards, the keys are rebalanced if a shard was added but not completed
+func Open(cfg Config) (*Database, error) {
+	if len(cfg.Shards) == 0 {
+		return nil, errors.New("no shard")
+	}
+	sdb := &Database{virtualNodes: cfg.VirtualNodes}
+	if sdb.virtualNodes <= 0 {
+		sdb.virtualNodes = 128
+	}
+	rebalance := false
+	var added []string
+	for _, shardCfg := range cfg.Shards {
+		s, err := sdb.openShard(shardCfg)
+		if err != nil {
+			sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, s)
+		name, ok, err := readMarker(s)
+		if err != nil {
+			sdb.Close()
+			return nil, err
+		}
+		if ok {
+			rebalance = true
+			added = append(added, name)
+		}
+	}
+	// the keys migrated to the shard would be lost without it
+	for _, name := range added {
+		if name != "" && !slices.Contains(sdb.names(), name) {
+			sdb.Close()
+			return nil, fmt.Errorf("%w: %s", core.ErrShardMissing, name)
+		}
+	}
+	sdb.ring = newRing(sdb.names(), sdb.virtualNodes)
+	if rebalance {
+		if err := sdb.Rebalance(); err != nil {
+			sdb.Close()
+			return nil, err
+		}
+	}
+	return sdb, nil
+}
+
+func (sdb *Database) openShard(cfg *config.DBConfig) (*shard, error) {
+	if err := config.Resolve(cfg); err != nil {
+		return nil, err
+	}
+	for _, s := range sdb.shards {
+		if s.name == cfg.DataDir {
+			return nil, fmt.Errorf("shard %s exists already", cfg.DataDir)
+		}
+	}
+	db, err := BytesDB.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &shard{name: cfg.DataDir, cfg: cfg, db: db}, nil
+}
+
+func (s *shard) markerPath() string {
+	return path.Join(s.cfg.DataDir, RebalanceMarkerName)
+}
+
+func (sdb *Database) names() []string {
+	names := make([]string, 0, len(sdb.shards))
+	for _, s := range sdb.shards {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// Shards the data.dir of the shards
+func (sdb *Database) Shards() []string {
+	sdb.mutex.RLock()
+	defer sdb.mutex.RUnlock()
+	return sdb.names()
+}
+
+// ShardOf the data.dir of the shard owning the key of the table
+func (sdb *Database) ShardOf(session core.Session, key core.Bytes) string {
+	sdb.mutex.RLock()
+	defer sdb.mutex.RUnlock()
+	return sdb.locate(session, key).name
+}
+
+func (sdb *Database) locate(session core.Session, key core.Bytes) *shard {
+	return sdb.shards[sdb.ring.locate(session, key)]
+}
+
+// Put the value of the key, ErrRebalancing until Rebalance completes if a rebalance failed,
+// since the copy of the key not migrated yet would be moved over the value
+func (sdb *Database) Put(session core.Session, key, value core.Bytes) error {
+	sdb.mutex.RLock()
+	defer sdb.mutex.RUnlock()
+	if sdb.rebalancing {
+		return core.ErrRebalancing
+	}
+	return sdb.locate(session, key).db.Put(session, key, value)
+}
+
+// Get the value of the key, it's read from the copy left in the other shards if the owner does
+// not have it and a rebalance failed
+func (sdb *Database) Get(session core.Session, key core.Bytes) (core.Bytes, error) {
+	sdb.mutex.RLock()
+	defer sdb.mutex.RUnlock()
+	owner := sdb.locate(session, key)
+	value, err := owner.db.Get(session, key)
+	if !sdb.rebalancing || !errors.Is(err, core.ErrKeyNotFound) {
+		return value, err
+	}
+	// read again since the key may be moved to the owner after it's read
+	sdb.moveMutex.Lock()
+	defer sdb.moveMutex.Unlock()
+	if value, err = owner.db.Get(session, key); !errors.Is(err, core.ErrKeyNotFound) {
+		return value, err
+	}
+	for _, s := range sdb.shards {
+		if s == owner {
+			continue
+		}
+		if value, err := s.db.Get(session, key); !errors.Is(err, core.ErrKeyNotFound) {
+			return value, err
+		}
+	}
+	return nil, core.ErrKeyNotFound
+}
+
+// Delete the key, ErrRebalancing until Rebalance completes if a rebalance failed, since the
+// copy of the key not migrated yet would be moved to the owner again
+func (sdb *Database) Delete(session core.Session, key core.Bytes) error {
+	sdb.mutex.RLock()
+	defer sdb.mutex.RUnlock()
+	if sdb.rebalancing {
+		return core.ErrRebalancing
+	}
+	return sdb.locate(session, key).db.Delete(session, key)
+}
+
+// Keys the keys of the table across the shards in order
+func (sdb *Database) Keys(session core.Session) ([]core.Bytes, error) {
+	it, err := sdb.Iterator(session, false)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var keys []core.Bytes
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys, nil
+}
+
+// Iterator the keys of the table across the shards, in the order of the keys
+func (sdb *Database) Iterator(session core.Session, reverse bool) (*Iterator, error) {
+	return sdb.PrefixIterator(session, nil, reverse)
+}
+
+// PrefixIterator same as Iterator, but only the keys with the prefix
+func (sdb *Database) PrefixIterator(session core.Session, prefix core.Bytes, reverse bool) (*Iterator, error) {
+	sdb.mutex.RLock()
+	defer sdb.mutex.RUnlock()
+
+	r := sdb.ring
+	rebalancing := sdb.rebalancing
+	if rebalancing {
+		// a key moved between the snapshots would be missed
+		sdb.moveMutex.Lock()
+		defer sdb.moveMutex.Unlock()
+	}
+	sources := make([]*source, 0, len(sdb.shards))
+	release := func() {
+		for _, s := range sources {
+			s.it.Close()
+			_ = s.snapshot.Release()
+		}
+	}
+	for i, s := range sdb.shards {
+		snapshot, err := s.db.Snapshot(session)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		it, err := snapshot.PrefixIterator(prefix, reverse)
+		if err != nil {
+			_ = snapshot.Release()
+			release()
+			return nil, err
+		}
+		owner := i
+		sources = append(sources, &source{
+			snapshot: snapshot,
+			it:       it,
+			owned: func(key core.Bytes) bool {
+				located := r.locate(session, key)
+				if located == owner {
+					return true
+				}
+				if !rebalancing {
+					return false
+				}
+				// the copy not migrated yet is seen if the owner does not have it
+				_, err := sources[located].snapshot.Get(key)
+				return errors.Is(err, core.ErrKeyNotFound)
+			},
+		})
+	}
+	return newIterator(sources, reverse), nil
+}
+
+// AddShard add the shard and migrate the keys owned by it from the others, the reads go on
+// while the keys are migrated, the writes are rejected with ErrRebalancing until it's done.
+// the shard is kept if the migration fails, it's completed by Rebalance, or by Open with the
+// shard in the config
+func (sdb *Database) AddShard(cfg *config.DBConfig) error {
+	sdb.rebalanceMutex.Lock()
+	defer sdb.rebalanceMutex.Unlock()
+
+	// the failed migration is completed first, so a key is left in one shard other than its owner
+	sdb.mutex.RLock()
+	rebalancing := sdb.rebalancing
+	sdb.mutex.RUnlock()
+	if rebalancing {
+		if err := sdb.rebalance(); err != nil {
+			return err
+		}
+	}
+	sdb.mutex.RLock()
+	s, err := sdb.openShard(cfg)
+	if err == nil {
+		if err = sdb.writeMarkers(s); err != nil {
+			s.db.Close()
+		}
+	}
+	sdb.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	sdb.mutex.Lock()
+	sdb.shards = append(sdb.shards, s)
+	sdb.ring = newRing(sdb.names(), sdb.virtualNodes)
+	sdb.rebalancing = true
+	sdb.mutex.Unlock()
+	return sdb.rebalance()
+}
+
+// Rebalance move the keys not in the shards owning them, e.g. left by a failed AddShard
+func (sdb *Database) Rebalance() error {
+	sdb.rebalanceMutex.Lock()
+	defer sdb.rebalanceMutex.Unlock()
+	return sdb.rebalance()
+}
+
+// rebalance the writes are rejected while the keys are migrated under the read lock, the caller
+// holds rebalanceMutex
+func (sdb *Database) rebalance() error {
+	sdb.mutex.Lock()
+	sdb.rebalancing = true
+	sdb.mutex.Unlock()
+
+	sdb.mutex.RLock()
+	err := sdb.migrate()
+	sdb.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	sdb.mutex.Lock()
+	sdb.rebalancing = false
+	sdb.mutex.Unlock()
+	return nil
+}
+
+// migrate the key is copied to the owner before it's deleted, so it's not lost by a failure,
+// the value of the owner wins if both have it. the markers are removed once it's done
+func (sdb *Database) migrate() error {
+	for _, s := range sdb.shards {
+		sessions, err := s.db.Tables()
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			for _, key := range s.db.Keys(session) {
+				if owner := sdb.locate(session, key); owner != s {
+					if err := sdb.move(session, key, s, owner); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	for _, s := range sdb.shards {
+		if s.cfg.StorageType == storage.Memory {
+			continue
+		}
+		err := vfs.Or(s.cfg.FS).Remove(s.markerPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sdb *Database) move(session core.Session, key core.Bytes, from, to *shard) error {
+	sdb.moveMutex.Lock()
+	defer sdb.moveMutex.Unlock()
+	value, err := from.db.Get(session, key)
+	if errors.Is(err, core.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := to.db.PutIfAbsent(session, key, value); err != nil {
+		return err
+	}
+	return from.db.Delete(session, key)
+}
+
+// writeMarkers write the markers naming the shard added to it and the other shards, so the
+// failed migration is known after a crash even if the shard added is not in the config. the
+// markers written are removed if it fails
+func (sdb *Database) writeMarkers(added *shard) error {
+	var written []*shard
+	for _, s := range append(slices.Clone(sdb.shards), added) {
+		if err := writeMarker(s, added.name); err != nil {
+			for _, w := range written {
+				_ = vfs.Or(w.cfg.FS).Remove(w.markerPath())
+			}
+			return err
+		}
+		written = append(written, s)
+	}
+	return nil
+}
+
+// writeMarker the marker is synced, so the failed migration is known after a crash
+func writeMarker(s *shard, added string) error {
+	if s.cfg.StorageType == storage.Memory {
+		return nil
+	}
+	file, err := vfs.Or(s.cfg.FS).OpenFile(s.markerPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte(added))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readMarker the data.dir of the shard added named by the marker of the shard, ok is false if
+// there's no marker
+func readMarker(s *shard) (string, bool, error) {
+	if s.cfg.StorageType == storage.Memory {
+		return "", false, nil
+	}
+	file, err := vfs.Open(vfs.Or(s.cfg.FS), s.markerPath())
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+	name, err := io.ReadAll(file)
+	if err != nil {
+		return "", false, err
+	}
+	return string(name), true, nil
+}
+
+func (sdb *Database) Close() {
+	sdb.mutex.Lock()
+	defer sdb.mutex.Unlock()
+	for _, s := range sdb.shards {
+		s.db.Close()
+	}
+	sdb.shards = nil
+}
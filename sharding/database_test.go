@@ -0,0 +1,333 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"BytesDB"
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/vfs"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+var session = core.Session{
+	Schema: "public",
+	Table:  "test",
+}
+
+func shardConfigs(fs vfs.FS, from, to int) []*config.DBConfig {
+	var cfgs []*config.DBConfig
+	for i := from; i < to; i++ {
+		cfgs = append(cfgs, &config.DBConfig{DataDir: fmt.Sprintf("/tmp/bytesdb-shard%d", i), MaxFileSize: 4096, FS: fs})
+	}
+	return cfgs
+}
+
+func sortedKeys(count int) []core.Bytes {
+	keys := make([]core.Bytes, 0, count)
+	for i := 0; i < count; i++ {
+		keys = append(keys, core.Bytes(fmt.Sprintf("key%03d", i)))
+	}
+	sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+	return keys
+}
+
+func TestDatabase_Sharding(t *testing.T) {
+	fs := vfs.NewMemFS()
+	sdb, err := Open(Config{Shards: shardConfigs(fs, 0, 3)})
+	assert.Nil(t, err)
+	defer sdb.Close()
+	other := core.Session{Schema: "public", Table: "other"}
+
+	keys := sortedKeys(200)
+	for _, key := range keys {
+		assert.Nil(t, sdb.Put(session, key, append(core.Bytes("v-"), key...)))
+	}
+	assert.Nil(t, sdb.Put(other, core.Bytes("key000"), core.Bytes("other")))
+	for _, key := range keys {
+		value, err := sdb.Get(session, key)
+		assert.Nil(t, err)
+		assert.Equal(t, append(core.Bytes("v-"), key...), value)
+	}
+	// the keys are spread over the shards
+	for _, s := range sdb.shards {
+		count := len(s.db.Keys(session))
+		assert.True(t, count > 20 && count < 120, "%s has %d keys", s.name, count)
+	}
+
+	// the keys are merged in order across the shards
+	all, err := sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, keys, all)
+	it, err := sdb.Iterator(session, true)
+	assert.Nil(t, err)
+	for i := len(keys) - 1; i >= 0; i-- {
+		assert.True(t, it.Valid())
+		assert.Equal(t, keys[i], it.Key())
+		value, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, append(core.Bytes("v-"), keys[i]...), value)
+		it.Next()
+	}
+	assert.False(t, it.Valid())
+	it.Close()
+
+	assert.Nil(t, sdb.Delete(session, core.Bytes("key105")))
+	_, err = sdb.Get(session, core.Bytes("key105"))
+	assert.ErrorIs(t, err, core.ErrKeyNotFound)
+	it, err = sdb.PrefixIterator(session, core.Bytes("key10"), false)
+	assert.Nil(t, err)
+	var prefixed []string
+	for ; it.Valid(); it.Next() {
+		prefixed = append(prefixed, string(it.Key()))
+	}
+	it.Close()
+	assert.Equal(t, []string{"key100", "key101", "key102", "key103", "key104", "key106", "key107", "key108", "key109"}, prefixed)
+	all, err = sdb.Keys(other)
+	assert.Nil(t, err)
+	assert.Equal(t, []core.Bytes{core.Bytes("key000")}, all)
+
+	_, err = Open(Config{Shards: append(shardConfigs(vfs.NewMemFS(), 0, 1), shardConfigs(vfs.NewMemFS(), 0, 1)...)})
+	assert.NotNil(t, err)
+}
+
+func TestDatabase_AddShard(t *testing.T) {
+	fs := vfs.NewMemFS()
+	sdb, err := Open(Config{Shards: shardConfigs(fs, 0, 2)})
+	assert.Nil(t, err)
+
+	keys := sortedKeys(300)
+	owners := make(map[string]string)
+	for _, key := range keys {
+		assert.Nil(t, sdb.Put(session, key, key))
+		owners[string(key)] = sdb.ShardOf(session, key)
+	}
+
+	// the keys are only moved to the new shard
+	added := shardConfigs(fs, 2, 3)[0]
+	assert.Nil(t, sdb.AddShard(added))
+	assert.Equal(t, 3, len(sdb.Shards()))
+	moved := 0
+	for _, key := range keys {
+		owner := sdb.ShardOf(session, key)
+		if owner != owners[string(key)] {
+			assert.Equal(t, added.DataDir, owner)
+			moved++
+		}
+		value, err := sdb.Get(session, key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, value)
+	}
+	assert.True(t, moved > 30 && moved < 200, "%d keys moved", moved)
+	for _, s := range sdb.shards {
+		for _, key := range s.db.Keys(session) {
+			assert.Equal(t, s.name, sdb.ShardOf(session, key))
+		}
+	}
+	all, err := sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, keys, all)
+	_, err = fs.Stat(path.Join(added.DataDir, RebalanceMarkerName))
+	assert.True(t, os.IsNotExist(err))
+	sdb.Close()
+
+	// reopened with the shard added
+	sdb, err = Open(Config{Shards: shardConfigs(fs, 0, 3)})
+	assert.Nil(t, err)
+	defer sdb.Close()
+	all, err = sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, keys, all)
+}
+
+func TestDatabase_Rebalance(t *testing.T) {
+	fs := vfs.NewMemFS()
+	cfgs := shardConfigs(fs, 0, 2)
+	sdb, err := Open(Config{Shards: cfgs})
+	assert.Nil(t, err)
+	assert.Nil(t, sdb.Put(session, core.Bytes("key"), core.Bytes("owned")))
+	owner := sdb.ShardOf(session, core.Bytes("key"))
+	// the keys left in the other shards by a failed migration
+	misplaced := cfgs[0]
+	if misplaced.DataDir == owner {
+		misplaced = cfgs[1]
+	}
+	moved := core.Bytes("moved")
+	for i := 0; sdb.ShardOf(session, moved) == misplaced.DataDir; i++ {
+		moved = core.Bytes(fmt.Sprintf("moved%d", i))
+	}
+	sdb.Close()
+
+	db, err := BytesDB.Open(misplaced)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(session, core.Bytes("key"), core.Bytes("stale")))
+	assert.Nil(t, db.Put(session, moved, core.Bytes("value")))
+	db.Close()
+
+	// not seen until it's moved to its owner
+	sdb, err = Open(Config{Shards: cfgs})
+	assert.Nil(t, err)
+	all, err := sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, []core.Bytes{core.Bytes("key")}, all)
+	sdb.Close()
+
+	// the failed migration is completed by Open, the value of the owner wins
+	file, err := fs.OpenFile(path.Join(misplaced.DataDir, RebalanceMarkerName), os.O_CREATE|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	sdb, err = Open(Config{Shards: cfgs})
+	assert.Nil(t, err)
+	defer sdb.Close()
+	all, err = sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, []core.Bytes{core.Bytes("key"), moved}, all)
+	value, err := sdb.Get(session, core.Bytes("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("owned"), value)
+	value, err = sdb.Get(session, moved)
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("value"), value)
+}
+
+func TestDatabase_AddShard_Failed(t *testing.T) {
+	fs := vfs.NewMemFS()
+	sdb, err := Open(Config{Shards: shardConfigs(fs, 0, 2)})
+	assert.Nil(t, err)
+	defer sdb.Close()
+	keys := sortedKeys(300)
+	for _, key := range keys {
+		assert.Nil(t, sdb.Put(session, key, key))
+	}
+
+	// the migration fails partway since the new shard is full
+	ffs := vfs.NewFaultFS(fs)
+	added := shardConfigs(ffs, 2, 3)[0]
+	ffs.Inject(vfs.Fault{Op: vfs.OpWrite, Suffix: ".data", After: 10, Err: syscall.ENOSPC})
+	assert.ErrorIs(t, sdb.AddShard(added), syscall.ENOSPC)
+	ffs.Reset()
+	var missed core.Bytes
+	for _, key := range keys {
+		_, err := sdb.shards[2].db.Get(session, key)
+		if sdb.ShardOf(session, key) == added.DataDir && errors.Is(err, core.ErrKeyNotFound) {
+			missed = key
+			break
+		}
+	}
+	assert.NotNil(t, missed)
+
+	// the key not migrated is read from the previous owner, the writes are rejected
+	value, err := sdb.Get(session, missed)
+	assert.Nil(t, err)
+	assert.Equal(t, missed, value)
+	all, err := sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, keys, all)
+	assert.ErrorIs(t, sdb.Delete(session, missed), core.ErrRebalancing)
+	assert.ErrorIs(t, sdb.Put(session, missed, core.Bytes("new")), core.ErrRebalancing)
+
+	// the deleted key is not moved back by the later rebalance
+	assert.Nil(t, sdb.Rebalance())
+	assert.Nil(t, sdb.Delete(session, missed))
+	assert.Nil(t, sdb.Rebalance())
+	_, err = sdb.Get(session, missed)
+	assert.ErrorIs(t, err, core.ErrKeyNotFound)
+	all, err = sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys)-1, len(all))
+	for _, s := range sdb.shards {
+		for _, key := range s.db.Keys(session) {
+			assert.Equal(t, s.name, sdb.ShardOf(session, key))
+		}
+	}
+	_, err = fs.Stat(path.Join(added.DataDir, RebalanceMarkerName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDatabase_AddShard_Concurrent_Reads(t *testing.T) {
+	fs := vfs.NewMemFS()
+	sdb, err := Open(Config{Shards: shardConfigs(fs, 0, 2)})
+	assert.Nil(t, err)
+	defer sdb.Close()
+	keys := sortedKeys(300)
+	for _, key := range keys {
+		assert.Nil(t, sdb.Put(session, key, key))
+	}
+
+	// the keys are read while they're migrated, the writes are rejected until it's done
+	done := make(chan error)
+	go func() {
+		done <- sdb.AddShard(shardConfigs(fs, 2, 3)[0])
+	}()
+	for migrating := true; migrating; {
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+			migrating = false
+		default:
+		}
+		for _, key := range keys[:50] {
+			value, err := sdb.Get(session, key)
+			assert.Nil(t, err)
+			assert.Equal(t, key, value)
+		}
+		all, err := sdb.Keys(session)
+		assert.Nil(t, err)
+		assert.Equal(t, keys, all)
+		if err := sdb.Put(session, keys[0], keys[0]); err != nil {
+			assert.ErrorIs(t, err, core.ErrRebalancing)
+		}
+	}
+	assert.Nil(t, sdb.Put(session, keys[0], keys[0]))
+}
+
+func TestDatabase_AddShard_Missing(t *testing.T) {
+	fs := vfs.NewMemFS()
+	sdb, err := Open(Config{Shards: shardConfigs(fs, 0, 2)})
+	assert.Nil(t, err)
+	keys := sortedKeys(300)
+	for _, key := range keys {
+		assert.Nil(t, sdb.Put(session, key, key))
+	}
+	ffs := vfs.NewFaultFS(fs)
+	added := shardConfigs(ffs, 2, 3)[0]
+	ffs.Inject(vfs.Fault{Op: vfs.OpWrite, Suffix: ".data", After: 10, Err: syscall.ENOSPC})
+	assert.ErrorIs(t, sdb.AddShard(added), syscall.ENOSPC)
+	sdb.Close()
+
+	// the keys migrated to the shard added would be lost without it
+	_, err = Open(Config{Shards: shardConfigs(fs, 0, 2)})
+	assert.ErrorIs(t, err, core.ErrShardMissing)
+
+	// completed by Open with the shard added
+	sdb, err = Open(Config{Shards: shardConfigs(fs, 0, 3)})
+	assert.Nil(t, err)
+	defer sdb.Close()
+	all, err := sdb.Keys(session)
+	assert.Nil(t, err)
+	assert.Equal(t, keys, all)
+	for _, s := range sdb.shards {
+		_, err = fs.Stat(s.markerPath())
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Nil(t, sdb.Put(session, keys[0], keys[0]))
+}
@@ -0,0 +1,125 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"BytesDB"
+	"BytesDB/core"
+	"bytes"
+	"container/heap"
+)
+
+// Iterator the keys of a table across the shards in the order of the keys, each shard is read by
+// a snapshot taken when the iterator is created, so Close must be called once it's not used
+type Iterator struct {
+	sources []*source
+	// the sources not exhausted, the top one has the current key
+	heap sourceHeap
+}
+
+// source the keys of a shard, the keys not owned by the shard, e.g. left by a failed rebalance,
+// are skipped unless the owner does not have them until the rebalance completes
+type source struct {
+	snapshot *BytesDB.Snapshot
+	it       core.Iterator
+	owned    func(core.Bytes) bool
+}
+
+func (s *source) skip() {
+	for s.it.Valid() && !s.owned(s.it.Key()) {
+		s.it.Next()
+	}
+}
+
+type sourceHeap struct {
+	sources []*source
+	reverse bool
+}
+
+func (h *sourceHeap) Len() int {
+	return len(h.sources)
+}
+
+func (h *sourceHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.sources[i].it.Key(), h.sources[j].it.Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *sourceHeap) Swap(i, j int) {
+	h.sources[i], h.sources[j] = h.sources[j], h.sources[i]
+}
+
+func (h *sourceHeap) Push(x any) {
+	h.sources = append(h.sources, x.(*source))
+}
+
+func (h *sourceHeap) Pop() any {
+	last := h.sources[len(h.sources)-1]
+	h.sources = h.sources[:len(h.sources)-1]
+	return last
+}
+
+func newIterator(sources []*source, reverse bool) *Iterator {
+	it := &Iterator{sources: sources, heap: sourceHeap{reverse: reverse}}
+	for _, s := range sources {
+		s.skip()
+		if s.it.Valid() {
+			it.heap.sources = append(it.heap.sources, s)
+		}
+	}
+	heap.Init(&it.heap)
+	return it
+}
+
+func (it *Iterator) Valid() bool {
+	return it.heap.Len() > 0
+}
+
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	top := it.heap.sources[0]
+	top.it.Next()
+	top.skip()
+	if top.it.Valid() {
+		heap.Fix(&it.heap, 0)
+	} else {
+		heap.Pop(&it.heap)
+	}
+}
+
+func (it *Iterator) Key() core.Bytes {
+	return it.heap.sources[0].it.Key()
+}
+
+// Value the value of the current key read by the snapshot of its shard
+func (it *Iterator) Value() (core.Bytes, error) {
+	top := it.heap.sources[0]
+	return top.snapshot.Get(top.it.Key())
+}
+
+// Close release the snapshots of the shards
+func (it *Iterator) Close() {
+	for _, s := range it.sources {
+		s.it.Close()
+		_ = s.snapshot.Release()
+	}
+	it.sources = nil
+	it.heap.sources = nil
+}
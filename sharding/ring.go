@@ -0,0 +1,89 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"BytesDB/core"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ring the consistent hashing ring, each shard is placed at the points of its virtual nodes, and
+// a key is owned by the shard of the first point after its hash, so adding a shard only moves the
+// keys between the new points and the ones before them
+type ring struct {
+	points []uint64
+	// owners[i] the index of the shard of points[i]
+	owners []int
+}
+
+func newRing(names []string, virtualNodes int) *ring {
+	r := &ring{}
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	points := make([]point, 0, len(names)*virtualNodes)
+	for owner, name := range names {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{hash: hashBytes([]byte(name + "#" + strconv.Itoa(i))), owner: owner})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r
+}
+
+// locate the index of the shard owning the key of the table
+func (r *ring) locate(session core.Session, key core.Bytes) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(session.Schema))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(session.Table))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(key)
+	hash := mix(h.Sum64())
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func hashBytes(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return mix(h.Sum64())
+}
+
+// mix the finalizer of splitmix64, the fnv hashes of the similar names and keys are spread
+// over the ring
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,253 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"BytesDB/index"
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+)
+
+// Snapshot the read handle of a table as of the time it's taken, the writes after it are not seen
+// by its Get and iterators. the segments merged by Compact are kept until the snapshots of the
+// table are released, so Release must be called once it's not used
+type Snapshot struct {
+	db       *Database
+	session  core.Session
+	position core.RecordPosition
+	// the positions of the keys before their first change after the snapshot is taken, nil if
+	// the key was not exists, the keys not changed are read from the index
+	previous map[string]*core.RecordPosition
+	released bool
+}
+
+// Snapshot take a snapshot of the table, it's pinned to the end of the active segment
+func (db *Database) Snapshot(session core.Session) (*Snapshot, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	storage, err := db.sm.Storage(session)
+	if err != nil {
+		return nil, err
+	}
+	size, err := storage.Size()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{
+		db:       db,
+		session:  session,
+		position: core.RecordPosition{Segment: storage.ActiveSegment(), Position: size},
+		previous: make(map[string]*core.RecordPosition),
+	}
+	if db.snapshots[session] == nil {
+		db.snapshots[session] = make(map[*Snapshot]struct{})
+	}
+	db.snapshots[session][snapshot] = struct{}{}
+	return snapshot, nil
+}
+
+// Position the end of the records seen by the snapshot
+func (s *Snapshot) Position() core.RecordPosition {
+	return s.position
+}
+
+func (s *Snapshot) Get(key core.Bytes) (core.Bytes, error) {
+	s.db.mutex.RLock()
+	defer s.db.mutex.RUnlock()
+	if s.released {
+		return nil, core.ErrSnapshotReleased
+	}
+
+	pos, ok := s.previous[string(key)]
+	if !ok {
+		var err error
+		if pos, err = s.db.im.Get(s.session, key); err != nil {
+			return nil, err
+		}
+	}
+	if pos == nil {
+		return nil, core.ErrKeyNotFound
+	}
+	return s.db.readValue(s.session, pos)
+}
+
+func (s *Snapshot) Keys() []core.Bytes {
+	it, err := s.Iterator(false)
+	if err != nil {
+		return nil
+	}
+	defer it.Close()
+
+	var keys []core.Bytes
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+// Iterator the keys and the positions of the records seen by the snapshot, in the order of the keys
+func (s *Snapshot) Iterator(reverse bool) (core.Iterator, error) {
+	return s.PrefixIterator(nil, reverse)
+}
+
+// PrefixIterator same as Iterator, but only the keys with the prefix
+func (s *Snapshot) PrefixIterator(prefix core.Bytes, reverse bool) (core.Iterator, error) {
+	s.db.mutex.RLock()
+	defer s.db.mutex.RUnlock()
+	if s.released {
+		return nil, core.ErrSnapshotReleased
+	}
+
+	var it core.Iterator
+	var err error
+	if len(prefix) == 0 {
+		it, err = s.db.im.Iterator(s.session, false)
+	} else {
+		it, err = s.db.im.PrefixIterator(s.session, prefix, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys []core.Bytes
+	var values []*core.RecordPosition
+	seen := make(map[string]bool)
+	for ; it.Valid(); it.Next() {
+		pos := it.Value()
+		if previous, ok := s.previous[string(it.Key())]; ok {
+			seen[string(it.Key())] = true
+			pos = previous
+		}
+		if pos != nil {
+			keys = append(keys, it.Key())
+			values = append(values, pos)
+		}
+	}
+	// the keys deleted after the snapshot
+	for key, pos := range s.previous {
+		if pos != nil && !seen[key] && bytes.HasPrefix(core.Bytes(key), prefix) {
+			keys = append(keys, core.Bytes(key))
+			values = append(values, pos)
+		}
+	}
+	if s.db.options.Versioned {
+		keys, values, err = s.db.liveKeys(s.session, keys, values)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if reverse {
+			return bytes.Compare(keys[order[i]], keys[order[j]]) > 0
+		}
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	sortedKeys := make([]core.Bytes, len(keys))
+	sortedValues := make([]*core.RecordPosition, len(values))
+	for i, j := range order {
+		sortedKeys[i], sortedValues[i] = keys[j], values[j]
+	}
+	return index.NewSliceIterator(sortedKeys, sortedValues, reverse), nil
+}
+
+// Release the snapshot, the segments merged while the snapshots of the table are open are
+// removed by the last release
+func (s *Snapshot) Release() error {
+	db := s.db
+	db.mutex.Lock()
+	if s.released {
+		db.mutex.Unlock()
+		return nil
+	}
+	s.released = true
+	s.previous = nil
+	delete(db.snapshots[s.session], s)
+	var segments []int64
+	if len(db.snapshots[s.session]) == 0 {
+		segments = db.obsolete[s.session]
+		delete(db.snapshots, s.session)
+		delete(db.obsolete, s.session)
+	}
+	db.mutex.Unlock()
+
+	if len(segments) == 0 {
+		return nil
+	}
+	db.maintenance.Lock()
+	defer db.maintenance.Unlock()
+	for _, segment := range segments {
+		// removed by a later Compact already
+		err := db.sm.RemoveSegment(s.session, segment)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepPrevious save the position of the key into the snapshots of the table before it's changed,
+// the caller holds the write lock
+func (db *Database) keepPrevious(session core.Session, key core.Bytes) error {
+	var current *core.RecordPosition
+	loaded := false
+	for snapshot := range db.snapshots[session] {
+		if _, ok := snapshot.previous[string(key)]; ok {
+			continue
+		}
+		if !loaded {
+			pos, err := db.im.Get(session, key)
+			if err != nil && !errors.Is(err, core.ErrKeyNotFound) {
+				return err
+			}
+			if pos != nil {
+				copied := *pos
+				current = &copied
+			}
+			loaded = true
+		}
+		snapshot.previous[string(key)] = current
+	}
+	return nil
+}
+
+// indexPut put the position of the key into the index, the caller holds the write lock
+func (db *Database) indexPut(session core.Session, key core.Bytes, pos *core.RecordPosition) error {
+	if err := db.keepPrevious(session, key); err != nil {
+		return err
+	}
+	db.txns.touch(session, key)
+	_, err := db.im.Put(session, key, pos)
+	return err
+}
+
+// indexDelete delete the key from the index, the caller holds the write lock
+func (db *Database) indexDelete(session core.Session, key core.Bytes) error {
+	if err := db.keepPrevious(session, key); err != nil {
+		return err
+	}
+	db.txns.touch(session, key)
+	_, err := db.im.Delete(session, key)
+	return err
+}
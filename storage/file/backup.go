@@ -0,0 +1,95 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"BytesDB/utils"
+	"BytesDB/vfs"
+	"io"
+	"os"
+	"path"
+)
+
+// BackupFiles the sealed segments with their hit files, then the active segment up to the
+// current size, the writes are not appended into the backup since they hold the write lock
+func (fio *fileStorage) BackupFiles() ([]core.BackupFile, error) {
+	fio.mutex.RLock()
+	defer fio.mutex.RUnlock()
+
+	var files []core.BackupFile
+	for _, segment := range fio.sealedSegments() {
+		segmentFiles, err := OpenSegmentBackupFiles(fio.fs, fio.dataDir(), segment)
+		if err != nil {
+			CloseBackupFiles(files)
+			return nil, err
+		}
+		files = append(files, segmentFiles...)
+	}
+
+	size, err := fio.size()
+	if err != nil {
+		CloseBackupFiles(files)
+		return nil, err
+	}
+	name := utils.BuildDataFileName(fio.activeSeq)
+	active, err := vfs.Open(fio.fs, path.Join(fio.dataDir(), name))
+	if os.IsNotExist(err) && fio.readOnly {
+		return files, nil
+	}
+	if err != nil {
+		CloseBackupFiles(files)
+		return nil, err
+	}
+	return append(files, core.BackupFile{
+		Name: name,
+		Data: &sectionFile{SectionReader: io.NewSectionReader(active, 0, size), file: active},
+	}), nil
+}
+
+// OpenSegmentBackupFiles open the hit file and the data file of the sealed segment in dir,
+// the hit file is skipped if it's not exists
+func OpenSegmentBackupFiles(fs vfs.FS, dir string, segment int64) ([]core.BackupFile, error) {
+	var files []core.BackupFile
+	for _, name := range []string{utils.BuildHitFileName(segment), utils.BuildDataFileName(segment)} {
+		file, err := vfs.Open(fs, path.Join(dir, name))
+		if os.IsNotExist(err) && name == utils.BuildHitFileName(segment) {
+			continue
+		}
+		if err != nil {
+			CloseBackupFiles(files)
+			return nil, err
+		}
+		files = append(files, core.BackupFile{Name: name, Path: path.Join(dir, name), Data: file})
+	}
+	return files, nil
+}
+
+// CloseBackupFiles close the data of the files
+func CloseBackupFiles(files []core.BackupFile) {
+	for _, file := range files {
+		_ = file.Data.Close()
+	}
+}
+
+// sectionFile the bytes of the active file up to the size of the backup
+type sectionFile struct {
+	*io.SectionReader
+	file vfs.File
+}
+
+func (sf *sectionFile) Close() error {
+	return sf.file.Close()
+}
@@ -0,0 +1,90 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// emptyFile the active file of the table not exists, opened in the read-only mode
+type emptyFile struct {
+	name string
+}
+
+func (ef *emptyFile) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (ef *emptyFile) ReadAt([]byte, int64) (int, error) {
+	return 0, io.EOF
+}
+
+func (ef *emptyFile) Write([]byte) (int, error) {
+	return 0, core.ErrReadOnly
+}
+
+func (ef *emptyFile) WriteAt([]byte, int64) (int, error) {
+	return 0, core.ErrReadOnly
+}
+
+func (ef *emptyFile) Close() error {
+	return nil
+}
+
+func (ef *emptyFile) Name() string {
+	return ef.name
+}
+
+func (ef *emptyFile) Stat() (os.FileInfo, error) {
+	return emptyFileInfo(filepath.Base(ef.name)), nil
+}
+
+func (ef *emptyFile) Sync() error {
+	return nil
+}
+
+func (ef *emptyFile) Truncate(int64) error {
+	return core.ErrReadOnly
+}
+
+type emptyFileInfo string
+
+func (efi emptyFileInfo) Name() string {
+	return string(efi)
+}
+
+func (efi emptyFileInfo) Size() int64 {
+	return 0
+}
+
+func (efi emptyFileInfo) Mode() os.FileMode {
+	return 0444
+}
+
+func (efi emptyFileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (efi emptyFileInfo) IsDir() bool {
+	return false
+}
+
+func (efi emptyFileInfo) Sys() any {
+	return nil
+}
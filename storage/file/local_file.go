@@ -17,7 +17,9 @@ package file
 import (
 	"BytesDB/core"
 	"BytesDB/utils"
+	"BytesDB/vfs"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -27,31 +29,62 @@ import (
 	"sync"
 )
 
-// TODO: shall we check storageId? we are writing active file only
+// defaultMaxSize 1MB
+const defaultMaxSize = 1024 * 1024
 
 // fileStorage FilePerm defines default file permissions (readable by everyone, writable by owner)
 type fileStorage struct {
-	activeFile *os.File
-	oldFiles   []string
-	rootPath   string
-	schema     string
-	tableName  string
-	maxSize    int64
-	mutex      sync.RWMutex
+	fs         vfs.FS
+	activeFile vfs.File
+	activeSeq  int64
+	// file names of the sealed segments, the active file not included
+	oldFiles  []string
+	rootPath  string
+	schema    string
+	tableName string
+	maxSize   int64
+	keys      core.KeyProvider
+	// cipher of the active file, nil if the active file is plain
+	activeCipher *frameCipher
+	activeKeyID  uint32
+	// readers of the sealed segments, opened on the first read
+	sealed   map[int64]*SealedSegment
+	mmap     bool
+	readOnly bool
+	mutex    sync.RWMutex
+}
+
+// Options of the local file storage
+type Options struct {
+	// KeyProvider encrypts the segments created after it's set, nil means plain segments
+	KeyProvider core.KeyProvider
+	// MaxSize the max size of a segment, 1MB if it's not set
+	MaxSize int64
+	// Mmap read the sealed segments by mmap instead of pread, only for the files of the os
+	Mmap bool
+	// FS the file system of the segments, vfs.Default if it's not set
+	FS vfs.FS
+	// ReadOnly open the segments with O_RDONLY, the writes return core.ErrReadOnly,
+	// and the table not exists is opened as an empty one
+	ReadOnly bool
 }
 
 func NewLocalFileStorage(rootPath, schema, table string) (core.Storage, error) {
+	return NewLocalFileStorageWithOptions(rootPath, schema, table, Options{})
+}
+
+func NewLocalFileStorageWithOptions(rootPath, schema, table string, opts Options) (core.Storage, error) {
+	fs := vfs.Or(opts.FS)
 	dir := path.Join(rootPath, schema, table)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err = os.MkdirAll(dir, 0755); err != nil {
-			// TODO: better message
-			panic(err)
+	if !opts.ReadOnly {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return nil, err
 		}
 	}
 
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		panic(err)
+	entries, err := fs.ReadDir(dir)
+	if err != nil && !(opts.ReadOnly && os.IsNotExist(err)) {
+		return nil, err
 	}
 
 	var fileNames []string
@@ -61,10 +94,11 @@ func NewLocalFileStorage(rootPath, schema, table string) (core.Storage, error) {
 		}
 		if strings.HasSuffix(entry.Name(), utils.DataFileSuffix) {
 			fileNames = append(fileNames, entry.Name())
-		} else if strings.HasSuffix(entry.Name(), utils.HitFileSuffix) {
+		} else if strings.HasSuffix(entry.Name(), utils.HitFileSuffix) ||
+			strings.HasSuffix(entry.Name(), utils.IndexFileSuffix) {
 			// skip
 		} else {
-			panic("Unexpected file: " + entry.Name())
+			return nil, fmt.Errorf("unexpected file: %s", entry.Name())
 		}
 	}
 	sort.Strings(fileNames)
@@ -74,60 +108,157 @@ func NewLocalFileStorage(rootPath, schema, table string) (core.Storage, error) {
 		activePath = dir + "/" + utils.BuildDataFileName(0)
 	} else {
 		activePath = dir + "/" + fileNames[len(fileNames)-1]
+		fileNames = fileNames[:len(fileNames)-1]
 	}
-	// note: append mode
-	activeFile, err := os.OpenFile(activePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+	activeFile, err := openActiveFile(fs, activePath, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	// the encryption of a segment is decided when it's created, keep using the
+	// same way as the header of the active file says
+	header, err := readSegmentHeader(activeFile)
+	if err != nil {
+		_ = activeFile.Close()
+		return nil, err
+	}
+	cipher, err := segmentCipher(opts.KeyProvider, header, utils.GetFileSeqNo(activePath))
 	if err != nil {
-		panic(err)
+		_ = activeFile.Close()
+		return nil, err
+	}
+	var keyID uint32
+	if header != nil {
+		keyID = header.keyID
+	}
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
 	}
 
 	return &fileStorage{
-		activeFile: activeFile,
-		oldFiles:   fileNames,
-		rootPath:   rootPath,
-		schema:     schema,
-		tableName:  table,
-		// 1MB
-		maxSize: 1024 * 1024,
-		mutex:   sync.RWMutex{}}, nil
+		fs:           fs,
+		activeFile:   activeFile,
+		activeSeq:    utils.GetFileSeqNo(activePath),
+		oldFiles:     fileNames,
+		rootPath:     rootPath,
+		schema:       schema,
+		tableName:    table,
+		maxSize:      maxSize,
+		keys:         opts.KeyProvider,
+		activeCipher: cipher,
+		activeKeyID:  keyID,
+		sealed:       make(map[int64]*SealedSegment),
+		mmap:         opts.Mmap,
+		readOnly:     opts.ReadOnly,
+		mutex:        sync.RWMutex{}}, nil
 }
 
-func (fio *fileStorage) createAndResetActiveFile() {
-	fio.mutex.Lock()
-	defer fio.mutex.Unlock()
+// openActiveFile the active file is opened in the append mode, or an empty file if it's
+// read-only and the file not exists
+func openActiveFile(fs vfs.FS, activePath string, readOnly bool) (vfs.File, error) {
+	if !readOnly {
+		return fs.OpenFile(activePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+	}
+	activeFile, err := vfs.Open(fs, activePath)
+	if os.IsNotExist(err) {
+		return &emptyFile{name: activePath}, nil
+	}
+	return activeFile, err
+}
 
-	old := fio.activeFile.Name()
-	_ = fio.Flush()
+// createAndResetActiveFile seal the active file and create the segment, note: the caller should
+// hold the lock
+func (fio *fileStorage) createAndResetActiveFile(nextSeq int64) error {
+	old := filepath.Base(fio.activeFile.Name())
+	oldCipher := fio.activeCipher
+	oldKeyID := fio.activeKeyID
+	if err := fio.Flush(); err != nil {
+		return err
+	}
 
-	err := fio.Close()
+	oldSeq := fio.activeSeq
+	activePath := path.Join(fio.rootPath, fio.schema, fio.tableName, utils.BuildDataFileName(nextSeq))
+	// note: append mode
+	activeFile, err := fio.fs.OpenFile(activePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err = fio.activeFile.Close(); err != nil {
+		_ = activeFile.Close()
+		return err
 	}
-
 	fio.oldFiles = append(fio.oldFiles, old)
+	fio.activeFile = activeFile
+	fio.activeSeq = nextSeq
+	// header of the new active file is written by the first write
+	fio.activeCipher = nil
 
-	oldSeq := utils.GetFileSeqNo(old)
-	nextSeq := oldSeq + 1
-	activePath := path.Join(fio.rootPath, fio.schema, fio.tableName, utils.BuildDataFileName(nextSeq))
-	// note: append mode
-	activeFile, err := os.OpenFile(activePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+	return fio.writeHitFile(oldSeq, oldCipher, oldKeyID)
+}
+
+// RotateTo seal the active segment and start the segment, e.g. the replica following the segments
+// of the primary, the empty active segment is removed instead of sealed
+func (fio *fileStorage) RotateTo(segment int64) error {
+	if fio.readOnly {
+		return core.ErrReadOnly
+	}
+	fio.mutex.Lock()
+	defer fio.mutex.Unlock()
+
+	if segment <= fio.activeSeq {
+		return fmt.Errorf("segment %d is not after the active segment %d", segment, fio.activeSeq)
+	}
+	size, err := fio.size()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	if size > 0 {
+		return fio.createAndResetActiveFile(segment)
+	}
+
+	activeFile, err := fio.fs.OpenFile(path.Join(fio.dataDir(), utils.BuildDataFileName(segment)), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+	if err := fio.fs.Remove(path.Join(fio.dataDir(), utils.BuildDataFileName(fio.activeSeq))); err != nil {
+		_ = activeFile.Close()
+		return err
+	}
+	_ = fio.activeFile.Close()
 	fio.activeFile = activeFile
+	fio.activeSeq = segment
+	fio.activeCipher = nil
+	return nil
+}
 
-	// write hit file
+// writeHitFile the keys and positions of the live records in the sealed segment
+func (fio *fileStorage) writeHitFile(segment int64, cipher *frameCipher, keyID uint32) error {
 	oldIt := &PositionIterator{
-		files:   []string{old},
-		dataDir: path.Join(fio.rootPath, fio.schema, fio.tableName),
+		scanner: newSegmentScanner(fio.openSegment, []int64{segment}, fio.keys, core.ScanOptions{}),
 	}
 
-	hitPath := path.Join(fio.rootPath, fio.schema, fio.tableName, utils.BuildHitFileName(oldSeq))
-	hitFile, err := os.OpenFile(hitPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+	hitPath := path.Join(fio.rootPath, fio.schema, fio.tableName, utils.BuildHitFileName(segment))
+	hitFile, err := fio.fs.OpenFile(hitPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer hitFile.Close()
+	stat, err := hitFile.Stat()
+	if err != nil {
+		return err
+	}
+	offset := stat.Size()
+
+	// hit file of an encrypted segment is encrypted with the same key
+	if cipher != nil {
+		header := &segmentHeader{version: segmentVersion, encrypted: true, keyID: keyID}
+		if _, err := hitFile.Write(header.pack()); err != nil {
+			return err
+		}
+		offset += segmentHeaderSize
+		cipher = cipher.hitCipher()
+	}
 
 	// TODO: save it in index
 	hits := make(map[string]core.RecordPosition)
@@ -137,7 +268,7 @@ func (fio *fileStorage) createAndResetActiveFile() {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return err
 		}
 		if typ == core.Deleted {
 			delete(hits, string(key))
@@ -164,141 +295,348 @@ func (fio *fileStorage) createAndResetActiveFile() {
 		n = binary.PutVarint(buf[index:], int64(v.Size))
 		index += n
 
-		_, err := hitFile.Write(buf[:index])
-		if err != nil {
-			panic(err)
+		entry := buf[:index]
+		if cipher != nil {
+			entry, err = sealFrame(cipher, entry, offset)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := hitFile.Write(entry); err != nil {
+			return err
 		}
+		offset += int64(len(entry))
 	}
+	return nil
 }
 
+// Read for the encrypted segment, the buf should cover the whole written frame,
+// and the decrypted bytes are placed at buf[:n]
 func (fio *fileStorage) Read(buf core.Bytes, offset int64) (int, error) {
-	return fio.activeFile.ReadAt(buf, offset)
+	fio.mutex.RLock()
+	defer fio.mutex.RUnlock()
+	return fio.readActive(buf, offset)
+}
+
+func (fio *fileStorage) readActive(buf core.Bytes, offset int64) (int, error) {
+	if fio.activeCipher == nil {
+		return fio.activeFile.ReadAt(buf, offset)
+	}
+	return readFrame(fio.activeFile, fio.activeCipher, buf, offset)
+}
+
+func (fio *fileStorage) ReadSegment(buf core.Bytes, segment int64, offset int64) (int, error) {
+	fio.mutex.RLock()
+	if segment == fio.activeSeq {
+		defer fio.mutex.RUnlock()
+		return fio.readActive(buf, offset)
+	}
+	sealed, ok := fio.sealed[segment]
+	fio.mutex.RUnlock()
+
+	if !ok {
+		var err error
+		if sealed, err = fio.openSealed(segment); err != nil {
+			return 0, err
+		}
+	}
+
+	fio.mutex.RLock()
+	defer fio.mutex.RUnlock()
+	return sealed.ReadAt(buf, offset)
+}
+
+// View the bytes of the sealed segment mapped into the memory are passed to fn without copying,
+// the bytes must not be retained after fn returns, they are unmapped when the storage closed
+func (fio *fileStorage) View(segment int64, offset int64, size int, fn func(core.Bytes) error) error {
+	fio.mutex.RLock()
+	sealed, ok := fio.sealed[segment]
+	fio.mutex.RUnlock()
+	if !ok && segment != fio.ActiveSegment() {
+		var err error
+		if sealed, err = fio.openSealed(segment); err != nil {
+			return err
+		}
+	}
+
+	if sealed != nil && sealed.cipher == nil {
+		fio.mutex.RLock()
+		defer fio.mutex.RUnlock()
+		if mr, ok := sealed.reader.(*mmapReader); ok {
+			bts, err := mr.slice(offset, size)
+			if err != nil {
+				return err
+			}
+			return fn(bts)
+		}
+	}
+
+	buf := make(core.Bytes, size)
+	n, err := fio.ReadSegment(buf, segment, offset)
+	if err != nil {
+		return err
+	}
+	return fn(buf[:n])
+}
+
+func (fio *fileStorage) ActiveSegment() int64 {
+	fio.mutex.RLock()
+	defer fio.mutex.RUnlock()
+	return fio.activeSeq
+}
+
+func (fio *fileStorage) openSealed(segment int64) (*SealedSegment, error) {
+	fio.mutex.Lock()
+	defer fio.mutex.Unlock()
+	if sealed, ok := fio.sealed[segment]; ok {
+		return sealed, nil
+	}
+	if segment >= fio.activeSeq {
+		return nil, os.ErrNotExist
+	}
+
+	file, err := fio.openSegment(segment)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := openSealedSegment(file, segment, fio.keys, fio.mmap)
+	if err != nil {
+		return nil, err
+	}
+	fio.sealed[segment] = sealed
+	return sealed, nil
+}
+
+// openSegment open the data file of the segment for reading
+func (fio *fileStorage) openSegment(segment int64) (vfs.File, error) {
+	if fio.readOnly && segment == fio.activeSeq {
+		if empty, ok := fio.activeFile.(*emptyFile); ok {
+			return empty, nil
+		}
+	}
+	return vfs.Open(fio.fs, path.Join(fio.dataDir(), utils.BuildDataFileName(segment)))
+}
+
+func readFrame(file io.ReaderAt, cipher *frameCipher, buf core.Bytes, offset int64) (int, error) {
+	frame := make(core.Bytes, len(buf))
+	n, err := file.ReadAt(frame, offset)
+	if err != nil && (err != io.EOF || n < len(frame)) {
+		return 0, err
+	}
+	plain, err := openFrame(cipher, frame, offset)
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, plain), nil
 }
 
+// Write for the encrypted segment, the buf is sealed as one frame and
+// return the size of the frame
 func (fio *fileStorage) Write(buf core.Bytes) (int, error) {
-	size, err := fio.Size()
+	if fio.readOnly {
+		return 0, core.ErrReadOnly
+	}
+	fio.mutex.Lock()
+	defer fio.mutex.Unlock()
+
+	size, err := fio.size()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	if size+int64(len(buf)) > fio.maxSize {
-		err := fio.Flush()
-		if err != nil {
-			// TODO
-			panic(err)
+	// rotate if the active file is full, a record larger than the max size is written into
+	// an empty active file
+	if size > 0 && size+fio.encodedSize(buf) > fio.maxSize {
+		if err := fio.createAndResetActiveFile(fio.activeSeq + 1); err != nil {
+			return 0, err
 		}
-		err = fio.Flush()
-		if err != nil {
-			panic(err)
+		size = 0
+	}
+
+	if size == 0 && fio.keys != nil {
+		if err := fio.writeSegmentHeader(); err != nil {
+			return 0, err
 		}
-		fio.createAndResetActiveFile()
+		size = segmentHeaderSize
 	}
 
-	return fio.activeFile.Write(buf)
+	data := buf
+	if fio.activeCipher != nil {
+		if data, err = sealFrame(fio.activeCipher, buf, size); err != nil {
+			return 0, err
+		}
+	}
+	return fio.append(data, size)
+}
+
+// append the bytes to the active file of the size, the bytes written partially are truncated,
+// so the later records are not appended after a torn record
+func (fio *fileStorage) append(data core.Bytes, size int64) (int, error) {
+	n, err := fio.activeFile.Write(data)
+	if err != nil {
+		if n > 0 {
+			_ = fio.activeFile.Truncate(size)
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+func (fio *fileStorage) encodedSize(buf core.Bytes) int64 {
+	if fio.activeCipher == nil {
+		return int64(len(buf))
+	}
+	return int64(fio.activeCipher.overhead() + len(buf))
+}
+
+// writeSegmentHeader start a new encrypted segment with the current key
+func (fio *fileStorage) writeSegmentHeader() error {
+	header := &segmentHeader{
+		version:   segmentVersion,
+		encrypted: true,
+		keyID:     fio.keys.CurrentKeyID(),
+	}
+	cipher, err := segmentCipher(fio.keys, header, fio.activeSeq)
+	if err != nil {
+		return err
+	}
+	if _, err := fio.append(header.pack(), 0); err != nil {
+		return err
+	}
+	fio.activeCipher = cipher
+	fio.activeKeyID = header.keyID
+	return nil
 }
 
 func (fio *fileStorage) Flush() error {
+	if fio.readOnly {
+		return nil
+	}
 	return fio.activeFile.Sync()
 }
 
 func (fio *fileStorage) Close() error {
+	fio.mutex.Lock()
+	defer fio.mutex.Unlock()
+	for seq, sealed := range fio.sealed {
+		_ = sealed.Close()
+		delete(fio.sealed, seq)
+	}
 	return fio.activeFile.Close()
 }
 
+// PositionIterator iterate the sealed segments and then the active one
 func (fio *fileStorage) PositionIterator() (core.PositionIterator, error) {
-	return &PositionIterator{
-		files:   fio.oldFiles,
-		dataDir: path.Join(fio.rootPath, fio.schema, fio.tableName),
-	}, nil
-}
-
-func (fio *fileStorage) Size() (int64, error) {
-	stat, err := fio.activeFile.Stat()
+	scanner, err := fio.Scan(core.ScanOptions{})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return stat.Size(), nil
+	return &PositionIterator{scanner: scanner.(*segmentScanner)}, nil
 }
 
-func (fio *fileStorage) RemoveAll() error {
-	path := path.Join(fio.rootPath, fio.schema, fio.tableName)
-	return os.RemoveAll(path)
+func (fio *fileStorage) Scan(opts core.ScanOptions) (core.RecordScanner, error) {
+	segments := opts.Segments
+	if segments == nil {
+		fio.mutex.RLock()
+		segments = append(fio.sealedSegments(), fio.activeSeq)
+		fio.mutex.RUnlock()
+	}
+	return newSegmentScanner(fio.openSegment, segments, fio.keys, opts), nil
 }
 
-func (fio *fileStorage) CleanAll(id core.Session) error {
-	tableLocation := path.Join(fio.rootPath, id.Schema, id.Table)
-	return os.RemoveAll(tableLocation)
+func (fio *fileStorage) SealedSegments() []int64 {
+	fio.mutex.RLock()
+	defer fio.mutex.RUnlock()
+	return fio.sealedSegments()
 }
 
-type PositionIterator struct {
-	index   int
-	pos     int
-	files   []string
-	dataDir string
-	cur     *os.File
+func (fio *fileStorage) sealedSegments() []int64 {
+	segments := make([]int64, 0, len(fio.oldFiles))
+	for _, name := range fio.oldFiles {
+		segments = append(segments, utils.GetFileSeqNo(name))
+	}
+	return segments
 }
 
-// TODO: support read single file
-func (fpi *PositionIterator) Next() (*core.RecordPosition, core.Bytes, core.RecordType, error) {
-	if fpi.index >= len(fpi.files) {
-		return nil, nil, core.Deleted, io.EOF
+// RemoveSegment the data and hit file of the sealed segment are removed
+func (fio *fileStorage) RemoveSegment(segment int64) error {
+	if fio.readOnly {
+		return core.ErrReadOnly
 	}
+	fio.mutex.Lock()
+	defer fio.mutex.Unlock()
 
-	if fpi.cur == nil {
-		file, err := os.Open(filepath.Join(fpi.dataDir, fpi.files[fpi.index]))
-		if err != nil {
-			return nil, nil, core.Deleted, err
+	name := utils.BuildDataFileName(segment)
+	idx := -1
+	for i, old := range fio.oldFiles {
+		if old == name {
+			idx = i
+			break
 		}
-		fpi.cur = file
-		fpi.pos = 0
-	}
-
-	pos := fpi.pos
-	stat, err := fpi.cur.Stat()
-	if err != nil {
-		panic(err)
 	}
-	if int64(pos+5) >= stat.Size() {
-		fpi.index += 1
-		fpi.cur = nil
-		return fpi.Next()
+	if idx < 0 {
+		return os.ErrNotExist
 	}
 
-	// Read the data
-	buf := make(core.Bytes, core.MaxLogRecordHeaderSize)
-	n, err := fpi.cur.ReadAt(buf, int64(pos))
-	if err != nil && err != io.EOF {
-		return nil, nil, core.Deleted, err
+	if sealed, ok := fio.sealed[segment]; ok {
+		_ = sealed.Close()
+		delete(fio.sealed, segment)
 	}
+	fio.oldFiles = append(fio.oldFiles[:idx:idx], fio.oldFiles[idx+1:]...)
 
-	if n > 0 {
-		// decode buf[:n]
-		// [0,4) crc
-		// 4 type
-		// [4, x) keySize
-		// [x, y) valueSize
-		typ := core.RecordType(buf[4])
+	if err := fio.fs.Remove(path.Join(fio.dataDir(), name)); err != nil {
+		return err
+	}
+	err := fio.fs.Remove(path.Join(fio.dataDir(), utils.BuildHitFileName(segment)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
 
-		index := 5
-		keySize, n := binary.Varint(buf[index:])
-		index += n
-		valueSize, n := binary.Varint(buf[index:])
-		index += n
+func (fio *fileStorage) dataDir() string {
+	return path.Join(fio.rootPath, fio.schema, fio.tableName)
+}
 
-		buf = make(core.Bytes, keySize)
-		_, err := fpi.cur.ReadAt(buf, int64(pos+index))
-		if err != nil {
-			return nil, nil, core.Deleted, err
-		}
+func (fio *fileStorage) Size() (int64, error) {
+	fio.mutex.RLock()
+	defer fio.mutex.RUnlock()
+	return fio.size()
+}
 
-		index += int(keySize) + int(valueSize)
+func (fio *fileStorage) size() (int64, error) {
+	stat, err := fio.activeFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
 
-		fpi.pos += index
+func (fio *fileStorage) RemoveAll() error {
+	if fio.readOnly {
+		return core.ErrReadOnly
+	}
+	path := path.Join(fio.rootPath, fio.schema, fio.tableName)
+	return fio.fs.RemoveAll(path)
+}
 
-		return &core.RecordPosition{
-			Position: int64(pos),
-			Size:     index,
-		}, buf, typ, nil
+func (fio *fileStorage) CleanAll(id core.Session) error {
+	if fio.readOnly {
+		return core.ErrReadOnly
 	}
+	tableLocation := path.Join(fio.rootPath, id.Schema, id.Table)
+	return fio.fs.RemoveAll(tableLocation)
+}
+
+// PositionIterator iterate the positions and keys of the records, the values are skipped
+type PositionIterator struct {
+	scanner *segmentScanner
+}
 
-	return nil, nil, core.Deleted, io.EOF
+func (fpi *PositionIterator) Next() (*core.RecordPosition, core.Bytes, core.RecordType, error) {
+	pos, record, err := fpi.scanner.Next()
+	if err != nil {
+		_ = fpi.scanner.Close()
+		return nil, nil, core.Deleted, err
+	}
+	return pos, record.Key, record.Type, nil
 }
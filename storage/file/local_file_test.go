@@ -16,8 +16,14 @@ package file
 
 import (
 	"BytesDB/core"
+	"BytesDB/encryption"
+	"BytesDB/vfs"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
+	"path"
+	"strconv"
+	"syscall"
 	"testing"
 )
 
@@ -189,3 +195,395 @@ func TestFileIO_Flush(t *testing.T) {
 	assert.Equal(t, len(bs), r)
 	assert.Equal(t, bs, buf)
 }
+
+func TestFileIO_Encrypted_Read_Write(t *testing.T) {
+	fileName := "/tmp/local-file-encrypted-test"
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+
+	record := &core.Record{Key: core.Bytes("hello"), Value: core.Bytes("world"), Type: core.Normal}
+	bs := record.Pack()
+	n, err := f.Write(bs)
+	assert.Nil(t, err)
+	// frame size covers the length prefix, nonce and tag
+	assert.True(t, n > len(bs))
+	size, err := f.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(segmentHeaderSize+n), size)
+
+	buf := make(core.Bytes, n)
+	r, err := f.Read(buf, size-int64(n))
+	assert.Nil(t, err)
+	assert.Equal(t, bs, buf[:r])
+
+	// nothing in plain on disk
+	err = f.Flush()
+	assert.Nil(t, err)
+	raw, err := os.ReadFile(path.Join(fileName, "public", "test", "         0.data"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(raw), "hello")
+	assert.NotContains(t, string(raw), "world")
+
+	// the key of the records can be iterated after reopening
+	err = f.Close()
+	assert.Nil(t, err)
+	f, err = NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+	it, err := f.PositionIterator()
+	assert.Nil(t, err)
+	pos, key, typ, err := it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("hello"), key)
+	assert.Equal(t, core.Normal, typ)
+	assert.Equal(t, int64(segmentHeaderSize), pos.Position)
+	assert.Equal(t, n, pos.Size)
+	_, _, _, err = it.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFileIO_Encrypted_Key_Rotation(t *testing.T) {
+	fileName := "/tmp/local-file-encrypted-rotation-test"
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+
+	bs := (&core.Record{Key: core.Bytes("hello"), Value: core.Bytes("world"), Type: core.Normal}).Pack()
+	n, err := f.Write(bs)
+	assert.Nil(t, err)
+	err = f.Close()
+	assert.Nil(t, err)
+
+	// rotated key only applies to the new segments, the existing one keeps key 1
+	err = kp.Rotate(2, core.Bytes("fedcba9876543210"))
+	assert.Nil(t, err)
+	f, err = NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+	buf := make(core.Bytes, n)
+	r, err := f.Read(buf, segmentHeaderSize)
+	assert.Nil(t, err)
+	assert.Equal(t, bs, buf[:r])
+	err = f.Close()
+	assert.Nil(t, err)
+
+	// the key of the segment is unknown
+	another, err := encryption.NewStaticKeyProvider(2, core.Bytes("fedcba9876543210"))
+	assert.Nil(t, err)
+	_, err = NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: another})
+	assert.Equal(t, core.ErrUnknownKeyID, err)
+	_, err = NewLocalFileStorage(fileName, "public", "test")
+	assert.Equal(t, core.ErrUnknownKeyID, err)
+}
+
+func TestFileIO_Encrypted_Tampered(t *testing.T) {
+	fileName := "/tmp/local-file-encrypted-tampered-test"
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+
+	n, err := f.Write(core.Bytes("hello world"))
+	assert.Nil(t, err)
+	err = f.Close()
+	assert.Nil(t, err)
+
+	dataFile := path.Join(fileName, "public", "test", "         0.data")
+	raw, err := os.ReadFile(dataFile)
+	assert.Nil(t, err)
+	raw[len(raw)-1] ^= 1
+	err = os.WriteFile(dataFile, raw, 0755)
+	assert.Nil(t, err)
+
+	f, err = NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+	buf := make(core.Bytes, n)
+	_, err = f.Read(buf, segmentHeaderSize)
+	assert.Equal(t, core.ErrDecryptFailed, err)
+}
+
+func TestFileIO_Encrypted_Frame_Moved(t *testing.T) {
+	fileName := "/tmp/local-file-encrypted-moved-test"
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+
+	n, err := f.Write(core.Bytes("first"))
+	assert.Nil(t, err)
+	_, err = f.Write(core.Bytes("other"))
+	assert.Nil(t, err)
+	err = f.Close()
+	assert.Nil(t, err)
+
+	// the frames of the same size are swapped
+	dataFile := path.Join(fileName, "public", "test", "         0.data")
+	raw, err := os.ReadFile(dataFile)
+	assert.Nil(t, err)
+	swapped := append(core.Bytes{}, raw[:segmentHeaderSize]...)
+	swapped = append(swapped, raw[segmentHeaderSize+n:]...)
+	swapped = append(swapped, raw[segmentHeaderSize:segmentHeaderSize+n]...)
+	err = os.WriteFile(dataFile, swapped, 0755)
+	assert.Nil(t, err)
+
+	f, err = NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+	buf := make(core.Bytes, n)
+	_, err = f.Read(buf, segmentHeaderSize)
+	assert.Equal(t, core.ErrDecryptFailed, err)
+	err = f.Close()
+	assert.Nil(t, err)
+
+	// the segment file is replayed as another segment
+	err = os.WriteFile(dataFile, raw, 0755)
+	assert.Nil(t, err)
+	file, err := os.Open(dataFile)
+	assert.Nil(t, err)
+	sealed, err := OpenSealedSegment(file, 1, kp)
+	assert.Nil(t, err)
+	defer sealed.Close()
+	_, err = sealed.ReadAt(buf, segmentHeaderSize)
+	assert.Equal(t, core.ErrDecryptFailed, err)
+}
+
+func TestFileIO_Encrypted_Version1(t *testing.T) {
+	fileName := "/tmp/local-file-encrypted-version1-test"
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(fileName)
+	})
+
+	// the frames of the segments written before version 2 have no additional data
+	header := &segmentHeader{version: 1, encrypted: true, keyID: 1}
+	cipher, err := segmentCipher(kp, header, 0)
+	assert.Nil(t, err)
+	assert.False(t, cipher.bound)
+	frame, err := sealFrame(cipher, core.Bytes("hello world"), segmentHeaderSize)
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(path.Join(fileName, "public", "test"), 0755))
+	err = os.WriteFile(path.Join(fileName, "public", "test", "         0.data"), append(header.pack(), frame...), 0755)
+	assert.Nil(t, err)
+
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp})
+	assert.Nil(t, err)
+	defer f.Close()
+	buf := make(core.Bytes, len(frame))
+	r, err := f.Read(buf, segmentHeaderSize)
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("hello world"), buf[:r])
+}
+
+func TestFileIO_Rotate_Read_Sealed(t *testing.T) {
+	testRotateReadSealed(t, false)
+	testRotateReadSealed(t, true)
+}
+
+func testRotateReadSealed(t *testing.T, mmap bool) {
+	fileName := "/tmp/local-file-rotate-test-" + strconv.FormatBool(mmap)
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{MaxSize: 64, Mmap: mmap})
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+
+	var positions []*core.RecordPosition
+	var records []core.Bytes
+	for i := 0; i < 20; i++ {
+		bs := (&core.Record{Key: core.Bytes{byte(i)}, Value: core.Bytes("value of the key"), Type: core.Normal}).Pack()
+		n, err := f.Write(bs)
+		assert.Nil(t, err)
+		size, err := f.Size()
+		assert.Nil(t, err)
+		positions = append(positions, &core.RecordPosition{Segment: f.ActiveSegment(), Position: size - int64(n), Size: n})
+		records = append(records, bs)
+	}
+	assert.True(t, f.ActiveSegment() > 0)
+	_, err = os.Stat(path.Join(fileName, "public", "test", "         0.hit"))
+	assert.Nil(t, err)
+
+	for i, pos := range positions {
+		buf := make(core.Bytes, pos.Size)
+		n, err := f.ReadSegment(buf, pos.Segment, pos.Position)
+		assert.Nil(t, err)
+		assert.Equal(t, records[i], buf[:n])
+
+		err = f.(core.SegmentViewer).View(pos.Segment, pos.Position, pos.Size, func(bts core.Bytes) error {
+			assert.Equal(t, records[i], bts)
+			return nil
+		})
+		assert.Nil(t, err)
+	}
+
+	// iterate all segments after reopening
+	err = f.Close()
+	assert.Nil(t, err)
+	f, err = NewLocalFileStorageWithOptions(fileName, "public", "test", Options{MaxSize: 64, Mmap: mmap})
+	assert.Nil(t, err)
+	it, err := f.PositionIterator()
+	assert.Nil(t, err)
+	for i := 0; ; i++ {
+		pos, key, _, err := it.Next()
+		if err == io.EOF {
+			assert.Equal(t, len(positions), i)
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes{byte(i)}, key)
+		assert.Equal(t, positions[i], pos)
+	}
+}
+
+func scanKeys(t *testing.T, f core.Storage) []string {
+	scanner, err := f.Scan(core.ScanOptions{VerifyCRC: true})
+	assert.Nil(t, err)
+	defer scanner.Close()
+	var keys []string
+	for {
+		_, record, err := scanner.Next()
+		if err == io.EOF {
+			return keys
+		}
+		assert.Nil(t, err)
+		keys = append(keys, string(record.Key))
+	}
+}
+
+func TestFileIO_MemFS(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	rootPath := "/tmp/local-file-memfs-test"
+	f, err := NewLocalFileStorageWithOptions(rootPath, "public", "test", Options{MaxSize: 256, FS: mfs})
+	assert.Nil(t, err)
+	records := writeRecords(t, f, 50)
+	assert.True(t, len(f.SealedSegments()) > 1)
+	assert.Nil(t, f.Close())
+
+	_, err = os.Stat(rootPath)
+	assert.True(t, os.IsNotExist(err))
+
+	f, err = NewLocalFileStorageWithOptions(rootPath, "public", "test", Options{MaxSize: 256, FS: mfs})
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.Equal(t, len(records), len(scanKeys(t, f)))
+}
+
+func TestFileIO_RotateTo(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	rootPath := "/tmp/local-file-rotate-test"
+	f, err := NewLocalFileStorageWithOptions(rootPath, "public", "test", Options{FS: mfs})
+	assert.Nil(t, err)
+	// the empty active segment is removed
+	assert.Nil(t, f.(core.ReplicaStorage).RotateTo(5))
+	assert.Equal(t, int64(5), f.ActiveSegment())
+	assert.Equal(t, 0, len(f.SealedSegments()))
+	records := writeRecords(t, f, 10)
+	assert.Nil(t, f.(core.ReplicaStorage).RotateTo(7))
+	assert.NotNil(t, f.(core.ReplicaStorage).RotateTo(7))
+	assert.Equal(t, []int64{5}, f.SealedSegments())
+	assert.Nil(t, f.Close())
+
+	f, err = NewLocalFileStorageWithOptions(rootPath, "public", "test", Options{FS: mfs})
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.Equal(t, int64(7), f.ActiveSegment())
+	assert.Equal(t, len(records), len(scanKeys(t, f)))
+}
+
+func TestFileIO_Torn_Write(t *testing.T) {
+	ffs := vfs.NewFaultFS(vfs.NewMemFS())
+	f, err := NewLocalFileStorageWithOptions("/tmp/local-file-torn-test", "public", "test", Options{FS: ffs})
+	assert.Nil(t, err)
+	defer f.Close()
+	writeRecords(t, f, 5)
+
+	// the disk is full in the middle of the record
+	ffs.Inject(vfs.Fault{Op: vfs.OpWrite, Suffix: ".data", Err: syscall.ENOSPC, Partial: 3})
+	_, err = f.Write((&core.Record{Key: core.Bytes("torn"), Value: core.Bytes("value")}).Pack())
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+
+	// the records written after the space is freed are not appended after the torn one
+	ffs.Reset()
+	writeRecords(t, f, 5)
+	keys := scanKeys(t, f)
+	assert.Equal(t, 10, len(keys))
+	assert.NotContains(t, keys, "torn")
+}
+
+func TestFileIO_Sync_Failure_On_Rotation(t *testing.T) {
+	ffs := vfs.NewFaultFS(vfs.NewMemFS())
+	f, err := NewLocalFileStorageWithOptions("/tmp/local-file-sync-test", "public", "test", Options{MaxSize: 256, FS: ffs})
+	assert.Nil(t, err)
+	defer f.Close()
+
+	ffs.Inject(vfs.Fault{Op: vfs.OpSync, Err: syscall.EIO})
+	record := (&core.Record{Key: core.Bytes("key"), Value: core.Bytes("value")}).Pack()
+	for err == nil {
+		_, err = f.Write(record)
+	}
+	assert.ErrorIs(t, err, syscall.EIO)
+	// the active segment is kept when it's not synced
+	assert.Equal(t, 0, len(f.SealedSegments()))
+
+	ffs.Reset()
+	_, err = f.Write(record)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(f.SealedSegments()))
+}
+
+func TestFileIO_Read_Only(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	rootPath := "/tmp/local-file-read-only-test"
+	f, err := NewLocalFileStorageWithOptions(rootPath, "public", "test", Options{MaxSize: 256, FS: mfs})
+	assert.Nil(t, err)
+	records := writeRecords(t, f, 50)
+	assert.Nil(t, f.Close())
+	entries, err := mfs.ReadDir(path.Join(rootPath, "public", "test"))
+	assert.Nil(t, err)
+
+	f, err = NewLocalFileStorageWithOptions(rootPath, "public", "test", Options{MaxSize: 256, FS: mfs, ReadOnly: true})
+	assert.Nil(t, err)
+	_, err = f.Write(records[0].Pack())
+	assert.Equal(t, core.ErrReadOnly, err)
+	assert.Equal(t, core.ErrReadOnly, f.RemoveSegment(f.SealedSegments()[0]))
+	assert.Equal(t, core.ErrReadOnly, f.RemoveAll())
+	assert.Equal(t, len(records), len(scanKeys(t, f)))
+	assert.Nil(t, f.Flush())
+	assert.Nil(t, f.Close())
+	after, err := mfs.ReadDir(path.Join(rootPath, "public", "test"))
+	assert.Nil(t, err)
+	assert.Equal(t, entries, after)
+
+	// the table not exists is empty, and it's not created
+	f, err = NewLocalFileStorageWithOptions(rootPath, "public", "empty", Options{FS: mfs, ReadOnly: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(scanKeys(t, f)))
+	size, err := f.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+	assert.Nil(t, f.Close())
+	_, err = mfs.Stat(path.Join(rootPath, "public", "empty"))
+	assert.True(t, os.IsNotExist(err))
+}
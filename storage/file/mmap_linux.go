@@ -0,0 +1,78 @@
+//go:build linux
+
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"io"
+	"os"
+	"syscall"
+)
+
+// mmapReader reads the sealed segment mapped into the memory,
+// it's only used for the sealed segments since they are immutable
+type mmapReader struct {
+	data core.Bytes
+}
+
+// newMmapReader the file is closed after mapping, the mapping keeps valid until Close
+func newMmapReader(file *os.File) (segmentReader, error) {
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return &mmapReader{}, nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapReader{data: data}, nil
+}
+
+func (mr *mmapReader) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= int64(len(mr.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, mr.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// slice return the bytes of the mapping without copying
+func (mr *mmapReader) slice(offset int64, size int) (core.Bytes, error) {
+	if offset < 0 || size < 0 || offset+int64(size) > int64(len(mr.data)) {
+		return nil, io.EOF
+	}
+	return mr.data[offset : offset+int64(size) : offset+int64(size)], nil
+}
+
+func (mr *mmapReader) Close() error {
+	if mr.data == nil {
+		return nil
+	}
+	data := mr.data
+	mr.data = nil
+	return syscall.Munmap(data)
+}
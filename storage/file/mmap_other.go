@@ -0,0 +1,41 @@
+//go:build !linux
+
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"os"
+)
+
+// mmapReader mmap is only supported on linux, fallback to read the file,
+// so the sealed segments are read the same way on all the platforms
+type mmapReader struct {
+	*os.File
+}
+
+func newMmapReader(file *os.File) (segmentReader, error) {
+	return &mmapReader{File: file}, nil
+}
+
+// slice the bytes are copied out of the file, instead of the mapped bytes on linux
+func (mr *mmapReader) slice(offset int64, size int) (core.Bytes, error) {
+	buf := make(core.Bytes, size)
+	if _, err := mr.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
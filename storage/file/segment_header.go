@@ -0,0 +1,165 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"BytesDB/encryption"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// segment header is only written to the segments created with encryption enabled,
+// plain segments start with the first record directly
+// [0,4) magic
+// 4 version
+// 5 flags
+// [6,8) reserved
+// [8,12) key id
+// [12,16) crc of [0,12)
+const segmentHeaderSize = 16
+
+// segmentVersion the frames are bound to the segment and their offsets since version 2,
+// the frames of version 1 are sealed without the additional data
+const segmentVersion = 2
+
+const (
+	segmentFlagEncrypted byte = 1 << iota
+)
+
+var segmentMagic = core.Bytes("BKVS")
+
+// frameLenSize the size prefix of an encrypted frame, a frame is [len, nonce, ciphertext, tag]
+const frameLenSize = 4
+
+// the kind of the file a frame is written to, it's a part of the additional data
+const (
+	frameKindData byte = iota
+	frameKindHit
+)
+
+type segmentHeader struct {
+	version   byte
+	encrypted bool
+	keyID     uint32
+}
+
+func (sh *segmentHeader) pack() core.Bytes {
+	buf := make(core.Bytes, segmentHeaderSize)
+	copy(buf, segmentMagic)
+	buf[4] = sh.version
+	if sh.encrypted {
+		buf[5] |= segmentFlagEncrypted
+	}
+	binary.LittleEndian.PutUint32(buf[8:12], sh.keyID)
+	binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(buf[:12]))
+	return buf
+}
+
+// readSegmentHeader return nil header if the file has no segment header
+func readSegmentHeader(file io.ReaderAt) (*segmentHeader, error) {
+	buf := make(core.Bytes, segmentHeaderSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < segmentHeaderSize || buf[:4].Compare(segmentMagic) != 0 {
+		return nil, nil
+	}
+	if binary.LittleEndian.Uint32(buf[12:]) != crc32.ChecksumIEEE(buf[:12]) {
+		return nil, core.ErrCorruptedRecord
+	}
+	return &segmentHeader{
+		version:   buf[4],
+		encrypted: buf[5]&segmentFlagEncrypted != 0,
+		keyID:     binary.LittleEndian.Uint32(buf[8:12]),
+	}, nil
+}
+
+// frameCipher seals the frames of a segment, the frame is bound to the segment and its offset by
+// the additional data of GCM, so the frames swapped or replayed at another place are not opened
+type frameCipher struct {
+	aead    *encryption.AESGCM
+	segment int64
+	kind    byte
+	// false for the segments of version 1
+	bound bool
+}
+
+// segmentCipher resolve the cipher of a segment header, nil if the segment is plain
+func segmentCipher(keys core.KeyProvider, header *segmentHeader, segment int64) (*frameCipher, error) {
+	if header == nil || !header.encrypted {
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, core.ErrUnknownKeyID
+	}
+	key, err := keys.Key(header.keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := encryption.NewAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{aead: aead, segment: segment, kind: frameKindData, bound: header.version >= 2}, nil
+}
+
+// hitCipher the cipher of the hit file of the segment, it's always written with the current version
+func (fc *frameCipher) hitCipher() *frameCipher {
+	return &frameCipher{aead: fc.aead, segment: fc.segment, kind: frameKindHit, bound: true}
+}
+
+// overhead the extra bytes of a frame compare to the plain data
+func (fc *frameCipher) overhead() int {
+	return frameLenSize + fc.aead.Overhead()
+}
+
+// additional [kind, segment, offset] of the frame
+func (fc *frameCipher) additional(offset int64) core.Bytes {
+	if !fc.bound {
+		return nil
+	}
+	buf := make(core.Bytes, 17)
+	buf[0] = fc.kind
+	binary.LittleEndian.PutUint64(buf[1:9], uint64(fc.segment))
+	binary.LittleEndian.PutUint64(buf[9:], uint64(offset))
+	return buf
+}
+
+// sealFrame the frame written at the offset of the file
+func sealFrame(cipher *frameCipher, plain core.Bytes, offset int64) (core.Bytes, error) {
+	sealed, err := cipher.aead.SealWith(plain, cipher.additional(offset))
+	if err != nil {
+		return nil, err
+	}
+	frame := make(core.Bytes, frameLenSize+len(sealed))
+	binary.LittleEndian.PutUint32(frame, uint32(len(sealed)))
+	copy(frame[frameLenSize:], sealed)
+	return frame, nil
+}
+
+// openFrame the frame read at the offset of the file
+func openFrame(cipher *frameCipher, frame core.Bytes, offset int64) (core.Bytes, error) {
+	if len(frame) < frameLenSize {
+		return nil, core.ErrDecryptFailed
+	}
+	size := int(binary.LittleEndian.Uint32(frame))
+	if frameLenSize+size != len(frame) {
+		return nil, core.ErrDecryptFailed
+	}
+	return cipher.aead.OpenWith(frame[frameLenSize:], cipher.additional(offset))
+}
@@ -0,0 +1,81 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"BytesDB/vfs"
+	"io"
+	"os"
+)
+
+// segmentReader reads the sealed segment, it's the *os.File by default or
+// the mmapReader if the mmap is enabled
+type segmentReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// SealedSegment the rotated segment, it's immutable
+type SealedSegment struct {
+	reader segmentReader
+	cipher *frameCipher
+}
+
+// OpenSealedSegment read the records of the sealed segment file, e.g. the one moved out of
+// the table directory, the file is closed with the segment. the segment must be the one the
+// file is written as, the frames of an encrypted segment are bound to it
+func OpenSealedSegment(file vfs.File, segment int64, keys core.KeyProvider) (*SealedSegment, error) {
+	return openSealedSegment(file, segment, keys, false)
+}
+
+// openSealedSegment the file is mapped into the memory if mmap is true and it's a file of the os
+func openSealedSegment(file vfs.File, segment int64, keys core.KeyProvider, mmap bool) (*SealedSegment, error) {
+	header, err := readSegmentHeader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	cipher, err := segmentCipher(keys, header, segment)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	var reader segmentReader = file
+	if osFile, ok := file.(*os.File); ok && mmap {
+		if reader, err = newMmapReader(osFile); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return &SealedSegment{
+		reader: reader,
+		cipher: cipher,
+	}, nil
+}
+
+// ReadAt same as core.Storage ReadSegment, the frame of the encrypted segment is decrypted
+// into buf[:n]
+func (ss *SealedSegment) ReadAt(buf core.Bytes, offset int64) (int, error) {
+	if ss.cipher == nil {
+		return ss.reader.ReadAt(buf, offset)
+	}
+	return readFrame(ss.reader, ss.cipher, buf, offset)
+}
+
+func (ss *SealedSegment) Close() error {
+	return ss.reader.Close()
+}
@@ -0,0 +1,243 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"BytesDB/vfs"
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// scanBufferSize large sequential reads instead of a ReadAt for each record
+const scanBufferSize = 1 << 20
+
+// minRecordSize crc, type and the sizes of the empty key and value
+const minRecordSize = 4 + 1 + 1 + 1
+
+// segmentScanner reads the segment files sequentially through a buffer, the file is
+// only stat once when it's opened, the incomplete record at the tail is skipped
+type segmentScanner struct {
+	open     SegmentOpener
+	segments []int64
+	opts     core.ScanOptions
+	keys     core.KeyProvider
+
+	index   int
+	file    vfs.File
+	reader  *bufio.Reader
+	cipher  *frameCipher
+	segment int64
+	pos     int64
+	size    int64
+}
+
+// SegmentOpener open the data file of the segment for reading
+type SegmentOpener func(segment int64) (vfs.File, error)
+
+// NewSegmentScanner scan the segment files opened by open, e.g. the segments moved out of
+// the table directory
+func NewSegmentScanner(open SegmentOpener, segments []int64, keys core.KeyProvider, opts core.ScanOptions) core.RecordScanner {
+	return newSegmentScanner(open, segments, keys, opts)
+}
+
+func newSegmentScanner(open SegmentOpener, segments []int64, keys core.KeyProvider, opts core.ScanOptions) *segmentScanner {
+	return &segmentScanner{
+		open:     open,
+		segments: segments,
+		opts:     opts,
+		keys:     keys,
+	}
+}
+
+func (ss *segmentScanner) Next() (*core.RecordPosition, *core.Record, error) {
+	for {
+		if ss.file == nil {
+			if ss.index >= len(ss.segments) {
+				return nil, nil, io.EOF
+			}
+			if err := ss.openFile(ss.segments[ss.index]); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		var pos *core.RecordPosition
+		var record *core.Record
+		var err error
+		if ss.cipher != nil {
+			pos, record, err = ss.nextFrame()
+		} else {
+			pos, record, err = ss.nextRecord()
+		}
+		if err == io.EOF {
+			// next segment
+			ss.closeFile()
+			ss.index++
+			continue
+		}
+		return pos, record, err
+	}
+}
+
+func (ss *segmentScanner) openFile(segment int64) error {
+	file, err := ss.open(segment)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	header, err := readSegmentHeader(file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	cipher, err := segmentCipher(ss.keys, header, segment)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if ss.reader == nil {
+		ss.reader = bufio.NewReaderSize(file, scanBufferSize)
+	} else {
+		ss.reader.Reset(file)
+	}
+	ss.file = file
+	ss.cipher = cipher
+	ss.segment = segment
+	ss.size = stat.Size()
+	ss.pos = 0
+	if header != nil {
+		if _, err := ss.reader.Discard(segmentHeaderSize); err != nil {
+			return err
+		}
+		ss.pos = segmentHeaderSize
+	}
+	return nil
+}
+
+// nextRecord return io.EOF at the end of the segment
+func (ss *segmentScanner) nextRecord() (*core.RecordPosition, *core.Record, error) {
+	if ss.size-ss.pos < minRecordSize {
+		return nil, nil, io.EOF
+	}
+
+	// [0,4) crc, 4 type, [5, x) keySize, [x, y) valueSize
+	peek, err := ss.reader.Peek(int(min(int64(core.MaxLogRecordHeaderSize), ss.size-ss.pos)))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	header, headerSize := core.BytesToHeader(peek)
+	recordSize := int64(headerSize) + int64(header.KeySize) + int64(header.ValueSize)
+	if ss.pos+recordSize > ss.size {
+		// the record is not written completely
+		return nil, nil, io.EOF
+	}
+
+	crc := crc32.ChecksumIEEE(peek[4:headerSize])
+	if _, err := ss.reader.Discard(headerSize); err != nil {
+		return nil, nil, err
+	}
+	key := make(core.Bytes, header.KeySize)
+	if _, err := io.ReadFull(ss.reader, key); err != nil {
+		return nil, nil, err
+	}
+
+	var value core.Bytes
+	if ss.opts.WithValue || ss.opts.VerifyCRC {
+		value = make(core.Bytes, header.ValueSize)
+		if _, err := io.ReadFull(ss.reader, value); err != nil {
+			return nil, nil, err
+		}
+	} else if _, err := ss.reader.Discard(int(header.ValueSize)); err != nil {
+		return nil, nil, err
+	}
+
+	if ss.opts.VerifyCRC {
+		crc = crc32.Update(crc, crc32.IEEETable, key)
+		crc = crc32.Update(crc, crc32.IEEETable, value)
+		if crc != header.Crc {
+			return nil, nil, core.ErrCorruptedRecord
+		}
+	}
+	if !ss.opts.WithValue {
+		value = nil
+	}
+
+	pos := &core.RecordPosition{
+		Segment:  ss.segment,
+		Position: ss.pos,
+		Size:     int(recordSize),
+	}
+	ss.pos += recordSize
+	return pos, &core.Record{Key: key, Value: value, Type: header.Typ}, nil
+}
+
+// nextFrame the whole frame is read and decrypted, the crc is always verified
+func (ss *segmentScanner) nextFrame() (*core.RecordPosition, *core.Record, error) {
+	if ss.size-ss.pos <= frameLenSize {
+		return nil, nil, io.EOF
+	}
+	lenBuf, err := ss.reader.Peek(frameLenSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	frameSize := int64(frameLenSize) + int64(binary.LittleEndian.Uint32(lenBuf))
+	if ss.pos+frameSize > ss.size {
+		return nil, nil, io.EOF
+	}
+
+	frame := make(core.Bytes, frameSize)
+	if _, err := io.ReadFull(ss.reader, frame); err != nil {
+		return nil, nil, err
+	}
+	plain, err := openFrame(ss.cipher, frame, ss.pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	record, err := core.DecodeRecord(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ss.opts.WithValue {
+		record.Value = nil
+	}
+
+	pos := &core.RecordPosition{
+		Segment:  ss.segment,
+		Position: ss.pos,
+		Size:     int(frameSize),
+	}
+	ss.pos += frameSize
+	return pos, record, nil
+}
+
+func (ss *segmentScanner) closeFile() {
+	if ss.file != nil {
+		_ = ss.file.Close()
+		ss.file = nil
+	}
+}
+
+func (ss *segmentScanner) Close() error {
+	ss.closeFile()
+	ss.index = len(ss.segments)
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"BytesDB/core"
+	"BytesDB/encryption"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func writeRecords(t testing.TB, f core.Storage, n int) []*core.Record {
+	var records []*core.Record
+	for i := 0; i < n; i++ {
+		record := &core.Record{
+			Key:   core.Bytes("key" + strconv.Itoa(i)),
+			Value: core.Bytes("value" + strconv.Itoa(i)),
+			Type:  core.Normal,
+		}
+		if i%10 == 9 {
+			record.Type = core.Deleted
+		}
+		_, err := f.Write(record.Pack())
+		assert.Nil(t, err)
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestSegmentScanner_Next(t *testing.T) {
+	fileName := "/tmp/segment-scanner-test"
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{MaxSize: 256})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+	records := writeRecords(t, f, 50)
+	assert.True(t, len(f.SealedSegments()) > 1)
+
+	for _, opts := range []core.ScanOptions{{}, {WithValue: true}, {VerifyCRC: true}, {WithValue: true, VerifyCRC: true}} {
+		scanner, err := f.Scan(opts)
+		assert.Nil(t, err)
+		for i := 0; ; i++ {
+			pos, record, err := scanner.Next()
+			if err == io.EOF {
+				assert.Equal(t, len(records), i)
+				break
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, records[i].Key, record.Key)
+			assert.Equal(t, records[i].Type, record.Type)
+			assert.Equal(t, int(records[i].Pack().Size()), pos.Size)
+			if opts.WithValue {
+				assert.Equal(t, records[i].Value, record.Value)
+			} else {
+				assert.Nil(t, record.Value)
+			}
+		}
+		assert.Nil(t, scanner.Close())
+	}
+
+	// only the given segments
+	sealed := f.SealedSegments()
+	scanner, err := f.Scan(core.ScanOptions{Segments: sealed[1:2]})
+	assert.Nil(t, err)
+	pos, _, err := scanner.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, sealed[1], pos.Segment)
+	assert.Equal(t, int64(0), pos.Position)
+}
+
+func TestSegmentScanner_Corrupted(t *testing.T) {
+	fileName := "/tmp/segment-scanner-corrupted-test"
+	f, err := NewLocalFileStorage(fileName, "public", "test")
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+	records := writeRecords(t, f, 2)
+	assert.Nil(t, f.Close())
+
+	dataFile := path.Join(fileName, "public", "test", "         0.data")
+	raw, err := os.ReadFile(dataFile)
+	assert.Nil(t, err)
+	// flip the last byte of the value of the second record, and append a torn record
+	raw[len(raw)-1] ^= 1
+	raw = append(raw, records[0].Pack()[:10]...)
+	assert.Nil(t, os.WriteFile(dataFile, raw, 0755))
+
+	f, err = NewLocalFileStorage(fileName, "public", "test")
+	assert.Nil(t, err)
+
+	// the key only scanning not aware of the corrupted value, and the torn record is skipped
+	scanner, err := f.Scan(core.ScanOptions{})
+	assert.Nil(t, err)
+	count := 0
+	for _, _, err := scanner.Next(); err != io.EOF; _, _, err = scanner.Next() {
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 2, count)
+
+	scanner, err = f.Scan(core.ScanOptions{VerifyCRC: true})
+	assert.Nil(t, err)
+	_, _, err = scanner.Next()
+	assert.Nil(t, err)
+	_, _, err = scanner.Next()
+	assert.Equal(t, core.ErrCorruptedRecord, err)
+}
+
+func TestSegmentScanner_Encrypted(t *testing.T) {
+	fileName := "/tmp/segment-scanner-encrypted-test"
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{KeyProvider: kp, MaxSize: 256})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+	records := writeRecords(t, f, 20)
+
+	scanner, err := f.Scan(core.ScanOptions{WithValue: true})
+	assert.Nil(t, err)
+	for i := 0; ; i++ {
+		_, record, err := scanner.Next()
+		if err == io.EOF {
+			assert.Equal(t, len(records), i)
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, records[i], record)
+	}
+}
+
+// benchmarkTableSize the size of the table scanned by the benchmarks, set BYTESDB_BENCH_TABLE_SIZE
+// for the larger tables, e.g. BYTESDB_BENCH_TABLE_SIZE=4294967296 for 4GB
+func benchmarkTableSize() int64 {
+	if size, err := strconv.ParseInt(os.Getenv("BYTESDB_BENCH_TABLE_SIZE"), 10, 64); err == nil {
+		return size
+	}
+	return 64 * 1024 * 1024
+}
+
+func BenchmarkSegmentScanner(b *testing.B) {
+	fileName := "/tmp/segment-scanner-bench"
+	f, err := NewLocalFileStorageWithOptions(fileName, "public", "test", Options{MaxSize: 64 * 1024 * 1024})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		f.Close()
+		os.RemoveAll(fileName)
+	})
+
+	value := make(core.Bytes, 100)
+	var written int64
+	for i := 0; written < benchmarkTableSize(); i++ {
+		n, err := f.Write((&core.Record{Key: core.Bytes(strconv.Itoa(i)), Value: value}).Pack())
+		if err != nil {
+			b.Fatal(err)
+		}
+		written += int64(n)
+	}
+
+	for _, bc := range []struct {
+		name string
+		opts core.ScanOptions
+	}{
+		{"KeyOnly", core.ScanOptions{}},
+		{"VerifyCRC", core.ScanOptions{VerifyCRC: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(written)
+			for i := 0; i < b.N; i++ {
+				scanner, _ := f.Scan(bc.opts)
+				for _, _, err := scanner.Next(); err != io.EOF; _, _, err = scanner.Next() {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
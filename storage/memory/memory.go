@@ -0,0 +1,261 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"BytesDB/core"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Options of the memory storage
+type Options struct {
+	// MaxSize the max size of a segment, 1MB if it's not set
+	MaxSize int64
+}
+
+// memoryStorage keeps the segments in memory, in the same layout as the plain local file segments,
+// the data is dropped when it's closed
+type memoryStorage struct {
+	mutex     sync.RWMutex
+	maxSize   int64
+	segments  map[int64]core.Bytes
+	activeSeq int64
+}
+
+func NewMemoryStorage(opts Options) core.Storage {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 1024 * 1024
+	}
+	return &memoryStorage{
+		maxSize:  opts.MaxSize,
+		segments: map[int64]core.Bytes{0: nil},
+	}
+}
+
+func (ms *memoryStorage) Read(buf core.Bytes, offset int64) (int, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return readAt(ms.segments[ms.activeSeq], buf, offset)
+}
+
+func (ms *memoryStorage) ReadSegment(buf core.Bytes, segment int64, offset int64) (int, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	data, ok := ms.segments[segment]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return readAt(data, buf, offset)
+}
+
+// readAt the same as io.ReaderAt, io.EOF if the buf is not filled
+func readAt(data, buf core.Bytes, offset int64) (int, error) {
+	if offset < 0 || offset > int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// View the bytes are shared with the storage, they're valid after the fn returns as well,
+// since the written bytes are never changed
+func (ms *memoryStorage) View(segment int64, offset int64, size int, fn func(core.Bytes) error) error {
+	ms.mutex.RLock()
+	data, ok := ms.segments[segment]
+	ms.mutex.RUnlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	if offset < 0 || offset+int64(size) > int64(len(data)) {
+		return io.EOF
+	}
+	return fn(data[offset : offset+int64(size) : offset+int64(size)])
+}
+
+func (ms *memoryStorage) ActiveSegment() int64 {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.activeSeq
+}
+
+func (ms *memoryStorage) Write(buf core.Bytes) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	active := ms.segments[ms.activeSeq]
+	if len(active) > 0 && int64(len(active)+len(buf)) > ms.maxSize {
+		ms.activeSeq++
+		active = nil
+	}
+	ms.segments[ms.activeSeq] = append(active, buf...)
+	return len(buf), nil
+}
+
+func (ms *memoryStorage) Flush() error {
+	return nil
+}
+
+func (ms *memoryStorage) Close() error {
+	return ms.RemoveAll()
+}
+
+func (ms *memoryStorage) Size() (int64, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return int64(len(ms.segments[ms.activeSeq])), nil
+}
+
+func (ms *memoryStorage) RemoveAll() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.segments = map[int64]core.Bytes{ms.activeSeq: nil}
+	return nil
+}
+
+func (ms *memoryStorage) PositionIterator() (core.PositionIterator, error) {
+	scanner, err := ms.Scan(core.ScanOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &positionIterator{scanner: scanner}, nil
+}
+
+func (ms *memoryStorage) Scan(opts core.ScanOptions) (core.RecordScanner, error) {
+	segments := opts.Segments
+	if segments == nil {
+		ms.mutex.RLock()
+		segments = append(ms.sealedSegments(), ms.activeSeq)
+		ms.mutex.RUnlock()
+	}
+	return &scanner{storage: ms, segments: segments, opts: opts}, nil
+}
+
+func (ms *memoryStorage) SealedSegments() []int64 {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.sealedSegments()
+}
+
+func (ms *memoryStorage) sealedSegments() []int64 {
+	segments := make([]int64, 0, len(ms.segments))
+	for segment := range ms.segments {
+		if segment != ms.activeSeq {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments
+}
+
+func (ms *memoryStorage) RemoveSegment(segment int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.segments[segment]; !ok || segment == ms.activeSeq {
+		return os.ErrNotExist
+	}
+	delete(ms.segments, segment)
+	return nil
+}
+
+// scanner scans the bytes of the segments at the time it reaches them
+type scanner struct {
+	storage  *memoryStorage
+	segments []int64
+	opts     core.ScanOptions
+	segment  int64
+	data     core.Bytes
+	pos      int64
+}
+
+func (s *scanner) Next() (*core.RecordPosition, *core.Record, error) {
+	for {
+		if s.data != nil && s.pos < int64(len(s.data)) {
+			return s.next()
+		}
+		if len(s.segments) == 0 {
+			return nil, nil, io.EOF
+		}
+		s.segment, s.segments = s.segments[0], s.segments[1:]
+		s.storage.mutex.RLock()
+		s.data = s.storage.segments[s.segment]
+		s.storage.mutex.RUnlock()
+		s.pos = 0
+	}
+}
+
+func (s *scanner) next() (*core.RecordPosition, *core.Record, error) {
+	header, headerSize := core.BytesToHeader(s.data[s.pos:])
+	size := int64(headerSize) + int64(header.KeySize) + int64(header.ValueSize)
+	if s.pos+size > int64(len(s.data)) {
+		return nil, nil, core.ErrCorruptedRecord
+	}
+
+	var record *core.Record
+	if s.opts.VerifyCRC {
+		decoded, err := core.DecodeRecord(s.data[s.pos : s.pos+size])
+		if err != nil {
+			return nil, nil, err
+		}
+		record = decoded
+	} else {
+		keyEnd := s.pos + int64(headerSize) + int64(header.KeySize)
+		record = &core.Record{
+			Key:   s.data[s.pos+int64(headerSize) : keyEnd],
+			Value: s.data[keyEnd : s.pos+size],
+			Type:  header.Typ,
+		}
+	}
+	// the bytes of the storage are not handed out
+	record.Key = append(core.Bytes{}, record.Key...)
+	if s.opts.WithValue {
+		record.Value = append(core.Bytes{}, record.Value...)
+	} else {
+		record.Value = nil
+	}
+
+	pos := &core.RecordPosition{
+		Segment:  s.segment,
+		Position: s.pos,
+		Size:     int(size),
+	}
+	s.pos += size
+	return pos, record, nil
+}
+
+func (s *scanner) Close() error {
+	s.segments = nil
+	s.data = nil
+	return nil
+}
+
+type positionIterator struct {
+	scanner core.RecordScanner
+}
+
+func (pi *positionIterator) Next() (*core.RecordPosition, core.Bytes, core.RecordType, error) {
+	pos, record, err := pi.scanner.Next()
+	if err != nil {
+		return nil, nil, core.Deleted, err
+	}
+	return pos, record.Key, record.Type, nil
+}
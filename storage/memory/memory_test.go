@@ -0,0 +1,102 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"BytesDB/core"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestMemoryStorage_Write_Read(t *testing.T) {
+	ms := NewMemoryStorage(Options{})
+
+	n, err := ms.Write(core.Bytes("hello world"))
+	assert.Nil(t, err)
+	assert.Equal(t, 11, n)
+	size, _ := ms.Size()
+	assert.Equal(t, int64(11), size)
+
+	buf := make(core.Bytes, 5)
+	n, err = ms.Read(buf, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("world"), buf[:n])
+	n, err = ms.ReadSegment(buf, 0, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, core.Bytes("rld"), buf[:n])
+	_, err = ms.ReadSegment(buf, 1, 0)
+	assert.Equal(t, os.ErrNotExist, err)
+
+	assert.Nil(t, ms.Close())
+	size, _ = ms.Size()
+	assert.Equal(t, int64(0), size)
+}
+
+func TestMemoryStorage_Rotate_Scan(t *testing.T) {
+	ms := NewMemoryStorage(Options{MaxSize: 100})
+
+	var positions []*core.RecordPosition
+	for i := 0; i < 100; i++ {
+		record := &core.Record{Key: core.Bytes(strconv.Itoa(i)), Value: core.Bytes("value" + strconv.Itoa(i))}
+		if i%10 == 0 {
+			record.Type = core.Deleted
+		}
+		n, err := ms.Write(record.Pack())
+		assert.Nil(t, err)
+		size, _ := ms.Size()
+		positions = append(positions, &core.RecordPosition{Segment: ms.ActiveSegment(), Position: size - int64(n), Size: n})
+	}
+	sealed := ms.SealedSegments()
+	assert.Greater(t, len(sealed), 10)
+	assert.Equal(t, sealed[len(sealed)-1]+1, ms.ActiveSegment())
+
+	scanner, err := ms.Scan(core.ScanOptions{WithValue: true, VerifyCRC: true})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		pos, record, err := scanner.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, positions[i], pos)
+		assert.Equal(t, core.Bytes(strconv.Itoa(i)), record.Key)
+		assert.Equal(t, core.Bytes("value"+strconv.Itoa(i)), record.Value)
+		assert.Equal(t, i%10 == 0, record.Type == core.Deleted)
+	}
+	_, _, err = scanner.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// the records are read by the positions
+	for i, pos := range positions {
+		buf := make(core.Bytes, pos.Size)
+		_, err := ms.ReadSegment(buf, pos.Segment, pos.Position)
+		assert.Nil(t, err)
+		record, err := core.DecodeRecord(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, core.Bytes(strconv.Itoa(i)), record.Key)
+	}
+
+	assert.Nil(t, ms.RemoveSegment(sealed[0]))
+	assert.Equal(t, os.ErrNotExist, ms.RemoveSegment(sealed[0]))
+	assert.Equal(t, os.ErrNotExist, ms.RemoveSegment(ms.ActiveSegment()))
+	assert.Equal(t, sealed[1:], ms.SealedSegments())
+
+	pi, err := ms.PositionIterator()
+	assert.Nil(t, err)
+	pos, key, _, err := pi.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, sealed[1], pos.Segment)
+	assert.NotNil(t, key)
+}
@@ -0,0 +1,171 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package object
+
+import (
+	"BytesDB/core"
+	"BytesDB/storage/file"
+	"BytesDB/utils"
+	"BytesDB/vfs"
+	"container/list"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// segmentCache the segments fetched from the object store are kept in the local directory,
+// the least recently used ones are removed when the count of the segments exceeds the capacity.
+// the reads of the cached segments are serialized, the fetched segments are the cold data
+type segmentCache struct {
+	fs       vfs.FS
+	dir      string
+	capacity int
+	keys     core.KeyProvider
+	fetch    func(segment int64) (io.ReadCloser, error)
+
+	segments map[int64]*list.Element
+	lru      *list.List
+	mutex    sync.Mutex
+}
+
+type cachedSegment struct {
+	segment int64
+	sealed  *file.SealedSegment
+}
+
+// newSegmentCache the segments cached before are removed, the cache is rebuilt by the reads
+func newSegmentCache(fs vfs.FS, dir string, capacity int, keys core.KeyProvider, fetch func(int64) (io.ReadCloser, error)) (*segmentCache, error) {
+	if err := fs.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &segmentCache{
+		fs:       fs,
+		dir:      dir,
+		capacity: capacity,
+		keys:     keys,
+		fetch:    fetch,
+		segments: make(map[int64]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+func (sc *segmentCache) read(buf core.Bytes, segment int64, offset int64) (int, error) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	cached, err := sc.get(segment)
+	if err != nil {
+		return 0, err
+	}
+	return cached.sealed.ReadAt(buf, offset)
+}
+
+// open the cached file of the segment, the opened file is still readable after it's evicted
+func (sc *segmentCache) open(segment int64) (vfs.File, error) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if _, err := sc.get(segment); err != nil {
+		return nil, err
+	}
+	return vfs.Open(sc.fs, sc.path(segment))
+}
+
+// get the cached segment, it's fetched if it's not cached, the caller holds the lock
+func (sc *segmentCache) get(segment int64) (*cachedSegment, error) {
+	if elem, ok := sc.segments[segment]; ok {
+		sc.lru.MoveToFront(elem)
+		return elem.Value.(*cachedSegment), nil
+	}
+
+	if err := sc.download(segment); err != nil {
+		return nil, err
+	}
+	segmentFile, err := vfs.Open(sc.fs, sc.path(segment))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := file.OpenSealedSegment(segmentFile, segment, sc.keys)
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedSegment{segment: segment, sealed: sealed}
+	sc.segments[segment] = sc.lru.PushFront(cached)
+	for sc.lru.Len() > sc.capacity {
+		sc.evict(sc.lru.Back().Value.(*cachedSegment).segment)
+	}
+	return cached, nil
+}
+
+// download the segment into a temporary file then rename it
+func (sc *segmentCache) download(segment int64) error {
+	reader, err := sc.fetch(segment)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tmpPath := sc.path(segment) + uploadingSuffix
+	tmp, err := sc.fs.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = sc.fs.Remove(tmpPath)
+		return err
+	}
+	return sc.fs.Rename(tmpPath, sc.path(segment))
+}
+
+// evict close and remove the cached segment, the caller holds the lock
+func (sc *segmentCache) evict(segment int64) {
+	elem, ok := sc.segments[segment]
+	if !ok {
+		return
+	}
+	_ = elem.Value.(*cachedSegment).sealed.Close()
+	sc.lru.Remove(elem)
+	delete(sc.segments, segment)
+	_ = sc.fs.Remove(sc.path(segment))
+}
+
+func (sc *segmentCache) remove(segment int64) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.evict(segment)
+}
+
+func (sc *segmentCache) removeAll() error {
+	sc.close()
+	return sc.fs.RemoveAll(sc.dir)
+}
+
+func (sc *segmentCache) close() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	for segment := range sc.segments {
+		sc.evict(segment)
+	}
+}
+
+func (sc *segmentCache) path(segment int64) string {
+	return path.Join(sc.dir, utils.BuildDataFileName(segment))
+}
@@ -0,0 +1,123 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package object
+
+import (
+	"BytesDB/core"
+	"BytesDB/vfs"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// uploadingSuffix the object is written into the temporary file then renamed,
+// so a partial object is never visible
+const uploadingSuffix = ".uploading"
+
+// DirObjectStore keeps the objects as the files of a directory, the "/" of the names are
+// the sub directories, it's the stand-in of the S3-compatible storage for the offline use
+type DirObjectStore struct {
+	fs  vfs.FS
+	dir string
+}
+
+// NewDirObjectStore the fs is vfs.Default if it's nil
+func NewDirObjectStore(fs vfs.FS, dir string) *DirObjectStore {
+	return &DirObjectStore{
+		fs:  vfs.Or(fs),
+		dir: dir,
+	}
+}
+
+func (ds *DirObjectStore) Put(name string, data io.Reader) error {
+	objectPath := path.Join(ds.dir, name)
+	if err := ds.fs.MkdirAll(path.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+	tmpPath := objectPath + uploadingSuffix
+	file, err := ds.fs.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = ds.fs.Remove(tmpPath)
+		return err
+	}
+	return ds.fs.Rename(tmpPath, objectPath)
+}
+
+func (ds *DirObjectStore) Get(name string) (io.ReadCloser, error) {
+	file, err := vfs.Open(ds.fs, path.Join(ds.dir, name))
+	if os.IsNotExist(err) {
+		return nil, core.ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (ds *DirObjectStore) Delete(name string) error {
+	err := ds.fs.Remove(path.Join(ds.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ds *DirObjectStore) List(prefix string) ([]string, error) {
+	var names []string
+	if err := ds.list("", prefix, &names); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// list the objects of the sub directory, the directories not matching the prefix are skipped
+func (ds *DirObjectStore) list(dir, prefix string, names *[]string) error {
+	entries, err := ds.fs.ReadDir(path.Join(ds.dir, dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if dir != "" {
+			name = dir + "/" + name
+		}
+		if entry.IsDir() {
+			if strings.HasPrefix(name+"/", prefix) || strings.HasPrefix(prefix, name+"/") {
+				if err := ds.list(name, prefix, names); err != nil {
+					return err
+				}
+			}
+		} else if strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, uploadingSuffix) {
+			*names = append(*names, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,438 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package object
+
+import (
+	"BytesDB/core"
+	"BytesDB/storage/file"
+	"BytesDB/utils"
+	"BytesDB/vfs"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Options struct {
+	// File options of the local storage keeping the active segment
+	File file.Options
+	// Store the sealed segments are uploaded to
+	Store core.ObjectStore
+	// CacheDir the directory of the segments fetched from the store, <rootPath>/.object-cache
+	// if it's not set, the fetched segments are written into it even the storage is read-only
+	CacheDir string
+	// CacheSegments the max count of the fetched segments kept in the cache, 16 if it's not set
+	CacheSegments int
+}
+
+const (
+	defaultCacheDir      = ".object-cache"
+	defaultCacheSegments = 16
+)
+
+// objectStorage keeps the active segment in the local storage, the segments are uploaded
+// to the object store once they are sealed and removed locally, the positions of the records
+// are not changed so the index is not aware of where the segment is
+type objectStorage struct {
+	local  core.Storage
+	fs     vfs.FS
+	store  core.ObjectStore
+	prefix string
+	dir    string
+	cache  *segmentCache
+	// the segments in the object store
+	remote    map[int64]bool
+	activeSeq int64
+	// nothing is uploaded or removed if it's read-only
+	readOnly bool
+	// serialize the offloads, the uploads are not holding the mutex
+	offloadMutex sync.Mutex
+	mutex        sync.RWMutex
+
+	// the sealed segments are offloaded in the background once the worker is woken by
+	// the rotation, the error of the last offload is returned by Flush
+	offloadErr  error
+	wakeOffload chan struct{}
+	closing     chan struct{}
+	closeOnce   sync.Once
+	worker      sync.WaitGroup
+}
+
+func NewObjectStorage(rootPath, schema, table string, opts Options) (core.Storage, error) {
+	fs := vfs.Or(opts.File.FS)
+	if opts.CacheDir == "" {
+		opts.CacheDir = path.Join(rootPath, defaultCacheDir)
+	}
+	if opts.CacheSegments <= 0 {
+		opts.CacheSegments = defaultCacheSegments
+	}
+	obs := &objectStorage{
+		fs:          fs,
+		store:       opts.Store,
+		prefix:      schema + "/" + table + "/",
+		dir:         path.Join(rootPath, schema, table),
+		remote:      make(map[int64]bool),
+		readOnly:    opts.File.ReadOnly,
+		wakeOffload: make(chan struct{}, 1),
+		closing:     make(chan struct{}),
+	}
+
+	names, err := opts.Store.List(obs.prefix)
+	if err != nil {
+		return nil, err
+	}
+	maxRemote := int64(-1)
+	for _, name := range names {
+		if strings.HasSuffix(name, utils.DataFileSuffix) {
+			segment := utils.GetFileSeqNo(name)
+			obs.remote[segment] = true
+			maxRemote = max(maxRemote, segment)
+		}
+	}
+	if err := obs.ensureActive(maxRemote); err != nil {
+		return nil, err
+	}
+
+	if obs.local, err = file.NewLocalFileStorageWithOptions(rootPath, schema, table, opts.File); err != nil {
+		return nil, err
+	}
+	obs.activeSeq = obs.local.ActiveSegment()
+	obs.cache, err = newSegmentCache(fs, path.Join(opts.CacheDir, schema, table), opts.CacheSegments, opts.File.KeyProvider, obs.fetch)
+	if err != nil {
+		_ = obs.local.Close()
+		return nil, err
+	}
+	if !obs.readOnly {
+		obs.worker.Add(1)
+		go obs.offloadLoop()
+		// the segments sealed but not uploaded before closing
+		obs.wake()
+	}
+	return obs, nil
+}
+
+// offloadLoop offload the sealed segments each time it's woken until the storage is closed,
+// the failed ones are retried by the next rotation or Flush
+func (obs *objectStorage) offloadLoop() {
+	defer obs.worker.Done()
+	for {
+		select {
+		case <-obs.wakeOffload:
+			_ = obs.offload()
+		case <-obs.closing:
+			return
+		}
+	}
+}
+
+// wake the offload worker without waiting, the wakeups are merged while it's offloading
+func (obs *objectStorage) wake() {
+	select {
+	case obs.wakeOffload <- struct{}{}:
+	default:
+	}
+}
+
+// ensureActive the local active segment must be after the uploaded ones, an empty one is
+// created if the local directory is lost
+func (obs *objectStorage) ensureActive(maxRemote int64) error {
+	if maxRemote < 0 || obs.readOnly {
+		return nil
+	}
+	if err := obs.fs.MkdirAll(obs.dir, 0755); err != nil {
+		return err
+	}
+	entries, err := obs.fs.ReadDir(obs.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), utils.DataFileSuffix) && utils.GetFileSeqNo(entry.Name()) > maxRemote {
+			return nil
+		}
+	}
+	active, err := obs.fs.OpenFile(path.Join(obs.dir, utils.BuildDataFileName(maxRemote+1)), os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	return active.Close()
+}
+
+// offload upload the local sealed segments and remove them locally, the segment is read
+// locally until it's uploaded. The error is recorded for Flush
+func (obs *objectStorage) offload() error {
+	if obs.readOnly {
+		return nil
+	}
+	obs.offloadMutex.Lock()
+	defer obs.offloadMutex.Unlock()
+
+	err := obs.offloadSealed()
+	obs.mutex.Lock()
+	obs.offloadErr = err
+	obs.mutex.Unlock()
+	return err
+}
+
+func (obs *objectStorage) offloadSealed() error {
+	for _, segment := range obs.local.SealedSegments() {
+		obs.mutex.RLock()
+		uploaded := obs.remote[segment]
+		obs.mutex.RUnlock()
+		// uploaded but not removed locally before closing
+		if !uploaded {
+			if err := obs.upload(segment); err != nil {
+				return err
+			}
+		}
+
+		obs.mutex.Lock()
+		obs.remote[segment] = true
+		err := obs.local.RemoveSegment(segment)
+		obs.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload the hit file then the data file, the segment is in the store once the data file is uploaded
+func (obs *objectStorage) upload(segment int64) error {
+	for _, name := range []string{utils.BuildHitFileName(segment), utils.BuildDataFileName(segment)} {
+		file, err := vfs.Open(obs.fs, path.Join(obs.dir, name))
+		if os.IsNotExist(err) && name == utils.BuildHitFileName(segment) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = obs.store.Put(obs.prefix+name, file)
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (obs *objectStorage) fetch(segment int64) (io.ReadCloser, error) {
+	return obs.store.Get(obs.prefix + utils.BuildDataFileName(segment))
+}
+
+func (obs *objectStorage) isRemote(segment int64) bool {
+	obs.mutex.RLock()
+	defer obs.mutex.RUnlock()
+	return obs.remote[segment]
+}
+
+func (obs *objectStorage) Read(buf core.Bytes, offset int64) (int, error) {
+	return obs.local.Read(buf, offset)
+}
+
+func (obs *objectStorage) ReadSegment(buf core.Bytes, segment int64, offset int64) (int, error) {
+	obs.mutex.RLock()
+	if !obs.remote[segment] {
+		// the segment is not removed locally while reading it
+		defer obs.mutex.RUnlock()
+		return obs.local.ReadSegment(buf, segment, offset)
+	}
+	obs.mutex.RUnlock()
+	return obs.cache.read(buf, segment, offset)
+}
+
+func (obs *objectStorage) ActiveSegment() int64 {
+	return obs.local.ActiveSegment()
+}
+
+// Write the sealed segment is uploaded in the background after the rotation, the write is
+// not failed or blocked by the upload, it's retried by the next rotation or Flush
+func (obs *objectStorage) Write(buf core.Bytes) (int, error) {
+	n, err := obs.local.Write(buf)
+	if err != nil {
+		return n, err
+	}
+	obs.mutex.Lock()
+	active := obs.local.ActiveSegment()
+	rotated := active != obs.activeSeq
+	obs.activeSeq = active
+	obs.mutex.Unlock()
+	if rotated && !obs.readOnly {
+		obs.wake()
+	}
+	return n, nil
+}
+
+// Flush the active segment, the sealed segments failed to upload before are retried in the
+// background, the error of the last offload is returned until one succeeds
+func (obs *objectStorage) Flush() error {
+	if err := obs.local.Flush(); err != nil {
+		return err
+	}
+	obs.mutex.RLock()
+	err := obs.offloadErr
+	obs.mutex.RUnlock()
+	if err != nil && !obs.readOnly {
+		obs.wake()
+	}
+	return err
+}
+
+// Close stop the offload worker, the segments not uploaded yet are offloaded when it's
+// opened again
+func (obs *objectStorage) Close() error {
+	obs.closeOnce.Do(func() {
+		close(obs.closing)
+	})
+	obs.worker.Wait()
+	obs.offloadMutex.Lock()
+	defer obs.offloadMutex.Unlock()
+	obs.cache.close()
+	return obs.local.Close()
+}
+
+func (obs *objectStorage) Size() (int64, error) {
+	return obs.local.Size()
+}
+
+// RemoveAll remove the local and the uploaded segments
+func (obs *objectStorage) RemoveAll() error {
+	if obs.readOnly {
+		return core.ErrReadOnly
+	}
+	obs.offloadMutex.Lock()
+	defer obs.offloadMutex.Unlock()
+	obs.mutex.Lock()
+	defer obs.mutex.Unlock()
+	for segment := range obs.remote {
+		if err := obs.removeRemote(segment); err != nil {
+			return err
+		}
+	}
+	if err := obs.cache.removeAll(); err != nil {
+		return err
+	}
+	return obs.local.RemoveAll()
+}
+
+func (obs *objectStorage) PositionIterator() (core.PositionIterator, error) {
+	scanner, err := obs.Scan(core.ScanOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &positionIterator{scanner: scanner}, nil
+}
+
+// Scan the uploaded segments are fetched into the cache when they are scanned
+func (obs *objectStorage) Scan(opts core.ScanOptions) (core.RecordScanner, error) {
+	segments := opts.Segments
+	if segments == nil {
+		segments = append(obs.SealedSegments(), obs.ActiveSegment())
+	}
+	return file.NewSegmentScanner(obs.openSegment, segments, obs.cache.keys, opts), nil
+}
+
+func (obs *objectStorage) openSegment(segment int64) (vfs.File, error) {
+	obs.mutex.RLock()
+	if !obs.remote[segment] {
+		defer obs.mutex.RUnlock()
+		return vfs.Open(obs.fs, path.Join(obs.dir, utils.BuildDataFileName(segment)))
+	}
+	obs.mutex.RUnlock()
+	return obs.cache.open(segment)
+}
+
+func (obs *objectStorage) SealedSegments() []int64 {
+	obs.mutex.RLock()
+	defer obs.mutex.RUnlock()
+	segments := obs.local.SealedSegments()
+	for segment := range obs.remote {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments
+}
+
+func (obs *objectStorage) RemoveSegment(segment int64) error {
+	if obs.readOnly {
+		return core.ErrReadOnly
+	}
+	obs.mutex.Lock()
+	defer obs.mutex.Unlock()
+	if !obs.remote[segment] {
+		return obs.local.RemoveSegment(segment)
+	}
+	return obs.removeRemote(segment)
+}
+
+// removeRemote remove the uploaded segment, the caller holds the lock
+func (obs *objectStorage) removeRemote(segment int64) error {
+	if err := obs.store.Delete(obs.prefix + utils.BuildDataFileName(segment)); err != nil {
+		return err
+	}
+	delete(obs.remote, segment)
+	obs.cache.remove(segment)
+	return obs.store.Delete(obs.prefix + utils.BuildHitFileName(segment))
+}
+
+// BackupFiles the local files, then the segments in the store, which are fetched while
+// they're copied
+func (obs *objectStorage) BackupFiles() ([]core.BackupFile, error) {
+	obs.mutex.RLock()
+	defer obs.mutex.RUnlock()
+	files, err := obs.local.(core.BackupStorage).BackupFiles()
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int64, 0, len(obs.remote))
+	for segment := range obs.remote {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	for _, segment := range segments {
+		for _, name := range []string{utils.BuildHitFileName(segment), utils.BuildDataFileName(segment)} {
+			data, err := obs.store.Get(obs.prefix + name)
+			if errors.Is(err, core.ErrObjectNotFound) && name == utils.BuildHitFileName(segment) {
+				continue
+			}
+			if err != nil {
+				file.CloseBackupFiles(files)
+				return nil, err
+			}
+			files = append(files, core.BackupFile{Name: name, Data: data})
+		}
+	}
+	return files, nil
+}
+
+type positionIterator struct {
+	scanner core.RecordScanner
+}
+
+func (pi *positionIterator) Next() (*core.RecordPosition, core.Bytes, core.RecordType, error) {
+	pos, record, err := pi.scanner.Next()
+	if err != nil {
+		_ = pi.scanner.Close()
+		return nil, nil, core.Deleted, err
+	}
+	return pos, record.Key, record.Type, nil
+}
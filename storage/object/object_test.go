@@ -0,0 +1,273 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package object
+
+import (
+	"BytesDB/core"
+	"BytesDB/encryption"
+	"BytesDB/storage/file"
+	"BytesDB/vfs"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDirObjectStore(t *testing.T) {
+	store := NewDirObjectStore(vfs.NewMemFS(), "/objects")
+	names, err := store.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+
+	assert.Nil(t, store.Put("public/test/b", strings.NewReader("b")))
+	assert.Nil(t, store.Put("public/test/a", strings.NewReader("a")))
+	assert.Nil(t, store.Put("public/other/a", strings.NewReader("other")))
+	assert.Nil(t, store.Put("public/test/a", strings.NewReader("replaced")))
+
+	names, err = store.List("public/test/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"public/test/a", "public/test/b"}, names)
+	names, err = store.List("public/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(names))
+
+	reader, err := store.Get("public/test/a")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(reader)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, "replaced", string(data))
+
+	assert.Nil(t, store.Delete("public/test/a"))
+	assert.Nil(t, store.Delete("public/test/a"))
+	_, err = store.Get("public/test/a")
+	assert.Equal(t, core.ErrObjectNotFound, err)
+}
+
+// failingStore fails the uploads while failing is set
+type failingStore struct {
+	core.ObjectStore
+	failing atomic.Bool
+}
+
+func (fs *failingStore) Put(name string, data io.Reader) error {
+	if fs.failing.Load() {
+		return errors.New("upload failed")
+	}
+	return fs.ObjectStore.Put(name, data)
+}
+
+func writeRecords(t *testing.T, s core.Storage, from, to int) map[string]*core.RecordPosition {
+	positions := make(map[string]*core.RecordPosition)
+	for i := from; i < to; i++ {
+		key := "key" + strconv.Itoa(i)
+		n, err := s.Write((&core.Record{Key: core.Bytes(key), Value: core.Bytes("value" + strconv.Itoa(i))}).Pack())
+		assert.Nil(t, err)
+		size, err := s.Size()
+		assert.Nil(t, err)
+		positions[key] = &core.RecordPosition{Segment: s.ActiveSegment(), Position: size - int64(n), Size: n}
+	}
+	return positions
+}
+
+// waitOffload wait for the background worker to upload the sealed segments
+func waitOffload(t *testing.T, s core.Storage) {
+	assert.Eventually(t, func() bool {
+		obs := s.(*objectStorage)
+		obs.offloadMutex.Lock()
+		defer obs.offloadMutex.Unlock()
+		return len(obs.local.SealedSegments()) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func assertRecords(t *testing.T, s core.Storage, positions map[string]*core.RecordPosition) {
+	for key, pos := range positions {
+		buf := make(core.Bytes, pos.Size)
+		n, err := s.ReadSegment(buf, pos.Segment, pos.Position)
+		assert.Nil(t, err)
+		record, err := core.DecodeRecord(buf[:n])
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(record.Key))
+	}
+
+	scanner, err := s.Scan(core.ScanOptions{VerifyCRC: true})
+	assert.Nil(t, err)
+	defer scanner.Close()
+	count := 0
+	for {
+		pos, record, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, positions[string(record.Key)], pos)
+		count++
+	}
+	assert.Equal(t, len(positions), count)
+}
+
+func TestObjectStorage(t *testing.T) {
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	for name, keys := range map[string]core.KeyProvider{"plain": nil, "encrypted": kp} {
+		t.Run(name, func(t *testing.T) {
+			mfs := vfs.NewMemFS()
+			store := NewDirObjectStore(mfs, "/objects")
+			opts := Options{
+				File:          file.Options{MaxSize: 256, FS: mfs, KeyProvider: keys},
+				Store:         store,
+				CacheSegments: 2,
+			}
+			s, err := NewObjectStorage("/data", "public", "test", opts)
+			assert.Nil(t, err)
+			positions := writeRecords(t, s, 0, 100)
+			waitOffload(t, s)
+
+			// only the active segment is kept locally
+			sealed := s.SealedSegments()
+			assert.True(t, len(sealed) > 2)
+			entries, err := mfs.ReadDir("/data/public/test")
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(entries))
+			names, err := store.List("public/test/")
+			assert.Nil(t, err)
+			// the data and the hit file of each segment
+			assert.Equal(t, 2*len(sealed), len(names))
+			assertRecords(t, s, positions)
+			// the fetched segments more than the capacity are evicted
+			entries, err = mfs.ReadDir("/data/.object-cache/public/test")
+			assert.Nil(t, err)
+			assert.Equal(t, 2, len(entries))
+
+			assert.Nil(t, s.RemoveSegment(sealed[0]))
+			active := s.ActiveSegment()
+			assert.Nil(t, s.Close())
+
+			// the local directory is lost with the active segment, the uploaded segments are still readable
+			for key, pos := range positions {
+				if pos.Segment == sealed[0] || pos.Segment == active {
+					delete(positions, key)
+				}
+			}
+			assert.Nil(t, mfs.RemoveAll("/data"))
+			s, err = NewObjectStorage("/data", "public", "test", opts)
+			assert.Nil(t, err)
+			defer s.Close()
+			assert.Equal(t, sealed[1:], s.SealedSegments())
+			assert.True(t, s.ActiveSegment() > sealed[len(sealed)-1])
+			for key, pos := range writeRecords(t, s, 100, 110) {
+				positions[key] = pos
+			}
+			assertRecords(t, s, positions)
+
+			assert.Nil(t, s.RemoveAll())
+			names, err = store.List("")
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(names))
+		})
+	}
+}
+
+func TestObjectStorage_Upload_Failure(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	store := &failingStore{ObjectStore: NewDirObjectStore(mfs, "/objects")}
+	store.failing.Store(true)
+	opts := Options{
+		File:  file.Options{MaxSize: 256, FS: mfs},
+		Store: store,
+	}
+	s, err := NewObjectStorage("/data", "public", "test", opts)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// the writes are not failed, the sealed segments are read locally
+	positions := writeRecords(t, s, 0, 50)
+	assert.True(t, len(s.SealedSegments()) > 1)
+	obs := s.(*objectStorage)
+	assert.NotNil(t, obs.offload())
+	// the error of the background offload is returned by Flush
+	assert.NotNil(t, s.Flush())
+	names, _ := store.List("")
+	assert.Equal(t, 0, len(names))
+	assertRecords(t, s, positions)
+
+	store.failing.Store(false)
+	assert.Nil(t, obs.offload())
+	assert.Nil(t, s.Flush())
+	names, _ = store.List("")
+	assert.Equal(t, 2*len(s.SealedSegments()), len(names))
+	assertRecords(t, s, positions)
+}
+
+func TestObjectStorage_Fetch_Failure(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	ffs := vfs.NewFaultFS(mfs)
+	opts := Options{
+		File:  file.Options{MaxSize: 256, FS: mfs},
+		Store: NewDirObjectStore(ffs, "/objects"),
+	}
+	s, err := NewObjectStorage("/data", "public", "test", opts)
+	assert.Nil(t, err)
+	defer s.Close()
+	positions := writeRecords(t, s, 0, 50)
+	waitOffload(t, s)
+
+	ffs.Inject(vfs.Fault{Op: vfs.OpRead, Err: syscall.EIO})
+	pos := positions["key0"]
+	_, err = s.ReadSegment(make(core.Bytes, pos.Size), pos.Segment, pos.Position)
+	assert.ErrorIs(t, err, syscall.EIO)
+
+	// the failed fetch is not cached
+	ffs.Reset()
+	assertRecords(t, s, positions)
+}
+
+// blockingStore blocks the uploads until it's released
+type blockingStore struct {
+	core.ObjectStore
+	release chan struct{}
+}
+
+func (bs *blockingStore) Put(name string, data io.Reader) error {
+	<-bs.release
+	return bs.ObjectStore.Put(name, data)
+}
+
+func TestObjectStorage_Offload_Background(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	store := &blockingStore{ObjectStore: NewDirObjectStore(mfs, "/objects"), release: make(chan struct{})}
+	s, err := NewObjectStorage("/data", "public", "test", Options{
+		File:  file.Options{MaxSize: 256, FS: mfs},
+		Store: store,
+	})
+	assert.Nil(t, err)
+
+	// the writes rotating the segments are not blocked by the uploads
+	positions := writeRecords(t, s, 0, 50)
+	assert.True(t, len(s.SealedSegments()) > 1)
+	assert.Nil(t, s.Flush())
+	assertRecords(t, s, positions)
+
+	close(store.release)
+	waitOffload(t, s)
+	names, _ := store.List("")
+	assert.Equal(t, 2*len(s.SealedSegments()), len(names))
+	assertRecords(t, s, positions)
+	assert.Nil(t, s.Close())
+}
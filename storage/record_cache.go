@@ -0,0 +1,128 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"BytesDB/core"
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// recordEntryOverhead the estimated memory of an entry besides the key and value
+const recordEntryOverhead = 128
+
+type cacheKey struct {
+	session core.Session
+	segment int64
+	offset  int64
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	record *core.Record
+	size   int64
+}
+
+// CacheStats counters of the record cache
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Entries  int
+	Size     int64
+	Capacity int64
+}
+
+// recordCache LRU cache of the records, bounded by the size of the cached records
+type recordCache struct {
+	capacity int64
+	size     int64
+	entries  map[cacheKey]*list.Element
+	lru      *list.List
+	mutex    sync.Mutex
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+func newRecordCache(capacity int64) *recordCache {
+	return &recordCache{
+		capacity: capacity,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get the cached record should not be modified, copy it before handing out
+func (rc *recordCache) get(key cacheKey) (*core.Record, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	elem, ok := rc.entries[key]
+	if !ok {
+		rc.misses.Add(1)
+		return nil, false
+	}
+	rc.hits.Add(1)
+	rc.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).record, true
+}
+
+func (rc *recordCache) put(key cacheKey, record *core.Record) {
+	size := int64(len(record.Key)+len(record.Value)) + recordEntryOverhead
+	// not worth to evict everything for a huge record
+	if size > rc.capacity {
+		return
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if elem, ok := rc.entries[key]; ok {
+		rc.removeElement(elem)
+	}
+	rc.entries[key] = rc.lru.PushFront(&cacheEntry{key: key, record: record, size: size})
+	rc.size += size
+
+	for rc.size > rc.capacity {
+		rc.removeElement(rc.lru.Back())
+	}
+}
+
+// invalidate drop the entries of the session, and only the ones of the segment if segment >= 0
+func (rc *recordCache) invalidate(session core.Session, segment int64) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	for key, elem := range rc.entries {
+		if key.session == session && (segment < 0 || key.segment == segment) {
+			rc.removeElement(elem)
+		}
+	}
+}
+
+func (rc *recordCache) removeElement(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*cacheEntry)
+	delete(rc.entries, entry.key)
+	rc.size -= entry.size
+}
+
+func (rc *recordCache) stats() CacheStats {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return CacheStats{
+		Hits:     rc.hits.Load(),
+		Misses:   rc.misses.Load(),
+		Entries:  len(rc.entries),
+		Size:     rc.size,
+		Capacity: rc.capacity,
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"BytesDB/config"
+	"BytesDB/core"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestRecordCache_Evict(t *testing.T) {
+	// room for 2 records
+	rc := newRecordCache(2*recordEntryOverhead + 20)
+	record := func(i int) *core.Record {
+		return &core.Record{Key: core.Bytes("key" + strconv.Itoa(i)), Value: core.Bytes("val" + strconv.Itoa(i))}
+	}
+
+	rc.put(cacheKey{session: sid, offset: 0}, record(0))
+	rc.put(cacheKey{session: sid, offset: 1}, record(1))
+	// touch 0, so 1 is the least recently used
+	_, ok := rc.get(cacheKey{session: sid, offset: 0})
+	assert.True(t, ok)
+	rc.put(cacheKey{session: sid, offset: 2}, record(2))
+
+	_, ok = rc.get(cacheKey{session: sid, offset: 1})
+	assert.False(t, ok)
+	cached, ok := rc.get(cacheKey{session: sid, offset: 0})
+	assert.True(t, ok)
+	assert.Equal(t, record(0), cached)
+	_, ok = rc.get(cacheKey{session: sid, offset: 2})
+	assert.True(t, ok)
+
+	stats := rc.stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 2, stats.Entries)
+	assert.True(t, stats.Size <= stats.Capacity)
+
+	// larger than the capacity, not cached
+	rc.put(cacheKey{session: sid, offset: 3}, &core.Record{Value: make(core.Bytes, 2*recordEntryOverhead)})
+	assert.Equal(t, 2, rc.stats().Entries)
+}
+
+func TestRecordCache_Invalidate(t *testing.T) {
+	rc := newRecordCache(1024 * 1024)
+	other := core.Session{Schema: "public", Table: "other"}
+	rc.put(cacheKey{session: sid, segment: 0, offset: 0}, &core.Record{})
+	rc.put(cacheKey{session: sid, segment: 1, offset: 0}, &core.Record{})
+	rc.put(cacheKey{session: other, segment: 0, offset: 0}, &core.Record{})
+
+	rc.invalidate(sid, 0)
+	_, ok := rc.get(cacheKey{session: sid, segment: 0, offset: 0})
+	assert.False(t, ok)
+	_, ok = rc.get(cacheKey{session: sid, segment: 1, offset: 0})
+	assert.True(t, ok)
+
+	rc.invalidate(sid, -1)
+	_, ok = rc.get(cacheKey{session: sid, segment: 1, offset: 0})
+	assert.False(t, ok)
+	_, ok = rc.get(cacheKey{session: other, segment: 0, offset: 0})
+	assert.True(t, ok)
+	assert.Equal(t, 1, rc.stats().Entries)
+}
+
+func TestStorageManager_Read_Cache(t *testing.T) {
+	sm, _ := NewStorageManager(&config.DBConfig{
+		DataDir:       "/tmp/bytesdb-cache",
+		CacheCapacity: 1024 * 1024,
+	})
+	t.Cleanup(func() {
+		sm.RemoveAllData(sid)
+		sm.Close()
+	})
+
+	record := &core.Record{Key: core.Bytes("hello"), Value: core.Bytes("world"), Type: core.Normal}
+	pos, _ := sm.Write(sid, record)
+	for i := 0; i < 3; i++ {
+		read, err := sm.Read(sid, pos)
+		assert.Nil(t, err)
+		assert.Equal(t, record, read)
+		// the cached record is not affected by the caller
+		read.Value[0] = 'W'
+	}
+	stats := sm.CacheStats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+
+	sm.InvalidateSegment(sid, pos.Segment)
+	assert.Equal(t, 0, sm.CacheStats().Entries)
+}
@@ -0,0 +1,98 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/storage/file"
+	"BytesDB/storage/memory"
+	"BytesDB/storage/object"
+	"BytesDB/storage/tiered"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// StorageFactory creates the storage of a table
+type StorageFactory func(cfg *config.DBConfig, session core.Session) (core.Storage, error)
+
+var storageTypes = struct {
+	sync.RWMutex
+	factories map[StorageType]StorageFactory
+}{factories: make(map[StorageType]StorageFactory)}
+
+func init() {
+	RegisterStorageType(Local_File, func(cfg *config.DBConfig, session core.Session) (core.Storage, error) {
+		return file.NewLocalFileStorageWithOptions(cfg.DataDir, session.Schema, session.Table, FromDbOptions(cfg).fileOptions())
+	})
+	RegisterStorageType(Memory, func(cfg *config.DBConfig, session core.Session) (core.Storage, error) {
+		return memory.NewMemoryStorage(memory.Options{MaxSize: cfg.MaxFileSize}), nil
+	})
+	RegisterStorageType(Object, func(cfg *config.DBConfig, session core.Session) (core.Storage, error) {
+		store := cfg.ObjectStore
+		if store == nil {
+			if cfg.ObjectStoreDir == "" {
+				return nil, errors.New("storage.object.dir is not set for the object storage")
+			}
+			store = object.NewDirObjectStore(cfg.FS, cfg.ObjectStoreDir)
+		}
+		return object.NewObjectStorage(cfg.DataDir, session.Schema, session.Table, object.Options{
+			File:          FromDbOptions(cfg).fileOptions(),
+			Store:         store,
+			CacheDir:      cfg.ObjectCacheDir,
+			CacheSegments: cfg.ObjectCacheSegments,
+		})
+	})
+	RegisterStorageType(Tiered, func(cfg *config.DBConfig, session core.Session) (core.Storage, error) {
+		if cfg.TieredColdDir == "" {
+			return nil, errors.New("storage.tiered.cold.dir is not set for the tiered storage")
+		}
+		return tiered.NewTieredStorage(cfg.DataDir, session.Schema, session.Table, tiered.Options{
+			File:       FromDbOptions(cfg).fileOptions(),
+			ColdDir:    cfg.TieredColdDir,
+			MaxHotAge:  cfg.TieredHotMaxAge,
+			MaxHotSize: cfg.TieredHotMaxSize,
+		})
+	})
+}
+
+// RegisterStorageType make the storage type could be selected by storage.type in db.properties,
+// it panics if the type is registered twice, e.g. register it in the init function of the package
+func RegisterStorageType(typ StorageType, factory StorageFactory) {
+	storageTypes.Lock()
+	defer storageTypes.Unlock()
+	if factory == nil {
+		panic("storage factory is nil: " + typ)
+	}
+	if _, ok := storageTypes.factories[typ]; ok {
+		panic("storage type registered twice: " + typ)
+	}
+	storageTypes.factories[typ] = factory
+}
+
+// ResolveStorageType the factory of the registered storage type, local_file by default
+func ResolveStorageType(typ string) (StorageFactory, error) {
+	if typ == "" {
+		typ = Local_File
+	}
+	storageTypes.RLock()
+	defer storageTypes.RUnlock()
+	factory, ok := storageTypes.factories[typ]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", core.ErrUnknownStorageType, typ)
+	}
+	return factory, nil
+}
@@ -17,77 +17,170 @@ package storage
 import (
 	"BytesDB/config"
 	"BytesDB/core"
-	"BytesDB/storage/file"
 	"sync"
+	"sync/atomic"
 )
 
-type StorageType = byte
+type StorageType = string
 
+// the built-in storage types, see RegisterStorageType for the others
 const (
-	Local_File StorageType = iota
+	Local_File StorageType = "local_file"
+	Memory     StorageType = "memory"
+	Object     StorageType = "object"
+	Tiered     StorageType = "tiered"
 )
 
 type StorageManager struct {
 	storages map[core.Session]core.Storage
 	mutex    sync.RWMutex
+	cfg      *config.DBConfig
 	options  *StorageOptions
-	typ      StorageType
+	factory  StorageFactory
+	// cache of the read records, nil if it's disabled
+	cache *recordCache
+	// observer of the writes, nil if it's not set
+	observer atomic.Pointer[WriteObserver]
 }
 
-func NewStorageManager(cfg *config.DBConfig) *StorageManager {
-	return &StorageManager{
-		make(map[core.Session]core.Storage),
-		sync.RWMutex{},
-		FromDbOptions(cfg),
-		resolveStorageType(cfg.StorageType),
+// WriteObserver observes the records written and the segments removed, e.g. streaming them
+// to the replicas, Written is called by the writer in the order of the writes
+type WriteObserver interface {
+	Written(session core.Session, pos *core.RecordPosition, record *core.Record)
+	Removed(session core.Session, segment int64)
+}
+
+func NewStorageManager(cfg *config.DBConfig) (*StorageManager, error) {
+	factory, err := ResolveStorageType(cfg.StorageType)
+	if err != nil {
+		return nil, err
+	}
+	options := FromDbOptions(cfg)
+	var cache *recordCache
+	if options.cacheCapacity > 0 {
+		cache = newRecordCache(options.cacheCapacity)
 	}
+	return &StorageManager{
+		storages: make(map[core.Session]core.Storage),
+		cfg:      cfg,
+		options:  options,
+		factory:  factory,
+		cache:    cache,
+	}, nil
 }
 
-func resolveStorageType(typ string) StorageType {
-	// by default
-	if typ == "" {
-		return Local_File
+func (sm *StorageManager) Read(session core.Session, position *core.RecordPosition) (*core.Record, error) {
+	if sm.cache == nil {
+		return sm.read(session, position)
 	}
-	switch typ {
-	case "local_file":
-		return Local_File
-	default:
-		panic("unknown storage type")
+
+	key := cacheKey{session: session, segment: position.Segment, offset: position.Position}
+	if record, ok := sm.cache.get(key); ok {
+		return copyRecord(record), nil
 	}
+	record, err := sm.read(session, position)
+	if err != nil {
+		return nil, err
+	}
+	sm.cache.put(key, copyRecord(record))
+	return record, nil
 }
 
-func (sm *StorageManager) Read(session core.Session, position *core.RecordPosition) *core.Record {
-	storage := sm.resolveStorage(session)
+func (sm *StorageManager) read(session core.Session, position *core.RecordPosition) (*core.Record, error) {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return nil, err
+	}
+
+	// the record is decoded on the mapped bytes without copying, only the key and value
+	// are copied out since the bytes are not valid after View returns
+	if viewer, ok := storage.(core.SegmentViewer); ok && sm.options.mmap {
+		var record *core.Record
+		err := viewer.View(position.Segment, position.Position, position.Size, func(bytes core.Bytes) error {
+			rd, err := core.DecodeRecord(bytes)
+			if err != nil {
+				return err
+			}
+			record = copyRecord(rd)
+			return nil
+		})
+		return record, err
+	}
 
 	// TODO: consider shall we reader header separately, instead of read whole record size
 	bytes := make(core.Bytes, position.Size)
-	_, err := storage.Read(bytes, position.Position)
+	// n may less than the position size if the storage is encrypted
+	n, err := storage.ReadSegment(bytes, position.Segment, position.Position)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return core.BytesToRecord(bytes)
+	return core.DecodeRecord(bytes[:n])
+}
+
+func copyRecord(record *core.Record) *core.Record {
+	buf := make(core.Bytes, len(record.Key)+len(record.Value))
+	copy(buf, record.Key)
+	copy(buf[len(record.Key):], record.Value)
+	return &core.Record{
+		Key:   buf[:len(record.Key):len(record.Key)],
+		Value: buf[len(record.Key):],
+		Type:  record.Type,
+	}
 }
 
 // append
-func (sm *StorageManager) Write(session core.Session, record *core.Record) *core.RecordPosition {
-	storage := sm.resolveStorage(session)
+func (sm *StorageManager) Write(session core.Session, record *core.Record) (*core.RecordPosition, error) {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return nil, err
+	}
 	bytes := record.Pack()
 	write, err := storage.Write(bytes)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// TODO: maybe we could record the stats here instead of ask storage everytime
-	sz, _ := storage.Size()
+	sz, err := storage.Size()
+	if err != nil {
+		return nil, err
+	}
 
-	return &core.RecordPosition{
+	pos := &core.RecordPosition{
+		Segment:  storage.ActiveSegment(),
 		Position: sz - int64(write),
 		Size:     write,
 	}
+	if observer := sm.observer.Load(); observer != nil {
+		(*observer).Written(session, pos, record)
+	}
+	return pos, nil
+}
+
+// SetObserver set the observer of the writes, nil removes it
+func (sm *StorageManager) SetObserver(observer WriteObserver) {
+	if observer == nil {
+		sm.observer.Store(nil)
+		return
+	}
+	sm.observer.Store(&observer)
+}
+
+// RotateTo start the segment of the table, see core.ReplicaStorage
+func (sm *StorageManager) RotateTo(session core.Session, segment int64) error {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return err
+	}
+	replica, ok := storage.(core.ReplicaStorage)
+	if !ok {
+		return core.ErrReplicationNotSupported
+	}
+	return replica.RotateTo(segment)
 }
 
-func (sm *StorageManager) Delete(session core.Session, key core.Bytes) *core.RecordPosition {
+func (sm *StorageManager) Delete(session core.Session, key core.Bytes) (*core.RecordPosition, error) {
 	record := &core.Record{
 		Key:   key,
 		Value: core.Bytes{},
@@ -96,11 +189,58 @@ func (sm *StorageManager) Delete(session core.Session, key core.Bytes) *core.Rec
 	return sm.Write(session, record)
 }
 
-func (sm *StorageManager) RemoveAllData(sid core.Session) {
+func (sm *StorageManager) RemoveAllData(sid core.Session) error {
+	storage, err := sm.Storage(sid)
+	if err != nil {
+		return err
+	}
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
-	_ = sm.resolveStorage(sid).RemoveAll()
+	err = storage.RemoveAll()
+	if sm.cache != nil {
+		sm.cache.invalidate(sid, -1)
+	}
+	return err
+}
+
+// InvalidateSegment drop the cached records of the segment, it should be called before
+// the segment is rewritten or removed, e.g. by merge
+func (sm *StorageManager) InvalidateSegment(session core.Session, segment int64) {
+	if sm.cache != nil {
+		sm.cache.invalidate(session, segment)
+	}
+}
+
+// CacheStats the zero stats if the cache is disabled
+func (sm *StorageManager) CacheStats() CacheStats {
+	if sm.cache == nil {
+		return CacheStats{}
+	}
+	return sm.cache.stats()
+}
+
+// TierUsage the usage of each tier of the table, nil if the storage is not tiered
+func (sm *StorageManager) TierUsage(session core.Session) ([]core.TierUsage, error) {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return nil, err
+	}
+	if tiered, ok := storage.(core.TieredStorage); ok {
+		return tiered.TierUsage()
+	}
+	return nil, nil
+}
+
+// Sessions the tables opened, e.g. the tables of the memory storage not kept in data.dir
+func (sm *StorageManager) Sessions() []core.Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	sessions := make([]core.Session, 0, len(sm.storages))
+	for session := range sm.storages {
+		sessions = append(sessions, session)
+	}
+	return sessions
 }
 
 func (sm *StorageManager) Close() {
@@ -111,33 +251,80 @@ func (sm *StorageManager) Close() {
 	}
 }
 
-func (sm *StorageManager) Size(session core.Session) (int64, error) {
-	storage := sm.resolveStorage(session)
-	return storage.Size()
+func (sm *StorageManager) PositionIterator(session core.Session) (core.PositionIterator, error) {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return nil, err
+	}
+	return storage.PositionIterator()
 }
 
-func (sm *StorageManager) resolveStorage(sid core.Session) core.Storage {
-	if _, ok := sm.storages[sid]; !ok {
-		sm.initializeStorage(sm.typ, sid)
+func (sm *StorageManager) Scan(session core.Session, opts core.ScanOptions) (core.RecordScanner, error) {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return nil, err
 	}
+	return storage.Scan(opts)
+}
 
-	storage := sm.storages[sid]
-	return storage
+func (sm *StorageManager) SealedSegments(session core.Session) ([]int64, error) {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return nil, err
+	}
+	return storage.SealedSegments(), nil
 }
 
-func (sm *StorageManager) initializeStorage(storageType StorageType, session core.Session) {
-	if _, ok := sm.storages[session]; ok {
-		return
+// RemoveSegment the cached records of the segment are dropped as well
+func (sm *StorageManager) RemoveSegment(session core.Session, segment int64) error {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return err
+	}
+	sm.InvalidateSegment(session, segment)
+	if err := storage.RemoveSegment(segment); err != nil {
+		return err
 	}
-	switch storageType {
-	case Local_File:
-		storage, err := file.NewLocalFileStorage(sm.options.rootPath, session.Schema, session.Table)
-		if err != nil {
-			panic(err)
-		}
-		sm.storages[session] = storage
-	default:
-		// TODO: create error
-		panic("storage type not supported: " + string(storageType))
+	if observer := sm.observer.Load(); observer != nil {
+		(*observer).Removed(session, segment)
+	}
+	return nil
+}
+
+func (sm *StorageManager) Flush(session core.Session) error {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return err
+	}
+	return storage.Flush()
+}
+
+func (sm *StorageManager) Size(session core.Session) (int64, error) {
+	storage, err := sm.Storage(session)
+	if err != nil {
+		return 0, err
+	}
+	return storage.Size()
+}
+
+// Storage the storage of the table, it's opened by the first call
+func (sm *StorageManager) Storage(sid core.Session) (core.Storage, error) {
+	sm.mutex.RLock()
+	storage, ok := sm.storages[sid]
+	sm.mutex.RUnlock()
+	if ok {
+		return storage, nil
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if storage, ok = sm.storages[sid]; ok {
+		return storage, nil
+	}
+	storage, err := sm.factory(sm.cfg, sid)
+	if err != nil {
+		return nil, err
 	}
+	sm.storages[sid] = storage
+	return storage, nil
 }
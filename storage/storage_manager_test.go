@@ -17,8 +17,11 @@ package storage
 import (
 	"BytesDB/config"
 	"BytesDB/core"
+	"BytesDB/storage/file"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"math/rand"
 	"strconv"
 	"testing"
 )
@@ -32,12 +35,12 @@ var dbconfig = &config.DBConfig{
 }
 
 func TestNewStorageManager(t *testing.T) {
-	sm := NewStorageManager(dbconfig)
+	sm, _ := NewStorageManager(dbconfig)
 	assert.NotNil(t, sm)
 }
 
 func TestStorageManager_Write(t *testing.T) {
-	sm := NewStorageManager(dbconfig)
+	sm, _ := NewStorageManager(dbconfig)
 	t.Cleanup(func() {
 		sm.RemoveAllData(sid)
 	})
@@ -50,7 +53,7 @@ func TestStorageManager_Write(t *testing.T) {
 
 	var position int64
 
-	pos := sm.Write(sid, record)
+	pos, _ := sm.Write(sid, record)
 	assert.NotNil(t, pos)
 	assert.Equal(t, position, pos.Position)
 	assert.Equal(t, len(record.Pack()), pos.Size)
@@ -61,14 +64,14 @@ func TestStorageManager_Write(t *testing.T) {
 		Value: core.Bytes("吃了吗"),
 		Type:  core.Normal,
 	}
-	pos = sm.Write(sid, record)
+	pos, _ = sm.Write(sid, record)
 	assert.NotNil(t, pos)
 	assert.Equal(t, pos.Position, position)
 	assert.Equal(t, pos.Size, len(record.Pack()))
 }
 
 func TestStorageManager_Read(t *testing.T) {
-	sm := NewStorageManager(dbconfig)
+	sm, _ := NewStorageManager(dbconfig)
 	t.Cleanup(func() {
 		sm.RemoveAllData(sid)
 	})
@@ -81,12 +84,13 @@ func TestStorageManager_Read(t *testing.T) {
 
 	var position int64
 
-	pos := sm.Write(sid, record)
+	pos, _ := sm.Write(sid, record)
 	assert.NotNil(t, pos)
 	assert.Equal(t, position, pos.Position)
 	assert.Equal(t, len(record.Pack()), pos.Size)
 
-	read := sm.Read(sid, pos)
+	read, err := sm.Read(sid, pos)
+	assert.Nil(t, err)
 	assert.Equal(t, record, read)
 
 	position += int64(pos.Size)
@@ -95,16 +99,17 @@ func TestStorageManager_Read(t *testing.T) {
 		Value: core.Bytes("吃了吗"),
 		Type:  core.Normal,
 	}
-	pos = sm.Write(sid, record)
+	pos, _ = sm.Write(sid, record)
 	assert.NotNil(t, pos)
 	assert.Equal(t, pos.Position, position)
 	assert.Equal(t, pos.Size, len(record.Pack()))
-	read = sm.Read(sid, pos)
+	read, err = sm.Read(sid, pos)
+	assert.Nil(t, err)
 	assert.Equal(t, record, read)
 }
 
 func TestStorageManager_Remove(t *testing.T) {
-	sm := NewStorageManager(dbconfig)
+	sm, _ := NewStorageManager(dbconfig)
 	t.Cleanup(func() {
 		sm.RemoveAllData(sid)
 	})
@@ -117,27 +122,29 @@ func TestStorageManager_Remove(t *testing.T) {
 
 	var position int64
 
-	pos := sm.Write(sid, record)
+	pos, _ := sm.Write(sid, record)
 	assert.NotNil(t, pos)
 	assert.Equal(t, position, pos.Position)
 	assert.Equal(t, len(record.Pack()), pos.Size)
 
-	read := sm.Read(sid, pos)
+	read, err := sm.Read(sid, pos)
+	assert.Nil(t, err)
 	assert.Equal(t, record, read)
 
 	// Delete actual write a Deleted type record
-	pos = sm.Delete(sid, read.Key)
+	pos, _ = sm.Delete(sid, read.Key)
 	deleted := &core.Record{
 		Key:   read.Key,
 		Value: core.Bytes{},
 		Type:  core.Deleted,
 	}
-	writeDeleted := sm.Read(sid, pos)
+	writeDeleted, err := sm.Read(sid, pos)
+	assert.Nil(t, err)
 	assert.Equal(t, deleted, writeDeleted)
 }
 
 func TestStorageManager_Size(t *testing.T) {
-	sm := NewStorageManager(dbconfig)
+	sm, _ := NewStorageManager(dbconfig)
 	t.Cleanup(func() {
 		sm.RemoveAllData(sid)
 	})
@@ -151,21 +158,21 @@ func TestStorageManager_Size(t *testing.T) {
 		Type:  core.Normal,
 	}
 
-	pos := sm.Write(sid, record)
+	pos, _ := sm.Write(sid, record)
 	sz, err = sm.Size(sid)
 	assert.Nil(t, err)
 	assert.NotNil(t, pos)
 	assert.Equal(t, record.Pack().Size(), uint32(pos.Size))
 	assert.Equal(t, int64(record.Pack().Size()), sz)
 
-	_ = sm.Delete(sid, core.Bytes("hello"))
+	_, _ = sm.Delete(sid, core.Bytes("hello"))
 	nsz, err := sm.Size(sid)
 	assert.Nil(t, err)
 	assert.True(t, nsz > sz)
 }
 
 func TestFilePositionIterator(t *testing.T) {
-	sm := NewStorageManager(dbconfig)
+	sm, _ := NewStorageManager(dbconfig)
 	t.Cleanup(func() {
 		sm.RemoveAllData(sid)
 		sm.Close()
@@ -177,13 +184,14 @@ func TestFilePositionIterator(t *testing.T) {
 			Value: core.Bytes("val" + strconv.Itoa(i)),
 			Type:  core.Normal,
 		}
-		sm.Write(sid, rd)
+		_, _ = sm.Write(sid, rd)
 		writeSize += int(rd.Pack().Size())
 	}
 	sm.Close()
 
-	sm = NewStorageManager(dbconfig)
-	storage := sm.resolveStorage(sid)
+	sm, _ = NewStorageManager(dbconfig)
+	storage, err := sm.Storage(sid)
+	assert.Nil(t, err)
 	iterator, err := storage.PositionIterator()
 	assert.Nil(t, err)
 
@@ -197,7 +205,7 @@ func TestFilePositionIterator(t *testing.T) {
 		assert.Nil(t, err)
 		assert.Equal(t, atoi, index)
 
-		assert.Equal(t, sm.Read(sid, pos), &core.Record{
+		assert.Equal(t, readRecord(t, sm, pos), &core.Record{
 			Key:   core.Bytes(strconv.Itoa(index)),
 			Value: core.Bytes("val" + strconv.Itoa(index)),
 			Type:  core.Normal,
@@ -208,15 +216,16 @@ func TestFilePositionIterator(t *testing.T) {
 	}
 
 	// write a deleted record
-	sm.Write(sid, &core.Record{
+	_, _ = sm.Write(sid, &core.Record{
 		Key:   core.Bytes(strconv.Itoa(index)),
 		Value: core.Bytes("val" + strconv.Itoa(index)),
 		Type:  core.Deleted,
 	})
 	sm.Close()
 
-	sm = NewStorageManager(dbconfig)
-	storage = sm.resolveStorage(sid)
+	sm, _ = NewStorageManager(dbconfig)
+	storage, err = sm.Storage(sid)
+	assert.Nil(t, err)
 	iterator, err = storage.PositionIterator()
 	assert.Nil(t, err)
 
@@ -230,7 +239,7 @@ func TestFilePositionIterator(t *testing.T) {
 			assert.Nil(t, err)
 			assert.Equal(t, atoi, index)
 
-			assert.Equal(t, sm.Read(sid, pos), &core.Record{
+			assert.Equal(t, readRecord(t, sm, pos), &core.Record{
 				Key:   core.Bytes(strconv.Itoa(index)),
 				Value: core.Bytes("val" + strconv.Itoa(index)),
 				Type:  core.Normal,
@@ -241,7 +250,7 @@ func TestFilePositionIterator(t *testing.T) {
 			assert.Nil(t, err)
 			assert.Equal(t, atoi, index)
 
-			assert.Equal(t, sm.Read(sid, pos), &core.Record{
+			assert.Equal(t, readRecord(t, sm, pos), &core.Record{
 				Key:   core.Bytes(strconv.Itoa(index)),
 				Value: core.Bytes("val" + strconv.Itoa(index)),
 				Type:  core.Deleted,
@@ -252,3 +261,167 @@ func TestFilePositionIterator(t *testing.T) {
 		index++
 	}
 }
+
+func readRecord(t *testing.T, sm *StorageManager, pos *core.RecordPosition) *core.Record {
+	record, err := sm.Read(sid, pos)
+	assert.Nil(t, err)
+	return record
+}
+
+func TestStorageManager_Read_Sealed_Segments(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		cfg := &config.DBConfig{
+			DataDir:            "/tmp/bytesdb-sealed-" + strconv.FormatBool(mmap),
+			MaxFileSize:        1024,
+			MmapSealedSegments: mmap,
+		}
+		sm, _ := NewStorageManager(cfg)
+
+		var positions []*core.RecordPosition
+		for i := 0; i < 100; i++ {
+			pos, err := sm.Write(sid, &core.Record{
+				Key:   core.Bytes(strconv.Itoa(i)),
+				Value: core.Bytes("val" + strconv.Itoa(i)),
+				Type:  core.Normal,
+			})
+			assert.Nil(t, err)
+			positions = append(positions, pos)
+		}
+		assert.True(t, positions[len(positions)-1].Segment > 0)
+
+		for i, pos := range positions {
+			record, err := sm.Read(sid, pos)
+			assert.Nil(t, err)
+			assert.Equal(t, core.Bytes(strconv.Itoa(i)), record.Key)
+			assert.Equal(t, core.Bytes("val"+strconv.Itoa(i)), record.Value)
+		}
+		sm.RemoveAllData(sid)
+		sm.Close()
+	}
+}
+
+func TestNewStorageManager_Unknown_Type(t *testing.T) {
+	_, err := NewStorageManager(&config.DBConfig{StorageType: "unknown"})
+	assert.ErrorIs(t, err, core.ErrUnknownStorageType)
+}
+
+// countingStorage a storage type registered outside of the built-in ones
+type countingStorage struct {
+	core.Storage
+	writes int
+}
+
+func (cs *countingStorage) Write(bytes core.Bytes) (int, error) {
+	cs.writes++
+	return cs.Storage.Write(bytes)
+}
+
+func newCountingStorage(cfg *config.DBConfig, session core.Session) (core.Storage, error) {
+	storage, err := file.NewLocalFileStorage(cfg.DataDir, session.Schema, session.Table)
+	if err != nil {
+		return nil, err
+	}
+	return &countingStorage{Storage: storage}, nil
+}
+
+var errStorageUnavailable = errors.New("storage unavailable")
+
+func init() {
+	RegisterStorageType("counting", newCountingStorage)
+	RegisterStorageType("unavailable", func(*config.DBConfig, core.Session) (core.Storage, error) {
+		return nil, errStorageUnavailable
+	})
+}
+
+func TestRegisterStorageType(t *testing.T) {
+	cfg := &config.DBConfig{
+		DataDir:     "/tmp/bytesdb-counting",
+		StorageType: "counting",
+	}
+	assert.Panics(t, func() {
+		RegisterStorageType("counting", newCountingStorage)
+	})
+
+	sm, err := NewStorageManager(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		sm.RemoveAllData(sid)
+		sm.Close()
+	})
+	pos, _ := sm.Write(sid, &core.Record{Key: core.Bytes("key"), Value: core.Bytes("value")})
+	record, err := sm.Read(sid, pos)
+	assert.Nil(t, err)
+	assert.Equal(t, core.Bytes("value"), record.Value)
+
+	storage, err := sm.Storage(sid)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, storage.(*countingStorage).writes)
+}
+
+func TestStorageManager_Storage_Unavailable(t *testing.T) {
+	sm, err := NewStorageManager(&config.DBConfig{StorageType: "unavailable"})
+	assert.Nil(t, err)
+	defer sm.Close()
+
+	_, err = sm.Read(sid, &core.RecordPosition{Size: 1})
+	assert.ErrorIs(t, err, errStorageUnavailable)
+	_, err = sm.SealedSegments(sid)
+	assert.ErrorIs(t, err, errStorageUnavailable)
+	_, err = sm.Scan(sid, core.ScanOptions{})
+	assert.ErrorIs(t, err, errStorageUnavailable)
+	assert.ErrorIs(t, sm.RemoveSegment(sid, 0), errStorageUnavailable)
+	assert.ErrorIs(t, sm.RemoveAllData(sid), errStorageUnavailable)
+}
+
+func BenchmarkStorageManager_Read_ReadAt(b *testing.B) {
+	benchmarkSealedRead(b, false)
+}
+
+func BenchmarkStorageManager_Read_Mmap(b *testing.B) {
+	benchmarkSealedRead(b, true)
+}
+
+// benchmarkSealedRead read the records of the sealed segments randomly
+func benchmarkSealedRead(b *testing.B, mmap bool) {
+	cfg := &config.DBConfig{
+		DataDir:            "/tmp/bytesdb-bench-" + strconv.FormatBool(mmap),
+		MaxFileSize:        64 * 1024,
+		MmapSealedSegments: mmap,
+	}
+	sm, _ := NewStorageManager(cfg)
+	b.Cleanup(func() {
+		sm.RemoveAllData(sid)
+		sm.Close()
+	})
+
+	value := make(core.Bytes, 256)
+	var positions []*core.RecordPosition
+	for i := 0; i < 10000; i++ {
+		pos, err := sm.Write(sid, &core.Record{
+			Key:   core.Bytes(strconv.Itoa(i)),
+			Value: value,
+			Type:  core.Normal,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		positions = append(positions, pos)
+	}
+	// only the sealed segments
+	active := positions[len(positions)-1].Segment
+	sealed := positions[:0]
+	for _, pos := range positions {
+		if pos.Segment != active {
+			sealed = append(sealed, pos)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sm.Read(sid, sealed[rnd.Intn(len(sealed))]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -16,6 +16,9 @@ package storage
 
 import (
 	"BytesDB/config"
+	"BytesDB/core"
+	"BytesDB/storage/file"
+	"BytesDB/vfs"
 )
 
 // configurations
@@ -30,11 +33,39 @@ import (
 type StorageOptions struct {
 	// warehouse directory
 	rootPath string
+	// encrypt the new segments if set
+	keyProvider core.KeyProvider
+	// max size of a single segment
+	maxFileSize int64
+	// read the sealed segments by mmap
+	mmap bool
+	// max bytes of the cached records, 0 means no cache
+	cacheCapacity int64
+	// file system of the data files
+	fs vfs.FS
+	// open the segments read-only
+	readOnly bool
 }
 
 // FromDbOptions pure and validate config for storage
 func FromDbOptions(cfg *config.DBConfig) *StorageOptions {
 	return &StorageOptions{
-		rootPath: cfg.DataDir,
+		rootPath:      cfg.DataDir,
+		keyProvider:   cfg.KeyProvider,
+		maxFileSize:   cfg.MaxFileSize,
+		mmap:          cfg.MmapSealedSegments,
+		cacheCapacity: cfg.CacheCapacity,
+		fs:            cfg.FS,
+		readOnly:      cfg.ReadOnly,
+	}
+}
+
+func (opts *StorageOptions) fileOptions() file.Options {
+	return file.Options{
+		KeyProvider: opts.keyProvider,
+		MaxSize:     opts.maxFileSize,
+		Mmap:        opts.mmap,
+		FS:          opts.fs,
+		ReadOnly:    opts.readOnly,
 	}
 }
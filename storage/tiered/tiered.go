@@ -0,0 +1,500 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tiered
+
+import (
+	"BytesDB/core"
+	"BytesDB/storage/file"
+	"BytesDB/utils"
+	"BytesDB/vfs"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the tiers reported by TierUsage
+const (
+	Hot  = "hot"
+	Cold = "cold"
+)
+
+type Options struct {
+	// File options of the hot tier
+	File file.Options
+	// ColdDir the root directory of the cold tier, e.g. on a slower volume, the segments of
+	// a table are kept in <ColdDir>/<schema>/<table>
+	ColdDir string
+	// MaxHotAge the sealed segments older than it are moved to the cold tier, 0 means no limit
+	MaxHotAge time.Duration
+	// MaxHotSize the oldest sealed segments are moved to the cold tier until the size of the
+	// sealed segments in the hot tier is not larger than it, 0 means no limit
+	MaxHotSize int64
+}
+
+// tieredStorage keeps the active segment and the recent sealed ones in the hot tier, the
+// others are moved to the cold tier by the policy after the rotation, the positions of the
+// records are not changed so the index is not aware of the tiers
+type tieredStorage struct {
+	hot     core.Storage
+	fs      vfs.FS
+	keys    core.KeyProvider
+	hotDir  string
+	coldDir string
+	maxAge  time.Duration
+	maxSize int64
+	// the segments in the cold tier, the reader is nil until the segment is read
+	cold      map[int64]*file.SealedSegment
+	activeSeq int64
+	// nothing is moved or removed if it's read-only
+	readOnly bool
+	// serialize the moves, the copies are not holding the mutex
+	moveMutex sync.Mutex
+	mutex     sync.RWMutex
+
+	// the sealed segments are moved in the background once the worker is woken by the
+	// rotation or Flush, the error of the last move is returned by Flush
+	demoteErr  error
+	wakeDemote chan struct{}
+	closing    chan struct{}
+	closeOnce  sync.Once
+	worker     sync.WaitGroup
+}
+
+func NewTieredStorage(rootPath, schema, table string, opts Options) (core.Storage, error) {
+	fs := vfs.Or(opts.File.FS)
+	ts := &tieredStorage{
+		fs:         fs,
+		keys:       opts.File.KeyProvider,
+		hotDir:     path.Join(rootPath, schema, table),
+		coldDir:    path.Join(opts.ColdDir, schema, table),
+		maxAge:     opts.MaxHotAge,
+		maxSize:    opts.MaxHotSize,
+		cold:       make(map[int64]*file.SealedSegment),
+		readOnly:   opts.File.ReadOnly,
+		wakeDemote: make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+	}
+
+	if !ts.readOnly {
+		if err := fs.MkdirAll(ts.coldDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := fs.ReadDir(ts.coldDir)
+	if err != nil && !(ts.readOnly && os.IsNotExist(err)) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), utils.DataFileSuffix) {
+			ts.cold[utils.GetFileSeqNo(entry.Name())] = nil
+		}
+	}
+
+	if ts.hot, err = file.NewLocalFileStorageWithOptions(rootPath, schema, table, opts.File); err != nil {
+		return nil, err
+	}
+	ts.activeSeq = ts.hot.ActiveSegment()
+	// the segments copied but not removed from the hot tier before closing are removed
+	if err = ts.demote(); err != nil {
+		_ = ts.hot.Close()
+		return nil, err
+	}
+	if !ts.readOnly {
+		ts.worker.Add(1)
+		go ts.demoteLoop()
+	}
+	return ts, nil
+}
+
+// demoteLoop apply the policy each time it's woken until the storage is closed, the failed
+// moves are retried by the next rotation or Flush
+func (ts *tieredStorage) demoteLoop() {
+	defer ts.worker.Done()
+	for {
+		select {
+		case <-ts.wakeDemote:
+			err := ts.demote()
+			ts.mutex.Lock()
+			ts.demoteErr = err
+			ts.mutex.Unlock()
+		case <-ts.closing:
+			return
+		}
+	}
+}
+
+// wake the demote worker without waiting, the wakeups are merged while it's moving
+func (ts *tieredStorage) wake() {
+	select {
+	case ts.wakeDemote <- struct{}{}:
+	default:
+	}
+}
+
+// demote move the sealed segments to the cold tier by the policy, the oldest first
+func (ts *tieredStorage) demote() error {
+	if ts.readOnly {
+		return nil
+	}
+	ts.moveMutex.Lock()
+	defer ts.moveMutex.Unlock()
+
+	sealed := ts.hot.SealedSegments()
+	infos := make([]os.FileInfo, len(sealed))
+	var hotSize int64
+	for i, segment := range sealed {
+		info, err := ts.fs.Stat(path.Join(ts.hotDir, utils.BuildDataFileName(segment)))
+		if err != nil {
+			return err
+		}
+		infos[i] = info
+		hotSize += info.Size()
+	}
+
+	now := time.Now()
+	for i, segment := range sealed {
+		ts.mutex.RLock()
+		_, copied := ts.cold[segment]
+		ts.mutex.RUnlock()
+
+		tooOld := ts.maxAge > 0 && now.Sub(infos[i].ModTime()) > ts.maxAge
+		tooLarge := ts.maxSize > 0 && hotSize > ts.maxSize
+		if !copied && !tooOld && !tooLarge {
+			continue
+		}
+		if !copied {
+			if err := ts.copyToCold(segment); err != nil {
+				return err
+			}
+		}
+
+		ts.mutex.Lock()
+		ts.cold[segment] = nil
+		err := ts.hot.RemoveSegment(segment)
+		ts.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		hotSize -= infos[i].Size()
+	}
+	return nil
+}
+
+// copyToCold copy the hit file then the data file, the segment is in the cold tier once
+// the data file is renamed
+func (ts *tieredStorage) copyToCold(segment int64) error {
+	for _, name := range []string{utils.BuildHitFileName(segment), utils.BuildDataFileName(segment)} {
+		err := ts.copyFile(path.Join(ts.hotDir, name), path.Join(ts.coldDir, name))
+		if os.IsNotExist(err) && name == utils.BuildHitFileName(segment) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile the file is copied into a temporary file and synced, then renamed
+func (ts *tieredStorage) copyFile(src, dst string) error {
+	from, err := vfs.Open(ts.fs, src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	tmpPath := dst + ".tmp"
+	to, err := ts.fs.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(to, from)
+	if err == nil {
+		err = to.Sync()
+	}
+	if closeErr := to.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = ts.fs.Remove(tmpPath)
+		return err
+	}
+	return ts.fs.Rename(tmpPath, dst)
+}
+
+// coldSegment the reader of the segment in the cold tier, it's opened on the first read
+func (ts *tieredStorage) coldSegment(segment int64) (*file.SealedSegment, error) {
+	ts.mutex.RLock()
+	sealed := ts.cold[segment]
+	ts.mutex.RUnlock()
+	if sealed != nil {
+		return sealed, nil
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	sealed, ok := ts.cold[segment]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if sealed != nil {
+		return sealed, nil
+	}
+	segmentFile, err := vfs.Open(ts.fs, path.Join(ts.coldDir, utils.BuildDataFileName(segment)))
+	if err != nil {
+		return nil, err
+	}
+	if sealed, err = file.OpenSealedSegment(segmentFile, segment, ts.keys); err != nil {
+		return nil, err
+	}
+	ts.cold[segment] = sealed
+	return sealed, nil
+}
+
+func (ts *tieredStorage) Read(buf core.Bytes, offset int64) (int, error) {
+	return ts.hot.Read(buf, offset)
+}
+
+func (ts *tieredStorage) ReadSegment(buf core.Bytes, segment int64, offset int64) (int, error) {
+	ts.mutex.RLock()
+	if _, ok := ts.cold[segment]; !ok {
+		// the segment is not moved while reading it
+		defer ts.mutex.RUnlock()
+		return ts.hot.ReadSegment(buf, segment, offset)
+	}
+	ts.mutex.RUnlock()
+
+	sealed, err := ts.coldSegment(segment)
+	if err != nil {
+		return 0, err
+	}
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	return sealed.ReadAt(buf, offset)
+}
+
+func (ts *tieredStorage) ActiveSegment() int64 {
+	return ts.hot.ActiveSegment()
+}
+
+// Write the policy is applied in the background after the rotation, the write is not
+// failed or delayed by the move
+func (ts *tieredStorage) Write(buf core.Bytes) (int, error) {
+	n, err := ts.hot.Write(buf)
+	if err != nil {
+		return n, err
+	}
+	ts.mutex.Lock()
+	active := ts.hot.ActiveSegment()
+	rotated := active != ts.activeSeq
+	ts.activeSeq = active
+	ts.mutex.Unlock()
+	if rotated && !ts.readOnly {
+		ts.wake()
+	}
+	return n, nil
+}
+
+// Flush the active segment, and wake the worker to apply the policy, e.g. the segments get
+// older without rotation. The error of the last move is returned
+func (ts *tieredStorage) Flush() error {
+	if err := ts.hot.Flush(); err != nil {
+		return err
+	}
+	if ts.readOnly {
+		return nil
+	}
+	ts.mutex.RLock()
+	err := ts.demoteErr
+	ts.mutex.RUnlock()
+	ts.wake()
+	return err
+}
+
+// Close stop the demote worker, the segments not moved yet are moved when it's opened again
+func (ts *tieredStorage) Close() error {
+	ts.closeOnce.Do(func() {
+		close(ts.closing)
+	})
+	ts.worker.Wait()
+	ts.moveMutex.Lock()
+	defer ts.moveMutex.Unlock()
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for segment, sealed := range ts.cold {
+		if sealed != nil {
+			_ = sealed.Close()
+			ts.cold[segment] = nil
+		}
+	}
+	return ts.hot.Close()
+}
+
+func (ts *tieredStorage) Size() (int64, error) {
+	return ts.hot.Size()
+}
+
+// RemoveAll remove the segments of both tiers
+func (ts *tieredStorage) RemoveAll() error {
+	if ts.readOnly {
+		return core.ErrReadOnly
+	}
+	ts.moveMutex.Lock()
+	defer ts.moveMutex.Unlock()
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for segment, sealed := range ts.cold {
+		if sealed != nil {
+			_ = sealed.Close()
+		}
+		delete(ts.cold, segment)
+	}
+	if err := ts.fs.RemoveAll(ts.coldDir); err != nil {
+		return err
+	}
+	return ts.hot.RemoveAll()
+}
+
+func (ts *tieredStorage) PositionIterator() (core.PositionIterator, error) {
+	scanner, err := ts.Scan(core.ScanOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &positionIterator{scanner: scanner}, nil
+}
+
+func (ts *tieredStorage) Scan(opts core.ScanOptions) (core.RecordScanner, error) {
+	segments := opts.Segments
+	if segments == nil {
+		segments = append(ts.SealedSegments(), ts.ActiveSegment())
+	}
+	return file.NewSegmentScanner(ts.openSegment, segments, ts.keys, opts), nil
+}
+
+func (ts *tieredStorage) openSegment(segment int64) (vfs.File, error) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	dir := ts.hotDir
+	if _, ok := ts.cold[segment]; ok {
+		dir = ts.coldDir
+	}
+	return vfs.Open(ts.fs, path.Join(dir, utils.BuildDataFileName(segment)))
+}
+
+func (ts *tieredStorage) SealedSegments() []int64 {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	segments := ts.hot.SealedSegments()
+	for segment := range ts.cold {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments
+}
+
+func (ts *tieredStorage) RemoveSegment(segment int64) error {
+	if ts.readOnly {
+		return core.ErrReadOnly
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	sealed, ok := ts.cold[segment]
+	if !ok {
+		return ts.hot.RemoveSegment(segment)
+	}
+	if sealed != nil {
+		_ = sealed.Close()
+	}
+	delete(ts.cold, segment)
+	if err := ts.fs.Remove(path.Join(ts.coldDir, utils.BuildDataFileName(segment))); err != nil {
+		return err
+	}
+	err := ts.fs.Remove(path.Join(ts.coldDir, utils.BuildHitFileName(segment)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// TierUsage the segments and the bytes of the data files in the hot and the cold tier,
+// the active segment is in the hot tier
+func (ts *tieredStorage) TierUsage() ([]core.TierUsage, error) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	hot := core.TierUsage{Tier: Hot}
+	for _, segment := range append(ts.hot.SealedSegments(), ts.hot.ActiveSegment()) {
+		info, err := ts.fs.Stat(path.Join(ts.hotDir, utils.BuildDataFileName(segment)))
+		if err != nil {
+			return nil, err
+		}
+		hot.Segments++
+		hot.Bytes += info.Size()
+	}
+	cold := core.TierUsage{Tier: Cold}
+	for segment := range ts.cold {
+		info, err := ts.fs.Stat(path.Join(ts.coldDir, utils.BuildDataFileName(segment)))
+		if err != nil {
+			return nil, err
+		}
+		cold.Segments++
+		cold.Bytes += info.Size()
+	}
+	return []core.TierUsage{hot, cold}, nil
+}
+
+type positionIterator struct {
+	scanner core.RecordScanner
+}
+
+func (pi *positionIterator) Next() (*core.RecordPosition, core.Bytes, core.RecordType, error) {
+	pos, record, err := pi.scanner.Next()
+	if err != nil {
+		_ = pi.scanner.Close()
+		return nil, nil, core.Deleted, err
+	}
+	return pos, record.Key, record.Type, nil
+}
+
+// BackupFiles the files of the hot tier, then the sealed segments in the cold tier
+func (ts *tieredStorage) BackupFiles() ([]core.BackupFile, error) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	files, err := ts.hot.(core.BackupStorage).BackupFiles()
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int64, 0, len(ts.cold))
+	for segment := range ts.cold {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	for _, segment := range segments {
+		segmentFiles, err := file.OpenSegmentBackupFiles(ts.fs, ts.coldDir, segment)
+		if err != nil {
+			file.CloseBackupFiles(files)
+			return nil, err
+		}
+		files = append(files, segmentFiles...)
+	}
+	return files, nil
+}
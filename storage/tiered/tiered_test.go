@@ -0,0 +1,199 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tiered
+
+import (
+	"BytesDB/core"
+	"BytesDB/encryption"
+	"BytesDB/storage/file"
+	"BytesDB/vfs"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeRecords(t *testing.T, s core.Storage, from, to int) map[string]*core.RecordPosition {
+	positions := make(map[string]*core.RecordPosition)
+	for i := from; i < to; i++ {
+		key := "key" + strconv.Itoa(i)
+		n, err := s.Write((&core.Record{Key: core.Bytes(key), Value: core.Bytes("value" + strconv.Itoa(i))}).Pack())
+		assert.Nil(t, err)
+		size, err := s.Size()
+		assert.Nil(t, err)
+		positions[key] = &core.RecordPosition{Segment: s.ActiveSegment(), Position: size - int64(n), Size: n}
+	}
+	return positions
+}
+
+func assertRecords(t *testing.T, s core.Storage, positions map[string]*core.RecordPosition) {
+	for key, pos := range positions {
+		buf := make(core.Bytes, pos.Size)
+		n, err := s.ReadSegment(buf, pos.Segment, pos.Position)
+		assert.Nil(t, err)
+		record, err := core.DecodeRecord(buf[:n])
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(record.Key))
+	}
+
+	scanner, err := s.Scan(core.ScanOptions{VerifyCRC: true})
+	assert.Nil(t, err)
+	defer scanner.Close()
+	count := 0
+	for {
+		pos, record, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, positions[string(record.Key)], pos)
+		count++
+	}
+	assert.Equal(t, len(positions), count)
+}
+
+func usage(t *testing.T, s core.Storage) (core.TierUsage, core.TierUsage) {
+	tiers, err := s.(core.TieredStorage).TierUsage()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tiers))
+	assert.Equal(t, Hot, tiers[0].Tier)
+	assert.Equal(t, Cold, tiers[1].Tier)
+	return tiers[0], tiers[1]
+}
+
+// waitDemote wait the worker to move the sealed segments until the hot tier fits the budget
+func waitDemote(t *testing.T, s core.Storage, maxHotSize int64) {
+	assert.Eventually(t, func() bool {
+		hot, _ := usage(t, s)
+		active, err := s.Size()
+		assert.Nil(t, err)
+		return hot.Bytes-active <= maxHotSize
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestTieredStorage_Max_Size(t *testing.T) {
+	kp, err := encryption.NewStaticKeyProvider(1, core.Bytes("0123456789abcdef"))
+	assert.Nil(t, err)
+	for name, keys := range map[string]core.KeyProvider{"plain": nil, "encrypted": kp} {
+		t.Run(name, func(t *testing.T) {
+			mfs := vfs.NewMemFS()
+			opts := Options{
+				File:       file.Options{MaxSize: 256, FS: mfs, KeyProvider: keys},
+				ColdDir:    "/cold",
+				MaxHotSize: 512,
+			}
+			s, err := NewTieredStorage("/hot", "public", "test", opts)
+			assert.Nil(t, err)
+			positions := writeRecords(t, s, 0, 100)
+			waitDemote(t, s, 512)
+
+			sealed := s.SealedSegments()
+			hot, cold := usage(t, s)
+			assert.Equal(t, len(sealed)+1, hot.Segments+cold.Segments)
+			assert.True(t, cold.Segments > 0)
+			// the active segment is not counted by the budget
+			active, err := s.Size()
+			assert.Nil(t, err)
+			assert.True(t, hot.Bytes-active <= 512)
+			coldEntries, err := mfs.ReadDir("/cold/public/test")
+			assert.Nil(t, err)
+			// the data and the hit file of each segment
+			assert.Equal(t, 2*cold.Segments, len(coldEntries))
+			assertRecords(t, s, positions)
+
+			assert.Nil(t, s.RemoveSegment(sealed[0]))
+			for key, pos := range positions {
+				if pos.Segment == sealed[0] {
+					delete(positions, key)
+				}
+			}
+			assert.Nil(t, s.Close())
+
+			s, err = NewTieredStorage("/hot", "public", "test", opts)
+			assert.Nil(t, err)
+			defer s.Close()
+			assert.Equal(t, sealed[1:], s.SealedSegments())
+			for key, pos := range writeRecords(t, s, 100, 150) {
+				positions[key] = pos
+			}
+			waitDemote(t, s, 512)
+			assertRecords(t, s, positions)
+
+			assert.Nil(t, s.RemoveAll())
+			_, err = mfs.Stat("/cold/public/test")
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestTieredStorage_Max_Age(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	opts := Options{
+		File:      file.Options{MaxSize: 256, FS: mfs},
+		ColdDir:   "/cold",
+		MaxHotAge: time.Hour,
+	}
+	s, err := NewTieredStorage("/hot", "public", "test", opts)
+	assert.Nil(t, err)
+	positions := writeRecords(t, s, 0, 50)
+	assert.Nil(t, s.Flush())
+	hot, cold := usage(t, s)
+	assert.Equal(t, len(s.SealedSegments())+1, hot.Segments)
+	assert.Equal(t, 0, cold.Segments)
+	assert.Nil(t, s.Close())
+
+	// all sealed segments are older than the max age
+	opts.MaxHotAge = time.Nanosecond
+	s, err = NewTieredStorage("/hot", "public", "test", opts)
+	assert.Nil(t, err)
+	defer s.Close()
+	hot, cold = usage(t, s)
+	assert.Equal(t, 1, hot.Segments)
+	assert.Equal(t, len(s.SealedSegments()), cold.Segments)
+	assertRecords(t, s, positions)
+}
+
+func TestTieredStorage_Demote_Failure(t *testing.T) {
+	mfs := vfs.NewMemFS()
+	opts := Options{
+		File:       file.Options{MaxSize: 256, FS: mfs},
+		ColdDir:    "/cold",
+		MaxHotSize: 256,
+	}
+	s, err := NewTieredStorage("/hot", "public", "test", opts)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// the segments can't be copied without the cold directory, the writes are not failed
+	assert.Nil(t, mfs.RemoveAll("/cold/public/test"))
+	positions := writeRecords(t, s, 0, 50)
+	assert.Eventually(t, func() bool {
+		return s.Flush() != nil
+	}, 5*time.Second, time.Millisecond)
+	_, cold := usage(t, s)
+	assert.Equal(t, 0, cold.Segments)
+	assertRecords(t, s, positions)
+
+	// retried by Flush
+	assert.Nil(t, mfs.MkdirAll("/cold/public/test", 0755))
+	assert.Eventually(t, func() bool {
+		return s.Flush() == nil
+	}, 5*time.Second, time.Millisecond)
+	waitDemote(t, s, 256)
+	_, cold = usage(t, s)
+	assert.True(t, cold.Segments > 0)
+	assertRecords(t, s, positions)
+}
@@ -0,0 +1,407 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"BytesDB/storage"
+	"BytesDB/vfs"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// TxnSession the internal table of the transactions, it keeps the TxnFinished records of the
+// committed transactions and the reserved sequence numbers of the transactions and the versions
+var TxnSession = core.Session{Schema: "_bytesdb", Table: "txn"}
+
+// txnReserveKey the key of the record keeping the max reserved sequence number
+var txnReserveKey = core.Bytes("txn-r")
+
+// reserveSize the numbers reserved by a write of the txn table, the ones not used before closing
+// are skipped, so a number written into the records, e.g. by a transaction not committed,
+// is not reused
+const reserveSize = 1024
+
+// sequence the numbers reserved by the records of the txn table, the caller holds the write lock
+type sequence struct {
+	key core.Bytes
+	// the last number used and the max reserved one
+	last     uint64
+	reserved uint64
+}
+
+// next the next number, more numbers are reserved if they're used up
+func (seq *sequence) next(sm *storage.StorageManager) (uint64, error) {
+	next := seq.last + 1
+	if next > seq.reserved {
+		reserved := next + reserveSize - 1
+		value := binary.AppendUvarint(nil, reserved)
+		if _, err := sm.Write(TxnSession, &core.Record{Key: seq.key, Value: value, Type: core.Normal}); err != nil {
+			return 0, err
+		}
+		if err := sm.Flush(TxnSession); err != nil {
+			return 0, err
+		}
+		seq.reserved = reserved
+	}
+	seq.last = next
+	return next, nil
+}
+
+// Txn the optimistic transaction across the tables, the writes are buffered until Commit, which
+// fails with ErrTxnConflict if the keys read or written by the transaction are written by others
+// after Begin. the records are written with the sequence number of the transaction, they're
+// loaded only if the TxnFinished record of the sequence number is in the txn table
+type Txn struct {
+	db *Database
+	// the version of the writes when the transaction begins
+	version uint64
+	reads   map[core.Session]map[string]struct{}
+	writes  map[core.Session]map[string]*core.Record
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// txnManager the state of the transactions, it's guarded by the write lock of the database,
+// except the committed sequence numbers read while loading the indexes
+type txnManager struct {
+	seq *sequence
+	// the open transactions
+	active map[*Txn]struct{}
+	// the version of the writes, bumped by each write while the transactions are open
+	version uint64
+	// the version of the last write of the keys, kept while the transactions are open
+	writes map[core.Session]map[string]uint64
+
+	committed      map[uint64]bool
+	committedMutex sync.RWMutex
+}
+
+func newTxnManager() *txnManager {
+	return &txnManager{
+		seq:       &sequence{key: txnReserveKey},
+		active:    make(map[*Txn]struct{}),
+		writes:    make(map[core.Session]map[string]uint64),
+		committed: make(map[uint64]bool),
+	}
+}
+
+func (tm *txnManager) isCommitted(seq uint64) bool {
+	tm.committedMutex.RLock()
+	defer tm.committedMutex.RUnlock()
+	return tm.committed[seq]
+}
+
+func (tm *txnManager) commit(seq uint64) {
+	tm.committedMutex.Lock()
+	defer tm.committedMutex.Unlock()
+	tm.committed[seq] = true
+}
+
+// touch track the write of the key if the transactions are open
+func (tm *txnManager) touch(session core.Session, key core.Bytes) {
+	if len(tm.active) == 0 {
+		return
+	}
+	tm.version++
+	if tm.writes[session] == nil {
+		tm.writes[session] = make(map[string]uint64)
+	}
+	tm.writes[session][string(key)] = tm.version
+}
+
+// conflicts the keys read or written by the transaction are written after it begins
+func (tm *txnManager) conflicts(txn *Txn) bool {
+	changed := func(keys map[core.Session]map[string]struct{}) bool {
+		for session, tableKeys := range keys {
+			for key := range tableKeys {
+				if tm.writes[session][key] > txn.version {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	written := make(map[core.Session]map[string]struct{}, len(txn.writes))
+	for session, records := range txn.writes {
+		written[session] = make(map[string]struct{}, len(records))
+		for key := range records {
+			written[session][key] = struct{}{}
+		}
+	}
+	return changed(txn.reads) || changed(written)
+}
+
+// finish the transaction is not open anymore, the writes are not tracked if no one is open
+func (tm *txnManager) finish(txn *Txn) {
+	delete(tm.active, txn)
+	if len(tm.active) == 0 {
+		tm.writes = make(map[core.Session]map[string]uint64)
+	}
+}
+
+// loadTxns read the committed transactions and the reserved numbers from the txn table
+func (db *Database) loadTxns() error {
+	db.txns = newTxnManager()
+	db.versions = &sequence{key: versionReserveKey}
+	if db.options.StorageType == storage.Memory {
+		return nil
+	}
+	// no transaction is committed if the table not exists
+	_, err := vfs.Or(db.options.FS).Stat(path.Join(db.options.DataDir, TxnSession.Schema, TxnSession.Table))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner, err := db.sm.Scan(TxnSession, core.ScanOptions{WithValue: true})
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+	for {
+		_, record, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case record.Type == core.TxnFinished:
+			seq, _, err := core.DecodeTxnKey(record.Key)
+			if err != nil {
+				return err
+			}
+			db.txns.committed[seq] = true
+			db.txns.seq.last = max(db.txns.seq.last, seq)
+		case record.Type == core.Normal:
+			for _, seq := range []*sequence{db.txns.seq, db.versions} {
+				if record.Key.Compare(seq.key) != 0 {
+					continue
+				}
+				reserved, n := binary.Uvarint(record.Value)
+				if n <= 0 {
+					return core.ErrCorruptedRecord
+				}
+				seq.last = max(seq.last, reserved)
+			}
+		}
+	}
+	// the numbers reserved are skipped
+	for _, seq := range []*sequence{db.txns.seq, db.versions} {
+		seq.reserved = seq.last
+	}
+	return nil
+}
+
+// Begin the transaction, it must be committed or rolled back, since the writes of the keys are
+// tracked while the transactions are open
+func (db *Database) Begin() *Txn {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	txn := &Txn{
+		db:      db,
+		version: db.txns.version,
+		reads:   make(map[core.Session]map[string]struct{}),
+		writes:  make(map[core.Session]map[string]*core.Record),
+	}
+	db.txns.active[txn] = struct{}{}
+	return txn
+}
+
+// Get the value written by the transaction, or the latest value, the key is validated by Commit
+func (txn *Txn) Get(session core.Session, key core.Bytes) (core.Bytes, error) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	if txn.closed {
+		return nil, core.ErrTxnClosed
+	}
+
+	if record, ok := txn.writes[session][string(key)]; ok {
+		if record.Type == core.Deleted {
+			return nil, core.ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+	if txn.reads[session] == nil {
+		txn.reads[session] = make(map[string]struct{})
+	}
+	txn.reads[session][string(key)] = struct{}{}
+	return txn.db.Get(session, key)
+}
+
+func (txn *Txn) Put(session core.Session, key, value core.Bytes) error {
+	return txn.write(session, &core.Record{Key: key, Value: value, Type: core.Normal})
+}
+
+func (txn *Txn) Delete(session core.Session, key core.Bytes) error {
+	return txn.write(session, &core.Record{Key: key, Type: core.Deleted})
+}
+
+func (txn *Txn) write(session core.Session, record *core.Record) error {
+	if txn.db.readOnly() {
+		return core.ErrReadOnly
+	}
+	if len(record.Key) == 0 {
+		return core.ErrKeyIsEmpty
+	}
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	if txn.closed {
+		return core.ErrTxnClosed
+	}
+
+	if txn.writes[session] == nil {
+		txn.writes[session] = make(map[string]*core.Record)
+	}
+	txn.writes[session][string(record.Key)] = record
+	return nil
+}
+
+// Rollback discard the writes of the transaction
+func (txn *Txn) Rollback() {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	if txn.closed {
+		return
+	}
+	txn.closed = true
+
+	txn.db.mutex.Lock()
+	defer txn.db.mutex.Unlock()
+	txn.db.txns.finish(txn)
+}
+
+// Commit write the records of the transaction, the tables are flushed, then the TxnFinished
+// record is written into the txn table and flushed, the transaction is committed once it's
+// written. return ErrTxnConflict if the keys are written by others after Begin
+func (txn *Txn) Commit() error {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	if txn.closed {
+		return core.ErrTxnClosed
+	}
+	if txn.db.readOnly() {
+		return core.ErrReadOnly
+	}
+	txn.closed = true
+
+	db := txn.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	defer db.txns.finish(txn)
+
+	if db.txns.conflicts(txn) {
+		return core.ErrTxnConflict
+	}
+	if len(txn.writes) == 0 {
+		return nil
+	}
+	seq, err := db.txns.seq.next(db.sm)
+	if err != nil {
+		return err
+	}
+
+	sessions := make([]core.Session, 0, len(txn.writes))
+	for session := range txn.writes {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Schema != sessions[j].Schema {
+			return sessions[i].Schema < sessions[j].Schema
+		}
+		return sessions[i].Table < sessions[j].Table
+	})
+	positions := make(map[core.Session]map[string]*core.RecordPosition, len(sessions))
+	records := make(map[core.Session]map[string]*core.Record, len(sessions))
+	for _, session := range sessions {
+		positions[session] = make(map[string]*core.RecordPosition, len(txn.writes[session]))
+		records[session] = make(map[string]*core.Record, len(txn.writes[session]))
+		for key, record := range txn.writes[session] {
+			if record.Type == core.Deleted {
+				// nothing is written for the key not exists
+				pos, err := db.im.Get(session, record.Key)
+				if err != nil && !errors.Is(err, core.ErrKeyNotFound) {
+					return err
+				}
+				if pos == nil {
+					continue
+				}
+				if live, err := db.isLive(session, pos); err != nil || !live {
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			written, err := db.newRecord(session, record.Key, record.Value, record.Type)
+			if err != nil {
+				return err
+			}
+			typ := core.TxnNormal | written.Type&core.Versioned
+			if record.Type == core.Deleted {
+				typ = core.TxnDeleted | written.Type&core.Versioned
+			}
+			pos, err := db.sm.Write(session, &core.Record{Key: core.EncodeTxnKey(seq, record.Key), Value: written.Value, Type: typ})
+			if err != nil {
+				return err
+			}
+			positions[session][key] = pos
+			records[session][key] = written
+		}
+		if err := db.sm.Flush(session); err != nil {
+			return err
+		}
+	}
+
+	finish := &core.Record{Key: core.EncodeTxnKey(seq, core.TxnFinishKey), Type: core.TxnFinished}
+	if _, err := db.sm.Write(TxnSession, finish); err != nil {
+		return err
+	}
+	if err := db.sm.Flush(TxnSession); err != nil {
+		return err
+	}
+	db.txns.commit(seq)
+
+	for _, session := range sessions {
+		// in the order of the records, so the watchers receive the events in order
+		keys := make([]string, 0, len(positions[session]))
+		for key := range positions[session] {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return before(positions[session][keys[i]], positions[session][keys[j]])
+		})
+		for _, key := range keys {
+			written, pos := records[session][key], positions[session][key]
+			if err := db.applyIndex(session, written.Key, written.Type, pos); err != nil {
+				return err
+			}
+			if err := db.publish(session, written, pos); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
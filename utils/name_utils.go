@@ -16,6 +16,7 @@ package utils
 
 import (
 	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -23,6 +24,8 @@ import (
 const (
 	DataFileSuffix = ".data"
 	HitFileSuffix  = ".hit"
+	// IndexFileSuffix the files of the persistent indexes in the table directory
+	IndexFileSuffix = ".idx"
 )
 
 func BuildDataFileName(seqNo int64) string {
@@ -33,11 +36,13 @@ func BuildHitFileName(seqNo int64) string {
 	return fmt.Sprintf("%10d"+HitFileSuffix, seqNo)
 }
 
+// GetFileSeqNo the path could be the file name or the full path of the data file
 func GetFileSeqNo(path string) int64 {
-	if !strings.HasPrefix(path, DataFileSuffix) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, DataFileSuffix) {
 		panic("the file is not a bytesdb data file")
 	}
-	seqNo, err := strconv.ParseInt(path[:len(path)-5], 10, 64)
+	seqNo, err := strconv.ParseInt(strings.TrimSpace(name[:len(name)-len(DataFileSuffix)]), 10, 64)
 	if err != nil {
 		panic(err)
 	}
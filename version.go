@@ -0,0 +1,290 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"errors"
+	"time"
+)
+
+// versionReserveKey the key of the record in the txn table keeping the max reserved version
+var versionReserveKey = core.Bytes("ver-r")
+
+// KeyVersion a version of a key returned by GetHistory
+type KeyVersion struct {
+	Version uint64
+	Time    time.Time
+	Value   core.Bytes
+	Deleted bool
+}
+
+// newRecord the record of the write, it gets the next version and points to the previous version
+// of the key in the versioned mode, the merge operand points to the previous record of the key
+// as well, the caller holds the write lock
+func (db *Database) newRecord(session core.Session, key, value core.Bytes, typ core.RecordType) (*core.Record, error) {
+	if !db.options.Versioned && typ != core.Merge {
+		return &core.Record{Key: key, Value: value, Type: typ}, nil
+	}
+	prev, err := db.im.Get(session, key)
+	if err != nil && !errors.Is(err, core.ErrKeyNotFound) {
+		return nil, err
+	}
+	if prev != nil {
+		copied := *prev
+		prev = &copied
+	}
+	if !db.options.Versioned {
+		return &core.Record{Key: key, Value: core.EncodeMergeOperand(prev, value), Type: typ}, nil
+	}
+	version, err := db.versions.next(db.sm)
+	if err != nil {
+		return nil, err
+	}
+	header := &core.VersionHeader{Version: version, Time: time.Now().UnixNano(), Prev: prev}
+	return &core.Record{Key: key, Value: core.EncodeVersioned(header, value), Type: typ | core.Versioned}, nil
+}
+
+// applyIndex update the index by the written record, the deleted key is kept in the index in the
+// versioned mode, so its old versions are still reachable. the caller holds the write lock
+func (db *Database) applyIndex(session core.Session, key core.Bytes, typ core.RecordType, pos *core.RecordPosition) error {
+	if isDeletion(typ) && !db.options.Versioned {
+		return db.indexDelete(session, key)
+	}
+	return db.indexPut(session, key, pos)
+}
+
+func isDeletion(typ core.RecordType) bool {
+	return typ.Base() == core.Deleted || typ.Base() == core.TxnDeleted
+}
+
+// readValue the value of the record at the position, the merge operands are folded, return
+// ErrKeyNotFound if it's the deletion of the key in the versioned mode
+func (db *Database) readValue(session core.Session, pos *core.RecordPosition) (core.Bytes, error) {
+	prev, record, err := db.readLinked(session, pos)
+	if err != nil {
+		return nil, err
+	}
+	if isDeletion(record.Type) {
+		return nil, core.ErrKeyNotFound
+	}
+	if record.Type == core.Merge {
+		return db.fold(session, record, prev)
+	}
+	return record.Value, nil
+}
+
+// isLive the key at the position is not deleted, only the deleted keys of the versioned mode
+// are in the index
+func (db *Database) isLive(session core.Session, pos *core.RecordPosition) (bool, error) {
+	if !db.options.Versioned {
+		return true, nil
+	}
+	_, record, err := db.readLinked(session, pos)
+	if err != nil {
+		return false, err
+	}
+	return !isDeletion(record.Type), nil
+}
+
+// liveKeys filter out the deleted keys, the caller holds the lock
+func (db *Database) liveKeys(session core.Session, keys []core.Bytes, positions []*core.RecordPosition) ([]core.Bytes, []*core.RecordPosition, error) {
+	var liveKeys []core.Bytes
+	var livePositions []*core.RecordPosition
+	for i, pos := range positions {
+		live, err := db.isLive(session, pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		if live {
+			liveKeys = append(liveKeys, keys[i])
+			livePositions = append(livePositions, pos)
+		}
+	}
+	return liveKeys, livePositions, nil
+}
+
+// LastVersion the version of the last write, 0 if it's not in the versioned mode
+func (db *Database) LastVersion() uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.versions.last
+}
+
+// GetAt the value of the key at the version, i.e. the value of the latest version not newer than
+// it, return ErrKeyNotFound if the key is deleted or not exists then, or the versions are dropped
+func (db *Database) GetAt(session core.Session, key core.Bytes, version uint64) (core.Bytes, error) {
+	if !db.options.Versioned {
+		return nil, core.ErrNotVersioned
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var found *core.Record
+	var prev *core.RecordPosition
+	err := db.walkVersions(session, key, func(header *core.VersionHeader, record *core.Record) bool {
+		if header.Version > version {
+			return true
+		}
+		found, prev = record, header.Prev
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil || isDeletion(found.Type) {
+		return nil, core.ErrKeyNotFound
+	}
+	if found.Type == core.Merge {
+		return db.fold(session, found, prev)
+	}
+	return found.Value, nil
+}
+
+// GetHistory the versions of the key kept, the latest first
+func (db *Database) GetHistory(session core.Session, key core.Bytes) ([]KeyVersion, error) {
+	if !db.options.Versioned {
+		return nil, core.ErrNotVersioned
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var versions []KeyVersion
+	var foldErr error
+	err := db.walkVersions(session, key, func(header *core.VersionHeader, record *core.Record) bool {
+		version := KeyVersion{Version: header.Version, Time: time.Unix(0, header.Time), Deleted: isDeletion(record.Type)}
+		if record.Type == core.Merge {
+			version.Value, foldErr = db.fold(session, record, header.Prev)
+		} else if !version.Deleted {
+			version.Value = record.Value
+		}
+		versions = append(versions, version)
+		return foldErr == nil
+	})
+	if err == nil {
+		err = foldErr
+	}
+	return versions, err
+}
+
+// walkVersions call fn with the versions of the key, the latest first, until fn returns false,
+// the caller holds the lock
+func (db *Database) walkVersions(session core.Session, key core.Bytes, fn func(*core.VersionHeader, *core.Record) bool) error {
+	pos, err := db.im.Get(session, key)
+	if err != nil {
+		return err
+	}
+	for pos != nil {
+		header, record, err := db.readVersion(session, pos)
+		if err != nil {
+			return err
+		}
+		if !fn(header, record) {
+			return nil
+		}
+		pos = header.Prev
+	}
+	return nil
+}
+
+// readVersion the header and the plain record at the position, the transaction is unwrapped
+func (db *Database) readVersion(session core.Session, pos *core.RecordPosition) (*core.VersionHeader, *core.Record, error) {
+	record, err := db.sm.Read(session, pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.IsTxn() {
+		if _, record, err = record.UnwrapTxn(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return record.UnwrapVersion()
+}
+
+// rewriteVersions append the versions of the key kept by the retention again if they're in the
+// merged segments, the oldest first, so the versions are not pointing to the merged segments
+func (db *Database) rewriteVersions(session core.Session, key core.Bytes, merged map[int64]bool) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	head, err := db.im.Get(session, key)
+	if errors.Is(err, core.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	type version struct {
+		header *core.VersionHeader
+		record *core.Record
+	}
+	var kept []version
+	touched := false
+	for pos := head; pos != nil; {
+		touched = touched || merged[pos.Segment]
+		header, record, err := db.readVersion(session, pos)
+		if err != nil {
+			return err
+		}
+		info := core.VersionInfo{
+			Version: header.Version,
+			Time:    time.Unix(0, header.Time),
+			Newer:   len(kept),
+			Deleted: isDeletion(record.Type),
+		}
+		if len(kept) > 0 && !db.options.VersionRetention(info) {
+			break
+		}
+		kept = append(kept, version{header: header, record: record})
+		pos = header.Prev
+	}
+	// the oldest merge operand kept is replaced by the folded value, since the older records
+	// it's folded with may be dropped
+	oldest := kept[len(kept)-1]
+	if oldest.record.Type == core.Merge {
+		value, err := db.fold(session, oldest.record, oldest.header.Prev)
+		if err != nil {
+			return err
+		}
+		oldest.record = &core.Record{Key: key, Value: value, Type: core.Normal}
+		kept[len(kept)-1] = oldest
+		touched = true
+	}
+	if !touched {
+		return nil
+	}
+	// the deletion merged without the older versions kept
+	if len(kept) == 1 && isDeletion(kept[0].record.Type) && merged[head.Segment] {
+		_, err = db.im.Delete(session, key)
+		return err
+	}
+
+	var prev *core.RecordPosition
+	for i := len(kept) - 1; i >= 0; i-- {
+		header := *kept[i].header
+		header.Prev = prev
+		record := &core.Record{
+			Key:   key,
+			Value: core.EncodeVersioned(&header, kept[i].record.Value),
+			Type:  kept[i].record.Type.Base() | core.Versioned,
+		}
+		if prev, err = db.sm.Write(session, record); err != nil {
+			return err
+		}
+	}
+	_, err = db.im.Put(session, key, prev)
+	return err
+}
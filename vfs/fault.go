@@ -0,0 +1,159 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vfs
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// Op the file operation a Fault applies to
+type Op int
+
+const (
+	OpOpen Op = iota
+	OpRead
+	OpWrite
+	OpSync
+	OpRemove
+)
+
+// Fault the operation fails after the count of the matched operations succeed,
+// e.g. the writes fail with syscall.ENOSPC after the disk is full
+type Fault struct {
+	Op Op
+	// Suffix the fault applies to the files with the suffix, e.g. ".data", all files if it's empty
+	Suffix string
+	// After the count of the matched operations succeed before failing
+	After int
+	// Err the error of the failed operations
+	Err error
+	// Partial the bytes written by the failed write, a short or torn write if it's not 0
+	Partial int
+}
+
+// FaultFS wraps a FS and fails the operations matching the injected faults
+type FaultFS struct {
+	FS
+	mutex  sync.Mutex
+	faults []*faultState
+}
+
+type faultState struct {
+	Fault
+	count int
+}
+
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{FS: fs}
+}
+
+// Inject the fault applies to the operations after it's injected
+func (ffs *FaultFS) Inject(fault Fault) {
+	ffs.mutex.Lock()
+	defer ffs.mutex.Unlock()
+	ffs.faults = append(ffs.faults, &faultState{Fault: fault})
+}
+
+// Reset remove all faults
+func (ffs *FaultFS) Reset() {
+	ffs.mutex.Lock()
+	defer ffs.mutex.Unlock()
+	ffs.faults = nil
+}
+
+// fault the first fault failing the operation, nil if it succeeds
+func (ffs *FaultFS) fault(op Op, name string) *Fault {
+	ffs.mutex.Lock()
+	defer ffs.mutex.Unlock()
+	for _, state := range ffs.faults {
+		if state.Op != op || !strings.HasSuffix(name, state.Suffix) {
+			continue
+		}
+		state.count++
+		if state.count > state.After {
+			return &state.Fault
+		}
+	}
+	return nil
+}
+
+func (ffs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fault := ffs.fault(OpOpen, name); fault != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fault.Err}
+	}
+	file, err := ffs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: ffs}, nil
+}
+
+func (ffs *FaultFS) Remove(name string) error {
+	if fault := ffs.fault(OpRemove, name); fault != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: fault.Err}
+	}
+	return ffs.FS.Remove(name)
+}
+
+func (ffs *FaultFS) RemoveAll(path string) error {
+	if fault := ffs.fault(OpRemove, path); fault != nil {
+		return &os.PathError{Op: "removeall", Path: path, Err: fault.Err}
+	}
+	return ffs.FS.RemoveAll(path)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (ff *faultFile) Read(buf []byte) (int, error) {
+	if fault := ff.fs.fault(OpRead, ff.Name()); fault != nil {
+		return 0, &os.PathError{Op: "read", Path: ff.Name(), Err: fault.Err}
+	}
+	return ff.File.Read(buf)
+}
+
+func (ff *faultFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if fault := ff.fs.fault(OpRead, ff.Name()); fault != nil {
+		return 0, &os.PathError{Op: "read", Path: ff.Name(), Err: fault.Err}
+	}
+	return ff.File.ReadAt(buf, offset)
+}
+
+func (ff *faultFile) Write(buf []byte) (int, error) {
+	if fault := ff.fs.fault(OpWrite, ff.Name()); fault != nil {
+		n, _ := ff.File.Write(buf[:min(fault.Partial, len(buf))])
+		return n, &os.PathError{Op: "write", Path: ff.Name(), Err: fault.Err}
+	}
+	return ff.File.Write(buf)
+}
+
+func (ff *faultFile) WriteAt(buf []byte, offset int64) (int, error) {
+	if fault := ff.fs.fault(OpWrite, ff.Name()); fault != nil {
+		n, _ := ff.File.WriteAt(buf[:min(fault.Partial, len(buf))], offset)
+		return n, &os.PathError{Op: "write", Path: ff.Name(), Err: fault.Err}
+	}
+	return ff.File.WriteAt(buf, offset)
+}
+
+func (ff *faultFile) Sync() error {
+	if fault := ff.fs.fault(OpSync, ff.Name()); fault != nil {
+		return &os.PathError{Op: "sync", Path: ff.Name(), Err: fault.Err}
+	}
+	return ff.File.Sync()
+}
@@ -0,0 +1,54 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFaultFS(t *testing.T) {
+	ffs := NewFaultFS(NewMemFS())
+	ffs.Inject(Fault{Op: OpWrite, Suffix: ".data", After: 1, Err: syscall.ENOSPC, Partial: 2})
+	ffs.Inject(Fault{Op: OpSync, Err: syscall.EIO})
+
+	file, err := ffs.OpenFile("a.data", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	n, err := file.Write([]byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	// the second write is torn
+	n, err = file.Write([]byte("second"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, 2, n)
+	assert.ErrorIs(t, file.Sync(), syscall.EIO)
+	info, _ := file.Stat()
+	assert.Equal(t, int64(7), info.Size())
+
+	// the other files are not affected by the write fault
+	hit, err := ffs.OpenFile("a.hit", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = hit.Write([]byte("hit"))
+	assert.Nil(t, err)
+	_, err = hit.Write([]byte("hit"))
+	assert.Nil(t, err)
+
+	ffs.Reset()
+	_, err = file.Write([]byte("third"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Sync())
+}
@@ -0,0 +1,426 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS keeps the files in memory, the data not synced is dropped by Crash,
+// as the page cache lost in a power failure
+type MemFS struct {
+	mutex sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+type memData struct {
+	mutex   sync.RWMutex
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{"/": true, ".": true},
+		locks: make(map[string]bool),
+	}
+}
+
+func (mfs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+
+	if mfs.dirs[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	data, ok := mfs.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !mfs.dirs[filepath.Dir(name)] {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		data = &memData{modTime: time.Now()}
+		mfs.files[name] = data
+	}
+
+	file := &memFile{name: name, data: data, flag: flag}
+	if flag&os.O_TRUNC != 0 && file.writable() {
+		data.mutex.Lock()
+		data.data = nil
+		data.mutex.Unlock()
+	}
+	return file, nil
+}
+
+func (mfs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	if mfs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	if data, ok := mfs.files[name]; ok {
+		return data.stat(name), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	name = filepath.Clean(name)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	if !mfs.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []os.DirEntry
+	for dir := range mfs.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(dir), dir: true}))
+		}
+	}
+	for path, data := range mfs.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(data.stat(path)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (mfs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	for dir := path; !mfs.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := mfs.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		mfs.dirs[dir] = true
+	}
+	return nil
+}
+
+func (mfs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	if _, ok := mfs.files[name]; ok {
+		delete(mfs.files, name)
+		return nil
+	}
+	if !mfs.dirs[name] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	prefix := name + string(filepath.Separator)
+	for path := range mfs.files {
+		if strings.HasPrefix(path, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	for dir := range mfs.dirs {
+		if strings.HasPrefix(dir, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(mfs.dirs, name)
+	return nil
+}
+
+func (mfs *MemFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	prefix := path + string(filepath.Separator)
+	for name := range mfs.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(mfs.files, name)
+		}
+	}
+	for dir := range mfs.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			delete(mfs.dirs, dir)
+		}
+	}
+	return nil
+}
+
+// Rename only the files could be renamed
+func (mfs *MemFS) Rename(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	data, ok := mfs.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if !mfs.dirs[filepath.Dir(newPath)] || mfs.dirs[newPath] {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrInvalid}
+	}
+	delete(mfs.files, oldPath)
+	mfs.files[newPath] = data
+	return nil
+}
+
+// Link the new file shares the data with the old one, as a hard link
+func (mfs *MemFS) Link(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	data, ok := mfs.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if _, exists := mfs.files[newPath]; exists || mfs.dirs[newPath] {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: fs.ErrExist}
+	}
+	if !mfs.dirs[filepath.Dir(newPath)] {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	mfs.files[newPath] = data
+	return nil
+}
+
+func (mfs *MemFS) Lock(name string) (io.Closer, error) {
+	file, err := mfs.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_ = file.Close()
+
+	name = filepath.Clean(name)
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	if mfs.locks[name] {
+		return nil, ErrLocked
+	}
+	mfs.locks[name] = true
+	return &memLock{fs: mfs, name: name}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (ml *memLock) Close() error {
+	ml.once.Do(func() {
+		ml.fs.mutex.Lock()
+		defer ml.fs.mutex.Unlock()
+		delete(ml.fs.locks, ml.name)
+	})
+	return nil
+}
+
+// Crash drop the data not synced of all files and release the locks, the files opened before
+// should not be used anymore
+func (mfs *MemFS) Crash() {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	mfs.locks = make(map[string]bool)
+	for _, data := range mfs.files {
+		data.mutex.Lock()
+		data.data = append([]byte(nil), data.synced...)
+		data.mutex.Unlock()
+	}
+}
+
+func (md *memData) stat(path string) *memFileInfo {
+	md.mutex.RLock()
+	defer md.mutex.RUnlock()
+	return &memFileInfo{name: filepath.Base(path), size: int64(len(md.data)), modTime: md.modTime}
+}
+
+type memFile struct {
+	name   string
+	data   *memData
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (mf *memFile) writable() bool {
+	return mf.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (mf *memFile) check(op string, write bool) error {
+	if mf.closed {
+		return &fs.PathError{Op: op, Path: mf.name, Err: fs.ErrClosed}
+	}
+	if write && !mf.writable() {
+		return &fs.PathError{Op: op, Path: mf.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (mf *memFile) Read(buf []byte) (int, error) {
+	n, err := mf.ReadAt(buf, mf.offset)
+	mf.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (mf *memFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if err := mf.check("read", false); err != nil {
+		return 0, err
+	}
+	mf.data.mutex.RLock()
+	defer mf.data.mutex.RUnlock()
+	if offset >= int64(len(mf.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, mf.data.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mf *memFile) Write(buf []byte) (int, error) {
+	if err := mf.check("write", true); err != nil {
+		return 0, err
+	}
+	if mf.flag&os.O_APPEND != 0 {
+		mf.data.mutex.Lock()
+		mf.data.data = append(mf.data.data, buf...)
+		mf.data.modTime = time.Now()
+		mf.offset = int64(len(mf.data.data))
+		mf.data.mutex.Unlock()
+		return len(buf), nil
+	}
+	n, err := mf.writeAt(buf, mf.offset)
+	mf.offset += int64(n)
+	return n, err
+}
+
+func (mf *memFile) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := mf.check("write", true); err != nil {
+		return 0, err
+	}
+	if mf.flag&os.O_APPEND != 0 {
+		return 0, errors.New("vfs: invalid use of WriteAt on file opened with O_APPEND")
+	}
+	return mf.writeAt(buf, offset)
+}
+
+func (mf *memFile) writeAt(buf []byte, offset int64) (int, error) {
+	mf.data.mutex.Lock()
+	defer mf.data.mutex.Unlock()
+	if end := offset + int64(len(buf)); end > int64(len(mf.data.data)) {
+		mf.data.data = append(mf.data.data, make([]byte, end-int64(len(mf.data.data)))...)
+	}
+	copy(mf.data.data[offset:], buf)
+	mf.data.modTime = time.Now()
+	return len(buf), nil
+}
+
+func (mf *memFile) Close() error {
+	if err := mf.check("close", false); err != nil {
+		return err
+	}
+	mf.closed = true
+	return nil
+}
+
+func (mf *memFile) Name() string {
+	return mf.name
+}
+
+func (mf *memFile) Stat() (os.FileInfo, error) {
+	if err := mf.check("stat", false); err != nil {
+		return nil, err
+	}
+	return mf.data.stat(mf.name), nil
+}
+
+func (mf *memFile) Sync() error {
+	if err := mf.check("sync", false); err != nil {
+		return err
+	}
+	mf.data.mutex.Lock()
+	defer mf.data.mutex.Unlock()
+	mf.data.synced = append(mf.data.synced[:0], mf.data.data...)
+	return nil
+}
+
+func (mf *memFile) Truncate(size int64) error {
+	if err := mf.check("truncate", true); err != nil {
+		return err
+	}
+	mf.data.mutex.Lock()
+	defer mf.data.mutex.Unlock()
+	if size < int64(len(mf.data.data)) {
+		mf.data.data = mf.data.data[:size]
+	} else {
+		mf.data.data = append(mf.data.data, make([]byte, size-int64(len(mf.data.data)))...)
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (mfi *memFileInfo) Name() string {
+	return mfi.name
+}
+
+func (mfi *memFileInfo) Size() int64 {
+	return mfi.size
+}
+
+func (mfi *memFileInfo) Mode() fs.FileMode {
+	if mfi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (mfi *memFileInfo) ModTime() time.Time {
+	return mfi.modTime
+}
+
+func (mfi *memFileInfo) IsDir() bool {
+	return mfi.dir
+}
+
+func (mfi *memFileInfo) Sys() any {
+	return nil
+}
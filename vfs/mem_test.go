@@ -0,0 +1,123 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestMemFS_Read_Write(t *testing.T) {
+	mfs := NewMemFS()
+	_, err := mfs.OpenFile("/data/public/test/a.data", os.O_CREATE|os.O_RDWR, 0644)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.Nil(t, mfs.MkdirAll("/data/public/test", 0755))
+	file, err := mfs.OpenFile("/data/public/test/a.data", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("hello "))
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("world"))
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("x"), 0)
+	assert.NotNil(t, err)
+
+	buf := make([]byte, 5)
+	n, err := file.ReadAt(buf, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	n, err = file.ReadAt(buf, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "rld", string(buf[:n]))
+	assert.Nil(t, file.Close())
+	_, err = file.Write([]byte("closed"))
+	assert.ErrorIs(t, err, fs.ErrClosed)
+
+	reader, err := Open(mfs, "/data/public/test/a.data")
+	assert.Nil(t, err)
+	all, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(all))
+	_, err = reader.Write([]byte("read only"))
+	assert.ErrorIs(t, err, fs.ErrPermission)
+
+	info, err := mfs.Stat("/data/public/test/a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), info.Size())
+	entries, err := mfs.ReadDir("/data/public")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, entries[0].IsDir())
+
+	assert.Nil(t, mfs.Rename("/data/public/test/a.data", "/data/public/test/b.data"))
+	_, err = mfs.Stat("/data/public/test/a.data")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.NotNil(t, mfs.Remove("/data/public"))
+	assert.Nil(t, mfs.RemoveAll("/data/public"))
+	entries, err = mfs.ReadDir("/data")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestMemFS_Crash(t *testing.T) {
+	mfs := NewMemFS()
+	file, err := mfs.OpenFile("a.data", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, _ = file.Write([]byte("synced"))
+	assert.Nil(t, file.Sync())
+	_, _ = file.Write([]byte(" lost"))
+
+	mfs.Crash()
+	info, err := mfs.Stat("a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("synced")), info.Size())
+}
+
+func TestMemFS_Lock(t *testing.T) {
+	mfs := NewMemFS()
+	lock, err := mfs.Lock("LOCK")
+	assert.Nil(t, err)
+	_, err = mfs.Lock("LOCK")
+	assert.Equal(t, ErrLocked, err)
+	assert.Nil(t, lock.Close())
+	assert.Nil(t, lock.Close())
+
+	_, err = mfs.Lock("LOCK")
+	assert.Nil(t, err)
+	// the locks are released by the crash of the process
+	mfs.Crash()
+	_, err = mfs.Lock("LOCK")
+	assert.Nil(t, err)
+}
+
+func TestMemFS_Link(t *testing.T) {
+	mfs := NewMemFS()
+	file, err := mfs.OpenFile("a.data", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, _ = file.Write([]byte("linked"))
+
+	assert.Nil(t, Link(mfs, "a.data", "b.data"))
+	assert.ErrorIs(t, Link(mfs, "a.data", "b.data"), fs.ErrExist)
+	// the data is kept by the link after the old file is removed
+	assert.Nil(t, mfs.Remove("a.data"))
+	info, err := mfs.Stat("b.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("linked")), info.Size())
+
+	assert.Equal(t, ErrLinkNotSupported, Link(NewFaultFS(mfs), "b.data", "c.data"))
+}
@@ -0,0 +1,135 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// File the file opened by a FS, *os.File implements it
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS the file operations used by the storage and the index, so the engine could run on
+// the in-memory files, or on the files failing as the tests choose
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldPath, newPath string) error
+	// Lock take the exclusive lock of the file, it's created if it's not exists, return ErrLocked
+	// if the lock is held by another process or another Lock call, the lock is released by Close
+	Lock(name string) (io.Closer, error)
+}
+
+// Linker is implemented by the FS could hard-link the files
+type Linker interface {
+	Link(oldPath, newPath string) error
+}
+
+// ErrLocked the lock of the file is held by others
+var ErrLocked = errors.New("file is locked")
+
+// ErrLinkNotSupported the FS could not hard-link the files
+var ErrLinkNotSupported = errors.New("hard link is not supported")
+
+// Default the file system of the operating system
+var Default FS = osFS{}
+
+// Or the fs, or the Default if it's nil
+func Or(fs FS) FS {
+	if fs == nil {
+		return Default
+	}
+	return fs
+}
+
+// Open the file for reading, the same as os.Open
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Link hard-link the file if the fs implements Linker, or return ErrLinkNotSupported
+func Link(fs FS, oldPath, newPath string) error {
+	if linker, ok := fs.(Linker); ok {
+		return linker.Link(oldPath, newPath)
+	}
+	return ErrLinkNotSupported
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osFS) Link(oldPath, newPath string) error {
+	return os.Link(oldPath, newPath)
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	// the lock is released when the file is closed
+	return file, nil
+}
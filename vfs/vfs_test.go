@@ -0,0 +1,38 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefault_Lock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "LOCK")
+	lock, err := Default.Lock(name)
+	assert.Nil(t, err)
+	// the flock conflicts with another open of the same process
+	_, err = Default.Lock(name)
+	assert.Equal(t, ErrLocked, err)
+	assert.Nil(t, lock.Close())
+
+	lock, err = Default.Lock(name)
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Close())
+	_, err = os.Stat(name)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,382 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package BytesDB
+
+import (
+	"BytesDB/core"
+	"bytes"
+	"io"
+	"slices"
+	"sync"
+)
+
+type WatchEventType byte
+
+const (
+	// WatchPut the value of the key is put
+	WatchPut WatchEventType = iota
+	// WatchDelete the key is deleted
+	WatchDelete
+	// WatchMerge the merge operand of the key is written, Value is the operand
+	WatchMerge
+	// WatchDeleteRange the keys in [Key, End) are deleted
+	WatchDeleteRange
+)
+
+// defaultMaxPendingEvents the events queued but not received by default before the watcher fails
+const defaultMaxPendingEvents = 10000
+
+// WatchEvent a change of the keys watched
+type WatchEvent struct {
+	Type  WatchEventType
+	Key   core.Bytes
+	Value core.Bytes
+	// End the end of the deleted range, it's not bounded above if it's empty
+	End core.Bytes
+	// Position the position of the record of the event, the events are ordered by it, the
+	// watch is resumed after it by WatchOptions.After
+	Position core.RecordPosition
+	// Version the version of the write in the versioned mode
+	Version uint64
+}
+
+type WatchOptions struct {
+	// After replay the records after the position kept in the segments before watching the
+	// later writes, e.g. the Position of the last event seen, {Segment: -1} replays all the
+	// records kept. The watcher fails with ErrWatchPositionCompacted if the segment of the
+	// position is removed by Compact, since the deletes after it may be dropped, the keys should
+	// be read again before watching
+	After *core.RecordPosition
+	// MaxPending the events of the writes queued but not received yet, the watcher fails with
+	// ErrWatchOverflow once it's exceeded, 0 means defaultMaxPendingEvents
+	MaxPending int
+}
+
+// Watcher the change events of the keys with the prefix, the events are queued in memory until
+// they're received, so Close must be called once it's not used
+type Watcher struct {
+	db      *Database
+	session core.Session
+	prefix  core.Bytes
+	events  chan WatchEvent
+	// the events of the writes queued, signal is sent once they're appended
+	pending    []WatchEvent
+	maxPending int
+	signal     chan struct{}
+	err        error
+	mutex      sync.Mutex
+	done       chan struct{}
+	stopped    chan struct{}
+	once       sync.Once
+}
+
+// Watch the changes of the keys with the prefix in the table, the events are received from
+// Events in the order of the writes
+func (db *Database) Watch(session core.Session, prefix core.Bytes, opts WatchOptions) (*Watcher, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	storage, err := db.sm.Storage(session)
+	if err != nil {
+		return nil, err
+	}
+	size, err := storage.Size()
+	if err != nil {
+		return nil, err
+	}
+	// the records before it are replayed, the later ones are pushed by the writes
+	end := core.RecordPosition{Segment: storage.ActiveSegment(), Position: size}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultMaxPendingEvents
+	}
+	w := &Watcher{
+		db:         db,
+		session:    session,
+		prefix:     bytes.Clone(prefix),
+		events:     make(chan WatchEvent),
+		maxPending: opts.MaxPending,
+		signal:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	if db.watchers[session] == nil {
+		db.watchers[session] = make(map[*Watcher]struct{})
+	}
+	db.watchers[session][w] = struct{}{}
+	go w.run(opts.After, end)
+	return w, nil
+}
+
+// Events the channel of the events, it's closed once the watcher is closed or failed, see Err
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Err the error failed the watcher, e.g. the segments replayed are removed, the position
+// resumed after is compacted, or the events are not received fast enough
+func (w *Watcher) Err() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.db.mutex.Lock()
+	delete(w.db.watchers[w.session], w)
+	w.db.mutex.Unlock()
+	w.stop()
+}
+
+func (w *Watcher) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+	<-w.stopped
+}
+
+func (w *Watcher) run(after *core.RecordPosition, end core.RecordPosition) {
+	defer close(w.stopped)
+	defer close(w.events)
+	if after != nil {
+		if err := w.replay(*after, end); err != nil {
+			w.mutex.Lock()
+			w.err = err
+			w.mutex.Unlock()
+			return
+		}
+	}
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.signal:
+		}
+		w.mutex.Lock()
+		pending, err := w.pending, w.err
+		w.pending = nil
+		w.mutex.Unlock()
+		if err != nil {
+			return
+		}
+		for _, event := range pending {
+			if !w.send(event) {
+				return
+			}
+		}
+	}
+}
+
+func (w *Watcher) send(event WatchEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// replay the records in (after, end), the transactions of them are committed or failed already
+// since the end is captured under the write lock
+func (w *Watcher) replay(after, end core.RecordPosition) error {
+	db := w.db
+	if after.Segment >= 0 {
+		sealed, err := db.sm.SealedSegments(w.session)
+		if err != nil {
+			return err
+		}
+		if after.Segment <= end.Segment && !slices.Contains(append(sealed, end.Segment), after.Segment) {
+			return core.ErrWatchPositionCompacted
+		}
+	}
+	var sendErr error
+	err := db.tail(w.session, after, end, func(pos *core.RecordPosition, record *core.Record) bool {
+		if !before(&after, pos) {
+			return true
+		}
+		if record.IsTxn() {
+			seq, plain, err := record.UnwrapTxn()
+			if err != nil {
+				sendErr = err
+				return false
+			}
+			if !db.txns.isCommitted(seq) {
+				return true
+			}
+			record = plain
+		}
+		event, ok, err := newWatchEvent(record, pos)
+		if err != nil {
+			sendErr = err
+			return false
+		}
+		return !ok || !w.matches(event) || w.send(event)
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// tail call fn with the records in [from, end) by tailing the segments until it returns false,
+// end is the end of the active segment captured under the write lock. the read lock is held
+// while reading each record, so the record is not partially written
+func (db *Database) tail(session core.Session, from, end core.RecordPosition, fn func(*core.RecordPosition, *core.Record) bool) error {
+	sealed, err := db.sm.SealedSegments(session)
+	if err != nil {
+		return err
+	}
+	var segments []int64
+	for _, segment := range append(sealed, end.Segment) {
+		if segment >= from.Segment && segment <= end.Segment {
+			segments = append(segments, segment)
+		}
+	}
+	scanner, err := db.sm.Scan(session, core.ScanOptions{Segments: segments, WithValue: true})
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	for {
+		db.mutex.RLock()
+		pos, record, err := scanner.Next()
+		db.mutex.RUnlock()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !before(pos, &end) {
+			return nil
+		}
+		if !before(pos, &from) && !fn(pos, record) {
+			return nil
+		}
+		if pos.Segment == end.Segment && pos.Position+int64(pos.Size) >= end.Position {
+			return nil
+		}
+	}
+}
+
+// push queue the event of the write, the caller holds the write lock. The watcher fails with
+// ErrWatchOverflow and false is returned if the events queued exceed the limit, the events
+// not received are dropped
+func (w *Watcher) push(event WatchEvent) bool {
+	if !w.matches(event) {
+		return true
+	}
+	w.mutex.Lock()
+	overflow := len(w.pending) >= w.maxPending
+	if overflow {
+		w.pending = nil
+		w.err = core.ErrWatchOverflow
+	} else {
+		w.pending = append(w.pending, event)
+	}
+	w.mutex.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+	return !overflow
+}
+
+// matches the key has the prefix, or the deleted range has the keys with the prefix
+func (w *Watcher) matches(event WatchEvent) bool {
+	if event.Type != WatchDeleteRange {
+		return bytes.HasPrefix(event.Key, w.prefix)
+	}
+	end := core.PrefixEnd(w.prefix)
+	return (len(end) == 0 || bytes.Compare(event.Key, end) < 0) &&
+		(len(event.End) == 0 || bytes.Compare(event.End, w.prefix) > 0)
+}
+
+// publish push the event of the record written to the watchers of the table, the caller holds
+// the write lock
+func (db *Database) publish(session core.Session, record *core.Record, pos *core.RecordPosition) error {
+	if len(db.watchers[session]) == 0 {
+		return nil
+	}
+	event, ok, err := newWatchEvent(record, pos)
+	if err != nil || !ok {
+		return err
+	}
+	// the key and the value are owned by the caller of the write
+	event.Key = bytes.Clone(event.Key)
+	event.Value = bytes.Clone(event.Value)
+	for w := range db.watchers[session] {
+		if !w.push(event) {
+			// the failed watcher is not pushed again, it's stopped once the events are closed
+			delete(db.watchers[session], w)
+		}
+	}
+	return nil
+}
+
+// closeWatchers stop the watchers when the database is closed
+func (db *Database) closeWatchers() {
+	db.mutex.Lock()
+	var watchers []*Watcher
+	for _, ws := range db.watchers {
+		for w := range ws {
+			watchers = append(watchers, w)
+		}
+	}
+	db.watchers = make(map[core.Session]map[*Watcher]struct{})
+	db.mutex.Unlock()
+	for _, w := range watchers {
+		w.stop()
+	}
+}
+
+// newWatchEvent the event of the record written, the transaction is unwrapped already,
+// ok is false if it's not a change of the keys
+func newWatchEvent(record *core.Record, pos *core.RecordPosition) (WatchEvent, bool, error) {
+	header, plain, err := record.UnwrapVersion()
+	if err != nil {
+		return WatchEvent{}, false, err
+	}
+	event := WatchEvent{Key: plain.Key, Value: plain.Value, Position: *pos, Version: header.Version}
+	switch plain.Type {
+	case core.Normal:
+		event.Type = WatchPut
+	case core.Deleted:
+		event.Type = WatchDelete
+		event.Value = nil
+	case core.Merge:
+		event.Type = WatchMerge
+		if !record.Type.IsVersioned() {
+			if _, plain, err = plain.UnwrapMerge(); err != nil {
+				return WatchEvent{}, false, err
+			}
+			event.Value = plain.Value
+		}
+	case core.RangeDeleted:
+		event.Type = WatchDeleteRange
+		if event.Key, event.End, err = core.DecodeRange(plain.Key); err != nil {
+			return WatchEvent{}, false, err
+		}
+		event.Value = nil
+	default:
+		return WatchEvent{}, false, nil
+	}
+	return event, true, nil
+}
+
+// before the position a is before b
+func before(a, b *core.RecordPosition) bool {
+	return a.Segment < b.Segment || (a.Segment == b.Segment && a.Position < b.Position)
+}